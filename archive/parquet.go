@@ -0,0 +1,82 @@
+package archive
+
+import (
+	"analytics-backend/models"
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// emptyPartition names the action directory for events without an action,
+// following the Hive convention so query engines read it as NULL.
+const emptyPartition = "__HIVE_DEFAULT_PARTITION__"
+
+type Row struct {
+	ID        int64     `parquet:"id"`
+	UserID    string    `parquet:"user_id,dict"`
+	Action    string    `parquet:"action,dict"`
+	Element   string    `parquet:"element,dict"`
+	Duration  float64   `parquet:"duration"`
+	Timestamp time.Time `parquet:"timestamp,timestamp(microsecond)"`
+}
+
+func Encode(events []models.Event) ([]byte, error) {
+	rows := make([]Row, 0, len(events))
+	for _, event := range events {
+		rows = append(rows, Row{
+			ID:        event.ID,
+			UserID:    event.UserId,
+			Action:    event.Action,
+			Element:   event.Element,
+			Duration:  event.Duration,
+			Timestamp: event.Timestamp.UTC(),
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := parquet.Write(&buf, rows, parquet.Compression(&parquet.Zstd)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func Decode(data []byte) ([]models.Event, error) {
+	rows, err := parquet.Read[Row](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]models.Event, 0, len(rows))
+	for _, row := range rows {
+		events = append(events, models.Event{
+			ID:        row.ID,
+			UserId:    row.UserID,
+			Action:    row.Action,
+			Element:   row.Element,
+			Duration:  row.Duration,
+			Timestamp: row.Timestamp,
+		})
+	}
+	return events, nil
+}
+
+// FileKey builds the object key for one hourly file of a partition. The
+// first stream message ID makes the name deterministic, so re-archiving the
+// same redelivered messages overwrites the file instead of duplicating it.
+func FileKey(hour time.Time, action, firstMessageID string) string {
+	hour = hour.UTC()
+	partition := emptyPartition
+	if action != "" {
+		partition = url.PathEscape(action)
+	}
+	return fmt.Sprintf("dt=%s/action=%s/%02d-%s.parquet",
+		hour.Format("2006-01-02"),
+		partition,
+		hour.Hour(),
+		strings.ReplaceAll(firstMessageID, "/", "_"),
+	)
+}
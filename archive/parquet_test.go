@@ -0,0 +1,53 @@
+package archive
+
+import (
+	"analytics-backend/models"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	events := []models.Event{
+		{ID: 1, UserId: "u1", Action: "click", Element: "button", Duration: 1.5, Timestamp: time.Date(2024, 5, 1, 13, 10, 0, 123456000, time.UTC)},
+		{ID: 2, UserId: "u2", Action: "click", Element: "link", Duration: 0, Timestamp: time.Date(2024, 5, 1, 13, 20, 0, 0, time.UTC)},
+	}
+
+	data, err := Encode(events)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	storage := &LocalStorage{Dir: t.TempDir()}
+	key := FileKey(events[0].Timestamp.Truncate(time.Hour), "click", "1-0")
+	if err := storage.Put(context.Background(), key, data); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	stored, err := storage.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	decoded, err := Decode(stored)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(decoded) != len(events) {
+		t.Fatalf("expected %d events, got %d", len(events), len(decoded))
+	}
+	for i := range events {
+		if decoded[i].ID != events[i].ID || decoded[i].Element != events[i].Element || !decoded[i].Timestamp.Equal(events[i].Timestamp) {
+			t.Errorf("event %d: expected %+v, got %+v", i, events[i], decoded[i])
+		}
+	}
+}
+
+func TestFileKey(t *testing.T) {
+	hour := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	if got, want := FileKey(hour, "add to cart", "17-3"), "dt=2024-05-01/action=add%20to%20cart/09-17-3.parquet"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if got, want := FileKey(hour, "", "17-3"), "dt=2024-05-01/action=__HIVE_DEFAULT_PARTITION__/09-17-3.parquet"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
@@ -13,6 +13,7 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	database.ConfigureBackends(cfg.Backends)
 	database.Initdb(cfg.Postgres)
 	if err := database.InitElasticsearch(cfg.Elasticsearch); err != nil {
 		log.Fatalf("Failed to initialize Elasticsearch: %v", err)
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"analytics-backend/worker"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	source := flag.String("source", database.ReindexSourcePostgres, "Where to read events from: postgres or index (the current search indices)")
+	fromFlag := flag.String("from", "", "Start of a range to reindex into the current indices (RFC3339, inclusive)")
+	toFlag := flag.String("to", "", "End of a range to reindex into the current indices (RFC3339, exclusive)")
+	workers := flag.Int("workers", 1, "Number of slices to index at a time")
+	batchSize := flag.Int("batch-size", worker.ReindexBatchSize, "Events to read and index per request")
+	catchUpMargin := flag.Duration("catch-up-margin", worker.ReindexCatchUpMargin, "How long before the job started to index the events ingested since again after the swap")
+	resume := flag.Uint("resume", 0, "Resume an interrupted or failed job instead of creating one")
+	flag.Parse()
+
+	if *workers < 1 || *batchSize < 1 {
+		log.Fatal("-workers and -batch-size must be positive")
+	}
+	worker.ReindexBatchSize = *batchSize
+	worker.ReindexCatchUpMargin = *catchUpMargin
+
+	cfg, err := config.LoadConfig("config.yaml")
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	database.ConfigureBackends(cfg.Backends)
+	database.Initdb(cfg.Postgres)
+	if err := database.InitElasticsearch(cfg.Elasticsearch); err != nil {
+		log.Fatalf("Failed to initialize Elasticsearch: %v", err)
+	}
+
+	id := uint(*resume)
+	if id == 0 {
+		id = createJob(ctx, *source, *fromFlag, *toFlag, *workers)
+	}
+
+	store := &worker.DefaultReindexStore{}
+	job, err := store.Claim(ctx, id)
+	if err != nil {
+		log.Fatalf("Failed to claim reindex job %d: %v", id, err)
+	}
+	if job == nil {
+		log.Fatalf("Reindex job %d is completed or is being run elsewhere", id)
+	}
+
+	if err := worker.RunReindexJob(ctx, store, job, *workers); err != nil {
+		if ctx.Err() != nil {
+			log.Fatalf("Reindex job %d stopped after %d events; continue with -resume %d", id, job.Indexed, id)
+		}
+		log.Fatalf("Reindex job %d failed: %v; retry with -resume %d", id, err, id)
+	}
+
+	log.Printf("Reindex job %d completed: %d events indexed", id, job.Indexed)
+}
+
+// createJob creates a full job unless a range is given. A full job covers
+// every event up to now, which is its cutoff.
+func createJob(ctx context.Context, source, fromFlag, toFlag string, workers int) uint {
+	job := models.ReindexJob{Source: source, Full: fromFlag == "" && toFlag == ""}
+
+	if job.Full {
+		cutoff := time.Now().UTC()
+		var (
+			oldest, newest time.Time
+			ok             bool
+			err            error
+		)
+		if source == database.ReindexSourceIndex {
+			job.SourceIndices, _, err = database.SearchAliasIndices(ctx)
+			if err != nil {
+				log.Fatalf("Failed to list search indices: %v", err)
+			}
+			if len(job.SourceIndices) == 0 {
+				log.Fatal("There are no search indices to reindex from")
+			}
+			oldest, newest, ok, err = database.IndexedEventTimeRange(ctx, job.SourceIndices)
+		} else {
+			oldest, newest, ok, err = database.EventTimeRange(ctx)
+		}
+		if err != nil {
+			log.Fatalf("Failed to find the range of events: %v", err)
+		}
+		job.RangeStart, job.RangeEnd = cutoff, cutoff
+		if ok {
+			job.RangeStart = oldest
+			if !newest.Before(cutoff) {
+				// Events dated in the future are part of the job too.
+				job.RangeEnd = newest.Add(time.Millisecond)
+			}
+		}
+	} else {
+		from, err := time.Parse(time.RFC3339, fromFlag)
+		if err != nil {
+			log.Fatalf("Invalid -from: %v", err)
+		}
+		to, err := time.Parse(time.RFC3339, toFlag)
+		if err != nil {
+			log.Fatalf("Invalid -to: %v", err)
+		}
+		job.RangeStart, job.RangeEnd = from, to
+	}
+
+	// More slices than workers keeps them busy when the events are not spread
+	// evenly over time.
+	if err := worker.PrepareReindexJob(&job, workers*4); err != nil {
+		log.Fatalf("Invalid reindex job: %v", err)
+	}
+	if err := database.CreateReindexJob(ctx, &job); err != nil {
+		log.Fatalf("Failed to create reindex job: %v", err)
+	}
+
+	log.Printf("Created reindex job %d for %s - %s from %s", job.ID, job.RangeStart.Format(time.RFC3339), job.RangeEnd.Format(time.RFC3339), job.Source)
+	return job.ID
+}
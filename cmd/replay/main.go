@@ -0,0 +1,144 @@
+package main
+
+import (
+	"analytics-backend/archive"
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"analytics-backend/sinks"
+	"analytics-backend/worker"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	fromFlag := flag.String("from", "", "Start of the range to replay (RFC3339, inclusive)")
+	toFlag := flag.String("to", "", "End of the range to replay (RFC3339, exclusive)")
+	source := flag.String("source", worker.ReplaySourcePostgres, "Where to read events from: postgres or archive")
+	actionsFlag := flag.String("actions", "", "Comma-separated actions to replay (default: all)")
+	usersFlag := flag.String("users", "", "Comma-separated user IDs to replay (default: all)")
+	targetsFlag := flag.String("targets", "", "Comma-separated sinks to replay into, or aggregates to recompute them")
+	rate := flag.Int("rate", 0, "Maximum events per second to enqueue (default from config, -1 for unlimited)")
+	deleteDerived := flag.Bool("delete-derived", false, "Delete existing data in the targets for the range before replaying")
+	resume := flag.Uint("resume", 0, "Resume an existing paused or failed job instead of creating one")
+	detach := flag.Bool("detach", false, "Only queue the job and let the server's replay scheduler run it")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig("config.yaml")
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	database.ConfigureBackends(cfg.Backends)
+	database.Initdb(cfg.Postgres)
+	database.InitRedis(cfg.Redis)
+	worker.ConfigureReplay(cfg.Replay)
+	if err := sinks.Init(cfg.Sinks); err != nil {
+		log.Fatalf("Failed to configure sinks: %v", err)
+	}
+	if err := database.EnsureReplayGroup(); err != nil {
+		log.Fatalf("Failed to create replay group: %v", err)
+	}
+
+	var id uint
+	if *resume > 0 {
+		id = uint(*resume)
+		if _, err := database.TransitionReplayJob(ctx, id, []string{database.ReplayStatusPaused, database.ReplayStatusFailed}, database.ReplayStatusPending); err != nil {
+			log.Fatalf("Failed to resume replay job %d: %v", id, err)
+		}
+	} else {
+		id = createJob(ctx, *fromFlag, *toFlag, *source, *actionsFlag, *usersFlag, *targetsFlag, *rate, *deleteDerived)
+	}
+
+	if *detach {
+		log.Printf("Queued replay job %d", id)
+		return
+	}
+
+	store := &worker.DefaultReplayJobStore{}
+	job, err := store.ClaimJob(ctx, id)
+	if err != nil {
+		log.Fatalf("Failed to claim replay job %d: %v", id, err)
+	}
+	if job == nil {
+		log.Fatalf("Replay job %d is not pending or is being run elsewhere", id)
+	}
+
+	if job.DeleteDerived && !job.DerivedDeleted {
+		database.InitClickHouse(cfg.ClickHouse)
+		if err := database.InitElasticsearch(cfg.Elasticsearch); err != nil {
+			log.Fatalf("Failed to initialize Elasticsearch: %v", err)
+		}
+	}
+	if job.Source == worker.ReplaySourceArchive {
+		store.Storage, err = archive.NewStorage(ctx, cfg.Archive)
+		if err != nil {
+			log.Fatalf("Failed to configure archive storage: %v", err)
+		}
+	}
+
+	if err := worker.RunReplayJob(ctx, store, job); err != nil {
+		if ctx.Err() != nil {
+			// Pause rather than leave the lease to expire, so the server does
+			// not pick the job up on its own.
+			if _, err := database.TransitionReplayJob(context.Background(), id, []string{database.ReplayStatusRunning}, database.ReplayStatusPaused); err != nil {
+				log.Printf("Failed to pause replay job %d: %v", id, err)
+			}
+			log.Fatalf("Replay job %d paused after enqueuing %d events; continue with -resume %d", id, job.Enqueued, id)
+		}
+		log.Fatalf("Replay job %d failed: %v", id, err)
+	}
+
+	log.Printf("Replay job %d enqueued %d events into %s; the replay workers write them to %s",
+		id, job.Enqueued, database.ReplayStreamName, strings.Join(job.Targets, ", "))
+}
+
+func createJob(ctx context.Context, fromFlag, toFlag, source, actions, users, targets string, rate int, deleteDerived bool) uint {
+	from, err := time.Parse(time.RFC3339, fromFlag)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	to, err := time.Parse(time.RFC3339, toFlag)
+	if err != nil {
+		log.Fatalf("Invalid -to: %v", err)
+	}
+
+	job := models.ReplayJob{
+		Source:        source,
+		RangeStart:    from,
+		RangeEnd:      to,
+		Actions:       splitList(actions),
+		UserIDs:       splitList(users),
+		Targets:       splitList(targets),
+		Rate:          rate,
+		DeleteDerived: deleteDerived,
+	}
+	if err := worker.PrepareReplayJob(&job, sinks.Active); err != nil {
+		log.Fatalf("Invalid replay job: %v", err)
+	}
+	if err := database.CreateReplayJob(ctx, &job); err != nil {
+		log.Fatalf("Failed to create replay job: %v", err)
+	}
+
+	log.Printf("Created replay job %d for %s - %s", job.ID, job.RangeStart.Format(time.RFC3339), job.RangeEnd.Format(time.RFC3339))
+	return job.ID
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
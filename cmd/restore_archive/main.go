@@ -0,0 +1,150 @@
+package main
+
+import (
+	"analytics-backend/archive"
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	fromFlag := flag.String("from", "", "Start of the range to restore (RFC3339, inclusive)")
+	toFlag := flag.String("to", "", "End of the range to restore (RFC3339, exclusive)")
+	actionsFlag := flag.String("actions", "", "Comma-separated actions to restore (default: all)")
+	stream := flag.String("stream", database.StreamName, "Stream to replay events into")
+	skipExisting := flag.Bool("skip-existing", true, "Skip events whose ID is still present in Postgres")
+	rate := flag.Int("rate", 0, "Maximum events per second to replay (0 for unlimited)")
+	dryRun := flag.Bool("dry-run", false, "List matching files and count events without replaying them")
+	flag.Parse()
+
+	from, err := time.Parse(time.RFC3339, *fromFlag)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	to, err := time.Parse(time.RFC3339, *toFlag)
+	if err != nil {
+		log.Fatalf("Invalid -to: %v", err)
+	}
+	if !to.After(from) {
+		log.Fatalf("-to must be after -from")
+	}
+
+	var actions []string
+	for _, action := range strings.Split(*actionsFlag, ",") {
+		if action = strings.TrimSpace(action); action != "" {
+			actions = append(actions, action)
+		}
+	}
+
+	cfg, err := config.LoadConfig("config.yaml")
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	database.ConfigureBackends(cfg.Backends)
+	database.Initdb(cfg.Postgres)
+	if !*dryRun {
+		database.InitRedis(cfg.Redis)
+	}
+	storage, err := archive.NewStorage(ctx, cfg.Archive)
+	if err != nil {
+		log.Fatalf("Failed to configure archive storage: %v", err)
+	}
+
+	files, err := database.ListArchiveFiles(ctx, from, to, actions)
+	if err != nil {
+		log.Fatalf("Failed to read archive manifest: %v", err)
+	}
+	log.Printf("Found %d archive files overlapping %s - %s", len(files), from.Format(time.RFC3339), to.Format(time.RFC3339))
+
+	var interval time.Duration
+	if *rate > 0 {
+		interval = time.Second / time.Duration(*rate)
+	}
+
+	// A redelivered batch can be archived twice under different keys, so the
+	// same event may appear in more than one file.
+	seen := map[int64]bool{}
+	var matched, replayed, skipped int
+	for _, file := range files {
+		if ctx.Err() != nil {
+			log.Fatalf("Restore interrupted after replaying %d events", replayed)
+		}
+
+		events, err := readArchiveFile(ctx, storage, file)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", file.Path, err)
+		}
+
+		var batch []models.Event
+		for _, event := range events {
+			if event.Timestamp.Before(from) || !event.Timestamp.Before(to) {
+				continue
+			}
+			if event.ID != 0 && seen[event.ID] {
+				continue
+			}
+			seen[event.ID] = true
+			batch = append(batch, event)
+		}
+		matched += len(batch)
+		if *dryRun {
+			log.Printf("%s: %d events in range", file.Path, len(batch))
+			continue
+		}
+
+		existing := map[int64]bool{}
+		if *skipExisting {
+			ids := make([]int64, 0, len(batch))
+			for _, event := range batch {
+				ids = append(ids, event.ID)
+			}
+			existing, err = database.ExistingEventIDs(ctx, ids)
+			if err != nil {
+				log.Fatalf("Failed to check existing events: %v", err)
+			}
+		}
+
+		fileReplayed := 0
+		for _, event := range batch {
+			if existing[event.ID] {
+				skipped++
+				continue
+			}
+			if err := database.AddRestoredToStream(ctx, *stream, event); err != nil {
+				log.Fatalf("Failed to replay event %d: %v", event.ID, err)
+			}
+			fileReplayed++
+			if interval > 0 {
+				time.Sleep(interval)
+			}
+		}
+		replayed += fileReplayed
+		log.Printf("%s: replayed %d of %d events", file.Path, fileReplayed, len(batch))
+	}
+
+	if *dryRun {
+		log.Printf("Dry run: %d events would be replayed", matched)
+		return
+	}
+	log.Printf("Restore completed: %d events replayed into %s, %d skipped because they still exist", replayed, *stream, skipped)
+}
+
+func readArchiveFile(ctx context.Context, storage archive.Storage, file models.ArchiveFile) ([]models.Event, error) {
+	data, err := storage.Get(ctx, file.Path)
+	if err != nil {
+		return nil, err
+	}
+	return archive.Decode(data)
+}
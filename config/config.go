@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -13,10 +14,26 @@ type Config struct {
 	Postgres      PostgresConfig      `yaml:"postgres"`
 	ClickHouse    ClickHouseConfig    `yaml:"clickhouse"`
 	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch"`
+	Search        SearchConfig        `yaml:"search"`
+	Aggregation   AggregationConfig   `yaml:"aggregation"`
+	Workers       WorkersConfig       `yaml:"workers"`
+	Sinks         []SinkConfig        `yaml:"sinks"`
+	Webhooks      WebhooksConfig      `yaml:"webhooks"`
+	Archive       ArchiveConfig       `yaml:"archive"`
+	Transforms    TransformsConfig    `yaml:"transforms"`
+	Outbox        OutboxConfig        `yaml:"outbox"`
+	Replay        ReplayConfig        `yaml:"replay"`
+	Lanes         LanesConfig         `yaml:"lanes"`
+	Sharding      ShardingConfig      `yaml:"sharding"`
+	Backends      BackendsConfig      `yaml:"backends"`
+	Retention     RetentionConfig     `yaml:"retention"`
+	SavedSearches SavedSearchesConfig `yaml:"saved_searches"`
 }
 
 type ServerConfig struct {
-	Port int `yaml:"port"`
+	Port                  int           `yaml:"port"`
+	ShutdownTimeout       time.Duration `yaml:"shutdown_timeout"`
+	WorkerShutdownTimeout time.Duration `yaml:"worker_shutdown_timeout"`
 }
 
 type RedisConfig struct {
@@ -43,11 +60,184 @@ type ClickHouseConfig struct {
 	Password string   `yaml:"password"`
 }
 
+// ElasticsearchConfig names the search indices after Index: backing indices
+// Index-<date>-<n> are written through the Index-write alias and searched
+// through Index-read.
 type ElasticsearchConfig struct {
-	Addr     string `yaml:"addr"`
-	Index    string `yaml:"index"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Addr                string        `yaml:"addr"`
+	Index               string        `yaml:"index"`
+	Username            string        `yaml:"username"`
+	Password            string        `yaml:"password"`
+	IndexPeriod         string        `yaml:"index_period"`
+	RolloverMaxAge      time.Duration `yaml:"rollover_max_age"`
+	RolloverMaxSize     string        `yaml:"rollover_max_size"`
+	Retention           time.Duration `yaml:"retention"`
+	MaintenanceInterval time.Duration `yaml:"maintenance_interval"`
+	Fallback            string        `yaml:"fallback"`
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+	ExportMaxRows       int           `yaml:"export_max_rows"`
+	ExportPageSize      int           `yaml:"export_page_size"`
+	ExportKeepAlive     time.Duration `yaml:"export_keep_alive"`
+}
+
+// SearchConfig picks what answers event searches: elasticsearch, the
+// default, or postgres.
+type SearchConfig struct {
+	Backend string `yaml:"backend"`
+}
+
+type AggregationConfig struct {
+	AllowedLateness time.Duration `yaml:"allowed_lateness"`
+	LatePolicy      string        `yaml:"late_policy"`
+}
+
+type WorkersConfig struct {
+	CheckInterval  time.Duration    `yaml:"check_interval"`
+	InitialBackoff time.Duration    `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration    `yaml:"max_backoff"`
+	Aggregators    WorkerPoolConfig `yaml:"aggregators"`
+	Indexers       WorkerPoolConfig `yaml:"indexers"`
+}
+
+type WorkerPoolConfig struct {
+	Min                int           `yaml:"min"`
+	Max                int           `yaml:"max"`
+	ScaleUpBacklog     int64         `yaml:"scale_up_backlog"`
+	ScaleDownBacklog   int64         `yaml:"scale_down_backlog"`
+	TargetBatchLatency time.Duration `yaml:"target_batch_latency"`
+	Cooldown           time.Duration `yaml:"cooldown"`
+}
+
+type SinkConfig struct {
+	Name     string            `yaml:"name"`
+	Type     string            `yaml:"type"`
+	Enabled  *bool             `yaml:"enabled"`
+	Optional bool              `yaml:"optional"`
+	Options  map[string]string `yaml:"options"`
+}
+
+func (c SinkConfig) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+func (c SinkConfig) SinkType() string {
+	if c.Type != "" {
+		return c.Type
+	}
+	return c.Name
+}
+
+type WebhooksConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	Workers        int           `yaml:"workers"`
+	Timeout        time.Duration `yaml:"timeout"`
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+type ArchiveConfig struct {
+	Enabled         bool            `yaml:"enabled"`
+	Workers         int             `yaml:"workers"`
+	Storage         string          `yaml:"storage"`
+	Dir             string          `yaml:"dir"`
+	CloseDelay      time.Duration   `yaml:"close_delay"`
+	MaxRowsPerFile  int             `yaml:"max_rows_per_file"`
+	MaxBufferedRows int             `yaml:"max_buffered_rows"`
+	S3              ArchiveS3Config `yaml:"s3"`
+}
+
+type ArchiveS3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	UseSSL    bool   `yaml:"use_ssl"`
+}
+
+type TransformsConfig struct {
+	Path           string        `yaml:"path"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type OutboxConfig struct {
+	Relays         int           `yaml:"relays"`
+	PollInterval   time.Duration `yaml:"poll_interval"`
+	BatchSize      int           `yaml:"batch_size"`
+	Lease          time.Duration `yaml:"lease"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	Retention      time.Duration `yaml:"retention"`
+}
+
+type ReplayConfig struct {
+	Workers      int           `yaml:"workers"`
+	BatchSize    int           `yaml:"batch_size"`
+	DefaultRate  int           `yaml:"default_rate"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	Lease        time.Duration `yaml:"lease"`
+}
+
+// LanesConfig routes events to prioritized streams. With no lanes, every
+// event goes to the single events stream as before. Messages left
+// unacknowledged by a consumer for ClaimIdle, such as one stopped when its
+// pool scaled down, are taken over by the consumers still reading.
+type LanesConfig struct {
+	Default   string        `yaml:"default"`
+	Lanes     []LaneConfig  `yaml:"lanes"`
+	ClaimIdle time.Duration `yaml:"claim_idle"`
+}
+
+type LaneConfig struct {
+	Name   string              `yaml:"name"`
+	Stream string              `yaml:"stream"`
+	Weight int                 `yaml:"weight"`
+	Match  map[string][]string `yaml:"match"`
+}
+
+// ShardingConfig splits the events stream into shards by user, each read by
+// one aggregator at a time, so every user's events are aggregated in order.
+// It cannot be combined with lanes.
+type ShardingConfig struct {
+	Shards int           `yaml:"shards"`
+	Lease  time.Duration `yaml:"lease"`
+}
+
+// BackendsConfig sets the timeout, retry policy and circuit breaker of each
+// backend the database package talks to.
+type BackendsConfig struct {
+	Postgres      BackendConfig `yaml:"postgres"`
+	ClickHouse    BackendConfig `yaml:"clickhouse"`
+	Elasticsearch BackendConfig `yaml:"elasticsearch"`
+	Redis         BackendConfig `yaml:"redis"`
+}
+
+type BackendConfig struct {
+	Timeout          time.Duration `yaml:"timeout"`
+	MaxAttempts      int           `yaml:"max_attempts"`
+	InitialBackoff   time.Duration `yaml:"initial_backoff"`
+	MaxBackoff       time.Duration `yaml:"max_backoff"`
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenTimeout      time.Duration `yaml:"open_timeout"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+// RetentionConfig trims the streams that consumer groups read. Only entries
+// every group has acknowledged are trimmed, down to MaxLen entries or MaxAge,
+// and a stream with neither set is not trimmed at all. Streams overrides
+// Default by stream name.
+type RetentionConfig struct {
+	Interval   time.Duration                    `yaml:"interval"`
+	StuckAfter time.Duration                    `yaml:"stuck_after"`
+	Default    StreamRetentionConfig            `yaml:"default"`
+	Streams    map[string]StreamRetentionConfig `yaml:"streams"`
+}
+
+type StreamRetentionConfig struct {
+	MaxLen int64         `yaml:"max_len"`
+	MaxAge time.Duration `yaml:"max_age"`
 }
 
 var AppConfig *Config
@@ -66,3 +256,15 @@ func LoadConfig(path string) (*Config, error) {
 	AppConfig = &cfg
 	return AppConfig, nil
 }
+
+// SavedSearchesConfig schedules saved searches. Every PollInterval, due
+// searches are leased for Lease and run; a notification carries at most
+// MaxMatches of the new events. Events ingested less than IndexGrace ago are
+// left for a later run, so those still on their way to the index are not
+// passed over.
+type SavedSearchesConfig struct {
+	PollInterval time.Duration `yaml:"poll_interval"`
+	Lease        time.Duration `yaml:"lease"`
+	MaxMatches   int           `yaml:"max_matches"`
+	IndexGrace   time.Duration `yaml:"index_grace"`
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"analytics-backend/models"
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ArchiveGroupName = "event-archivers"
+	ArchiveBatchSize = int64(1000)
+)
+
+// RestoredField marks stream entries replayed from the archive so the
+// archiver does not write them out a second time.
+const RestoredField = "restored"
+
+// EnsureArchiveGroup starts the group at the beginning of each lane so
+// whatever is still retained when archiving is first enabled is captured too.
+func EnsureArchiveGroup() error {
+	return ensureLaneGroups(ArchiveGroupName, "0")
+}
+
+func NewArchiveReader(consumer string) *LaneReader {
+	return NewLaneReader(ArchiveGroupName, consumer, ArchiveBatchSize, "read_archive_events")
+}
+
+func ReadPendingArchiveEvents(stream, consumer, after string) ([]redis.XMessage, error) {
+	return ReadPendingStreamGroup(stream, ArchiveGroupName, consumer, after, ArchiveBatchSize, "read_pending_archive_events")
+}
+
+func AckArchiveEvents(stream string, ids ...string) error {
+	return AckStreamGroup(stream, ArchiveGroupName, "ack_archive_events", ids...)
+}
+
+// AddRestoredToStream replays an archived event into the pipeline stream.
+func AddRestoredToStream(ctx context.Context, stream string, event models.Event) error {
+	values := EncodeEvent(event)
+	values[RestoredField] = "1"
+
+	started := time.Now()
+	err := Rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: values,
+	}).Err()
+	observeRedisOperation("add_restored_to_stream", stream, started, err)
+	return err
+}
+
+// RecordArchiveFile upserts by path: a file rewritten after a redelivery has
+// the same key and replaces its earlier manifest entry.
+func RecordArchiveFile(ctx context.Context, file *models.ArchiveFile) error {
+	started := time.Now()
+	err := DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "path"}},
+		DoUpdates: clause.AssignmentColumns([]string{"storage", "rows", "bytes", "min_timestamp", "max_timestamp", "checksum", "created_at"}),
+	}).Create(file).Error
+	observeDBOperation("postgres", "upsert", "archive_files", started, err)
+	return err
+}
+
+// ListArchiveFiles returns the files that may hold events in [from, to).
+func ListArchiveFiles(ctx context.Context, from, to time.Time, actions []string) ([]models.ArchiveFile, error) {
+	started := time.Now()
+	query := DB.WithContext(ctx).
+		Where("min_timestamp < ? AND max_timestamp >= ?", to, from).
+		Order("hour asc, action asc, path asc")
+	if len(actions) > 0 {
+		query = query.Where("action IN ?", actions)
+	}
+
+	var files []models.ArchiveFile
+	err := query.Find(&files).Error
+	observeDBOperation("postgres", "select", "archive_files", started, err)
+	return files, err
+}
+
+func ExistingEventIDs(ctx context.Context, ids []int64) (map[int64]bool, error) {
+	existing := make(map[int64]bool, len(ids))
+	if len(ids) == 0 {
+		return existing, nil
+	}
+
+	started := time.Now()
+	var found []int64
+	err := DB.WithContext(ctx).Model(&models.Event{}).Where("id IN ?", ids).Pluck("id", &found).Error
+	observeDBOperation("postgres", "select", "events", started, err)
+	for _, id := range found {
+		existing[id] = true
+	}
+	return existing, err
+}
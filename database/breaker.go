@@ -0,0 +1,288 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerHalfOpen = "half_open"
+	BreakerOpen     = "open"
+)
+
+// ErrCircuitOpen is returned without calling a backend while its breaker is
+// open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Backend guards the calls to one backend. Its breaker opens after
+// FailureThreshold consecutive failures and rejects calls for OpenTimeout.
+// It then lets HalfOpenRequests probes through: a successful probe closes it
+// and a failed one opens it again.
+type Backend struct {
+	name string
+
+	mu            sync.Mutex
+	policy        config.BackendConfig
+	state         string
+	failures      int
+	probes        int
+	openedAt      time.Time
+	lastError     string
+	lastFailureAt time.Time
+}
+
+type BackendStatus struct {
+	Name                string     `json:"name"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+}
+
+var (
+	postgresBackend      = newBackend("postgres", 30*time.Second)
+	clickhouseBackend    = newBackend("clickhouse", 30*time.Second)
+	elasticsearchBackend = newBackend("elasticsearch", 10*time.Second)
+	redisBackend         = newBackend("redis", 3*time.Second)
+
+	backends = []*Backend{postgresBackend, clickhouseBackend, elasticsearchBackend, redisBackend}
+)
+
+func newBackend(name string, timeout time.Duration) *Backend {
+	b := &Backend{name: name, state: BreakerClosed}
+	b.policy = withBackendDefaults(config.BackendConfig{}, timeout)
+	metrics.BackendBreakerState.WithLabelValues(name).Set(0)
+	return b
+}
+
+func withBackendDefaults(cfg config.BackendConfig, timeout time.Duration) config.BackendConfig {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = timeout
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 3
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 2 * time.Second
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return cfg
+}
+
+// ConfigureBackends sets the policies of every backend. It must run before
+// the backends are initialized, since Redis and Postgres apply their timeouts
+// when connecting.
+func ConfigureBackends(cfg config.BackendsConfig) {
+	postgresBackend.configure(cfg.Postgres)
+	clickhouseBackend.configure(cfg.ClickHouse)
+	elasticsearchBackend.configure(cfg.Elasticsearch)
+	redisBackend.configure(cfg.Redis)
+}
+
+func (b *Backend) configure(cfg config.BackendConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.policy = withBackendDefaults(cfg, b.policy.Timeout)
+}
+
+func (b *Backend) Policy() config.BackendConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.policy
+}
+
+func (b *Backend) Status() BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BackendStatus{
+		Name:                b.name,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		LastError:           b.lastError,
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if !b.lastFailureAt.IsZero() {
+		lastFailureAt := b.lastFailureAt
+		status.LastFailureAt = &lastFailureAt
+	}
+	return status
+}
+
+func BackendStatuses() []BackendStatus {
+	statuses := make([]BackendStatus, 0, len(backends))
+	for _, b := range backends {
+		statuses = append(statuses, b.Status())
+	}
+	return statuses
+}
+
+// allow reports whether a call may go ahead, moving an open breaker to
+// half-open once OpenTimeout has passed.
+func (b *Backend) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.policy.OpenTimeout {
+		b.setState(BreakerHalfOpen)
+		b.probes = 0
+	}
+
+	switch b.state {
+	case BreakerOpen:
+	case BreakerHalfOpen:
+		if b.probes >= b.policy.HalfOpenRequests {
+			break
+		}
+		b.probes++
+		return nil
+	default:
+		return nil
+	}
+
+	metrics.BackendRejectedCalls.WithLabelValues(b.name).Inc()
+	return fmt.Errorf("%s: %w", b.name, ErrCircuitOpen)
+}
+
+func (b *Backend) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+	if errors.Is(err, context.Canceled) {
+		// The caller gave up, which says nothing about the backend.
+		return
+	}
+
+	if !isBackendFailure(err) {
+		b.failures = 0
+		if b.state == BreakerHalfOpen {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	b.lastFailureAt = time.Now()
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.policy.FailureThreshold) {
+		b.openedAt = b.lastFailureAt
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *Backend) setState(state string) {
+	if b.state == state {
+		return
+	}
+	log.Printf("Circuit breaker for %s is now %s", b.name, state)
+	b.state = state
+	metrics.BackendBreakerTransitions.WithLabelValues(b.name, state).Inc()
+	metrics.BackendBreakerState.WithLabelValues(b.name).Set(float64(slices.Index([]string{BreakerClosed, BreakerHalfOpen, BreakerOpen}, state)))
+}
+
+// guard runs fn if the breaker allows it and records the outcome.
+func (b *Backend) guard(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn(ctx)
+	b.record(err)
+	return err
+}
+
+// retry runs fn until it succeeds, fails in a way that retrying cannot fix,
+// or runs out of attempts. Attempts are spaced by jittered exponential
+// backoff.
+func (b *Backend) retry(ctx context.Context, fn func(ctx context.Context) error) error {
+	policy := b.Policy()
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if !isBackendFailure(err) || attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		metrics.BackendRetries.WithLabelValues(b.name).Inc()
+		timer := time.NewTimer(backoff/2 + time.Duration(rand.Int64N(int64(backoff/2)+1)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
+
+// do runs fn under the breaker with the backend's timeout applied to each
+// attempt, retrying failures.
+func (b *Backend) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	timeout := b.Policy().Timeout
+	return b.retry(ctx, func(ctx context.Context) error {
+		return b.guard(ctx, func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return fn(ctx)
+		})
+	})
+}
+
+// isBackendFailure reports whether err means the backend is unavailable or
+// struggling. Errors it returned on purpose, like a missing row or a rejected
+// query, are answers rather than failures.
+func isBackendFailure(err error) bool {
+	var pgErr interface{ SQLState() string }
+	var chErr *clickhouse.Exception
+	var redisErr redis.Error
+
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled),
+		errors.Is(err, ErrCircuitOpen),
+		errors.Is(err, gorm.ErrRecordNotFound),
+		errors.Is(err, redis.Nil):
+		return false
+	case errors.As(err, &pgErr):
+		// Connection, resource and operator errors, which include statement
+		// timeouts.
+		state := pgErr.SQLState()
+		return len(state) >= 2 && slices.Contains([]string{"08", "53", "57", "58"}, state[:2])
+	case errors.As(err, &chErr):
+		// TIMEOUT_EXCEEDED, TOO_MANY_SIMULTANEOUS_QUERIES and MEMORY_LIMIT_EXCEEDED.
+		return slices.Contains([]int32{159, 202, 241}, chErr.Code)
+	case errors.As(err, &redisErr):
+		return false
+	}
+	return true
+}
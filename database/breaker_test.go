@@ -0,0 +1,86 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func newTestBackend(cfg config.BackendConfig) *Backend {
+	b := newBackend("test", time.Second)
+	b.configure(cfg)
+	return b
+}
+
+func TestBackendOpensAndRecoversThroughHalfOpen(t *testing.T) {
+	b := newTestBackend(config.BackendConfig{FailureThreshold: 2, OpenTimeout: 20 * time.Millisecond})
+	failing := func(ctx context.Context) error { return errors.New("connection refused") }
+	succeeding := func(ctx context.Context) error { return nil }
+
+	b.guard(context.Background(), failing)
+	b.guard(context.Background(), failing)
+	if b.Status().State != BreakerOpen {
+		t.Fatalf("expected breaker to open after 2 failures, got %s", b.Status().State)
+	}
+
+	called := false
+	err := b.guard(context.Background(), func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, ErrCircuitOpen) || called {
+		t.Fatalf("expected an open breaker to reject the call, got %v", err)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if err := b.guard(context.Background(), failing); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the half-open probe to reach the backend, got %v", err)
+	}
+	if b.Status().State != BreakerOpen {
+		t.Fatalf("expected a failed probe to reopen the breaker, got %s", b.Status().State)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if err := b.guard(context.Background(), succeeding); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.Status().State != BreakerClosed {
+		t.Fatalf("expected a successful probe to close the breaker, got %s", b.Status().State)
+	}
+}
+
+func TestBackendIgnoresAnswersAndCancellations(t *testing.T) {
+	b := newTestBackend(config.BackendConfig{FailureThreshold: 1})
+
+	b.guard(context.Background(), func(ctx context.Context) error { return gorm.ErrRecordNotFound })
+	b.guard(context.Background(), func(ctx context.Context) error { return context.Canceled })
+	if status := b.Status(); status.State != BreakerClosed || status.ConsecutiveFailures != 0 {
+		t.Fatalf("expected breaker to stay closed, got %+v", status)
+	}
+}
+
+func TestBackendRetriesFailuresOnly(t *testing.T) {
+	b := newTestBackend(config.BackendConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, FailureThreshold: 10})
+
+	attempts := 0
+	err := b.do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return errors.New("i/o timeout")
+	})
+	if err == nil || attempts != 3 {
+		t.Fatalf("expected 3 attempts and an error, got %d and %v", attempts, err)
+	}
+
+	attempts = 0
+	b.do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return gorm.ErrRecordNotFound
+	})
+	if attempts != 1 {
+		t.Fatalf("expected a missing row not to be retried, got %d attempts", attempts)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"analytics-backend/config"
 	"analytics-backend/models"
 	"context"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
@@ -38,6 +40,7 @@ func InitClickHouse(cfg config.ClickHouseConfig) {
 
 	schema := `
 	CREATE TABLE IF NOT EXISTS events (
+		id Int64,
 		user_id String,
 		action String,
 		element String,
@@ -53,49 +56,103 @@ func InitClickHouse(cfg config.ClickHouseConfig) {
 		log.Fatalf("Failed to create ClickHouse table: %v", err)
 	}
 
+	// Tables created before events carried their id get the column; their
+	// existing rows read as 0.
+	if err := CH.Exec(context.Background(), "ALTER TABLE events ADD COLUMN IF NOT EXISTS id Int64 DEFAULT 0 FIRST"); err != nil {
+		log.Fatalf("Failed to add id to ClickHouse events: %v", err)
+	}
+
+	// Lets inserts carrying a deduplication token be retried safely; without
+	// it a plain MergeTree ignores the token.
+	if err := CH.Exec(context.Background(), "ALTER TABLE events MODIFY SETTING non_replicated_deduplication_window = 1000"); err != nil {
+		log.Printf("Failed to enable ClickHouse insert deduplication: %v", err)
+	}
+
 	log.Println("Connected to ClickHouse and ensured schema exists")
 }
 
-func InsertToClickHouse(ctx context.Context, userID, action, element string, duration float64, timestamp time.Time) error {
-	started := time.Now()
-	batch, err := CH.PrepareBatch(ctx, "INSERT INTO events")
-	if err != nil {
-		observeDBOperation("clickhouse", "prepare_batch", "events", started, err)
-		return err
+func CloseClickHouse() error {
+	if CH == nil {
+		return nil
 	}
+	return CH.Close()
+}
 
-	if err := batch.Append(userID, action, element, duration, timestamp); err != nil {
-		observeDBOperation("clickhouse", "append", "events", started, err)
-		return err
+// insertEventsQuery names its columns so the insert does not depend on the
+// column order of tables created by older versions.
+const insertEventsQuery = "INSERT INTO events (id, user_id, action, element, duration, timestamp)"
+
+// WithClickHouseDedupToken makes ClickHouse drop an insert whose token it has
+// already seen, so a retried batch is not stored twice.
+func WithClickHouseDedupToken(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
 	}
+	return clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"insert_deduplication_token": token,
+	}))
+}
 
-	err = batch.Send()
-	observeDBOperation("clickhouse", "insert", "events", started, err)
-	return err
+func PingClickHouse(ctx context.Context) error {
+	if CH == nil {
+		return fmt.Errorf("clickhouse not initialized")
+	}
+	return clickhouseBackend.guard(ctx, CH.Ping)
 }
 
 func BatchInsertToClickHouse(events []models.Event) error {
+	return BatchInsertToClickHouseWithContext(context.Background(), events)
+}
+
+func BatchInsertToClickHouseWithContext(ctx context.Context, events []models.Event) error {
 	if len(events) == 0 {
 		return nil
 	}
 
-	started := time.Now()
-	ctx := context.Background()
-	batch, err := CH.PrepareBatch(ctx, "INSERT INTO events")
-	if err != nil {
-		observeDBOperation("clickhouse", "prepare_batch", "events", started, err)
-		return err
-	}
-
-	for _, e := range events {
-		if err := batch.Append(e.UserId, e.Action, e.Element, e.Duration, e.Timestamp); err != nil {
-			observeDBOperation("clickhouse", "append", "events", started, err)
+	// A retried insert is only stored once when ctx carries a deduplication
+	// token from WithClickHouseDedupToken.
+	return clickhouseBackend.do(ctx, func(ctx context.Context) error {
+		started := time.Now()
+		batch, err := CH.PrepareBatch(ctx, insertEventsQuery)
+		if err != nil {
+			observeDBOperation("clickhouse", "prepare_batch", "events", started, err)
 			return err
 		}
+
+		for _, e := range events {
+			if err := batch.Append(e.ID, e.UserId, e.Action, e.Element, e.Duration, e.Timestamp); err != nil {
+				observeDBOperation("clickhouse", "append", "events", started, err)
+				return err
+			}
+		}
+
+		err = batch.Send()
+		observeDBOperation("clickhouse", "batch_insert", "events", started, err)
+		return err
+	})
+}
+
+// DeleteClickHouseEvents removes raw events in the range. The mutation is run
+// synchronously so a replay that follows does not race with it, which can
+// take longer than the ClickHouse timeout and is not retried.
+func DeleteClickHouseEvents(ctx context.Context, r EventRange) error {
+	conditions := []string{"timestamp >= ?", "timestamp < ?"}
+	args := []any{r.From, r.To}
+	if len(r.Actions) > 0 {
+		conditions = append(conditions, "action IN ?")
+		args = append(args, r.Actions)
+	}
+	if len(r.UserIDs) > 0 {
+		conditions = append(conditions, "user_id IN ?")
+		args = append(args, r.UserIDs)
 	}
 
-	err = batch.Send()
-	observeDBOperation("clickhouse", "batch_insert", "events", started, err)
+	started := time.Now()
+	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{"mutations_sync": 2}))
+	err := clickhouseBackend.guard(ctx, func(ctx context.Context) error {
+		return CH.Exec(ctx, "ALTER TABLE events DELETE WHERE "+strings.Join(conditions, " AND "), args...)
+	})
+	observeDBOperation("clickhouse", "delete", "events", started, err)
 	return err
 }
 
@@ -117,7 +174,11 @@ func GetAnalyticsFromClickHouse(ctx context.Context) ([]ClickHouseAnalytics, err
 		GROUP BY action
 		ORDER BY count DESC
 	`
-	if err := CH.Select(ctx, &results, query); err != nil {
+	err := clickhouseBackend.do(ctx, func(ctx context.Context) error {
+		results = nil
+		return CH.Select(ctx, &results, query)
+	})
+	if err != nil {
 		observeDBOperation("clickhouse", "select", "events", started, err)
 		return nil, err
 	}
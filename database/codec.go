@@ -0,0 +1,100 @@
+package database
+
+import (
+	"analytics-backend/models"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// DecodeError says which field of a stream entry could not be decoded.
+type DecodeError struct {
+	Field  string
+	Reason string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// EncodeEvent returns the stream entry fields for an event. Every stream that
+// carries events uses it, and DecodeEvent reverses it.
+func EncodeEvent(event models.Event) map[string]any {
+	return map[string]any{
+		"id":        event.ID,
+		"user_id":   event.UserId,
+		"action":    event.Action,
+		"element":   event.Element,
+		"duration":  event.Duration,
+		"timestamp": event.Timestamp.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// DecodeEvent reads an event from stream entry fields. The id and timestamp
+// are required, and a field that is present must parse; nothing is defaulted,
+// so a bad entry is reported instead of being stored with made-up values.
+// Fields it does not know are ignored.
+func DecodeEvent(values map[string]any) (models.Event, error) {
+	var event models.Event
+
+	id, err := decodeField(values, "id", true)
+	if err != nil {
+		return models.Event{}, err
+	}
+	event.ID, err = strconv.ParseInt(id, 10, 64)
+	if err != nil || event.ID <= 0 {
+		return models.Event{}, &DecodeError{Field: "id", Reason: fmt.Sprintf("%q is not a positive integer", id)}
+	}
+
+	for field, target := range map[string]*string{"user_id": &event.UserId, "action": &event.Action, "element": &event.Element} {
+		if *target, err = decodeField(values, field, false); err != nil {
+			return models.Event{}, err
+		}
+	}
+
+	if _, present := values["duration"]; present {
+		duration, err := decodeField(values, "duration", true)
+		if err != nil {
+			return models.Event{}, err
+		}
+		event.Duration, err = strconv.ParseFloat(duration, 64)
+		if err != nil || math.IsNaN(event.Duration) || math.IsInf(event.Duration, 0) {
+			return models.Event{}, &DecodeError{Field: "duration", Reason: fmt.Sprintf("%q is not a number", duration)}
+		}
+	}
+
+	timestamp, err := decodeField(values, "timestamp", true)
+	if err != nil {
+		return models.Event{}, err
+	}
+	event.Timestamp, err = time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return models.Event{}, &DecodeError{Field: "timestamp", Reason: fmt.Sprintf("%q is not an RFC 3339 time", timestamp)}
+	}
+
+	return event, nil
+}
+
+// decodeField returns a field as a string. Entries read from Redis only hold
+// strings; numbers are accepted for entries built in process.
+func decodeField(values map[string]any, field string, required bool) (string, error) {
+	raw, ok := values[field]
+	if !ok {
+		if required {
+			return "", &DecodeError{Field: field, Reason: "missing"}
+		}
+		return "", nil
+	}
+
+	switch value := raw.(type) {
+	case string:
+		return value, nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	default:
+		return "", &DecodeError{Field: field, Reason: fmt.Sprintf("unexpected type %T", raw)}
+	}
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"analytics-backend/models"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeEventRoundTrip(t *testing.T) {
+	event := models.Event{
+		ID:        42,
+		UserId:    "user-1",
+		Action:    "click",
+		Element:   "button",
+		Duration:  1.25,
+		Timestamp: time.Date(2024, 5, 1, 13, 10, 0, 123456789, time.UTC),
+	}
+
+	// Redis hands every field back as a string.
+	values := map[string]any{}
+	for field, value := range EncodeEvent(event) {
+		values[field] = fmt.Sprint(value)
+	}
+
+	decoded, err := DecodeEvent(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decoded != event {
+		t.Fatalf("expected %+v, got %+v", event, decoded)
+	}
+}
+
+func TestDecodeEventRejectsInsteadOfDefaulting(t *testing.T) {
+	valid := func() map[string]any {
+		return map[string]any{"id": "1", "action": "click", "duration": "1", "timestamp": "2024-05-01T13:10:00Z"}
+	}
+
+	cases := map[string]func(map[string]any){
+		"id":        func(v map[string]any) { delete(v, "id") },
+		"duration":  func(v map[string]any) { v["duration"] = "slow" },
+		"timestamp": func(v map[string]any) { v["timestamp"] = "01/05/2024" },
+	}
+	for field, corrupt := range cases {
+		values := valid()
+		corrupt(values)
+
+		_, err := DecodeEvent(values)
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) || decodeErr.Field != field {
+			t.Errorf("expected a decode error for %s, got %v", field, err)
+		}
+	}
+
+	values := valid()
+	delete(values, "timestamp")
+	if _, err := DecodeEvent(values); err == nil {
+		t.Error("expected a missing timestamp to be rejected")
+	}
+}
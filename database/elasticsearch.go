@@ -3,6 +3,7 @@ package database
 import (
 	"analytics-backend/config"
 	"analytics-backend/models"
+	"analytics-backend/searchql"
 	"bytes"
 	"context"
 	"encoding/base64"
@@ -13,6 +14,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,9 +23,20 @@ const DefaultElasticsearchIndex = "events-search"
 type ElasticsearchClient struct {
 	baseURL    string
 	index      string
+	readAlias  string
+	writeAlias string
 	username   string
 	password   string
 	httpClient *http.Client
+
+	period          string
+	rolloverMaxAge  time.Duration
+	rolloverMaxSize string
+	retention       time.Duration
+	catalog         searchIndexCatalog
+	// setupPending is set while the index template and first index still
+	// have to be installed because the cluster was down on start.
+	setupPending atomic.Bool
 }
 
 type SearchEventsParams struct {
@@ -34,6 +47,16 @@ type SearchEventsParams struct {
 	To     *time.Time
 	Size   int
 	Cursor string
+	// Ascending pages oldest first instead of newest first.
+	Ascending bool
+	// ByID orders by id, which is the order events were ingested in, instead
+	// of by timestamp. AfterID leaves out events up to and including that id.
+	ByID    bool
+	AfterID int64
+	// Facets names the facets to compute next to the items, from
+	// SearchFacetNames. FacetSize caps the terms facets.
+	Facets    []string
+	FacetSize int
 }
 
 type SearchEventsResponse struct {
@@ -42,6 +65,50 @@ type SearchEventsResponse struct {
 	Total      int64          `json:"total"`
 	TookMS     int            `json:"took_ms"`
 	Source     string         `json:"source"`
+	Facets     *SearchFacets  `json:"facets,omitempty"`
+}
+
+const (
+	FacetAction    = "action"
+	FacetElement   = "element"
+	FacetUserID    = "user_id"
+	FacetHistogram = "histogram"
+	FacetDuration  = "duration"
+)
+
+var SearchFacetNames = []string{FacetAction, FacetElement, FacetUserID, FacetHistogram, FacetDuration}
+
+// SearchFacets summarize every event matching a search, not just the page of
+// items returned.
+type SearchFacets struct {
+	Action    []FacetBucket   `json:"action,omitempty"`
+	Element   []FacetBucket   `json:"element,omitempty"`
+	UserID    []FacetBucket   `json:"user_id,omitempty"`
+	Histogram *DateHistogram  `json:"histogram,omitempty"`
+	Duration  *DurationFacets `json:"duration,omitempty"`
+}
+
+type FacetBucket struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type DateHistogram struct {
+	Interval string            `json:"interval"`
+	Buckets  []HistogramBucket `json:"buckets"`
+}
+
+type HistogramBucket struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"`
+}
+
+type DurationFacets struct {
+	Count int64    `json:"count"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+	Avg   *float64 `json:"avg"`
+	Sum   float64  `json:"sum"`
 }
 
 type searchCursor struct {
@@ -52,44 +119,87 @@ type searchCursor struct {
 var ES *ElasticsearchClient
 
 func InitElasticsearch(cfg config.ElasticsearchConfig) error {
+	return initElasticsearch(cfg, false)
+}
+
+// initElasticsearch connects to the cluster and installs its indices. With
+// degraded set, an unreachable cluster is not an error: searches go to the
+// fallback source and the indices are installed once a health check reaches
+// it.
+func initElasticsearch(cfg config.ElasticsearchConfig, degraded bool) error {
 	indexName := strings.TrimSpace(cfg.Index)
 	if indexName == "" {
 		indexName = DefaultElasticsearchIndex
 	}
 
+	period := cfg.IndexPeriod
+	switch period {
+	case "":
+		period = IndexPeriodDaily
+	case IndexPeriodDaily, IndexPeriodMonthly:
+	default:
+		return fmt.Errorf("unknown elasticsearch index_period %q", cfg.IndexPeriod)
+	}
+	maxAge := cfg.RolloverMaxAge
+	if maxAge <= 0 {
+		maxAge = 24 * time.Hour
+		if period == IndexPeriodMonthly {
+			maxAge = 30 * 24 * time.Hour
+		}
+	}
+	maxSize := cfg.RolloverMaxSize
+	if maxSize == "" {
+		maxSize = "50gb"
+	}
+
+	// Requests are bounded by the Elasticsearch backend timeout instead of a
+	// client-wide one.
 	ES = &ElasticsearchClient{
-		baseURL:  strings.TrimRight(cfg.Addr, "/"),
-		index:    indexName,
-		username: cfg.Username,
-		password: cfg.Password,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+		baseURL:         strings.TrimRight(cfg.Addr, "/"),
+		index:           indexName,
+		readAlias:       indexName + "-read",
+		writeAlias:      indexName + "-write",
+		username:        cfg.Username,
+		password:        cfg.Password,
+		httpClient:      &http.Client{},
+		period:          period,
+		rolloverMaxAge:  maxAge,
+		rolloverMaxSize: maxSize,
+		retention:       cfg.Retention,
 	}
 
 	if ES.baseURL == "" {
 		return fmt.Errorf("elasticsearch addr is required")
 	}
 
-	if err := ES.ping(context.Background()); err != nil {
+	err := ES.ping(context.Background())
+	if err == nil {
+		err = ES.ensureIndices(context.Background())
+	}
+	if err != nil && degraded {
+		ES.setupPending.Store(true)
+		setSearchHealthy(false, err)
+		err = nil
+	}
+	if err != nil {
 		return err
 	}
-
-	return ES.ensureIndex(context.Background())
+	Search = ES
+	return nil
 }
 
-func BulkIndexEvents(ctx context.Context, events []models.Event) error {
-	if ES == nil || len(events) == 0 {
-		return nil
+func CloseElasticsearch() {
+	if ES == nil {
+		return
 	}
-	return ES.bulkIndexEvents(ctx, events)
+	ES.httpClient.CloseIdleConnections()
 }
 
-func SearchEvents(ctx context.Context, params SearchEventsParams) (*SearchEventsResponse, error) {
-	if ES == nil {
-		return nil, fmt.Errorf("elasticsearch client not initialized")
+func BulkIndexEvents(ctx context.Context, events []models.Event) error {
+	if Search == nil || len(events) == 0 {
+		return nil
 	}
-	return ES.searchEvents(ctx, params)
+	return Search.IndexEvents(ctx, events)
 }
 
 func BackfillEventsToElasticsearch(ctx context.Context, batchSize int) error {
@@ -102,6 +212,14 @@ func BackfillEventsToElasticsearch(ctx context.Context, batchSize int) error {
 	})
 }
 
+// DeleteIndexedEvents removes indexed events in the range.
+func DeleteIndexedEvents(ctx context.Context, r EventRange) error {
+	if Search == nil {
+		return fmt.Errorf("search backend not initialized")
+	}
+	return Search.DeleteEvents(ctx, r)
+}
+
 func encodeSearchCursor(timestamp time.Time, id int64) (string, error) {
 	payload, err := json.Marshal(searchCursor{
 		Timestamp: timestamp.UTC().Format(time.RFC3339Nano),
@@ -144,6 +262,64 @@ func buildSearchEventsRequest(params SearchEventsParams) (map[string]any, error)
 		size = 100
 	}
 
+	query, err := buildSearchQuery(params)
+	if err != nil {
+		return nil, err
+	}
+
+	request := map[string]any{
+		"size":             size,
+		"track_total_hits": true,
+		"query":            query,
+		"sort":             searchSort(params.Ascending),
+	}
+	if params.ByID {
+		request["sort"] = idSort(params.Ascending)
+	}
+
+	cursor, err := decodeSearchCursor(params.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if cursor != nil {
+		request["search_after"] = []any{cursor.Timestamp, cursor.ID}
+		if params.ByID {
+			request["search_after"] = []any{cursor.ID}
+		}
+	}
+
+	if aggs := buildFacetAggregations(params.Facets, params.FacetSize); len(aggs) > 0 {
+		request["aggs"] = aggs
+	}
+
+	return request, nil
+}
+
+// searchSort orders results newest first, or oldest first when ascending,
+// with the id breaking ties.
+func searchSort(ascending bool) []any {
+	order := "desc"
+	if ascending {
+		order = "asc"
+	}
+	return []any{
+		map[string]any{"timestamp": map[string]any{"order": order}},
+		map[string]any{"id": map[string]any{"order": order}},
+	}
+}
+
+// idSort orders results by id alone.
+func idSort(ascending bool) []any {
+	order := "desc"
+	if ascending {
+		order = "asc"
+	}
+	return []any{map[string]any{"id": map[string]any{"order": order}}}
+}
+
+// buildSearchQuery turns the query and filters of a search into an
+// Elasticsearch query.
+func buildSearchQuery(params SearchEventsParams) (any, error) {
 	filterClauses := make([]any, 0, 4)
 	if params.Action != "" {
 		filterClauses = append(filterClauses, map[string]any{
@@ -173,12 +349,25 @@ func buildSearchEventsRequest(params SearchEventsParams) (map[string]any, error)
 			},
 		})
 	}
+	if params.AfterID != 0 {
+		filterClauses = append(filterClauses, map[string]any{
+			"range": map[string]any{
+				"id": map[string]any{"gt": params.AfterID},
+			},
+		})
+	}
 
 	var query any = map[string]any{"match_all": map[string]any{}}
 	if params.Query != "" || len(filterClauses) > 0 {
 		boolQuery := map[string]any{}
 
-		if params.Query != "" {
+		if searchql.IsQuery(params.Query) {
+			node, err := searchql.Parse(params.Query)
+			if err != nil {
+				return nil, err
+			}
+			boolQuery["must"] = []any{searchql.Compile(node)}
+		} else if params.Query != "" {
 			textSearch := map[string]any{
 				"multi_match": map[string]any{
 					"query":  params.Query,
@@ -208,25 +397,109 @@ func buildSearchEventsRequest(params SearchEventsParams) (map[string]any, error)
 		query = map[string]any{"bool": boolQuery}
 	}
 
-	request := map[string]any{
-		"size":             size,
-		"track_total_hits": true,
-		"query":            query,
-		"sort": []any{
-			map[string]any{"timestamp": map[string]any{"order": "desc"}},
-			map[string]any{"id": map[string]any{"order": "desc"}},
-		},
+	return query, nil
+}
+
+// facetTermFields maps the terms facets to the fields they count.
+var facetTermFields = map[string]string{
+	FacetAction:  "action.keyword",
+	FacetElement: "element.keyword",
+	FacetUserID:  "user_id.keyword",
+}
+
+func buildFacetAggregations(facets []string, size int) map[string]any {
+	size = clampFacetSize(size)
+	aggs := map[string]any{}
+	for _, facet := range facets {
+		switch facet {
+		case FacetAction, FacetElement, FacetUserID:
+			aggs[facet] = map[string]any{"terms": map[string]any{"field": facetTermFields[facet], "size": size}}
+		case FacetHistogram:
+			aggs[facet] = map[string]any{"auto_date_histogram": map[string]any{"field": "timestamp", "buckets": 30}}
+		case FacetDuration:
+			aggs[facet] = map[string]any{"stats": map[string]any{"field": "duration"}}
+		}
 	}
+	return aggs
+}
 
-	cursor, err := decodeSearchCursor(params.Cursor)
-	if err != nil {
-		return nil, err
+func clampFacetSize(size int) int {
+	if size <= 0 {
+		return 10
 	}
-	if cursor != nil {
-		request["search_after"] = []any{cursor.Timestamp, cursor.ID}
+	return min(size, 50)
+}
+
+type facetAggregations struct {
+	Action    *termsAggregation `json:"action"`
+	Element   *termsAggregation `json:"element"`
+	UserID    *termsAggregation `json:"user_id"`
+	Histogram *struct {
+		Interval string `json:"interval"`
+		Buckets  []struct {
+			Key      int64 `json:"key"`
+			DocCount int64 `json:"doc_count"`
+		} `json:"buckets"`
+	} `json:"histogram"`
+	Duration *DurationFacets `json:"duration"`
+}
+
+type termsAggregation struct {
+	Buckets []struct {
+		Key      string `json:"key"`
+		DocCount int64  `json:"doc_count"`
+	} `json:"buckets"`
+}
+
+func (a termsAggregation) buckets() []FacetBucket {
+	buckets := make([]FacetBucket, 0, len(a.Buckets))
+	for _, bucket := range a.Buckets {
+		buckets = append(buckets, FacetBucket{Value: bucket.Key, Count: bucket.DocCount})
 	}
+	return buckets
+}
 
-	return request, nil
+func (a *facetAggregations) facets() *SearchFacets {
+	if a == nil {
+		return nil
+	}
+
+	facets := &SearchFacets{Duration: a.Duration}
+	if a.Action != nil {
+		facets.Action = a.Action.buckets()
+	}
+	if a.Element != nil {
+		facets.Element = a.Element.buckets()
+	}
+	if a.UserID != nil {
+		facets.UserID = a.UserID.buckets()
+	}
+	if a.Histogram != nil {
+		facets.Histogram = &DateHistogram{Interval: a.Histogram.Interval, Buckets: make([]HistogramBucket, 0, len(a.Histogram.Buckets))}
+		for _, bucket := range a.Histogram.Buckets {
+			facets.Histogram.Buckets = append(facets.Histogram.Buckets, HistogramBucket{
+				Start: time.UnixMilli(bucket.Key).UTC(),
+				Count: bucket.DocCount,
+			})
+		}
+	}
+	return facets
+}
+
+func (c *ElasticsearchClient) Name() string {
+	return SearchSourceElasticsearch
+}
+
+func (c *ElasticsearchClient) SearchEvents(ctx context.Context, params SearchEventsParams) (*SearchEventsResponse, error) {
+	return c.searchEvents(ctx, params)
+}
+
+func (c *ElasticsearchClient) IndexEvents(ctx context.Context, events []models.Event) error {
+	return c.bulkIndexEvents(ctx, events)
+}
+
+func (c *ElasticsearchClient) DeleteEvents(ctx context.Context, r EventRange) error {
+	return c.deleteByQuery(ctx, r)
 }
 
 func (c *ElasticsearchClient) ping(ctx context.Context) error {
@@ -243,76 +516,63 @@ func (c *ElasticsearchClient) ping(ctx context.Context) error {
 	return nil
 }
 
-func (c *ElasticsearchClient) ensureIndex(ctx context.Context) error {
-	resp, err := c.doRequest(ctx, http.MethodHead, "/"+c.index, nil, nil)
+// bulkIndexEvents writes new events to the write index and events that are
+// already indexed back into the backing index holding them. An event written
+// again after a rollover, by a retry, a replay or a backfill, is then updated
+// in place instead of copied into a second index.
+func (c *ElasticsearchClient) bulkIndexEvents(ctx context.Context, events []models.Event) error {
+	holding, err := c.indicesHoldingEvents(ctx, events)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to look up indexed events: %w", err)
 	}
-	resp.Body.Close()
+	return c.bulkIndex(ctx, events, func(event models.Event) string {
+		if index, ok := holding[event.ID]; ok {
+			return index
+		}
+		return c.writeAlias
+	})
+}
 
-	if resp.StatusCode == http.StatusOK {
-		return nil
-	}
-	if resp.StatusCode != http.StatusNotFound {
-		return fmt.Errorf("failed to check index %s: %s", c.index, resp.Status)
+// indicesHoldingEvents returns the backing index of every event that is
+// already indexed behind the read alias.
+func (c *ElasticsearchClient) indicesHoldingEvents(ctx context.Context, events []models.Event) (map[int64]string, error) {
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, strconv.FormatInt(event.ID, 10))
 	}
-
-	mapping := map[string]any{
-		"mappings": map[string]any{
-			"properties": map[string]any{
-				"id": map[string]any{
-					"type": "long",
-				},
-				"user_id": map[string]any{
-					"type": "text",
-					"fields": map[string]any{
-						"keyword": map[string]any{"type": "keyword"},
-					},
-				},
-				"action": map[string]any{
-					"type": "text",
-					"fields": map[string]any{
-						"keyword": map[string]any{"type": "keyword"},
-					},
-				},
-				"element": map[string]any{
-					"type": "text",
-					"fields": map[string]any{
-						"keyword": map[string]any{"type": "keyword"},
-					},
-				},
-				"duration": map[string]any{
-					"type": "float",
-				},
-				"timestamp": map[string]any{
-					"type": "date",
-				},
-			},
-		},
+	request := map[string]any{
+		"query":   map[string]any{"ids": map[string]any{"values": ids}},
+		"_source": false,
+		"size":    len(ids),
 	}
-
-	payload, err := json.Marshal(mapping)
-	if err != nil {
-		return err
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Index string `json:"_index"`
+				ID    string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
 	}
-
-	createResp, err := c.doRequest(ctx, http.MethodPut, "/"+c.index, bytes.NewReader(payload), map[string]string{
-		"Content-Type": "application/json",
-	})
-	if err != nil {
-		return err
+	if err := c.callJSON(ctx, http.MethodPost, "/"+c.readAlias+"/_search?ignore_unavailable=true", request, &result); err != nil {
+		return nil, err
 	}
-	defer createResp.Body.Close()
 
-	if createResp.StatusCode >= 300 {
-		body, _ := io.ReadAll(createResp.Body)
-		return fmt.Errorf("failed to create elasticsearch index: %s", strings.TrimSpace(string(body)))
+	holding := make(map[int64]string, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		id, err := strconv.ParseInt(hit.ID, 10, 64)
+		if err != nil {
+			continue
+		}
+		holding[id] = hit.Index
 	}
+	return holding, nil
+}
 
-	return nil
+func (c *ElasticsearchClient) bulkIndexInto(ctx context.Context, index string, events []models.Event) error {
+	return c.bulkIndex(ctx, events, func(models.Event) string { return index })
 }
 
-func (c *ElasticsearchClient) bulkIndexEvents(ctx context.Context, events []models.Event) (err error) {
+func (c *ElasticsearchClient) bulkIndex(ctx context.Context, events []models.Event, indexFor func(models.Event) string) (err error) {
 	started := time.Now()
 	defer func() {
 		observeDBOperation("elasticsearch", "bulk_index", c.index, started, err)
@@ -323,7 +583,7 @@ func (c *ElasticsearchClient) bulkIndexEvents(ctx context.Context, events []mode
 	for _, event := range events {
 		actionMeta := map[string]any{
 			"index": map[string]any{
-				"_index": c.index,
+				"_index": indexFor(event),
 				"_id":    strconv.FormatInt(event.ID, 10),
 			},
 		}
@@ -397,13 +657,14 @@ func (c *ElasticsearchClient) searchEvents(ctx context.Context, params SearchEve
 	if err != nil {
 		return nil, err
 	}
+	requestBody["query"] = c.pruneQuery(requestBody["query"], params.From, params.To)
 
 	payload, err := json.Marshal(requestBody)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.doRequest(ctx, http.MethodPost, "/"+c.index+"/_search", bytes.NewReader(payload), map[string]string{
+	resp, err := c.doRequest(ctx, http.MethodPost, "/"+c.readAlias+"/_search?ignore_unavailable=true", bytes.NewReader(payload), map[string]string{
 		"Content-Type": "application/json",
 	})
 	if err != nil {
@@ -428,6 +689,7 @@ func (c *ElasticsearchClient) searchEvents(ctx context.Context, params SearchEve
 				Sort   []any        `json:"sort"`
 			} `json:"hits"`
 		} `json:"hits"`
+		Aggregations *facetAggregations `json:"aggregations"`
 	}
 	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, err
@@ -441,7 +703,10 @@ func (c *ElasticsearchClient) searchEvents(ctx context.Context, params SearchEve
 	nextCursor := ""
 	if len(result.Hits.Hits) == requestedSize {
 		last := result.Hits.Hits[len(result.Hits.Hits)-1]
-		if len(last.Sort) >= 2 {
+		if params.ByID {
+			// The id sort value is decoded as a float, which can round it.
+			nextCursor, _ = encodeSearchCursor(last.Source.Timestamp, last.Source.ID)
+		} else if len(last.Sort) >= 2 {
 			sortTimestamp, ok := last.Sort[0].(string)
 			if ok {
 				idValue, err := anyToInt64(last.Sort[1])
@@ -460,30 +725,125 @@ func (c *ElasticsearchClient) searchEvents(ctx context.Context, params SearchEve
 		NextCursor: nextCursor,
 		Total:      result.Hits.Total.Value,
 		TookMS:     result.Took,
-		Source:     "elasticsearch",
+		Source:     SearchSourceElasticsearch,
+		Facets:     result.Aggregations.facets(),
 	}
 	return response, nil
 }
 
-func (c *ElasticsearchClient) doRequest(ctx context.Context, method, path string, body io.Reader, headers map[string]string) (*http.Response, error) {
-	requestURL, err := url.JoinPath(c.baseURL, path)
+func (c *ElasticsearchClient) deleteByQuery(ctx context.Context, r EventRange) (err error) {
+	started := time.Now()
+	defer func() {
+		observeDBOperation("elasticsearch", "delete_by_query", c.index, started, err)
+	}()
+
+	filters := []map[string]any{
+		{"range": map[string]any{"timestamp": map[string]any{
+			"gte": r.From.UTC().Format(time.RFC3339Nano),
+			"lt":  r.To.UTC().Format(time.RFC3339Nano),
+		}}},
+	}
+	if len(r.Actions) > 0 {
+		filters = append(filters, map[string]any{"terms": map[string]any{"action.keyword": r.Actions}})
+	}
+	if len(r.UserIDs) > 0 {
+		filters = append(filters, map[string]any{"terms": map[string]any{"user_id.keyword": r.UserIDs}})
+	}
+
+	payload, err := json.Marshal(map[string]any{
+		"query": map[string]any{"bool": map[string]any{"filter": filters}},
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, method, requestURL, body)
+	// Deleting a large range can outlast the Elasticsearch timeout, so it only
+	// goes through the breaker.
+	resp, err := c.send(ctx, elasticsearchBackend.guard, http.MethodPost, "/"+c.readAlias+"/_delete_by_query?conflicts=proceed&refresh=true", bytes.NewReader(payload), map[string]string{
+		"Content-Type": "application/json",
+	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("delete by query failed: %s", strings.TrimSpace(string(body)))
+		return err
 	}
+	return nil
+}
+
+// elasticsearchError is a response saying the cluster is overloaded or
+// failing, as opposed to one rejecting the request.
+type elasticsearchError struct {
+	status string
+	body   string
+}
+
+func (e *elasticsearchError) Error() string {
+	return fmt.Sprintf("elasticsearch returned %s: %s", e.status, e.body)
+}
+
+func (c *ElasticsearchClient) doRequest(ctx context.Context, method, path string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	return c.send(ctx, elasticsearchBackend.do, method, path, body, headers)
+}
 
-	for key, value := range headers {
-		req.Header.Set(key, value)
+// send makes a request through call, which is the breaker alone or the
+// breaker with the timeout and retries. The response body is read inside the
+// call so the per-attempt deadline cannot cut it short.
+func (c *ElasticsearchClient) send(ctx context.Context, call func(context.Context, func(context.Context) error) error, method, path string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	path, query, _ := strings.Cut(path, "?")
+	requestURL, err := url.JoinPath(c.baseURL, path)
+	if err != nil {
+		return nil, err
 	}
-	if c.username != "" {
-		req.SetBasicAuth(c.username, c.password)
+	if query != "" {
+		requestURL += "?" + query
 	}
 
-	return c.httpClient.Do(req)
+	var payload []byte
+	if body != nil {
+		if payload, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
+
+	var resp *http.Response
+	err = call(ctx, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, method, requestURL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		if c.username != "" {
+			req.SetBasicAuth(c.username, c.password)
+		}
+
+		resp, err = c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return &elasticsearchError{status: resp.Status, body: strings.TrimSpace(string(data))}
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 func anyToInt64(value any) (int64, error) {
@@ -1,6 +1,14 @@
 package database
 
 import (
+	"analytics-backend/models"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
 	"testing"
 	"time"
 )
@@ -106,3 +114,164 @@ func TestBuildSearchEventsRequestSupportsNumericIDSearch(t *testing.T) {
 		t.Fatalf("expected 2 should clauses, got %#v", boolQuery["should"])
 	}
 }
+
+func TestBuildSearchEventsRequestCompilesQueryLanguage(t *testing.T) {
+	request, err := buildSearchEventsRequest(SearchEventsParams{Query: "action:click", UserID: "u1"})
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+
+	boolQuery := request["query"].(map[string]any)["bool"].(map[string]any)
+	must := boolQuery["must"].([]any)
+	term := must[0].(map[string]any)["term"].(map[string]any)
+	if term["action.keyword"] != "click" {
+		t.Fatalf("expected an exact action term, got %#v", must)
+	}
+	if _, ok := boolQuery["filter"]; !ok {
+		t.Fatalf("expected the user_id filter to be kept, got %#v", boolQuery)
+	}
+
+	if _, err := buildSearchEventsRequest(SearchEventsParams{Query: "colour:red"}); err == nil {
+		t.Fatal("expected an unknown field to be rejected")
+	}
+}
+
+func TestPrunedIndicesSkipOnlyKnownIndicesOutsideRange(t *testing.T) {
+	day := func(month time.Month, d int) time.Time { return time.Date(2026, month, d, 0, 0, 0, 0, time.UTC) }
+	client := &ElasticsearchClient{index: "events-search", readAlias: "events-search-read"}
+
+	from := day(4, 2)
+	if pruned := client.prunedIndices(&from, nil); pruned != nil {
+		t.Fatalf("expected nothing to be pruned before the catalog loads, got %v", pruned)
+	}
+
+	client.catalog = searchIndexCatalog{
+		loaded: true,
+		write:  "events-search-2026.04.03-000003",
+		indices: []searchIndex{
+			{Name: "events-search-2026.04.01-000001", MinTime: day(3, 28), MaxTime: day(4, 1)},
+			{Name: "events-search-2026.04.02-000002", MinTime: day(4, 1), MaxTime: day(4, 2)},
+			{Name: "events-search-2026.04.03-000003", MinTime: day(4, 2), MaxTime: day(4, 3)},
+		},
+	}
+
+	if pruned := client.prunedIndices(&from, nil); !slices.Equal(pruned, []string{"events-search-2026.04.01-000001"}) {
+		t.Fatalf("unexpected pruned indices for from: %v", pruned)
+	}
+
+	// The write index is kept even though its known events are all later.
+	to := day(3, 30)
+	if pruned := client.prunedIndices(nil, &to); !slices.Equal(pruned, []string{"events-search-2026.04.02-000002"}) {
+		t.Fatalf("expected only the rolled over index after the range to be pruned, got %v", pruned)
+	}
+
+	if pruned := client.prunedIndices(nil, nil); pruned != nil {
+		t.Fatalf("expected an unbounded search to prune nothing, got %v", pruned)
+	}
+
+	// An index rolled over to elsewhere is not in the catalog yet, so it is
+	// not excluded and the query on the read alias still reaches it.
+	query := client.pruneQuery(map[string]any{"match_all": map[string]any{}}, &from, nil)
+	mustNot := query.(map[string]any)["bool"].(map[string]any)["must_not"].([]any)
+	excluded := mustNot[0].(map[string]any)["terms"].(map[string]any)["_index"].([]string)
+	if !slices.Equal(excluded, []string{"events-search-2026.04.01-000001"}) {
+		t.Fatalf("expected the query to exclude only the pruned index, got %v", excluded)
+	}
+}
+
+func TestPruneQueryReachesIndexSwappedInByReindex(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 4, d, 0, 0, 0, 0, time.UTC) }
+	// The catalog from before a reindex swapped the aliases to
+	// events-search-reindex-7-000001, which it does not know about.
+	client := &ElasticsearchClient{index: "events-search", readAlias: "events-search-read"}
+	client.catalog = searchIndexCatalog{
+		loaded: true,
+		write:  "events-search-2026.04.02-000002",
+		indices: []searchIndex{
+			{Name: "events-search-2026.04.01-000001", MinTime: day(1), MaxTime: day(1)},
+			{Name: "events-search-2026.04.02-000002", MinTime: day(2), MaxTime: day(2)},
+		},
+	}
+
+	from := day(2)
+	query := client.pruneQuery(map[string]any{"match_all": map[string]any{}}, &from, nil)
+	mustNot := query.(map[string]any)["bool"].(map[string]any)["must_not"].([]any)
+	excluded := mustNot[0].(map[string]any)["terms"].(map[string]any)["_index"].([]string)
+	if slices.Contains(excluded, "events-search-reindex-7-000001") || len(excluded) != 1 {
+		t.Fatalf("expected only the old out-of-range index to be excluded, got %v", excluded)
+	}
+}
+
+func TestSearchFacetsAreRequestedAndDecoded(t *testing.T) {
+	request, err := buildSearchEventsRequest(SearchEventsParams{Facets: []string{FacetAction, FacetHistogram, FacetDuration}, FacetSize: 5})
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+
+	aggs, ok := request["aggs"].(map[string]any)
+	if !ok || len(aggs) != 3 {
+		t.Fatalf("expected 3 aggregations, got %#v", request["aggs"])
+	}
+	terms := aggs[FacetAction].(map[string]any)["terms"].(map[string]any)
+	if terms["field"] != "action.keyword" || terms["size"] != 5 {
+		t.Fatalf("unexpected action facet %#v", terms)
+	}
+
+	var decoded facetAggregations
+	err = json.Unmarshal([]byte(`{
+		"action": {"buckets": [{"key": "click", "doc_count": 7}, {"key": "view", "doc_count": 2}]},
+		"histogram": {"interval": "1h", "buckets": [{"key": 1775736000000, "doc_count": 9}]},
+		"duration": {"count": 9, "min": 0.5, "max": 4, "avg": 1.5, "sum": 13.5}
+	}`), &decoded)
+	if err != nil {
+		t.Fatalf("decode aggregations: %v", err)
+	}
+
+	facets := decoded.facets()
+	if len(facets.Action) != 2 || facets.Action[0] != (FacetBucket{Value: "click", Count: 7}) {
+		t.Fatalf("unexpected action facet %#v", facets.Action)
+	}
+	if facets.Histogram.Interval != "1h" || !facets.Histogram.Buckets[0].Start.Equal(time.Date(2026, 4, 9, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected histogram %#v", facets.Histogram)
+	}
+	if facets.Duration.Count != 9 || *facets.Duration.Max != 4 || facets.Element != nil {
+		t.Fatalf("unexpected facets %#v", facets)
+	}
+}
+
+func TestBulkIndexEventsUpdatesEventsInTheIndexHoldingThem(t *testing.T) {
+	targets := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/events-search-read/_search":
+			// Event 1 was indexed before the write alias rolled over.
+			fmt.Fprint(w, `{"hits":{"hits":[{"_index":"events-search-2026.10.18-000001","_id":"1"}]}}`)
+		case "/_bulk":
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				var action struct {
+					Index struct {
+						Index string `json:"_index"`
+						ID    string `json:"_id"`
+					} `json:"index"`
+				}
+				json.Unmarshal(scanner.Bytes(), &action)
+				targets[action.Index.ID] = action.Index.Index
+				scanner.Scan()
+			}
+			fmt.Fprint(w, `{"errors":false}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := &ElasticsearchClient{baseURL: server.URL, index: "events-search", readAlias: "events-search-read", writeAlias: "events-search-write", httpClient: server.Client()}
+	if err := client.bulkIndexEvents(context.Background(), []models.Event{{ID: 1}, {ID: 2}}); err != nil {
+		t.Fatalf("bulk index: %v", err)
+	}
+
+	if targets["1"] != "events-search-2026.10.18-000001" || targets["2"] != "events-search-write" {
+		t.Fatalf("expected the indexed event to stay in its index and the new one to go to the write alias, got %v", targets)
+	}
+}
@@ -0,0 +1,363 @@
+package database
+
+import (
+	"analytics-backend/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	StreamEntryPending     = "pending"
+	StreamEntryUndelivered = "undelivered"
+	StreamEntryAcked       = "acked"
+)
+
+// Streams and outbox entries are not indexed by event ID, so looking an event
+// up in them scans from a little before the time in its ID, to allow for
+// clocks that disagree, and gives up after EventLookupScanLimit entries.
+var (
+	EventLookupSkew      = time.Minute
+	EventLookupScanLimit = int64(10000)
+)
+
+// ErrLookupScanIncomplete is returned along with what was found when a scan
+// gave up at EventLookupScanLimit entries, so the event may still be further
+// on.
+var ErrLookupScanIncomplete = errors.New("scan stopped at the entry limit")
+
+// EventStreamEntry is a stream entry carrying an event, with where each of
+// the stream's groups is with it.
+type EventStreamEntry struct {
+	Stream  string             `json:"stream"`
+	EntryID string             `json:"entry_id"`
+	Groups  []EventStreamGroup `json:"groups"`
+}
+
+type EventStreamGroup struct {
+	Group      string `json:"group"`
+	Status     string `json:"status"`
+	Consumer   string `json:"consumer,omitempty"`
+	Deliveries int64  `json:"deliveries,omitempty"`
+	IdleMS     int64  `json:"idle_ms,omitempty"`
+}
+
+// EventDeadLetter is a quarantined entry or webhook dead letter holding an
+// event.
+type EventDeadLetter struct {
+	Stream   string    `json:"stream"`
+	EntryID  string    `json:"entry_id"`
+	Reason   string    `json:"reason"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// EventOutboxEntry is an outbox entry holding an event that has not reached
+// all its sinks yet.
+type EventOutboxEntry struct {
+	ID             uint     `json:"id"`
+	Stream         string   `json:"stream"`
+	PendingSinks   []string `json:"pending_sinks"`
+	CompletedSinks []string `json:"completed_sinks"`
+	Attempts       int      `json:"attempts"`
+	LastError      string   `json:"last_error,omitempty"`
+}
+
+// FindEvent returns the stored event, or nil when Postgres does not have it.
+func FindEvent(ctx context.Context, id int64) (*models.Event, error) {
+	started := time.Now()
+	var event models.Event
+	err := DB.WithContext(ctx).First(&event, id).Error
+	observeDBOperation("postgres", "select", "events", started, err)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// ClickHouseHasEvent reports whether ClickHouse has the event. When the
+// stored event is known, its action and timestamp narrow the lookup to the
+// part of the table sorted under them.
+func ClickHouseHasEvent(ctx context.Context, id int64, stored *models.Event) (found bool, err error) {
+	started := time.Now()
+	defer func() {
+		observeDBOperation("clickhouse", "select", "events", started, err)
+	}()
+
+	query := "SELECT count() FROM events WHERE id = ?"
+	args := []any{id}
+	if stored != nil {
+		// ClickHouse keeps timestamps to the second.
+		second := stored.Timestamp.UTC().Truncate(time.Second)
+		query += " AND action = ? AND timestamp >= ? AND timestamp < ?"
+		args = append(args, stored.Action, second, second.Add(time.Second))
+	}
+
+	var count uint64
+	err = clickhouseBackend.do(ctx, func(ctx context.Context) error {
+		return CH.QueryRow(ctx, query, args...).Scan(&count)
+	})
+	return count > 0, err
+}
+
+// IndicesHoldingEvent returns the search indices with a document for the
+// event. More than one means it was indexed into several backing indices.
+func IndicesHoldingEvent(ctx context.Context, id int64) ([]string, error) {
+	if ES == nil {
+		return nil, fmt.Errorf("elasticsearch client not initialized")
+	}
+	request := map[string]any{
+		"query":   map[string]any{"ids": map[string]any{"values": []string{strconv.FormatInt(id, 10)}}},
+		"_source": false,
+		"size":    10,
+	}
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Index string `json:"_index"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	err := ES.callJSON(ctx, http.MethodPost, "/"+url.PathEscape(ES.readAlias)+"/_search", request, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := []string{}
+	for _, hit := range result.Hits.Hits {
+		indices = append(indices, hit.Index)
+	}
+	return indices, nil
+}
+
+// RecentFeedHasEvent reports whether the event is in the recent feed. The
+// feed is scored by ID as a float, which can round several IDs to one score,
+// so the members with the event's score are decoded to find it.
+func RecentFeedHasEvent(ctx context.Context, id int64) (bool, error) {
+	score := strconv.FormatFloat(float64(id), 'f', -1, 64)
+	started := time.Now()
+	members, err := Rdb.ZRangeByScore(ctx, "events:recent", &redis.ZRangeBy{Min: score, Max: score}).Result()
+	observeRedisOperation("lookup_recent_feed", "events:recent", started, err)
+	if err != nil {
+		return false, err
+	}
+
+	for _, member := range members {
+		var event models.Event
+		if json.Unmarshal([]byte(member), &event) == nil && event.ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// eventStreams are the streams that carry events on their way to the stores.
+func eventStreams() []string {
+	streams := []string{}
+	for _, lane := range Lanes() {
+		streams = append(streams, lane.Stream)
+	}
+	return append(streams, IndexStreamName, ReplayStreamName)
+}
+
+// FindEventStreamEntries returns the entries carrying the event in the event
+// streams, from since on.
+func FindEventStreamEntries(ctx context.Context, id int64, since time.Time) ([]EventStreamEntry, error) {
+	entries := []EventStreamEntry{}
+	var truncated []string
+	for _, stream := range eventStreams() {
+		messages, complete, err := scanStreamSince(ctx, stream, since, "lookup_event_entries")
+		if err != nil {
+			return nil, err
+		}
+		if !complete {
+			truncated = append(truncated, stream)
+		}
+		for _, message := range messages {
+			event, err := DecodeEvent(message.Values)
+			if err != nil || event.ID != id {
+				continue
+			}
+			groups, err := streamEntryGroups(ctx, stream, message.ID)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, EventStreamEntry{Stream: stream, EntryID: message.ID, Groups: groups})
+		}
+	}
+	return entries, incompleteScan(truncated)
+}
+
+// streamEntryGroups says for each group of the stream whether the entry is
+// pending with a consumer, not delivered yet, or acknowledged.
+func streamEntryGroups(ctx context.Context, stream, entryID string) ([]EventStreamGroup, error) {
+	started := time.Now()
+	groups, err := Rdb.XInfoGroups(ctx, stream).Result()
+	observeRedisOperation("lookup_event_groups", stream, started, err)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]EventStreamGroup, 0, len(groups))
+	for _, group := range groups {
+		status := EventStreamGroup{Group: group.Name, Status: streamEntryStatus(entryID, group.LastDeliveredID)}
+		if group.Pending > 0 {
+			started := time.Now()
+			pending, err := Rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: stream,
+				Group:  group.Name,
+				Start:  entryID,
+				End:    entryID,
+				Count:  1,
+			}).Result()
+			observeRedisOperation("lookup_event_groups", stream, started, err)
+			if err != nil {
+				return nil, err
+			}
+			if len(pending) > 0 {
+				status.Status = StreamEntryPending
+				status.Consumer = pending[0].Consumer
+				status.Deliveries = pending[0].RetryCount
+				status.IdleMS = pending[0].Idle.Milliseconds()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// streamEntryStatus is the status of an entry that is not pending with the
+// group: it was acknowledged if the group has been delivered past it.
+func streamEntryStatus(entryID, lastDeliveredID string) string {
+	if compareStreamIDs(entryID, lastDeliveredID) > 0 {
+		return StreamEntryUndelivered
+	}
+	return StreamEntryAcked
+}
+
+// FindEventDeadLetters returns the quarantined entries and webhook dead
+// letters holding the event, from since on.
+func FindEventDeadLetters(ctx context.Context, id int64, since time.Time) ([]EventDeadLetter, error) {
+	idString := strconv.FormatInt(id, 10)
+	deadLetters := []EventDeadLetter{}
+	var truncated []string
+
+	messages, complete, err := scanStreamSince(ctx, QuarantineStreamName, since, "lookup_event_dead_letters")
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		truncated = append(truncated, QuarantineStreamName)
+	}
+	for _, message := range messages {
+		var values map[string]string
+		raw, _ := message.Values["values"].(string)
+		if json.Unmarshal([]byte(raw), &values) != nil || values["id"] != idString {
+			continue
+		}
+		deadLetter := EventDeadLetter{Stream: QuarantineStreamName, EntryID: message.ID}
+		deadLetter.Reason, _ = message.Values["reason"].(string)
+		if quarantinedAt, ok := message.Values["quarantined_at"].(string); ok {
+			deadLetter.FailedAt, _ = time.Parse(time.RFC3339Nano, quarantinedAt)
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	destinations, err := ListWebhookDestinations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, destination := range destinations {
+		stream := webhookDeadLetterStream(destination.ID)
+		messages, complete, err := scanStreamSince(ctx, stream, since, "lookup_event_dead_letters")
+		if err != nil {
+			return nil, err
+		}
+		if !complete {
+			truncated = append(truncated, stream)
+		}
+		for _, message := range messages {
+			eventIDs, _ := message.Values["event_ids"].(string)
+			if !slices.Contains(strings.Split(eventIDs, ","), idString) {
+				continue
+			}
+			deadLetter := EventDeadLetter{Stream: stream, EntryID: message.ID}
+			deadLetter.Reason, _ = message.Values["reason"].(string)
+			if failedAt, ok := message.Values["failed_at"].(string); ok {
+				deadLetter.FailedAt, _ = time.Parse(time.RFC3339Nano, failedAt)
+			}
+			deadLetters = append(deadLetters, deadLetter)
+		}
+	}
+	return deadLetters, incompleteScan(truncated)
+}
+
+// FindEventOutboxEntries returns the uncompleted outbox entries created from
+// since on that hold the event.
+func FindEventOutboxEntries(ctx context.Context, id int64, since time.Time) ([]EventOutboxEntry, error) {
+	started := time.Now()
+	var outbox []models.OutboxEntry
+	err := DB.WithContext(ctx).
+		Where("completed_at IS NULL AND created_at >= ?", since).
+		Order("id asc").
+		Limit(int(EventLookupScanLimit)).
+		Find(&outbox).Error
+	observeDBOperation("postgres", "select", "outbox_entries", started, err)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []EventOutboxEntry{}
+	for _, entry := range outbox {
+		for _, event := range entry.Events {
+			if event.ID != id {
+				continue
+			}
+			entries = append(entries, EventOutboxEntry{
+				ID:             entry.ID,
+				Stream:         entry.Stream,
+				PendingSinks:   entry.PendingSinks,
+				CompletedSinks: entry.CompletedSinks,
+				Attempts:       entry.Attempts,
+				LastError:      entry.LastError,
+			})
+			break
+		}
+	}
+	if int64(len(outbox)) == EventLookupScanLimit {
+		return entries, incompleteScan([]string{"outbox_entries"})
+	}
+	return entries, nil
+}
+
+// scanStreamSince reads up to EventLookupScanLimit entries added from since
+// on. complete is false when it stopped at the limit rather than at the end.
+// A stream that does not exist has no entries.
+func scanStreamSince(ctx context.Context, stream string, since time.Time, operation string) ([]redis.XMessage, bool, error) {
+	start := strconv.FormatInt(max(since.UnixMilli(), 0), 10)
+	started := time.Now()
+	messages, err := Rdb.XRangeN(ctx, stream, start, "+", EventLookupScanLimit).Result()
+	observeRedisOperation(operation, stream, started, err)
+	return messages, int64(len(messages)) < EventLookupScanLimit, err
+}
+
+// incompleteScan returns ErrLookupScanIncomplete for the scans that stopped
+// at the limit, or nil when every scan reached the end.
+func incompleteScan(sources []string) error {
+	if len(sources) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w in %s", ErrLookupScanIncomplete, strings.Join(sources, ", "))
+}
@@ -0,0 +1,19 @@
+package database
+
+import "testing"
+
+func TestStreamEntryStatusComparesWithLastDelivered(t *testing.T) {
+	cases := []struct {
+		entry, lastDelivered, want string
+	}{
+		{"1700000000000-3", "1700000000000-3", StreamEntryAcked},
+		{"1700000000000-3", "1700000000001-0", StreamEntryAcked},
+		{"1700000000000-4", "1700000000000-3", StreamEntryUndelivered},
+		{"1700000000000-0", "0-0", StreamEntryUndelivered},
+	}
+	for _, c := range cases {
+		if got := streamEntryStatus(c.entry, c.lastDelivered); got != c.want {
+			t.Errorf("entry %s after %s: expected %s, got %s", c.entry, c.lastDelivered, c.want, got)
+		}
+	}
+}
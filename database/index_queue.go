@@ -34,14 +34,7 @@ func EnqueueEventsForIndexing(ctx context.Context, events []models.Event) error
 	for _, event := range events {
 		pipe.XAdd(ctx, &redis.XAddArgs{
 			Stream: IndexStreamName,
-			Values: map[string]any{
-				"id":        event.ID,
-				"user_id":   event.UserId,
-				"action":    event.Action,
-				"element":   event.Element,
-				"duration":  event.Duration,
-				"timestamp": event.Timestamp.UTC().Format(time.RFC3339Nano),
-			},
+			Values: EncodeEvent(event),
 		})
 	}
 
@@ -81,6 +74,25 @@ func ReadIndexJobsFromGroup(consumer string) ([]redis.XMessage, error) {
 	return messages, nil
 }
 
+// ReadPendingIndexJobs returns the oldest index jobs delivered to consumer
+// but not acknowledged yet.
+func ReadPendingIndexJobs(consumer string) ([]redis.XMessage, error) {
+	return ReadPendingStreamGroup(IndexStreamName, IndexGroupName, consumer, "0", IndexBatchSize, "read_pending_index_jobs")
+}
+
+// ClaimIdleIndexJobs moves index jobs other indexers left unacknowledged for
+// LaneClaimIdle to consumer and returns them. Indexers acknowledge every
+// batch once it is indexed, so such jobs belong to a stopped indexer.
+func ClaimIdleIndexJobs(consumer string) ([]redis.XMessage, error) {
+	started := time.Now()
+	messages, err := redisIdleClaimer{}.claimIdle(Ctx, IndexStreamName, IndexGroupName, consumer, LaneClaimIdle, IndexBatchSize)
+	if err != nil {
+		log.Printf("Failed to claim idle index jobs: %v", err)
+	}
+	observeRedisOperation("claim_idle_index_jobs", IndexStreamName, started, err)
+	return messages, err
+}
+
 func AckIndexJobs(ids ...string) error {
 	if len(ids) == 0 {
 		return nil
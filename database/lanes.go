@@ -0,0 +1,438 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const DefaultLaneName = "default"
+
+// Lane is a stream that a class of events is routed to. Consumer groups
+// read every lane, weighted by Weight.
+type Lane struct {
+	Name   string
+	Stream string
+	Weight int
+	Match  map[string][]string
+}
+
+func (l Lane) matches(event models.Event) bool {
+	if len(l.Match) == 0 {
+		return false
+	}
+	for field, patterns := range l.Match {
+		value, _ := event.FieldValue(field)
+		if !slices.ContainsFunc(patterns, func(pattern string) bool {
+			ok, _ := path.Match(pattern, value)
+			return ok
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	lanes       = []Lane{{Name: DefaultLaneName, Stream: StreamName, Weight: 1}}
+	defaultLane = 0
+	// LaneClaimIdle is how long a message may sit unacknowledged with one
+	// aggregator or indexer before another takes it over. A worker retrying
+	// a failed batch reads it again on every attempt, so it must be longer
+	// than the longest retry backoff.
+	LaneClaimIdle = 2 * time.Minute
+)
+
+// ConfigureLanes replaces the single events stream with the configured lanes.
+// The default lane keeps the events stream unless it names another one, so
+// switching lanes on does not strand what is already queued.
+func ConfigureLanes(cfg config.LanesConfig) error {
+	if cfg.ClaimIdle > 0 {
+		LaneClaimIdle = cfg.ClaimIdle
+	}
+	if len(cfg.Lanes) == 0 {
+		return nil
+	}
+
+	configured := make([]Lane, 0, len(cfg.Lanes))
+	defaultIndex := -1
+	for i, laneCfg := range cfg.Lanes {
+		if laneCfg.Name == "" {
+			return fmt.Errorf("lane name is required")
+		}
+		if laneCfg.Weight < 0 {
+			return fmt.Errorf("lane %q has a negative weight", laneCfg.Name)
+		}
+		for field, patterns := range laneCfg.Match {
+			if !slices.Contains(models.EventFields, field) {
+				return fmt.Errorf("lane %q matches unknown field %q", laneCfg.Name, field)
+			}
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("lane %q has invalid pattern %q", laneCfg.Name, pattern)
+				}
+			}
+		}
+
+		lane := Lane{Name: laneCfg.Name, Stream: laneCfg.Stream, Weight: laneCfg.Weight, Match: laneCfg.Match}
+		if laneCfg.Name == cfg.Default {
+			defaultIndex = i
+			if lane.Stream == "" {
+				lane.Stream = StreamName
+			}
+		} else if lane.Stream == "" {
+			lane.Stream = StreamName + ":" + lane.Name
+		}
+		if lane.Weight == 0 {
+			lane.Weight = 1
+		}
+
+		for _, existing := range configured {
+			if existing.Name == lane.Name || existing.Stream == lane.Stream {
+				return fmt.Errorf("lane %q reuses the name or stream of lane %q", lane.Name, existing.Name)
+			}
+		}
+		configured = append(configured, lane)
+	}
+	if defaultIndex < 0 {
+		return fmt.Errorf("default lane %q is not configured", cfg.Default)
+	}
+
+	lanes = configured
+	defaultLane = defaultIndex
+	for _, lane := range lanes {
+		log.Printf("Lane %s reads %s with weight %d", lane.Name, lane.Stream, lane.Weight)
+	}
+	return nil
+}
+
+func Lanes() []Lane {
+	return append([]Lane(nil), lanes...)
+}
+
+// RouteEvent returns the first lane whose match rules all accept the event,
+// or the default lane. With sharding on, it returns the user's shard.
+func RouteEvent(event models.Event) Lane {
+	if Sharded() {
+		return lanes[shardFor(event.UserId)]
+	}
+	for _, lane := range lanes {
+		if lane.matches(event) {
+			return lane
+		}
+	}
+	return lanes[defaultLane]
+}
+
+// LaneStreams returns the stream of every lane, or of every shard with
+// sharding on.
+func LaneStreams() []string {
+	streams := make([]string, 0, len(lanes))
+	for _, lane := range lanes {
+		streams = append(streams, lane.Stream)
+	}
+	return streams
+}
+
+// LaneName returns the lane reading a stream, or "" for other streams.
+func LaneName(stream string) string {
+	for _, lane := range lanes {
+		if lane.Stream == stream {
+			return lane.Name
+		}
+	}
+	return ""
+}
+
+// IsDefaultLane reports whether stream belongs to the default lane.
+func IsDefaultLane(stream string) bool {
+	return lanes[defaultLane].Stream == stream
+}
+
+// ensureLaneGroups creates a consumer group on every lane stream.
+func ensureLaneGroups(group, start string) error {
+	for _, lane := range lanes {
+		err := Rdb.XGroupCreateMkStream(Ctx, lane.Stream, group, start).Err()
+		if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+			return err
+		}
+		RegisterMonitoredStream(lane.Stream, group)
+	}
+	return nil
+}
+
+// EventReader reads batches for a consumer group. A batch never mixes
+// streams, so it can be acknowledged as a unit.
+type EventReader interface {
+	Read() (string, []redis.XMessage, error)
+	// ReadPending reads this consumer's pending list. Batches read along
+	// with an earlier one and not returned yet are pending too, so they are
+	// dropped and only come back from here.
+	ReadPending() (string, []redis.XMessage, error)
+	// Holds reports whether the consumer may still commit a batch read from
+	// stream.
+	Holds(stream string) (bool, error)
+	Close() error
+}
+
+// LaneReader reads one consumer group across every lane. While lanes have a
+// backlog, each read goes to a lane picked by smooth weighted round robin, so
+// a busy bulk lane cannot starve a higher-weighted one. When every lane is
+// idle it blocks on all of them at once.
+type LaneReader struct {
+	group     string
+	consumer  string
+	count     int64
+	operation string
+	claimer   idleClaimer
+	minIdle   time.Duration
+	credit    []int
+	buffered  []redis.XStream
+	claimedAt time.Time
+}
+
+// NewLaneReader reads without taking over other consumers' messages, which
+// suits groups that keep messages pending on purpose, like the archiver
+// until an hour is closed or webhooks while a delivery backs off.
+func NewLaneReader(group, consumer string, count int64, operation string) *LaneReader {
+	return &LaneReader{group: group, consumer: consumer, count: count, operation: operation, claimer: redisIdleClaimer{}}
+}
+
+// ClaimingIdle makes the reader take over messages other consumers left
+// unacknowledged for minIdle, which must be longer than the group ever holds
+// a message on purpose.
+func (r *LaneReader) ClaimingIdle(minIdle time.Duration) *LaneReader {
+	r.minIdle = minIdle
+	return r
+}
+
+// Read returns the next batch and the stream it came from. A batch never
+// mixes streams, so it can be acknowledged as a unit.
+func (r *LaneReader) Read() (string, []redis.XMessage, error) {
+	if stream, messages, err := r.claimIdle(Ctx, time.Now()); err != nil || len(messages) > 0 {
+		return stream, messages, err
+	}
+
+	if len(r.buffered) > 0 {
+		next := r.buffered[0]
+		r.buffered = r.buffered[1:]
+		return next.Stream, next.Messages, nil
+	}
+
+	if len(lanes) == 1 {
+		messages, err := ReadStreamGroup(lanes[0].Stream, r.group, r.consumer, r.count, BlockTimeMs, r.operation)
+		r.observe(lanes[0].Stream, messages)
+		return lanes[0].Stream, messages, err
+	}
+
+	for _, i := range r.order() {
+		messages, err := readStreamGroup(lanes[i].Stream, r.group, r.consumer, ">", r.count, -1, r.operation)
+		if err != nil {
+			return lanes[i].Stream, nil, err
+		}
+		if len(messages) > 0 {
+			r.observe(lanes[i].Stream, messages)
+			return lanes[i].Stream, messages, nil
+		}
+	}
+
+	results, err := r.readAll()
+	if err != nil || len(results) == 0 {
+		return lanes[0].Stream, nil, err
+	}
+	for _, result := range results {
+		r.observe(result.Stream, result.Messages)
+	}
+	r.buffered = results[1:]
+	return results[0].Stream, results[0].Messages, nil
+}
+
+// ReadPending returns unacknowledged messages of this consumer from the first
+// lane that has any.
+func (r *LaneReader) ReadPending() (string, []redis.XMessage, error) {
+	r.buffered = nil
+	for _, lane := range lanes {
+		messages, err := ReadPendingStreamGroup(lane.Stream, r.group, r.consumer, "0", r.count, r.operation)
+		if err != nil || len(messages) > 0 {
+			return lane.Stream, messages, err
+		}
+	}
+	return lanes[defaultLane].Stream, nil, nil
+}
+
+// claimIdle takes over, every minIdle/2, the messages other consumers of
+// the group left unacknowledged for minIdle, and returns the first lane's
+// worth. A consumer stopped when its pool scaled down keeps its pending
+// messages, and without this nobody would read them again. Once claimed they
+// are this consumer's pending messages, so a failed batch of them is retried
+// like any other. A reader that does not claim idle messages skips this.
+func (r *LaneReader) claimIdle(ctx context.Context, now time.Time) (string, []redis.XMessage, error) {
+	if r.minIdle <= 0 || now.Sub(r.claimedAt) < r.minIdle/2 {
+		return lanes[defaultLane].Stream, nil, nil
+	}
+	for _, lane := range lanes {
+		started := time.Now()
+		messages, err := r.claimer.claimIdle(ctx, lane.Stream, r.group, r.consumer, r.minIdle, r.count)
+		observeRedisOperation("claim_idle", lane.Stream, started, err)
+		if err != nil {
+			return lane.Stream, nil, err
+		}
+		if len(messages) > 0 {
+			log.Printf("Consumer %s took over %d idle messages on %s", r.consumer, len(messages), lane.Stream)
+			return lane.Stream, messages, nil
+		}
+	}
+	r.claimedAt = now
+	return lanes[defaultLane].Stream, nil, nil
+}
+
+// idleClaimer moves messages left idle by other consumers of a group.
+type idleClaimer interface {
+	// claimIdle moves up to count messages of stream that other consumers
+	// left unacknowledged for minIdle to consumer and returns them.
+	claimIdle(ctx context.Context, stream, group, consumer string, minIdle time.Duration, count int64) ([]redis.XMessage, error)
+}
+
+type redisIdleClaimer struct{}
+
+// claimIdle looks the idle messages up with XPENDING rather than claiming
+// them with XAUTOCLAIM, which would also claim the consumer's own, such as
+// a batch it is still retrying. XCLAIM checks the idle time again, so a
+// message its owner read in the meantime stays with it.
+func (redisIdleClaimer) claimIdle(ctx context.Context, stream, group, consumer string, minIdle time.Duration, count int64) ([]redis.XMessage, error) {
+	start := "-"
+	for {
+		pending, err := Rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  group,
+			Idle:   minIdle,
+			Start:  start,
+			End:    "+",
+			Count:  count,
+		}).Result()
+		if err != nil || len(pending) == 0 {
+			return nil, err
+		}
+
+		var ids []string
+		for _, entry := range pending {
+			if entry.Consumer != consumer {
+				ids = append(ids, entry.ID)
+			}
+		}
+		if len(ids) > 0 {
+			return Rdb.XClaim(ctx, &redis.XClaimArgs{
+				Stream:   stream,
+				Group:    group,
+				Consumer: consumer,
+				MinIdle:  minIdle,
+				Messages: ids,
+			}).Result()
+		}
+		if int64(len(pending)) < count {
+			return nil, nil
+		}
+		start = "(" + pending[len(pending)-1].ID
+	}
+}
+
+// order puts the lane due next by weight first, followed by the others in
+// configured order.
+func (r *LaneReader) order() []int {
+	if len(r.credit) != len(lanes) {
+		r.credit = make([]int, len(lanes))
+	}
+
+	total, best := 0, 0
+	for i, lane := range lanes {
+		r.credit[i] += lane.Weight
+		total += lane.Weight
+		if r.credit[i] > r.credit[best] {
+			best = i
+		}
+	}
+	r.credit[best] -= total
+
+	order := []int{best}
+	for i := range lanes {
+		if i != best {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (r *LaneReader) readAll() ([]redis.XStream, error) {
+	return readGroupStreams(r.group, r.consumer, LaneStreams(), r.count, r.operation)
+}
+
+// readGroupStreams blocks on several streams of a group at once and returns
+// the streams that had messages.
+func readGroupStreams(group, consumer string, streams []string, count int64, operation string) ([]redis.XStream, error) {
+	args := append([]string(nil), streams...)
+	for range streams {
+		args = append(args, ">")
+	}
+
+	started := time.Now()
+	results, err := Rdb.XReadGroup(Ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  args,
+		Count:    count,
+		Block:    BlockTimeMs,
+	}).Result()
+	if err == redis.Nil {
+		err = nil
+	}
+	if err != nil {
+		log.Printf("Failed to read %d streams for %s: %v", len(streams), group, err)
+	}
+	observeRedisOperation(operation, "lanes", started, err)
+
+	var nonEmpty []redis.XStream
+	for _, result := range results {
+		if len(result.Messages) > 0 {
+			nonEmpty = append(nonEmpty, result)
+		}
+	}
+	return nonEmpty, err
+}
+
+func (r *LaneReader) observe(stream string, messages []redis.XMessage) {
+	if len(messages) > 0 {
+		metrics.LaneEventsRead.WithLabelValues(LaneName(stream), r.group).Add(float64(len(messages)))
+	}
+}
+
+// Holds is always true; every consumer of a group reads every lane.
+func (r *LaneReader) Holds(stream string) (bool, error) {
+	return true, nil
+}
+
+func (r *LaneReader) Close() error {
+	return nil
+}
+
+// DeleteLaneConsumer removes a consumer from a group on every lane, keeping
+// it wherever it still owns pending messages.
+func DeleteLaneConsumer(group, consumer string) error {
+	for _, lane := range lanes {
+		removed, err := DeleteConsumer(lane.Stream, group, consumer)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			log.Printf("Keeping consumer %s registered on %s because it still owns pending messages", consumer, lane.Stream)
+		}
+	}
+	return nil
+}
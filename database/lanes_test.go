@@ -0,0 +1,154 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/models"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func configureTestLanes(t *testing.T) {
+	t.Helper()
+	previous, previousDefault := lanes, defaultLane
+	t.Cleanup(func() { lanes, defaultLane = previous, previousDefault })
+
+	err := ConfigureLanes(config.LanesConfig{
+		Default: "normal",
+		Lanes: []config.LaneConfig{
+			{Name: "high", Weight: 5, Match: map[string][]string{"action": {"purchase", "checkout_*"}}},
+			{Name: "normal", Weight: 3},
+			{Name: "bulk", Weight: 1, Match: map[string][]string{"action": {"scroll"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRouteEventUsesFirstMatchingLaneOrDefault(t *testing.T) {
+	configureTestLanes(t)
+
+	cases := map[string]string{
+		"purchase":       StreamName + ":high",
+		"checkout_start": StreamName + ":high",
+		"scroll":         StreamName + ":bulk",
+		"click":          StreamName,
+	}
+	for action, stream := range cases {
+		if got := RouteEvent(models.Event{Action: action}).Stream; got != stream {
+			t.Errorf("action %s: expected %s, got %s", action, stream, got)
+		}
+	}
+}
+
+func TestConfigureLanesRejectsMissingDefault(t *testing.T) {
+	previous, previousDefault := lanes, defaultLane
+	defer func() { lanes, defaultLane = previous, previousDefault }()
+
+	err := ConfigureLanes(config.LanesConfig{
+		Default: "normal",
+		Lanes:   []config.LaneConfig{{Name: "high", Match: map[string][]string{"action": {"purchase"}}}},
+	})
+	if err == nil {
+		t.Fatal("expected a missing default lane to be rejected")
+	}
+	if len(lanes) != 1 || lanes[0].Stream != StreamName {
+		t.Fatalf("expected lanes to be left unchanged, got %+v", lanes)
+	}
+}
+
+func TestLaneReaderOrderFollowsWeights(t *testing.T) {
+	configureTestLanes(t)
+
+	reader := NewLaneReader(GroupName, "worker-1", 10, "read_group")
+	first := map[string]int{}
+	for i := 0; i < 90; i++ {
+		first[lanes[reader.order()[0]].Name]++
+	}
+
+	if first["high"] != 50 || first["normal"] != 30 || first["bulk"] != 10 {
+		t.Fatalf("expected reads split 5:3:1, got %v", first)
+	}
+}
+
+type fakeIdleClaimer struct {
+	idle   map[string][]redis.XMessage
+	claims int
+}
+
+func (c *fakeIdleClaimer) claimIdle(ctx context.Context, stream, group, consumer string, minIdle time.Duration, count int64) ([]redis.XMessage, error) {
+	c.claims++
+	messages := c.idle[stream]
+	delete(c.idle, stream)
+	return messages, nil
+}
+
+func TestLaneReaderTakesOverIdleMessagesPeriodically(t *testing.T) {
+	configureTestLanes(t)
+
+	claimer := &fakeIdleClaimer{idle: map[string][]redis.XMessage{
+		"events:bulk": {{ID: "1-0"}, {ID: "2-0"}},
+	}}
+	reader := NewLaneReader(GroupName, "worker-1", 10, "read_group").ClaimingIdle(LaneClaimIdle)
+	reader.claimer = claimer
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	stream, messages, err := reader.claimIdle(context.Background(), now)
+	if err != nil || stream != "events:bulk" || len(messages) != 2 {
+		t.Fatalf("expected the idle bulk messages, got %s %v %v", stream, messages, err)
+	}
+
+	// Claiming goes on until no lane has idle messages left, then waits.
+	if _, messages, _ := reader.claimIdle(context.Background(), now); len(messages) != 0 {
+		t.Fatalf("expected nothing left to claim, got %v", messages)
+	}
+	claims := claimer.claims
+	claimer.idle["events"] = []redis.XMessage{{ID: "3-0"}}
+	if _, messages, _ := reader.claimIdle(context.Background(), now.Add(LaneClaimIdle/4)); len(messages) != 0 || claimer.claims != claims {
+		t.Fatalf("expected no claim before the interval, got %v after %d claims", messages, claimer.claims-claims)
+	}
+	if _, messages, _ := reader.claimIdle(context.Background(), now.Add(LaneClaimIdle/2)); len(messages) != 1 {
+		t.Fatalf("expected the new idle message once the interval passed, got %v", messages)
+	}
+}
+
+func TestLaneReaderLeavesIdleMessagesAloneUnlessClaiming(t *testing.T) {
+	configureTestLanes(t)
+
+	// Archivers and webhook workers keep messages pending on purpose, so
+	// their readers must not take them from each other.
+	claimer := &fakeIdleClaimer{idle: map[string][]redis.XMessage{
+		"events:bulk": {{ID: "1-0"}},
+	}}
+	reader := NewLaneReader(ArchiveGroupName, "archiver-1", 10, "read_group")
+	reader.claimer = claimer
+
+	_, messages, err := reader.claimIdle(context.Background(), time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil || len(messages) != 0 || claimer.claims != 0 {
+		t.Fatalf("expected no claim, got %v after %d claims (%v)", messages, claimer.claims, err)
+	}
+}
+
+func TestLaneReaderDropsBufferedBatchesWhenRetryingPending(t *testing.T) {
+	configureTestLanes(t)
+	previous := Rdb
+	t.Cleanup(func() { Rdb = previous })
+	// Nothing listens here, so every read from Redis fails straight away.
+	Rdb = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+
+	reader := NewLaneReader(GroupName, "worker-1", 10, "read_group")
+	reader.claimer = &fakeIdleClaimer{}
+	reader.claimedAt = time.Now()
+	// Read along with a batch that failed, and still pending like it.
+	reader.buffered = []redis.XStream{{Stream: "events:bulk", Messages: []redis.XMessage{{ID: "1-0"}, {ID: "2-0"}}}}
+
+	if _, _, err := reader.ReadPending(); err == nil {
+		t.Fatal("expected the pending read to reach Redis")
+	}
+	if stream, messages, _ := reader.Read(); len(messages) != 0 {
+		t.Fatalf("expected the buffered batch to be left to the pending retry, got %v from %s", messages, stream)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"analytics-backend/metrics"
 	"context"
 	"log"
+	"sync"
 	"time"
 )
 
@@ -12,9 +13,63 @@ type monitoredStream struct {
 	group  string
 }
 
-var monitoredStreams = []monitoredStream{
-	{stream: StreamName, group: GroupName},
-	{stream: IndexStreamName, group: IndexGroupName},
+type StreamSnapshot struct {
+	Length      int64
+	Pending     int64
+	Lag         int64
+	CollectedAt time.Time
+}
+
+// Backlog is everything the group has not finished: delivered but unacked
+// messages plus entries not yet delivered.
+func (s StreamSnapshot) Backlog() int64 {
+	return s.Pending + s.Lag
+}
+
+var (
+	streamSnapshotsMu sync.RWMutex
+	streamSnapshots   = map[string]StreamSnapshot{}
+)
+
+func GetStreamSnapshot(stream, group string) (StreamSnapshot, bool) {
+	streamSnapshotsMu.RLock()
+	defer streamSnapshotsMu.RUnlock()
+	snapshot, ok := streamSnapshots[stream+"/"+group]
+	return snapshot, ok
+}
+
+func storeStreamSnapshot(stream, group string, snapshot StreamSnapshot) {
+	streamSnapshotsMu.Lock()
+	defer streamSnapshotsMu.Unlock()
+	streamSnapshots[stream+"/"+group] = snapshot
+}
+
+var (
+	monitoredStreamsMu sync.RWMutex
+	monitoredStreams   = []monitoredStream{
+		{stream: StreamName, group: GroupName},
+		{stream: IndexStreamName, group: IndexGroupName},
+	}
+)
+
+// RegisterMonitoredStream adds a stream/group pair to the metrics collector.
+// Registering the same pair twice is a no-op.
+func RegisterMonitoredStream(stream, group string) {
+	monitoredStreamsMu.Lock()
+	defer monitoredStreamsMu.Unlock()
+
+	for _, existing := range monitoredStreams {
+		if existing.stream == stream && existing.group == group {
+			return
+		}
+	}
+	monitoredStreams = append(monitoredStreams, monitoredStream{stream: stream, group: group})
+}
+
+func getMonitoredStreams() []monitoredStream {
+	monitoredStreamsMu.RLock()
+	defer monitoredStreamsMu.RUnlock()
+	return append([]monitoredStream(nil), monitoredStreams...)
 }
 
 func observeDBOperation(backend, operation, target string, started time.Time, err error) {
@@ -86,9 +141,12 @@ func collectStreamMetrics(ctx context.Context) {
 		return
 	}
 
-	for _, stream := range monitoredStreams {
+	for _, stream := range getMonitoredStreams() {
+		snapshot := StreamSnapshot{CollectedAt: time.Now()}
+
 		length, err := Rdb.XLen(ctx, stream.stream).Result()
 		if err == nil {
+			snapshot.Length = length
 			metrics.StreamLength.WithLabelValues(stream.stream, stream.group).Set(float64(length))
 		} else {
 			log.Printf("Failed to collect stream length for %s: %v", stream.stream, err)
@@ -96,11 +154,30 @@ func collectStreamMetrics(ctx context.Context) {
 
 		pending, err := Rdb.XPending(ctx, stream.stream, stream.group).Result()
 		if err == nil {
+			snapshot.Pending = pending.Count
 			metrics.StreamBacklog.WithLabelValues(stream.stream, stream.group).Set(float64(pending.Count))
 		} else {
 			log.Printf("Failed to collect stream backlog for %s/%s: %v", stream.stream, stream.group, err)
 		}
 
+		groups, err := Rdb.XInfoGroups(ctx, stream.stream).Result()
+		if err == nil {
+			for _, group := range groups {
+				if group.Name == stream.group && group.Lag > 0 {
+					snapshot.Lag = group.Lag
+				}
+			}
+			metrics.StreamLag.WithLabelValues(stream.stream, stream.group).Set(float64(snapshot.Lag))
+		} else {
+			log.Printf("Failed to collect group lag for %s/%s: %v", stream.stream, stream.group, err)
+		}
+
+		storeStreamSnapshot(stream.stream, stream.group, snapshot)
+		if lane := LaneName(stream.stream); lane != "" {
+			metrics.LaneBacklog.WithLabelValues(lane, stream.group).Set(float64(snapshot.Backlog()))
+			metrics.LaneLag.WithLabelValues(lane, stream.group).Set(float64(snapshot.Lag))
+		}
+
 		consumers, err := Rdb.XInfoConsumers(ctx, stream.stream, stream.group).Result()
 		if err != nil {
 			log.Printf("Failed to collect consumer info for %s/%s: %v", stream.stream, stream.group, err)
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"analytics-backend/models"
+	"context"
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type OutboxBatch struct {
+	Key        string
+	Stream     string
+	Aggregated []*models.AggregatedEvent
+	LateEvents []models.LateEvent
+	Events     []models.Event
+	Sinks      []string
+}
+
+// CommitBatch writes a batch's aggregated rows, late events and outbox entry
+// in one transaction, along with anything writeEvents adds to it. It returns
+// false without writing anything when the batch key was already committed,
+// which is what happens when a batch is redelivered after a crash. For the
+// same reason a failed commit is safe to retry.
+func CommitBatch(ctx context.Context, batch OutboxBatch, writeEvents func(tx *gorm.DB) error) (bool, error) {
+	started := time.Now()
+	committed := false
+
+	err := postgresBackend.retry(ctx, func(ctx context.Context) error {
+		committed = false
+		return DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			entry := &models.OutboxEntry{
+				BatchKey:      batch.Key,
+				Stream:        batch.Stream,
+				Events:        batch.Events,
+				PendingSinks:  batch.Sinks,
+				NextAttemptAt: time.Now(),
+			}
+			if len(batch.Sinks) == 0 {
+				now := time.Now()
+				entry.CompletedAt = &now
+			}
+
+			result := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "batch_key"}},
+				DoNothing: true,
+			}).Create(entry)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return nil
+			}
+
+			if len(batch.Aggregated) > 0 {
+				if err := tx.CreateInBatches(batch.Aggregated, 100).Error; err != nil {
+					return err
+				}
+			}
+			if len(batch.LateEvents) > 0 {
+				if err := tx.CreateInBatches(batch.LateEvents, 100).Error; err != nil {
+					return err
+				}
+			}
+			if writeEvents != nil {
+				if err := writeEvents(tx); err != nil {
+					return err
+				}
+			}
+
+			committed = true
+			return nil
+		})
+	})
+
+	observeDBOperation("postgres", "commit_batch", "outbox_entries", started, err)
+	return committed && err == nil, err
+}
+
+// BatchAddToDatabaseTx inserts raw events inside a batch transaction. Events
+// that already exist are skipped so a replayed batch cannot fail on them.
+func BatchAddToDatabaseTx(ctx context.Context, tx *gorm.DB, events []models.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	started := time.Now()
+	err := tx.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(events, 100).Error
+	observeDBOperation("postgres", "batch_create", "events", started, err)
+	return err
+}
+
+// ClaimOutboxEntries leases up to limit entries that are due for relaying.
+// SKIP LOCKED lets several relays run without handing out the same entry.
+func ClaimOutboxEntries(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxEntry, error) {
+	started := time.Now()
+	now := time.Now()
+
+	var entries []models.OutboxEntry
+	err := DB.WithContext(ctx).Raw(`
+		UPDATE outbox_entries SET locked_until = ?, attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM outbox_entries
+			WHERE completed_at IS NULL AND next_attempt_at <= ? AND locked_until <= ?
+			ORDER BY id
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, now.Add(lease), now, now, limit).Scan(&entries).Error
+	observeDBOperation("postgres", "claim", "outbox_entries", started, err)
+	return entries, err
+}
+
+func MarkOutboxSinkDone(ctx context.Context, id uint, completedSinks []string) error {
+	encoded, err := json.Marshal(completedSinks)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	err = DB.WithContext(ctx).Model(&models.OutboxEntry{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"completed_sinks": string(encoded)}).Error
+	observeDBOperation("postgres", "update", "outbox_entries", started, err)
+	return err
+}
+
+func CompleteOutboxEntry(ctx context.Context, id uint) error {
+	started := time.Now()
+	err := DB.WithContext(ctx).Model(&models.OutboxEntry{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"completed_at": time.Now(), "last_error": ""}).Error
+	observeDBOperation("postgres", "update", "outbox_entries", started, err)
+	return err
+}
+
+// RetryOutboxEntry releases the lease and schedules the next attempt.
+func RetryOutboxEntry(ctx context.Context, id uint, reason string, retryAt time.Time) error {
+	if len(reason) > 1024 {
+		reason = reason[:1024]
+	}
+
+	started := time.Now()
+	err := DB.WithContext(ctx).Model(&models.OutboxEntry{}).Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"last_error":      reason,
+			"next_attempt_at": retryAt,
+			"locked_until":    time.Time{},
+		}).Error
+	observeDBOperation("postgres", "update", "outbox_entries", started, err)
+	return err
+}
+
+func PurgeCompletedOutbox(ctx context.Context, before time.Time) (int64, error) {
+	started := time.Now()
+	result := DB.WithContext(ctx).Where("completed_at IS NOT NULL AND completed_at < ?", before).Delete(&models.OutboxEntry{})
+	observeDBOperation("postgres", "delete", "outbox_entries", started, result.Error)
+	return result.RowsAffected, result.Error
+}
+
+func CountPendingOutbox(ctx context.Context) (int64, error) {
+	started := time.Now()
+	var count int64
+	err := DB.WithContext(ctx).Model(&models.OutboxEntry{}).Where("completed_at IS NULL").Count(&count).Error
+	observeDBOperation("postgres", "count", "outbox_entries", started, err)
+	return count, err
+}
@@ -15,8 +15,10 @@ import (
 var DB *gorm.DB
 
 func Initdb(cfg config.PostgresConfig) {
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s",
-		cfg.Host, cfg.User, cfg.Password, cfg.DBName, cfg.Port, cfg.SSLMode)
+	// statement_timeout makes the server cancel slow statements, including
+	// ones read through a cursor, which a context deadline would cut short.
+	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s statement_timeout=%d",
+		cfg.Host, cfg.User, cfg.Password, cfg.DBName, cfg.Port, cfg.SSLMode, postgresBackend.Policy().Timeout.Milliseconds())
 
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 
@@ -34,12 +36,22 @@ func Initdb(cfg config.PostgresConfig) {
 	sqlDB.SetConnMaxLifetime(time.Hour)
 	sqlDB.SetConnMaxIdleTime(10 * time.Minute)
 
+	if err := registerPostgresBreaker(db); err != nil {
+		log.Fatalf("Failed to register Postgres circuit breaker: %v", err)
+	}
+
 	log.Println("Connected to Postgres with connection pool configured")
 
 	if err := db.AutoMigrate(
 		&models.Event{},
 		&models.AggregatedEvent{},
-		&models.UserEventMap{},
+		&models.LateEvent{},
+		&models.WebhookDestination{},
+		&models.ArchiveFile{},
+		&models.OutboxEntry{},
+		&models.ReplayJob{},
+		&models.SavedSearch{},
+		&models.ReindexJob{},
 	); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
@@ -47,6 +59,69 @@ func Initdb(cfg config.PostgresConfig) {
 	DB = db
 }
 
+const postgresBreakerKey = "breaker:allowed"
+
+// registerPostgresBreaker puts every statement gorm runs behind the Postgres
+// breaker. Writes are checked before gorm opens its implicit transaction.
+func registerPostgresBreaker(db *gorm.DB) error {
+	before := func(db *gorm.DB) {
+		if err := postgresBackend.allow(); err != nil {
+			db.InstanceSet(postgresBreakerKey, false)
+			db.AddError(err)
+			return
+		}
+		db.InstanceSet(postgresBreakerKey, true)
+	}
+	after := func(db *gorm.DB) {
+		if allowed, _ := db.InstanceGet(postgresBreakerKey); allowed == true {
+			postgresBackend.record(db.Error)
+		}
+	}
+
+	callbacks := db.Callback()
+	for _, err := range []error{
+		callbacks.Create().Before("gorm:begin_transaction").Register("breaker:before_create", before),
+		callbacks.Create().After("gorm:commit_or_rollback_transaction").Register("breaker:after_create", after),
+		callbacks.Update().Before("gorm:begin_transaction").Register("breaker:before_update", before),
+		callbacks.Update().After("gorm:commit_or_rollback_transaction").Register("breaker:after_update", after),
+		callbacks.Delete().Before("gorm:begin_transaction").Register("breaker:before_delete", before),
+		callbacks.Delete().After("gorm:commit_or_rollback_transaction").Register("breaker:after_delete", after),
+		callbacks.Query().Before("gorm:query").Register("breaker:before_query", before),
+		callbacks.Query().After("gorm:after_query").Register("breaker:after_query", after),
+		callbacks.Row().Before("gorm:row").Register("breaker:before_row", before),
+		callbacks.Row().After("gorm:row").Register("breaker:after_row", after),
+		callbacks.Raw().Before("gorm:raw").Register("breaker:before_raw", before),
+		callbacks.Raw().After("gorm:raw").Register("breaker:after_raw", after),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ClosePostgres() error {
+	if DB == nil {
+		return nil
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+func PingPostgres(ctx context.Context) error {
+	if DB == nil {
+		return fmt.Errorf("postgres not initialized")
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
 func AddToDatabase(event models.Event) error {
 	started := time.Now()
 	err := DB.Create(&event).Error
@@ -98,30 +173,28 @@ func BatchCreateAggregatedEvents(aggEvents []*models.AggregatedEvent) error {
 	return err
 }
 
-func BatchCreateUserEventMaps(userMaps []models.UserEventMap) error {
-	if len(userMaps) == 0 {
-		return nil
-	}
+func FinalizeWindows(ctx context.Context, through time.Time) (int64, error) {
 	started := time.Now()
-	err := DB.CreateInBatches(userMaps, 500).Error
-	observeDBOperation("postgres", "batch_create", "user_event_maps", started, err)
-	return err
+	result := DB.WithContext(ctx).
+		Model(&models.AggregatedEvent{}).
+		Where(`finalized = ? AND "window" <= ?`, false, through).
+		Update("finalized", true)
+	observeDBOperation("postgres", "finalize_windows", "aggregated_events", started, result.Error)
+	return result.RowsAffected, result.Error
 }
 
 func GetEvents(limit int) ([]models.Event, error) {
-	started := time.Now()
-	var events []models.Event
-	result := DB.Limit(limit).Order("timestamp desc").Find(&events)
-	observeDBOperation("postgres", "select", "events", started, result.Error)
-	return events, result.Error
+	return GetEventsWithContext(context.Background(), limit)
 }
 
 func GetEventsWithContext(ctx context.Context, limit int) ([]models.Event, error) {
 	started := time.Now()
 	var events []models.Event
-	result := DB.WithContext(ctx).Limit(limit).Order("timestamp desc").Find(&events)
-	observeDBOperation("postgres", "select", "events", started, result.Error)
-	return events, result.Error
+	err := postgresBackend.retry(ctx, func(ctx context.Context) error {
+		return DB.WithContext(ctx).Limit(limit).Order("timestamp desc").Find(&events).Error
+	})
+	observeDBOperation("postgres", "select", "events", started, err)
+	return events, err
 }
 
 func GetAggregatedEvents(limit int) ([]models.AggregatedEvent, error) {
@@ -132,17 +205,6 @@ func GetAggregatedEvents(limit int) ([]models.AggregatedEvent, error) {
 	return events, result.Error
 }
 
-func GetUserEvents(userID string) ([]models.AggregatedEvent, error) {
-	started := time.Now()
-	var events []models.AggregatedEvent
-	result := DB.
-		Joins("JOIN user_event_maps ON user_event_maps.aggregated_event_id = aggregated_events.id").
-		Where("user_event_maps.user_id = ?", userID).
-		Find(&events)
-	observeDBOperation("postgres", "select_join", "user_event_maps", started, result.Error)
-	return events, result.Error
-}
-
 func FindEventsInBatches(batchSize int, fn func([]models.Event) error) error {
 	if batchSize <= 0 {
 		batchSize = 100
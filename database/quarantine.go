@@ -0,0 +1,117 @@
+package database
+
+import (
+	"analytics-backend/metrics"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	QuarantineStreamName = "events:quarantine"
+	QuarantineMaxLen     = int64(100000)
+)
+
+type QuarantinedMessage struct {
+	ID            string            `json:"id"`
+	Stream        string            `json:"stream"`
+	Group         string            `json:"group"`
+	MessageID     string            `json:"message_id"`
+	Field         string            `json:"field,omitempty"`
+	Reason        string            `json:"reason"`
+	Values        map[string]string `json:"values"`
+	QuarantinedAt time.Time         `json:"quarantined_at"`
+}
+
+type QuarantineFilter struct {
+	Stream string
+	Group  string
+	Before string
+	Count  int64
+}
+
+// QuarantineMessage keeps a copy of an entry that group could not decode,
+// with the reason, so the entry can be acked instead of being written with
+// made-up values. Each group that reads the entry records it.
+func QuarantineMessage(ctx context.Context, stream, group string, msg redis.XMessage, reason error) error {
+	field := ""
+	var decodeErr *DecodeError
+	if errors.As(reason, &decodeErr) {
+		field = decodeErr.Field
+	}
+
+	values, err := json.Marshal(msg.Values)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	err = Rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: QuarantineStreamName,
+		MaxLen: QuarantineMaxLen,
+		Approx: true,
+		Values: map[string]any{
+			"stream":         stream,
+			"group":          group,
+			"message_id":     msg.ID,
+			"field":          field,
+			"reason":         reason.Error(),
+			"values":         values,
+			"quarantined_at": time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}).Err()
+	observeRedisOperation("quarantine_message", QuarantineStreamName, started, err)
+	if err != nil {
+		return err
+	}
+
+	metrics.QuarantinedMessages.WithLabelValues(stream, group, field).Inc()
+	return nil
+}
+
+// ListQuarantinedMessages returns quarantined entries newest first, starting
+// before filter.Before when it is set. The stream and group filters apply to
+// the page read, so a page can come back short; the returned cursor continues
+// after the last entry read.
+func ListQuarantinedMessages(ctx context.Context, filter QuarantineFilter) ([]QuarantinedMessage, string, error) {
+	end := "+"
+	if filter.Before != "" {
+		end = "(" + filter.Before
+	}
+
+	started := time.Now()
+	entries, err := Rdb.XRevRangeN(ctx, QuarantineStreamName, end, "-", filter.Count).Result()
+	observeRedisOperation("list_quarantined_messages", QuarantineStreamName, started, err)
+	if err != nil {
+		return nil, "", err
+	}
+
+	messages := make([]QuarantinedMessage, 0, len(entries))
+	for _, entry := range entries {
+		message := QuarantinedMessage{ID: entry.ID}
+		message.Stream, _ = entry.Values["stream"].(string)
+		message.Group, _ = entry.Values["group"].(string)
+		message.MessageID, _ = entry.Values["message_id"].(string)
+		message.Field, _ = entry.Values["field"].(string)
+		message.Reason, _ = entry.Values["reason"].(string)
+		if values, ok := entry.Values["values"].(string); ok {
+			json.Unmarshal([]byte(values), &message.Values)
+		}
+		if quarantinedAt, ok := entry.Values["quarantined_at"].(string); ok {
+			message.QuarantinedAt, _ = time.Parse(time.RFC3339Nano, quarantinedAt)
+		}
+
+		if (filter.Stream == "" || filter.Stream == message.Stream) && (filter.Group == "" || filter.Group == message.Group) {
+			messages = append(messages, message)
+		}
+	}
+
+	next := ""
+	if int64(len(entries)) == filter.Count && len(entries) > 0 {
+		next = entries[len(entries)-1].ID
+	}
+	return messages, next, nil
+}
@@ -3,6 +3,8 @@ package database
 import (
 	"analytics-backend/config"
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
@@ -15,14 +17,20 @@ var (
 )
 
 func InitRedis(cfg config.RedisConfig) {
+	policy := redisBackend.Policy()
 	Rdb = redis.NewClient(&redis.Options{
-		Addr:         cfg.Addr,
-		Password:     cfg.Password,
-		DB:           cfg.DB,
-		PoolSize:     cfg.PoolSize,
-		MinIdleConns: cfg.MinIdleConns,
-		MaxRetries:   3,
+		Addr:            cfg.Addr,
+		Password:        cfg.Password,
+		DB:              cfg.DB,
+		PoolSize:        cfg.PoolSize,
+		MinIdleConns:    cfg.MinIdleConns,
+		MaxRetries:      policy.MaxAttempts - 1,
+		MinRetryBackoff: policy.InitialBackoff,
+		MaxRetryBackoff: policy.MaxBackoff,
+		ReadTimeout:     policy.Timeout,
+		WriteTimeout:    policy.Timeout,
 	})
+	Rdb.AddHook(redisBreakerHook{})
 
 	_, err := Rdb.Ping(Ctx).Result()
 	if err != nil {
@@ -32,6 +40,51 @@ func InitRedis(cfg config.RedisConfig) {
 	log.Println("Connected to Redis")
 }
 
+// redisBreakerHook puts every Redis command behind the Redis breaker. The
+// client retries on its own with the same policy, so the hook sees one
+// outcome per command.
+type redisBreakerHook struct{}
+
+func (redisBreakerHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisBreakerHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		return redisBackend.guard(ctx, func(ctx context.Context) error {
+			return next(ctx, cmd)
+		})
+	}
+}
+
+func (redisBreakerHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := redisBackend.guard(ctx, func(ctx context.Context) error {
+			return next(ctx, cmds)
+		})
+		if errors.Is(err, ErrCircuitOpen) {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+		}
+		return err
+	}
+}
+
+func CloseRedis() error {
+	if Rdb == nil {
+		return nil
+	}
+	return Rdb.Close()
+}
+
+func PingRedis(ctx context.Context) error {
+	if Rdb == nil {
+		return fmt.Errorf("redis not initialized")
+	}
+	return Rdb.Ping(ctx).Err()
+}
+
 func PushToRecentFeed(ctx context.Context, eventJSON []byte, snowflakeID int64) error {
 	started := time.Now()
 	pipe := Rdb.Pipeline()
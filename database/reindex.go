@@ -0,0 +1,409 @@
+package database
+
+import (
+	"analytics-backend/models"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ReindexSourcePostgres = "postgres"
+	ReindexSourceIndex    = "index"
+
+	ReindexStatusRunning   = "running"
+	ReindexStatusSwapped   = "swapped"
+	ReindexStatusCompleted = "completed"
+	ReindexStatusFailed    = "failed"
+)
+
+func CreateReindexJob(ctx context.Context, job *models.ReindexJob) error {
+	started := time.Now()
+	err := DB.WithContext(ctx).Create(job).Error
+	observeDBOperation("postgres", "create", "reindex_jobs", started, err)
+	return err
+}
+
+// ClaimReindexJob leases a job that is not completed and not leased by a run
+// that is still going. It returns nil when the job cannot be claimed.
+func ClaimReindexJob(ctx context.Context, id uint, lease time.Duration) (*models.ReindexJob, error) {
+	started := time.Now()
+	now := time.Now()
+
+	var jobs []models.ReindexJob
+	err := DB.WithContext(ctx).Raw(`
+		UPDATE reindex_jobs SET
+			leased_until = ?,
+			status = CASE WHEN status = ? THEN ? ELSE status END,
+			last_error = '', updated_at = ?
+		WHERE id = ? AND status <> ? AND leased_until < ?
+		RETURNING *`,
+		now.Add(lease), ReindexStatusFailed, ReindexStatusRunning, now,
+		id, ReindexStatusCompleted, now).Scan(&jobs).Error
+	observeDBOperation("postgres", "claim", "reindex_jobs", started, err)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return &jobs[0], nil
+}
+
+// SaveReindexJob stores the job's progress and renews its lease. A zero
+// lease releases the job.
+func SaveReindexJob(ctx context.Context, job *models.ReindexJob, lease time.Duration) error {
+	job.LeasedUntil = time.Time{}
+	if lease > 0 {
+		job.LeasedUntil = time.Now().Add(lease)
+	}
+	if len(job.LastError) > 1024 {
+		job.LastError = job.LastError[:1024]
+	}
+
+	started := time.Now()
+	err := DB.WithContext(ctx).Save(job).Error
+	observeDBOperation("postgres", "update", "reindex_jobs", started, err)
+	return err
+}
+
+// EventTimeRange returns the timestamps of the oldest and newest stored
+// events. ok is false when there are none.
+func EventTimeRange(ctx context.Context) (oldest, newest time.Time, ok bool, err error) {
+	started := time.Now()
+	var bounds struct {
+		Oldest *time.Time
+		Newest *time.Time
+	}
+	err = DB.WithContext(ctx).Model(&models.Event{}).
+		Select("MIN(timestamp) AS oldest, MAX(timestamp) AS newest").
+		Scan(&bounds).Error
+	observeDBOperation("postgres", "select", "events", started, err)
+	if err != nil || bounds.Oldest == nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	return bounds.Oldest.UTC(), bounds.Newest.UTC(), true, nil
+}
+
+func CountEventsInRange(ctx context.Context, from, to time.Time) (int64, error) {
+	started := time.Now()
+	var count int64
+	err := DB.WithContext(ctx).Model(&models.Event{}).
+		Where("timestamp >= ? AND timestamp < ?", from, to).
+		Count(&count).Error
+	observeDBOperation("postgres", "count", "events", started, err)
+	return count, err
+}
+
+// IndexedEventTimeRange is EventTimeRange for the events in the given search
+// indices.
+func IndexedEventTimeRange(ctx context.Context, indices []string) (oldest, newest time.Time, ok bool, err error) {
+	if ES == nil {
+		return time.Time{}, time.Time{}, false, fmt.Errorf("elasticsearch client not initialized")
+	}
+	request := map[string]any{
+		"size": 0,
+		"aggs": map[string]any{
+			"oldest": map[string]any{"min": map[string]any{"field": "timestamp"}},
+			"newest": map[string]any{"max": map[string]any{"field": "timestamp"}},
+		},
+	}
+	var result struct {
+		Aggregations struct {
+			Oldest struct {
+				Value *float64 `json:"value"`
+			} `json:"oldest"`
+			Newest struct {
+				Value *float64 `json:"value"`
+			} `json:"newest"`
+		} `json:"aggregations"`
+	}
+	path := "/" + strings.Join(indices, ",") + "/_search?ignore_unavailable=true"
+	if err := ES.callJSON(ctx, http.MethodPost, path, request, &result); err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	if result.Aggregations.Oldest.Value == nil || result.Aggregations.Newest.Value == nil {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	return time.UnixMilli(int64(*result.Aggregations.Oldest.Value)).UTC(),
+		time.UnixMilli(int64(*result.Aggregations.Newest.Value)).UTC(), true, nil
+}
+
+// SearchAliasIndices returns the indices behind the read alias and the write
+// index.
+func SearchAliasIndices(ctx context.Context) ([]string, string, error) {
+	if ES == nil {
+		return nil, "", fmt.Errorf("elasticsearch client not initialized")
+	}
+	readIndices, err := ES.aliasIndices(ctx, ES.readAlias)
+	if err != nil {
+		return nil, "", err
+	}
+	writeIndices, err := ES.aliasIndices(ctx, ES.writeAlias)
+	if err != nil {
+		return nil, "", err
+	}
+
+	read := make([]string, 0, len(readIndices))
+	for name := range readIndices {
+		read = append(read, name)
+	}
+	slices.Sort(read)
+	write := ""
+	for name, isWrite := range writeIndices {
+		if isWrite || len(writeIndices) == 1 {
+			write = name
+		}
+	}
+	return read, write, nil
+}
+
+// SearchWriteAlias is where a reindex into the current indices writes.
+func SearchWriteAlias() string {
+	if ES == nil {
+		return ""
+	}
+	return ES.writeAlias
+}
+
+func SearchReadAlias() string {
+	if ES == nil {
+		return ""
+	}
+	return ES.readAlias
+}
+
+// ReindexTargetName names the index a full reindex job builds for the events
+// of one day or month, like the indices rollover makes, so retention and
+// range pruning work on them the same way. It matches the index template, and
+// rollover numbers the indices after the one that becomes the write index.
+func ReindexTargetName(jobID uint, eventTime time.Time) string {
+	index, period := DefaultElasticsearchIndex, IndexPeriodDaily
+	if ES != nil {
+		index, period = ES.index, ES.period
+	}
+	layout := "2006.01.02"
+	if period == IndexPeriodMonthly {
+		layout = "2006.01"
+	}
+	return fmt.Sprintf("%s-reindex-%d-%s-000001", index, jobID, eventTime.UTC().Format(layout))
+}
+
+// ReindexTargetPattern matches every index a full reindex job builds.
+func ReindexTargetPattern(jobID uint) string {
+	index := DefaultElasticsearchIndex
+	if ES != nil {
+		index = ES.index
+	}
+	return fmt.Sprintf("%s-reindex-%d-*", index, jobID)
+}
+
+// CreateReindexTarget creates an index a full reindex builds. It gets the
+// template's mapping, but is taken out of the read alias until the swap so
+// searches do not see it half built, and it is not refreshed while it is
+// being filled.
+func CreateReindexTarget(ctx context.Context, name string) error {
+	if ES == nil {
+		return fmt.Errorf("elasticsearch client not initialized")
+	}
+
+	var existing map[string]any
+	err := ES.callJSON(ctx, http.MethodGet, "/"+url.PathEscape(name), nil, &existing)
+	if err != nil && !isElasticsearchNotFound(err) {
+		return err
+	}
+	if err != nil {
+		settings := map[string]any{"settings": map[string]any{"index": map[string]any{"refresh_interval": "-1"}}}
+		if err := ES.callJSON(ctx, http.MethodPut, "/"+url.PathEscape(name), settings, nil); err != nil {
+			return fmt.Errorf("failed to create %s: %w", name, err)
+		}
+	}
+
+	actions := map[string]any{"actions": []any{
+		map[string]any{"remove": map[string]any{"index": name, "alias": ES.readAlias, "must_exist": false}},
+	}}
+	return ES.callJSON(ctx, http.MethodPost, "/_aliases", actions, nil)
+}
+
+// FinishReindexTarget turns refreshes back on and refreshes the indices
+// matching pattern, so everything written to them can be counted and
+// searched.
+func FinishReindexTarget(ctx context.Context, pattern string) error {
+	if ES == nil {
+		return fmt.Errorf("elasticsearch client not initialized")
+	}
+	path := "/" + pattern
+	settings := map[string]any{"index": map[string]any{"refresh_interval": nil}}
+	if err := ES.callJSON(ctx, http.MethodPut, path+"/_settings", settings, nil); err != nil {
+		return err
+	}
+	return ES.callJSON(ctx, http.MethodPost, path+"/_refresh", nil, nil)
+}
+
+func BulkIndexEventsInto(ctx context.Context, index string, events []models.Event) error {
+	if ES == nil {
+		return fmt.Errorf("elasticsearch client not initialized")
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	if index == ES.writeAlias {
+		// Events already indexed are updated where they are.
+		return ES.bulkIndexEvents(ctx, events)
+	}
+	return ES.bulkIndexInto(ctx, index, events)
+}
+
+// ListIndexedEventsAfter is ListEventsAfter for events in the given search
+// indices. An event indexed into more than one of them is returned once.
+func ListIndexedEventsAfter(ctx context.Context, indices []string, from, to, afterTimestamp time.Time, afterID int64, limit int) (events []models.Event, err error) {
+	if ES == nil {
+		return nil, fmt.Errorf("elasticsearch client not initialized")
+	}
+	started := time.Now()
+	defer func() {
+		observeDBOperation("elasticsearch", "list_after", ES.index, started, err)
+	}()
+
+	request := map[string]any{
+		"size": limit,
+		"query": map[string]any{"range": map[string]any{"timestamp": map[string]any{
+			"gte": from.UTC().Format(time.RFC3339Nano),
+			"lt":  to.UTC().Format(time.RFC3339Nano),
+		}}},
+		"sort": []any{
+			map[string]any{"timestamp": map[string]any{"order": "asc", "format": "strict_date_optional_time_nanos"}},
+			map[string]any{"id": map[string]any{"order": "asc"}},
+		},
+	}
+	if !afterTimestamp.IsZero() {
+		request["search_after"] = []any{afterTimestamp.UTC().Format(time.RFC3339Nano), afterID}
+	}
+
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source models.Event `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	path := "/" + strings.Join(indices, ",") + "/_search?ignore_unavailable=true"
+	if err := ES.callJSON(ctx, http.MethodPost, path, request, &result); err != nil {
+		return nil, err
+	}
+
+	events = make([]models.Event, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		// Copies of an event sort next to each other.
+		if n := len(events); n > 0 && events[n-1].ID == hit.Source.ID {
+			continue
+		}
+		events = append(events, hit.Source)
+	}
+	return events, nil
+}
+
+// ListEventsIngestedAfter returns up to limit stored events with an id above
+// afterID, whatever their timestamp, in the order they were ingested.
+func ListEventsIngestedAfter(ctx context.Context, afterID int64, limit int) ([]models.Event, error) {
+	started := time.Now()
+	var events []models.Event
+	err := DB.WithContext(ctx).Where("id > ?", afterID).Order("id asc").Limit(limit).Find(&events).Error
+	observeDBOperation("postgres", "select", "events", started, err)
+	return events, err
+}
+
+// ListIndexedEventsIngestedAfter is ListEventsIngestedAfter for events in the
+// given search indices. An event indexed into more than one of them is
+// returned once.
+func ListIndexedEventsIngestedAfter(ctx context.Context, indices []string, afterID int64, limit int) (events []models.Event, err error) {
+	if ES == nil {
+		return nil, fmt.Errorf("elasticsearch client not initialized")
+	}
+	started := time.Now()
+	defer func() {
+		observeDBOperation("elasticsearch", "list_after", ES.index, started, err)
+	}()
+
+	request := map[string]any{
+		"size":  limit,
+		"query": map[string]any{"range": map[string]any{"id": map[string]any{"gt": afterID}}},
+		"sort":  idSort(true),
+	}
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source models.Event `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	path := "/" + strings.Join(indices, ",") + "/_search?ignore_unavailable=true"
+	if err := ES.callJSON(ctx, http.MethodPost, path, request, &result); err != nil {
+		return nil, err
+	}
+
+	events = make([]models.Event, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		if n := len(events); n > 0 && events[n-1].ID == hit.Source.ID {
+			continue
+		}
+		events = append(events, hit.Source)
+	}
+	return events, nil
+}
+
+// CountIndexedEvents counts the events in index with a timestamp in
+// [from, to).
+func CountIndexedEvents(ctx context.Context, index string, from, to time.Time) (int64, error) {
+	if ES == nil {
+		return 0, fmt.Errorf("elasticsearch client not initialized")
+	}
+	request := map[string]any{"query": map[string]any{"range": map[string]any{"timestamp": map[string]any{
+		"gte": from.UTC().Format(time.RFC3339Nano),
+		"lt":  to.UTC().Format(time.RFC3339Nano),
+	}}}}
+	var result struct {
+		Count int64 `json:"count"`
+	}
+	err := ES.callJSON(ctx, http.MethodPost, "/"+index+"/_count?ignore_unavailable=true", request, &result)
+	return result.Count, err
+}
+
+// SwapSearchAliases points the read alias at targets and the write alias at
+// write, one of them, in one atomic update. The indices they pointed at
+// before are kept, out of the aliases, and returned.
+func SwapSearchAliases(ctx context.Context, targets []string, write string) ([]string, error) {
+	read, previousWrite, err := SearchAliasIndices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := []any{
+		map[string]any{"add": map[string]any{"indices": targets, "alias": ES.readAlias}},
+		map[string]any{"add": map[string]any{"index": write, "alias": ES.writeAlias, "is_write_index": true}},
+	}
+	var previous []string
+	for _, name := range read {
+		if slices.Contains(targets, name) {
+			continue
+		}
+		actions = append(actions, map[string]any{"remove": map[string]any{"index": name, "alias": ES.readAlias}})
+		previous = append(previous, name)
+	}
+	if previousWrite != "" && previousWrite != write {
+		actions = append(actions, map[string]any{"remove": map[string]any{"index": previousWrite, "alias": ES.writeAlias}})
+	}
+
+	if err := ES.callJSON(ctx, http.MethodPost, "/_aliases", map[string]any{"actions": actions}, nil); err != nil {
+		return nil, fmt.Errorf("failed to swap search aliases: %w", err)
+	}
+	log.Printf("Swapped search aliases to %d indices writing to %s", len(targets), write)
+	return previous, ES.refreshCatalog(ctx)
+}
+
+// SearchMappingVersion is the mapping version new indices are created with.
+func SearchMappingVersion() int {
+	return searchMappingVersion
+}
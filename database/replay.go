@@ -0,0 +1,275 @@
+package database
+
+import (
+	"analytics-backend/models"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ReplayStreamName = "events:replay"
+	ReplayGroupName  = "event-replayers"
+	ReplayBatchSize  = int64(500)
+)
+
+const (
+	ReplayStatusPending   = "pending"
+	ReplayStatusRunning   = "running"
+	ReplayStatusDraining  = "draining"
+	ReplayStatusCompleted = "completed"
+	ReplayStatusPaused    = "paused"
+	ReplayStatusFailed    = "failed"
+	ReplayStatusCancelled = "cancelled"
+)
+
+// EventRange selects raw events in [From, To), optionally narrowed to some
+// actions and users.
+type EventRange struct {
+	From    time.Time
+	To      time.Time
+	Actions []string
+	UserIDs []string
+}
+
+func ReplayJobRange(job *models.ReplayJob) EventRange {
+	return EventRange{From: job.RangeStart, To: job.RangeEnd, Actions: job.Actions, UserIDs: job.UserIDs}
+}
+
+func (r EventRange) Contains(event models.Event) bool {
+	if event.Timestamp.Before(r.From) || !event.Timestamp.Before(r.To) {
+		return false
+	}
+	if len(r.Actions) > 0 && !containsString(r.Actions, event.Action) {
+		return false
+	}
+	if len(r.UserIDs) > 0 && !containsString(r.UserIDs, event.UserId) {
+		return false
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func EnsureReplayGroup() error {
+	err := Rdb.XGroupCreateMkStream(Ctx, ReplayStreamName, ReplayGroupName, "$").Err()
+	if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+		return err
+	}
+	RegisterMonitoredStream(ReplayStreamName, ReplayGroupName)
+	return nil
+}
+
+// EnqueueReplayEvents adds a page of events to the replay stream. Each entry
+// carries its job and targets so the replay workers need no other state.
+func EnqueueReplayEvents(ctx context.Context, job *models.ReplayJob, events []models.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	started := time.Now()
+	targets := strings.Join(job.Targets, ",")
+	pipe := Rdb.Pipeline()
+	for _, event := range events {
+		values := EncodeEvent(event)
+		values["job"] = strconv.FormatUint(uint64(job.ID), 10)
+		values["targets"] = targets
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: ReplayStreamName,
+			Values: values,
+		})
+	}
+
+	_, err := pipe.Exec(ctx)
+	observeRedisOperation("enqueue_replay_events", ReplayStreamName, started, err)
+	return err
+}
+
+func ReadReplayEventsFromGroup(consumer string) ([]redis.XMessage, error) {
+	return ReadStreamGroup(ReplayStreamName, ReplayGroupName, consumer, ReplayBatchSize, BlockTimeMs, "read_replay_events")
+}
+
+func ReadPendingReplayEvents(consumer string) ([]redis.XMessage, error) {
+	return ReadPendingStreamGroup(ReplayStreamName, ReplayGroupName, consumer, "0", ReplayBatchSize, "read_pending_replay_events")
+}
+
+func AckReplayEvents(ids ...string) error {
+	return AckStreamGroup(ReplayStreamName, ReplayGroupName, "ack_replay_events", ids...)
+}
+
+// ListEventsAfter pages through raw events in timestamp order, starting after
+// the given (timestamp, id) cursor.
+func ListEventsAfter(ctx context.Context, r EventRange, afterTimestamp time.Time, afterID int64, limit int) ([]models.Event, error) {
+	started := time.Now()
+	query := DB.WithContext(ctx).
+		Where("timestamp >= ? AND timestamp < ?", r.From, r.To).
+		Where("(timestamp, id) > (?, ?)", afterTimestamp, afterID)
+	if len(r.Actions) > 0 {
+		query = query.Where("action IN ?", r.Actions)
+	}
+	if len(r.UserIDs) > 0 {
+		query = query.Where("user_id IN ?", r.UserIDs)
+	}
+
+	var events []models.Event
+	err := query.Order("timestamp asc, id asc").Limit(limit).Find(&events).Error
+	observeDBOperation("postgres", "select", "events", started, err)
+	return events, err
+}
+
+// DeleteAggregatedEvents removes the aggregated rows whose window starts in
+// the range, so replayed events can rebuild them.
+func DeleteAggregatedEvents(ctx context.Context, r EventRange) (int64, error) {
+	started := time.Now()
+	query := DB.WithContext(ctx).Where(`"window" >= ? AND "window" < ?`, r.From, r.To)
+	if len(r.Actions) > 0 {
+		query = query.Where("action IN ?", r.Actions)
+	}
+	result := query.Delete(&models.AggregatedEvent{})
+	observeDBOperation("postgres", "delete", "aggregated_events", started, result.Error)
+	return result.RowsAffected, result.Error
+}
+
+func CreateReplayJob(ctx context.Context, job *models.ReplayJob) error {
+	started := time.Now()
+	err := DB.WithContext(ctx).Create(job).Error
+	observeDBOperation("postgres", "create", "replay_jobs", started, err)
+	return err
+}
+
+func ListReplayJobs(ctx context.Context, limit int) ([]models.ReplayJob, error) {
+	started := time.Now()
+	var jobs []models.ReplayJob
+	err := DB.WithContext(ctx).Order("id desc").Limit(limit).Find(&jobs).Error
+	observeDBOperation("postgres", "select", "replay_jobs", started, err)
+	return jobs, err
+}
+
+func GetReplayJob(ctx context.Context, id uint) (*models.ReplayJob, error) {
+	started := time.Now()
+	var job models.ReplayJob
+	err := DB.WithContext(ctx).First(&job, id).Error
+	observeDBOperation("postgres", "select", "replay_jobs", started, err)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ClaimReplayJob leases a pending job, or a running one whose previous owner
+// stopped renewing its lease. An id of 0 claims the oldest such job. It
+// returns nil when there is nothing to claim.
+func ClaimReplayJob(ctx context.Context, id uint, lease time.Duration) (*models.ReplayJob, error) {
+	started := time.Now()
+	now := time.Now()
+
+	var jobs []models.ReplayJob
+	err := DB.WithContext(ctx).Raw(`
+		UPDATE replay_jobs SET status = ?, leased_until = ?, started_at = COALESCE(started_at, ?), last_error = '', updated_at = ?
+		WHERE id = (
+			SELECT id FROM replay_jobs
+			WHERE (status = ? OR (status = ? AND leased_until < ?)) AND (? = 0 OR id = ?)
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		ReplayStatusRunning, now.Add(lease), now, now,
+		ReplayStatusPending, ReplayStatusRunning, now, id, id).Scan(&jobs).Error
+	observeDBOperation("postgres", "claim", "replay_jobs", started, err)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return &jobs[0], nil
+}
+
+// SaveReplayCheckpoint records progress and renews the lease. It returns
+// false when the job is no longer running, i.e. it was paused or cancelled.
+func SaveReplayCheckpoint(ctx context.Context, job *models.ReplayJob, lease time.Duration) (bool, error) {
+	started := time.Now()
+	result := DB.WithContext(ctx).Model(&models.ReplayJob{}).
+		Where("id = ? AND status = ?", job.ID, ReplayStatusRunning).
+		Updates(map[string]interface{}{
+			"cursor_timestamp": job.CursorTimestamp,
+			"cursor_id":        job.CursorID,
+			"cursor_path":      job.CursorPath,
+			"enqueued":         job.Enqueued,
+			"derived_deleted":  job.DerivedDeleted,
+			"leased_until":     time.Now().Add(lease),
+		})
+	observeDBOperation("postgres", "update", "replay_jobs", started, result.Error)
+	return result.RowsAffected > 0, result.Error
+}
+
+// FinishReplayEnqueue moves a job whose events are all enqueued to draining,
+// or straight to completed when the workers have already caught up.
+func FinishReplayEnqueue(ctx context.Context, id uint) error {
+	started := time.Now()
+	err := DB.WithContext(ctx).Exec(`
+		UPDATE replay_jobs SET
+			status = CASE WHEN processed >= enqueued THEN ? ELSE ? END,
+			completed_at = CASE WHEN processed >= enqueued THEN ? ELSE completed_at END,
+			leased_until = ?, updated_at = ?
+		WHERE id = ? AND status = ?`,
+		ReplayStatusCompleted, ReplayStatusDraining, time.Now(), time.Time{}, time.Now(),
+		id, ReplayStatusRunning).Error
+	observeDBOperation("postgres", "update", "replay_jobs", started, err)
+	return err
+}
+
+// AddReplayProgress counts events written by the replay workers and completes
+// a draining job once everything it enqueued has been processed.
+func AddReplayProgress(ctx context.Context, id uint, processed int) error {
+	started := time.Now()
+	err := DB.WithContext(ctx).Exec(`
+		UPDATE replay_jobs SET
+			processed = processed + ?,
+			status = CASE WHEN status = ? AND processed + ? >= enqueued THEN ? ELSE status END,
+			completed_at = CASE WHEN status = ? AND processed + ? >= enqueued THEN ? ELSE completed_at END,
+			updated_at = ?
+		WHERE id = ?`,
+		processed,
+		ReplayStatusDraining, processed, ReplayStatusCompleted,
+		ReplayStatusDraining, processed, time.Now(),
+		time.Now(), id).Error
+	observeDBOperation("postgres", "update", "replay_jobs", started, err)
+	return err
+}
+
+func FailReplayJob(ctx context.Context, id uint, reason string) error {
+	if len(reason) > 1024 {
+		reason = reason[:1024]
+	}
+
+	started := time.Now()
+	err := DB.WithContext(ctx).Model(&models.ReplayJob{}).
+		Where("id = ? AND status = ?", id, ReplayStatusRunning).
+		Updates(map[string]interface{}{
+			"status":       ReplayStatusFailed,
+			"last_error":   reason,
+			"leased_until": time.Time{},
+		}).Error
+	observeDBOperation("postgres", "update", "replay_jobs", started, err)
+	return err
+}
+
+// TransitionReplayJob moves a job to status if it is currently in one of the
+// from statuses. It reports whether the job changed.
+func TransitionReplayJob(ctx context.Context, id uint, from []string, status string) (bool, error) {
+	started := time.Now()
+	result := DB.WithContext(ctx).Model(&models.ReplayJob{}).
+		Where("id = ? AND status IN ?", id, from).
+		Updates(map[string]interface{}{"status": status, "leased_until": time.Time{}})
+	observeDBOperation("postgres", "update", "replay_jobs", started, result.Error)
+	return result.RowsAffected > 0, result.Error
+}
@@ -0,0 +1,231 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// trimScanLimit bounds how many entries one lookup of a length cap walks, so
+// a long backlog is trimmed in steps instead of one slow script.
+var trimScanLimit = int64(10000)
+
+type TrimResult struct {
+	MinID   string
+	Entries int64
+	Bytes   int64
+	Memory  int64
+	// Floor is the oldest entry FloorGroup still needs. Held is set when the
+	// policy would have trimmed past it.
+	Floor      string
+	FloorGroup string
+	Held       bool
+}
+
+// lengthBoundaryScript returns the ID of the last of the first ARGV[2]
+// entries up to ARGV[1], without sending the entries themselves back.
+var lengthBoundaryScript = redis.NewScript(`
+local entries = redis.call("XRANGE", KEYS[1], "-", ARGV[1], "COUNT", ARGV[2])
+if #entries == 0 then
+	return false
+end
+return entries[#entries][1]
+`)
+
+// ConsumedStreams returns every stream a consumer group reads.
+func ConsumedStreams() []string {
+	var streams []string
+	for _, monitored := range getMonitoredStreams() {
+		if !slices.Contains(streams, monitored.stream) {
+			streams = append(streams, monitored.stream)
+		}
+	}
+	return streams
+}
+
+// TrimStream removes entries that every consumer group of the stream has
+// acknowledged and that the policy does not keep. A stream without a policy
+// is not trimmed. Groups that are no longer read still hold entries back
+// until they are destroyed.
+func TrimStream(ctx context.Context, stream string, policy config.StreamRetentionConfig, now time.Time) (TrimResult, error) {
+	started := time.Now()
+	result, err := trimStream(ctx, stream, policy, now)
+	observeRedisOperation("trim_stream", stream, started, err)
+	return result, err
+}
+
+func trimStream(ctx context.Context, stream string, policy config.StreamRetentionConfig, now time.Time) (TrimResult, error) {
+	if policy.MaxLen <= 0 && policy.MaxAge <= 0 {
+		// Acknowledged entries are still what replays and lookups read.
+		return TrimResult{}, nil
+	}
+	floor, group, err := acknowledgedFloor(ctx, stream)
+	if err != nil {
+		return TrimResult{}, err
+	}
+
+	before := streamMemory(ctx, stream)
+	result := TrimResult{Floor: floor, FloorGroup: group}
+	for {
+		var minID string
+		var more, held bool
+		minID, more, held, err = trimThreshold(ctx, stream, policy, floor, now)
+		result.Held = result.Held || held
+		if err != nil || minID == "" {
+			break
+		}
+
+		var trimmed int64
+		trimmed, err = Rdb.XTrimMinID(ctx, stream, minID).Result()
+		if err != nil {
+			break
+		}
+		result.MinID = minID
+		result.Entries += trimmed
+		if !more || trimmed == 0 || ctx.Err() != nil {
+			break
+		}
+	}
+
+	result.Memory = streamMemory(ctx, stream)
+	if result.Entries > 0 && before > result.Memory && result.Memory > 0 {
+		result.Bytes = before - result.Memory
+	}
+	return result, err
+}
+
+// acknowledgedFloor returns the oldest entry some group still needs, and
+// that group. Every entry below the floor is acknowledged by all groups. A
+// stream without groups has no floor.
+func acknowledgedFloor(ctx context.Context, stream string) (string, string, error) {
+	groups, err := Rdb.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+
+	return oldestNeeded(groups, func(group string) (string, error) {
+		pending, err := Rdb.XPending(ctx, stream, group).Result()
+		if err != nil || pending.Count == 0 {
+			return "", err
+		}
+		return pending.Lower, nil
+	})
+}
+
+// oldestNeeded returns the lowest entry any of groups needs, which is its
+// oldest pending entry, or the one after the last it was delivered, and the
+// group needing it.
+func oldestNeeded(groups []redis.XInfoGroup, oldestPending func(group string) (string, error)) (string, string, error) {
+	floor, holder := "", ""
+	for _, group := range groups {
+		needed := nextStreamID(group.LastDeliveredID)
+		if group.Pending > 0 {
+			lower, err := oldestPending(group.Name)
+			if err != nil {
+				return "", "", err
+			}
+			if lower != "" {
+				needed = lower
+			}
+		}
+		if floor == "" || compareStreamIDs(needed, floor) < 0 {
+			floor, holder = needed, group.Name
+		}
+	}
+	return floor, holder, nil
+}
+
+// trimThreshold returns the MINID to trim to, or "" when nothing should go.
+// more is set when a length cap was only partly looked up, and held when the
+// floor kept the policy from trimming as far as it would have.
+func trimThreshold(ctx context.Context, stream string, policy config.StreamRetentionConfig, floor string, now time.Time) (string, bool, bool, error) {
+	if policy.MaxLen <= 0 && policy.MaxAge <= 0 {
+		return "", false, false, nil
+	}
+
+	minID, more, held := "", false, false
+	if policy.MaxAge > 0 {
+		minID = fmt.Sprintf("%d-0", now.Add(-policy.MaxAge).UnixMilli())
+	}
+
+	if policy.MaxLen > 0 {
+		length, err := Rdb.XLen(ctx, stream).Result()
+		if err != nil {
+			return "", false, false, err
+		}
+		if excess := length - policy.MaxLen; excess > 0 {
+			end := "+"
+			if floor != "" {
+				end = "(" + floor
+			}
+			last, err := lengthBoundaryScript.Run(ctx, Rdb, []string{stream}, end, min(excess, trimScanLimit)).Text()
+			if err != nil && err != redis.Nil {
+				return "", false, false, err
+			}
+			// Nothing below the floor is left, but the stream is still
+			// longer than the cap.
+			held = last == "" && floor != ""
+			if last != "" {
+				if candidate := nextStreamID(last); minID == "" || compareStreamIDs(candidate, minID) > 0 {
+					minID = candidate
+				}
+				more = excess > trimScanLimit
+			}
+		}
+	}
+
+	if minID != "" && floor != "" && compareStreamIDs(minID, floor) > 0 {
+		minID, held = floor, true
+	}
+	return minID, more, held, nil
+}
+
+func streamMemory(ctx context.Context, stream string) int64 {
+	bytes, err := Rdb.MemoryUsage(ctx, stream).Result()
+	if err != nil {
+		return 0
+	}
+	return bytes
+}
+
+func parseStreamID(id string) (uint64, uint64) {
+	millis, seq, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(millis, 10, 64)
+	sq, _ := strconv.ParseUint(seq, 10, 64)
+	return ms, sq
+}
+
+func compareStreamIDs(a, b string) int {
+	aMs, aSeq := parseStreamID(a)
+	bMs, bSeq := parseStreamID(b)
+	if c := cmp.Compare(aMs, bMs); c != 0 {
+		return c
+	}
+	return cmp.Compare(aSeq, bSeq)
+}
+
+// StreamIDTime returns the time an entry with the given ID was added.
+func StreamIDTime(id string) time.Time {
+	ms, _ := parseStreamID(id)
+	return time.UnixMilli(int64(ms))
+}
+
+// nextStreamID returns the smallest ID after id.
+func nextStreamID(id string) string {
+	ms, seq := parseStreamID(id)
+	if seq == math.MaxUint64 {
+		return fmt.Sprintf("%d-0", ms+1)
+	}
+	return fmt.Sprintf("%d-%d", ms, seq+1)
+}
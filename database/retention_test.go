@@ -0,0 +1,85 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestCompareStreamIDsOrdersByTimeThenSequence(t *testing.T) {
+	ordered := []string{"0-0", "0-1", "9-5", "10-0", "10-2", "1700000000000-0"}
+	for i := 1; i < len(ordered); i++ {
+		if compareStreamIDs(ordered[i-1], ordered[i]) >= 0 || compareStreamIDs(ordered[i], ordered[i-1]) <= 0 {
+			t.Errorf("expected %s to sort before %s", ordered[i-1], ordered[i])
+		}
+	}
+	if compareStreamIDs("10-2", "10-2") != 0 {
+		t.Error("expected equal IDs to compare equal")
+	}
+
+	if next := nextStreamID("1700000000000-4"); next != "1700000000000-5" {
+		t.Errorf("expected 1700000000000-5, got %s", next)
+	}
+	if next := nextStreamID("0-0"); next != "0-1" {
+		t.Errorf("expected 0-1, got %s", next)
+	}
+}
+
+func TestTrimStreamLeavesStreamsWithoutPolicyAlone(t *testing.T) {
+	previous := Rdb
+	t.Cleanup(func() { Rdb = previous })
+	// Any call to Redis would panic.
+	Rdb = nil
+
+	result, err := TrimStream(context.Background(), "events", config.StreamRetentionConfig{}, time.Now())
+	if err != nil || result != (TrimResult{}) {
+		t.Fatalf("expected nothing to be trimmed, got %+v %v", result, err)
+	}
+}
+
+func TestTrimThresholdKeepsMaxAgeBelowTheAcknowledgedFloor(t *testing.T) {
+	now := time.UnixMilli(1700000060000)
+	policy := config.StreamRetentionConfig{MaxAge: time.Minute}
+
+	if minID, _, _, _ := trimThreshold(context.Background(), "events", policy, "1700000030000-0", now); minID != "1700000000000-0" {
+		t.Errorf("expected to trim to a minute ago, got %s", minID)
+	}
+	if minID, _, _, _ := trimThreshold(context.Background(), "events", policy, "1699999990000-3", now); minID != "1699999990000-3" {
+		t.Errorf("expected to stop at the floor, got %s", minID)
+	}
+	if minID, _, _, _ := trimThreshold(context.Background(), "events", config.StreamRetentionConfig{}, "1700000030000-0", now); minID != "" {
+		t.Errorf("expected nothing to be trimmed without a policy, got %s", minID)
+	}
+}
+
+func TestOldestNeededIsHeldByAGroupsOldPendingEntry(t *testing.T) {
+	// The indexers left one job pending long ago. The aggregators are far
+	// ahead and have nothing pending.
+	groups := []redis.XInfoGroup{
+		{Name: "event-group", LastDeliveredID: "1700000090000-0"},
+		{Name: "event-indexers", LastDeliveredID: "1700000080000-0", Pending: 1},
+	}
+	floor, group, err := oldestNeeded(groups, func(group string) (string, error) {
+		if group != "event-indexers" {
+			t.Fatalf("expected only the group with pending entries to be looked up, got %s", group)
+		}
+		return "1700000000000-0", nil
+	})
+	if err != nil || floor != "1700000000000-0" || group != "event-indexers" {
+		t.Fatalf("expected the indexers' pending entry to be the floor, got %s %s %v", floor, group, err)
+	}
+
+	// The trim stops at that entry however old the policy allows, and says
+	// it was held back.
+	policy := config.StreamRetentionConfig{MaxAge: time.Minute}
+	minID, _, held, _ := trimThreshold(context.Background(), "events:index", policy, floor, time.UnixMilli(1700000090000))
+	if minID != floor || !held {
+		t.Fatalf("expected the trim to be held at %s, got %s held=%v", floor, minID, held)
+	}
+	if _, _, held, _ := trimThreshold(context.Background(), "events:index", policy, "1700000080001-0", time.UnixMilli(1700000090000)); held {
+		t.Error("expected a floor newer than the policy not to hold the trim")
+	}
+}
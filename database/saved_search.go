@@ -0,0 +1,133 @@
+package database
+
+import (
+	"analytics-backend/models"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SavedSearchParams returns the search a saved search runs.
+func SavedSearchParams(search *models.SavedSearch) SearchEventsParams {
+	return SearchEventsParams{
+		Query:  search.Query,
+		Action: search.Action,
+		UserID: search.UserID,
+		From:   search.From,
+		To:     search.To,
+		Size:   search.Size,
+	}
+}
+
+func CreateSavedSearch(ctx context.Context, search *models.SavedSearch) error {
+	started := time.Now()
+	err := DB.WithContext(ctx).Create(search).Error
+	observeDBOperation("postgres", "create", "saved_searches", started, err)
+	return err
+}
+
+func ListSavedSearches(ctx context.Context) ([]models.SavedSearch, error) {
+	started := time.Now()
+	var searches []models.SavedSearch
+	err := DB.WithContext(ctx).Order("id asc").Find(&searches).Error
+	observeDBOperation("postgres", "select", "saved_searches", started, err)
+	return searches, err
+}
+
+func GetSavedSearch(ctx context.Context, id uint) (*models.SavedSearch, error) {
+	started := time.Now()
+	var search models.SavedSearch
+	err := DB.WithContext(ctx).First(&search, id).Error
+	observeDBOperation("postgres", "select", "saved_searches", started, err)
+	if err != nil {
+		return nil, err
+	}
+	return &search, nil
+}
+
+// UpdateSavedSearch writes the user-editable columns and reloads the rest.
+// The high-water mark and lease belong to the scheduler, which may be saving
+// a run at the same time; the mark is only set here when the search has none
+// yet.
+func UpdateSavedSearch(ctx context.Context, search *models.SavedSearch) error {
+	started := time.Now()
+	err := DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.SavedSearch{}).Where("id = ?", search.ID).
+			Updates(map[string]interface{}{
+				"name":                   search.Name,
+				"query":                  search.Query,
+				"action":                 search.Action,
+				"user_id":                search.UserID,
+				"from":                   search.From,
+				"to":                     search.To,
+				"size":                   search.Size,
+				"interval_seconds":       search.IntervalSeconds,
+				"webhook_destination_id": search.WebhookDestinationID,
+				"enabled":                search.Enabled,
+				"next_run_at":            search.NextRunAt,
+				"high_water_timestamp": gorm.Expr("CASE WHEN high_water_timestamp = ? THEN ? ELSE high_water_timestamp END",
+					time.Time{}, search.HighWaterTimestamp),
+				"high_water_id": gorm.Expr("CASE WHEN high_water_timestamp = ? THEN ? ELSE high_water_id END",
+					time.Time{}, search.HighWaterID),
+			}).Error
+		if err != nil {
+			return err
+		}
+		return tx.First(search, search.ID).Error
+	})
+	observeDBOperation("postgres", "update", "saved_searches", started, err)
+	return err
+}
+
+func DeleteSavedSearch(ctx context.Context, id uint) (bool, error) {
+	started := time.Now()
+	result := DB.WithContext(ctx).Delete(&models.SavedSearch{}, id)
+	observeDBOperation("postgres", "delete", "saved_searches", started, result.Error)
+	return result.RowsAffected > 0, result.Error
+}
+
+// ClaimDueSavedSearches leases up to limit scheduled searches whose next run
+// is due, so only one instance runs each of them at a time.
+func ClaimDueSavedSearches(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]models.SavedSearch, error) {
+	started := time.Now()
+	// Postgres keeps microseconds, and the lease is compared again when the
+	// run is saved.
+	leasedUntil := now.Add(lease).Truncate(time.Microsecond)
+
+	var searches []models.SavedSearch
+	err := DB.WithContext(ctx).Raw(`
+		UPDATE saved_searches SET leased_until = ?
+		WHERE id IN (
+			SELECT id FROM saved_searches
+			WHERE enabled AND interval_seconds > 0 AND webhook_destination_id IS NOT NULL
+				AND next_run_at <= ? AND leased_until < ?
+			ORDER BY next_run_at
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		leasedUntil, now, now, limit).Scan(&searches).Error
+	observeDBOperation("postgres", "claim", "saved_searches", started, err)
+	return searches, err
+}
+
+// SaveSavedSearchRun records a scheduled run, including the high-water mark,
+// and releases the lease. It returns false when the lease was lost to another
+// instance, in which case nothing is written.
+func SaveSavedSearchRun(ctx context.Context, search *models.SavedSearch) (bool, error) {
+	started := time.Now()
+	result := DB.WithContext(ctx).Model(&models.SavedSearch{}).
+		Where("id = ? AND leased_until = ?", search.ID, search.LeasedUntil).
+		Updates(map[string]interface{}{
+			"high_water_timestamp": search.HighWaterTimestamp,
+			"high_water_id":        search.HighWaterID,
+			"next_run_at":          search.NextRunAt,
+			"last_run_at":          search.LastRunAt,
+			"last_matches":         search.LastMatches,
+			"last_error":           search.LastError,
+			"leased_until":         time.Time{},
+		})
+	observeDBOperation("postgres", "update", "saved_searches", started, result.Error)
+	return result.RowsAffected > 0, result.Error
+}
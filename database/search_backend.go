@@ -0,0 +1,46 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/models"
+	"context"
+	"fmt"
+)
+
+// SearchBackend answers GET /search/events and keeps its copy of the events,
+// if it has one, in step with the pipeline.
+type SearchBackend interface {
+	Name() string
+	SearchEvents(ctx context.Context, params SearchEventsParams) (*SearchEventsResponse, error)
+	IndexEvents(ctx context.Context, events []models.Event) error
+	DeleteEvents(ctx context.Context, r EventRange) error
+}
+
+// Search is the configured search backend, nil until it is initialized.
+var Search SearchBackend
+
+// InitSearch initializes the search backend named by cfg.Backend.
+// Elasticsearch is the default; the other features built on it, such as
+// exports, suggestions and index maintenance, need it.
+func InitSearch(cfg config.SearchConfig, esCfg config.ElasticsearchConfig) error {
+	switch cfg.Backend {
+	case "", SearchSourceElasticsearch:
+		// The server can answer searches from the fallback source, so it
+		// starts without Elasticsearch unless there is none.
+		return initElasticsearch(esCfg, SearchFallback != SearchSourceNone)
+	case SearchSourcePostgres:
+		if err := EnsurePostgresSearch(context.Background()); err != nil {
+			return err
+		}
+		Search = PostgresSearch{}
+		return nil
+	}
+	return fmt.Errorf("unknown search backend %q", cfg.Backend)
+}
+
+// UsesElasticsearch reports whether searches go to Elasticsearch, so the
+// workers feeding and maintaining it are needed.
+func UsesElasticsearch() bool {
+	_, ok := Search.(*ElasticsearchClient)
+	return ok
+}
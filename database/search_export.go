@@ -0,0 +1,132 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	SearchExportMaxRows   = 1000000
+	SearchExportPageSize  = 1000
+	SearchExportKeepAlive = time.Minute
+)
+
+func ConfigureSearchExport(cfg config.ElasticsearchConfig) {
+	if cfg.ExportMaxRows > 0 {
+		SearchExportMaxRows = cfg.ExportMaxRows
+	}
+	if cfg.ExportPageSize > 0 {
+		SearchExportPageSize = cfg.ExportPageSize
+	}
+	if cfg.ExportKeepAlive > 0 {
+		SearchExportKeepAlive = cfg.ExportKeepAlive
+	}
+}
+
+// SearchExportPage is one page of an export. Total is set on the first page
+// to the number of events matching the search, which is more than the export
+// holds when it is cut off at its limit.
+type SearchExportPage struct {
+	Events []models.Event
+	Total  int64
+}
+
+// ExportSearchEvents pages through every event matching params, newest first,
+// and passes each page to emit until limit events were exported. The pages
+// come from one point in time, so events indexed or deleted meanwhile do not
+// shift them. It stops early when emit fails or ctx is cancelled.
+func ExportSearchEvents(ctx context.Context, params SearchEventsParams, limit int, emit func(SearchExportPage) error) (int, error) {
+	if ES == nil {
+		return 0, fmt.Errorf("elasticsearch client not initialized")
+	}
+	if limit <= 0 || limit > SearchExportMaxRows {
+		limit = SearchExportMaxRows
+	}
+	return ES.exportEvents(ctx, params, limit, emit)
+}
+
+func (c *ElasticsearchClient) exportEvents(ctx context.Context, params SearchEventsParams, limit int, emit func(SearchExportPage) error) (exported int, err error) {
+	started := time.Now()
+	defer func() {
+		observeDBOperation("elasticsearch", "export", c.index, started, err)
+	}()
+
+	query, err := buildSearchQuery(params)
+	if err != nil {
+		return 0, err
+	}
+	query = c.pruneQuery(query, params.From, params.To)
+
+	keepAlive := fmt.Sprintf("%ds", int64(SearchExportKeepAlive.Seconds()))
+	var pit struct {
+		ID string `json:"id"`
+	}
+	if err := c.callJSON(ctx, http.MethodPost, "/"+c.readAlias+"/_pit?keep_alive="+keepAlive+"&ignore_unavailable=true", nil, &pit); err != nil {
+		return 0, fmt.Errorf("failed to open point in time: %w", err)
+	}
+	defer func() {
+		// The export may have ended because ctx was cancelled, and the point
+		// in time should still be closed rather than left to expire.
+		closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.callJSON(closeCtx, http.MethodDelete, "/_pit", map[string]any{"id": pit.ID}, nil); err != nil {
+			log.Printf("Failed to close point in time: %v", err)
+		}
+	}()
+
+	var searchAfter []json.RawMessage
+	for exported < limit {
+		request := map[string]any{
+			"size":             min(SearchExportPageSize, limit-exported),
+			"query":            query,
+			"sort":             searchSort(false),
+			"pit":              map[string]any{"id": pit.ID, "keep_alive": keepAlive},
+			"track_total_hits": searchAfter == nil,
+		}
+		if searchAfter != nil {
+			request["search_after"] = searchAfter
+		}
+
+		var result struct {
+			PitID string `json:"pit_id"`
+			Hits  struct {
+				Total struct {
+					Value int64 `json:"value"`
+				} `json:"total"`
+				Hits []struct {
+					Source models.Event      `json:"_source"`
+					Sort   []json.RawMessage `json:"sort"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		if err := c.callJSON(ctx, http.MethodPost, "/_search", request, &result); err != nil {
+			return exported, err
+		}
+		if result.PitID != "" {
+			pit.ID = result.PitID
+		}
+		if len(result.Hits.Hits) == 0 {
+			break
+		}
+
+		page := SearchExportPage{Events: make([]models.Event, 0, len(result.Hits.Hits)), Total: result.Hits.Total.Value}
+		for _, hit := range result.Hits.Hits {
+			page.Events = append(page.Events, hit.Source)
+		}
+		if err := emit(page); err != nil {
+			return exported, err
+		}
+		exported += len(page.Events)
+		// The sort values include the tiebreaker the point in time adds, so
+		// they are passed back as they are. They stay raw JSON because the
+		// id is a Snowflake id, which a float64 would round above 2^53.
+		searchAfter = result.Hits.Hits[len(result.Hits.Hits)-1].Sort
+	}
+	return exported, nil
+}
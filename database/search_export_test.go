@@ -0,0 +1,117 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExportEventsPagesThroughPointInTime(t *testing.T) {
+	previous := SearchExportPageSize
+	defer func() { SearchExportPageSize = previous }()
+	SearchExportPageSize = 2
+
+	var searchAfters []any
+	closed := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/events-search-read/_pit":
+			fmt.Fprint(w, `{"id":"pit-1"}`)
+		case r.Method == http.MethodDelete && r.URL.Path == "/_pit":
+			var body struct {
+				ID string `json:"id"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			closed = body.ID
+		case r.URL.Path == "/_search":
+			var body map[string]any
+			json.NewDecoder(r.Body).Decode(&body)
+			searchAfters = append(searchAfters, body["search_after"])
+			switch len(searchAfters) {
+			case 1:
+				fmt.Fprint(w, `{"pit_id":"pit-2","hits":{"total":{"value":5},"hits":[
+					{"_source":{"id":5},"sort":["t5",5,10]},{"_source":{"id":4},"sort":["t4",4,11]}]}}`)
+			case 2:
+				if body["size"] != float64(1) {
+					t.Errorf("expected the last page to be cut to the limit, got size %v", body["size"])
+				}
+				fmt.Fprint(w, `{"pit_id":"pit-2","hits":{"hits":[{"_source":{"id":3},"sort":["t3",3,12]}]}}`)
+			default:
+				t.Errorf("expected the export to stop at its limit, got search %d", len(searchAfters))
+			}
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := &ElasticsearchClient{baseURL: server.URL, index: "events-search", readAlias: "events-search-read", httpClient: server.Client()}
+
+	var ids []int64
+	var total int64
+	exported, err := client.exportEvents(context.Background(), SearchEventsParams{Action: "click"}, 3, func(page SearchExportPage) error {
+		if total == 0 {
+			total = page.Total
+		}
+		for _, event := range page.Events {
+			ids = append(ids, event.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	if exported != 3 || len(ids) != 3 || ids[2] != 3 || total != 5 {
+		t.Fatalf("expected the 3 newest of 5 events, got %d events %v of %d", exported, ids, total)
+	}
+	if searchAfters[0] != nil || fmt.Sprint(searchAfters[1]) != "[t4 4 11]" {
+		t.Errorf("expected search_after to be the last sort values, got %v", searchAfters)
+	}
+	if closed != "pit-2" {
+		t.Errorf("expected the latest point in time id to be closed, got %q", closed)
+	}
+}
+
+func TestExportEventsPassesLargeSortIDsBackExactly(t *testing.T) {
+	previous := SearchExportPageSize
+	defer func() { SearchExportPageSize = previous }()
+	SearchExportPageSize = 1
+
+	// 2^53 + 1 is the first integer a float64 cannot hold.
+	const largeID = "9007199254740993"
+	var searchAfter json.RawMessage
+	searches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/events-search-read/_pit":
+			fmt.Fprint(w, `{"id":"pit-1"}`)
+		case r.URL.Path == "/_pit":
+		case r.URL.Path == "/_search":
+			var body struct {
+				SearchAfter json.RawMessage `json:"search_after"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			searches++
+			if searches == 1 {
+				fmt.Fprint(w, `{"hits":{"total":{"value":2},"hits":[{"_source":{"id":`+largeID+`},"sort":["t1",`+largeID+`,7]}]}}`)
+				return
+			}
+			searchAfter = body.SearchAfter
+			fmt.Fprint(w, `{"hits":{"hits":[]}}`)
+		}
+	}))
+	defer server.Close()
+
+	client := &ElasticsearchClient{baseURL: server.URL, index: "events-search", readAlias: "events-search-read", httpClient: server.Client()}
+	if _, err := client.exportEvents(context.Background(), SearchEventsParams{}, 10, func(SearchExportPage) error { return nil }); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	if string(searchAfter) != `["t1",`+largeID+`,7]` {
+		t.Fatalf("expected the sort values to be sent back unchanged, got %s", searchAfter)
+	}
+}
@@ -0,0 +1,296 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SearchSourceElasticsearch = "elasticsearch"
+	SearchSourcePostgres      = "postgres"
+	SearchSourceClickHouse    = "clickhouse"
+	SearchSourceNone          = "none"
+)
+
+// ErrFullTextUnavailable is returned for text queries while Elasticsearch is
+// down, since the fallback sources only apply the structured filters.
+var ErrFullTextUnavailable = errors.New("full-text search is unavailable while Elasticsearch is down")
+
+var (
+	SearchFallback            = SearchSourcePostgres
+	SearchHealthCheckInterval = 5 * time.Second
+
+	searchHealthy atomic.Bool
+)
+
+func init() {
+	searchHealthy.Store(true)
+	metrics.SearchBackendHealthy.Set(1)
+}
+
+func ConfigureSearchFallback(cfg config.ElasticsearchConfig) error {
+	switch cfg.Fallback {
+	case "":
+	case SearchSourcePostgres, SearchSourceClickHouse, SearchSourceNone:
+		SearchFallback = cfg.Fallback
+	default:
+		return fmt.Errorf("unknown search fallback %q", cfg.Fallback)
+	}
+	if cfg.HealthCheckInterval > 0 {
+		SearchHealthCheckInterval = cfg.HealthCheckInterval
+	}
+	return nil
+}
+
+// SearchEvents answers from the search backend. Elasticsearch answers while
+// it is healthy, and the fallback source otherwise or when it fails the
+// request.
+func SearchEvents(ctx context.Context, params SearchEventsParams) (*SearchEventsResponse, error) {
+	if Search != nil && !UsesElasticsearch() {
+		return Search.SearchEvents(ctx, params)
+	}
+	if ES != nil && searchHealthy.Load() {
+		response, err := ES.searchEvents(ctx, params)
+		if err == nil || !isSearchOutage(err) || SearchFallback == SearchSourceNone {
+			return response, err
+		}
+		setSearchHealthy(false, err)
+	} else if ES == nil && SearchFallback == SearchSourceNone {
+		return nil, fmt.Errorf("elasticsearch client not initialized")
+	}
+	return searchFallback(ctx, params)
+}
+
+func searchFallback(ctx context.Context, params SearchEventsParams) (*SearchEventsResponse, error) {
+	if params.Query != "" {
+		return nil, ErrFullTextUnavailable
+	}
+
+	switch SearchFallback {
+	case SearchSourceClickHouse:
+		return searchEventsClickHouse(ctx, params)
+	case SearchSourcePostgres:
+		return searchEventsPostgres(ctx, params)
+	}
+	return nil, fmt.Errorf("elasticsearch: %w", ErrCircuitOpen)
+}
+
+// StartSearchHealthChecks checks the Elasticsearch cluster health every
+// SearchHealthCheckInterval until ctx is cancelled. Searches go to the
+// fallback source while the cluster is unreachable or red.
+func StartSearchHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(SearchHealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkSearchHealth(ctx)
+		}
+	}
+}
+
+func checkSearchHealth(ctx context.Context) {
+	if ES == nil {
+		return
+	}
+
+	var health struct {
+		Status string `json:"status"`
+	}
+	err := ES.callJSON(ctx, "GET", "/_cluster/health", nil, &health)
+	if err == nil && health.Status == "red" {
+		err = fmt.Errorf("cluster health is red")
+	}
+	if err == nil && ES.setupPending.Load() {
+		if err = ES.ensureIndices(ctx); err == nil {
+			ES.setupPending.Store(false)
+		}
+	}
+	if ctx.Err() == nil {
+		setSearchHealthy(err == nil, err)
+	}
+}
+
+func setSearchHealthy(healthy bool, err error) {
+	if searchHealthy.Swap(healthy) != healthy {
+		if healthy {
+			log.Println("Elasticsearch is healthy again, searching it")
+		} else {
+			log.Printf("Elasticsearch is unhealthy, searching %s instead: %v", SearchFallback, err)
+		}
+	}
+	if healthy {
+		metrics.SearchBackendHealthy.Set(1)
+	} else {
+		metrics.SearchBackendHealthy.Set(0)
+	}
+}
+
+// isSearchOutage reports whether a search failed because Elasticsearch is
+// unavailable, rather than because the request was rejected.
+func isSearchOutage(err error) bool {
+	var esErr *elasticsearchError
+	var netErr net.Error
+	return errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &esErr) ||
+		errors.As(err, &netErr)
+}
+
+// structuredSearchFilters builds the SQL conditions shared by the fallback
+// sources, which both keep events in a table with the same column names.
+func structuredSearchFilters(params SearchEventsParams) (string, []any) {
+	conditions := []string{"1 = 1"}
+	var args []any
+	if params.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, params.Action)
+	}
+	if params.UserID != "" {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, params.UserID)
+	}
+	if params.From != nil {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, params.From.UTC())
+	}
+	if params.To != nil {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, params.To.UTC())
+	}
+	if params.AfterID != 0 {
+		conditions = append(conditions, "id > ?")
+		args = append(args, params.AfterID)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// searchPage applies the cursor and page size on top of the filters and
+// returns the page query arguments.
+func searchPage(params SearchEventsParams) (string, []any, int, error) {
+	where, args := structuredSearchFilters(params)
+	size := clampSearchSize(params.Size)
+
+	cursor, err := decodeSearchCursor(params.Cursor)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if cursor != nil {
+		timestamp, err := time.Parse(time.RFC3339Nano, cursor.Timestamp)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		after := "<"
+		if params.Ascending {
+			after = ">"
+		}
+		if params.ByID {
+			where += fmt.Sprintf(" AND id %s ?", after)
+			args = append(args, cursor.ID)
+			return where, args, size, nil
+		}
+		where += fmt.Sprintf(" AND (timestamp %s ? OR (timestamp = ? AND id %s ?))", after, after)
+		args = append(args, timestamp.UTC(), timestamp.UTC(), cursor.ID)
+	}
+	return where, args, size, nil
+}
+
+// searchOrder is the SQL sort direction of a search.
+func searchOrder(params SearchEventsParams) string {
+	if params.Ascending {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+// searchOrderBy is the SQL ORDER BY list of a search.
+func searchOrderBy(params SearchEventsParams) string {
+	if params.ByID {
+		return "id " + searchOrder(params)
+	}
+	return fmt.Sprintf("timestamp %[1]s, id %[1]s", searchOrder(params))
+}
+
+func clampSearchSize(size int) int {
+	if size <= 0 {
+		return 20
+	}
+	return min(size, 100)
+}
+
+func searchEventsClickHouse(ctx context.Context, params SearchEventsParams) (response *SearchEventsResponse, err error) {
+	started := time.Now()
+	defer func() {
+		observeDBOperation("clickhouse", "search", "events", started, err)
+	}()
+
+	pageWhere, pageArgs, size, err := searchPage(params)
+	if err != nil {
+		return nil, err
+	}
+	where, args := structuredSearchFilters(params)
+	// Rows written before events carried their id all have id 0, so the
+	// cursor cannot tell apart those stored in the same second. They are left
+	// out rather than skipped at random between pages; the TTL removes them
+	// within a month.
+	pageWhere += " AND id != 0"
+	where += " AND id != 0"
+
+	var rows []struct {
+		ID        int64     `ch:"id"`
+		UserID    string    `ch:"user_id"`
+		Action    string    `ch:"action"`
+		Element   string    `ch:"element"`
+		Duration  float64   `ch:"duration"`
+		Timestamp time.Time `ch:"timestamp"`
+	}
+	var total uint64
+	err = clickhouseBackend.do(ctx, func(ctx context.Context) error {
+		rows = nil
+		query := "SELECT id, user_id, action, element, duration, timestamp FROM events WHERE " + pageWhere +
+			fmt.Sprintf(" ORDER BY %s LIMIT %d", searchOrderBy(params), size)
+		if err := CH.Select(ctx, &rows, query, pageArgs...); err != nil {
+			return err
+		}
+		return CH.QueryRow(ctx, "SELECT count() FROM events WHERE "+where, args...).Scan(&total)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response = &SearchEventsResponse{Items: make([]models.Event, 0, len(rows)), Source: SearchSourceClickHouse, Total: int64(total)}
+	for _, row := range rows {
+		response.Items = append(response.Items, models.Event{
+			ID:        row.ID,
+			UserId:    row.UserID,
+			Action:    row.Action,
+			Element:   row.Element,
+			Duration:  row.Duration,
+			Timestamp: row.Timestamp.UTC(),
+		})
+	}
+	response.NextCursor = nextSearchCursor(response, size)
+	response.TookMS = int(time.Since(started).Milliseconds())
+	return response, nil
+}
+
+func nextSearchCursor(response *SearchEventsResponse, size int) string {
+	if len(response.Items) != size {
+		return ""
+	}
+	last := response.Items[len(response.Items)-1]
+	cursor, _ := encodeSearchCursor(last.Timestamp, last.ID)
+	return cursor
+}
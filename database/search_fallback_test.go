@@ -0,0 +1,160 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSearchPageAppliesFiltersAndCursor(t *testing.T) {
+	from := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	cursorTime := time.Date(2026, 4, 9, 12, 0, 0, 0, time.UTC)
+	cursor, err := encodeSearchCursor(cursorTime, 99)
+	if err != nil {
+		t.Fatalf("encode cursor: %v", err)
+	}
+
+	where, args, size, err := searchPage(SearchEventsParams{Action: "click", From: &from, Cursor: cursor, Size: 500})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "1 = 1 AND action = ? AND timestamp >= ? AND (timestamp < ? OR (timestamp = ? AND id < ?))"
+	if where != expected {
+		t.Fatalf("expected %q, got %q", expected, where)
+	}
+	if len(args) != 5 || args[0] != "click" || args[4] != int64(99) || !args[2].(time.Time).Equal(cursorTime) {
+		t.Fatalf("unexpected args %#v", args)
+	}
+	if size != 100 {
+		t.Fatalf("expected the page size to be capped at 100, got %d", size)
+	}
+}
+
+func TestSearchPageAscendingCursorMovesForward(t *testing.T) {
+	cursor, err := encodeSearchCursor(time.Date(2026, 4, 9, 12, 0, 0, 0, time.UTC), 99)
+	if err != nil {
+		t.Fatalf("encode cursor: %v", err)
+	}
+
+	params := SearchEventsParams{Cursor: cursor, Ascending: true}
+	where, _, _, err := searchPage(params)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "1 = 1 AND (timestamp > ? OR (timestamp = ? AND id > ?))"; where != expected {
+		t.Fatalf("expected %q, got %q", expected, where)
+	}
+	if order := searchOrder(params); order != "ASC" {
+		t.Fatalf("expected ASC, got %s", order)
+	}
+}
+
+func TestSearchPageByIDPagesInIngestOrder(t *testing.T) {
+	cursor, err := encodeSearchCursor(time.Date(2026, 4, 9, 12, 0, 0, 0, time.UTC), 99)
+	if err != nil {
+		t.Fatalf("encode cursor: %v", err)
+	}
+
+	params := SearchEventsParams{Cursor: cursor, Ascending: true, ByID: true, AfterID: 50}
+	where, args, _, err := searchPage(params)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "1 = 1 AND id > ? AND id > ?"; where != expected {
+		t.Fatalf("expected %q, got %q", expected, where)
+	}
+	if len(args) != 2 || args[0] != int64(50) || args[1] != int64(99) {
+		t.Fatalf("unexpected args %#v", args)
+	}
+	if order := searchOrderBy(params); order != "id ASC" {
+		t.Fatalf("expected id ASC, got %s", order)
+	}
+}
+
+func TestSearchFallbackRejectsTextQueries(t *testing.T) {
+	_, err := searchFallback(context.Background(), SearchEventsParams{Query: "checkout"})
+	if !errors.Is(err, ErrFullTextUnavailable) {
+		t.Fatalf("expected ErrFullTextUnavailable, got %v", err)
+	}
+}
+
+func TestIsSearchOutageOnlyForUnavailability(t *testing.T) {
+	outages := []error{
+		fmt.Errorf("elasticsearch: %w", ErrCircuitOpen),
+		&elasticsearchError{status: "503 Service Unavailable"},
+		&net.OpError{Op: "dial", Err: errors.New("connection refused")},
+	}
+	for _, err := range outages {
+		if !isSearchOutage(err) {
+			t.Errorf("expected %v to be an outage", err)
+		}
+	}
+
+	if isSearchOutage(errors.New("search request failed: parsing_exception")) {
+		t.Error("expected a rejected query not to be an outage")
+	}
+}
+
+func TestInitSearchStartsOnFallbackWhileElasticsearchIsDown(t *testing.T) {
+	previousES, previousSearch, previousFallback, previousBackend := ES, Search, SearchFallback, elasticsearchBackend
+	t.Cleanup(func() {
+		ES, Search, SearchFallback, elasticsearchBackend = previousES, previousSearch, previousFallback, previousBackend
+		setSearchHealthy(true, nil)
+	})
+	// The outage must not open the breaker, or the recovery would wait for it.
+	elasticsearchBackend = newBackend("elasticsearch", time.Second)
+	elasticsearchBackend.configure(config.BackendConfig{MaxAttempts: 1, FailureThreshold: 100})
+
+	var down atomic.Bool
+	down.Store(true)
+	var templateInstalled atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch {
+		case r.URL.Path == "/_cluster/health":
+			fmt.Fprint(w, `{"status":"green"}`)
+		case r.Method == http.MethodPut && r.URL.Path == "/_index_template/events-search":
+			templateInstalled.Store(true)
+			fmt.Fprint(w, `{}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+	cfg := config.ElasticsearchConfig{Addr: server.URL}
+
+	SearchFallback = SearchSourceNone
+	if err := InitSearch(config.SearchConfig{}, cfg); err == nil {
+		t.Fatal("expected an unreachable cluster to fail the start without a fallback")
+	}
+
+	SearchFallback = SearchSourcePostgres
+	if err := InitSearch(config.SearchConfig{}, cfg); err != nil {
+		t.Fatalf("expected to start on the fallback, got %v", err)
+	}
+	if Search != ES || searchHealthy.Load() {
+		t.Fatal("expected Elasticsearch to be the backend, marked unhealthy")
+	}
+
+	checkSearchHealth(context.Background())
+	if searchHealthy.Load() || templateInstalled.Load() {
+		t.Fatal("expected Elasticsearch to stay unhealthy while it is down")
+	}
+
+	down.Store(false)
+	checkSearchHealth(context.Background())
+	if !searchHealthy.Load() || !templateInstalled.Load() || ES.setupPending.Load() {
+		t.Fatal("expected the indices to be installed and Elasticsearch to be searched once it is reachable")
+	}
+}
@@ -0,0 +1,606 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IndexPeriodDaily   = "daily"
+	IndexPeriodMonthly = "monthly"
+)
+
+// searchMappingVersion is stored in the _meta of every index mapping. Indices
+// with an older version are migrated by maintenance. Version 2 added the
+// prefix subfields that suggestions search.
+const searchMappingVersion = 2
+
+// suggestPrefixLength is the longest prefix the prefix subfields index.
+const suggestPrefixLength = 50
+
+// searchIndex is a backing index and the range of event times it holds.
+type searchIndex struct {
+	Name    string
+	MinTime time.Time
+	MaxTime time.Time
+}
+
+// searchIndexCatalog is what searches prune by. It is refreshed on start and
+// by every maintenance run, which is also the only thing that rolls over, so
+// an index it describes as rolled over no longer changes.
+type searchIndexCatalog struct {
+	mu      sync.RWMutex
+	loaded  bool
+	write   string
+	indices []searchIndex
+}
+
+type SearchIndexMaintenance struct {
+	RolledOver string
+	Deleted    []string
+	Migrated   string
+	Indices    int
+}
+
+// MaintainSearchIndices rolls the write alias over once the write index is
+// old or large enough, then deletes backing indices whose newest event is
+// older than the retention.
+func MaintainSearchIndices(ctx context.Context, now time.Time) (SearchIndexMaintenance, error) {
+	if ES == nil {
+		return SearchIndexMaintenance{}, fmt.Errorf("elasticsearch client not initialized")
+	}
+	return ES.maintainIndices(ctx, now)
+}
+
+func (c *ElasticsearchClient) maintainIndices(ctx context.Context, now time.Time) (result SearchIndexMaintenance, err error) {
+	started := time.Now()
+	defer func() {
+		observeDBOperation("elasticsearch", "maintain_indices", c.index, started, err)
+	}()
+
+	if result.RolledOver, err = c.rollover(ctx, false); err != nil {
+		return result, err
+	}
+	if err = c.refreshCatalog(ctx); err != nil {
+		return result, err
+	}
+	if result.Deleted, err = c.deleteExpiredIndices(ctx, now); err != nil {
+		return result, err
+	}
+	if result.Migrated, err = c.migrateOldIndex(ctx); err != nil {
+		return result, err
+	}
+
+	c.catalog.mu.RLock()
+	result.Indices = len(c.catalog.indices)
+	c.catalog.mu.RUnlock()
+	return result, nil
+}
+
+// ensureIndices installs the index template and, on first start, the first
+// backing index with both aliases. A single index from before aliases is
+// added to the read alias so it stays searchable until retention drops it.
+func (c *ElasticsearchClient) ensureIndices(ctx context.Context) error {
+	template := map[string]any{
+		"index_patterns": []string{c.index + "-*"},
+		"template": map[string]any{
+			"settings": eventIndexSettings(),
+			"mappings": eventIndexMapping(),
+			"aliases":  map[string]any{c.readAlias: map[string]any{}},
+		},
+	}
+	if err := c.callJSON(ctx, http.MethodPut, "/_index_template/"+c.index, template, nil); err != nil {
+		return fmt.Errorf("failed to install index template: %w", err)
+	}
+
+	writeIndices, err := c.aliasIndices(ctx, c.writeAlias)
+	if err != nil {
+		return err
+	}
+	if len(writeIndices) == 0 {
+		bootstrap := map[string]any{
+			"aliases": map[string]any{c.writeAlias: map[string]any{"is_write_index": true}},
+		}
+		if err := c.callJSON(ctx, http.MethodPut, "/"+url.PathEscape(c.bootstrapIndexName()), bootstrap, nil); err != nil {
+			return fmt.Errorf("failed to create first search index: %w", err)
+		}
+	}
+
+	var legacy map[string]json.RawMessage
+	err = c.callJSON(ctx, http.MethodGet, "/"+c.index, nil, &legacy)
+	if err != nil && !isElasticsearchNotFound(err) {
+		return err
+	}
+	if _, ok := legacy[c.index]; ok {
+		actions := map[string]any{"actions": []any{
+			map[string]any{"add": map[string]any{"index": c.index, "alias": c.readAlias}},
+		}}
+		if err := c.callJSON(ctx, http.MethodPost, "/_aliases", actions, nil); err != nil {
+			return fmt.Errorf("failed to add %s to %s: %w", c.index, c.readAlias, err)
+		}
+	}
+
+	if err := c.migrateWriteIndex(ctx); err != nil {
+		return err
+	}
+	return c.refreshCatalog(ctx)
+}
+
+// migrateWriteIndex rolls the write alias over when the write index has an
+// older mapping, so new events get the current one from the template
+// straight away.
+func (c *ElasticsearchClient) migrateWriteIndex(ctx context.Context) error {
+	writeIndices, err := c.aliasIndices(ctx, c.writeAlias)
+	if err != nil {
+		return err
+	}
+	metas, err := c.mappingMetas(ctx)
+	if err != nil {
+		return err
+	}
+	for name := range writeIndices {
+		if metas[name].MappingVersion >= searchMappingVersion {
+			continue
+		}
+		rolledOver, err := c.rollover(ctx, true)
+		if err != nil {
+			return err
+		}
+		log.Printf("Rolled search writes over from %s to %s for mapping version %d", name, rolledOver, searchMappingVersion)
+		return nil
+	}
+	return nil
+}
+
+// migrateOldIndex brings one index behind the read alias with an older
+// mapping up to date. The analyzers can only be added to a closed index, so
+// it is closed for a moment, during which searches skip it. Its events are
+// then updated in place in a background task to fill the new subfields. The
+// task is recorded in the index's _meta, and the index only gets the current
+// mapping version once a later run finds the task completed without
+// failures. A task that failed or was lost with its node is started again.
+// It returns the index migrated, if any.
+func (c *ElasticsearchClient) migrateOldIndex(ctx context.Context) (string, error) {
+	metas, err := c.mappingMetas(ctx)
+	if err != nil {
+		return "", err
+	}
+	writeIndices, err := c.aliasIndices(ctx, c.writeAlias)
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(metas))
+	for name, meta := range metas {
+		if _, isWrite := writeIndices[name]; !isWrite && meta.MappingVersion < searchMappingVersion {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	slices.Sort(names)
+	name := names[0]
+	meta := metas[name]
+	path := "/" + url.PathEscape(name)
+
+	if meta.MigrationTask != "" {
+		task, err := c.migrationTask(ctx, meta.MigrationTask)
+		switch {
+		case err != nil:
+			return "", err
+		case task != nil && !task.Completed:
+			return "", nil
+		case task != nil && task.succeeded():
+			versioned := map[string]any{"_meta": map[string]any{"mapping_version": searchMappingVersion}}
+			if err := c.callJSON(ctx, http.MethodPut, path+"/_mapping", versioned, nil); err != nil {
+				return "", fmt.Errorf("failed to update the mapping version of %s: %w", name, err)
+			}
+			log.Printf("Migrated %s to mapping version %d", name, searchMappingVersion)
+			return name, nil
+		default:
+			// Failed, or lost when its node restarted.
+			log.Printf("Task %s filling new fields of %s did not complete, starting it again", meta.MigrationTask, name)
+			return "", c.startMigrationTask(ctx, name, meta.MappingVersion)
+		}
+	}
+
+	if err := c.callJSON(ctx, http.MethodPost, path+"/_close", nil, nil); err != nil {
+		return "", fmt.Errorf("failed to close %s: %w", name, err)
+	}
+	settingsErr := c.callJSON(ctx, http.MethodPut, path+"/_settings", eventIndexSettings(), nil)
+	if err := c.callJSON(ctx, http.MethodPost, path+"/_open", nil, nil); err != nil {
+		return "", fmt.Errorf("failed to reopen %s: %w", name, err)
+	}
+	if settingsErr != nil {
+		return "", fmt.Errorf("failed to add analyzers to %s: %w", name, settingsErr)
+	}
+
+	// The new fields are added under the old version, which the index keeps
+	// until they are filled.
+	mapping := eventIndexMapping()
+	mapping["_meta"] = map[string]any{"mapping_version": meta.MappingVersion}
+	if err := c.callJSON(ctx, http.MethodPut, path+"/_mapping", mapping, nil); err != nil {
+		return "", fmt.Errorf("failed to update the mapping of %s: %w", name, err)
+	}
+	return "", c.startMigrationTask(ctx, name, meta.MappingVersion)
+}
+
+// startMigrationTask updates every event of an index in place in the
+// background, which fills new subfields, and records the task in the index's
+// _meta.
+func (c *ElasticsearchClient) startMigrationTask(ctx context.Context, name string, version int) error {
+	path := "/" + url.PathEscape(name)
+	var task struct {
+		Task string `json:"task"`
+	}
+	if err := c.callJSON(ctx, http.MethodPost, path+"/_update_by_query?conflicts=proceed&wait_for_completion=false", nil, &task); err != nil {
+		return fmt.Errorf("failed to start updating %s: %w", name, err)
+	}
+	recorded := map[string]any{"_meta": map[string]any{"mapping_version": version, "migration_task": task.Task}}
+	if err := c.callJSON(ctx, http.MethodPut, path+"/_mapping", recorded, nil); err != nil {
+		return fmt.Errorf("failed to record task %s on %s: %w", task.Task, name, err)
+	}
+	log.Printf("Filling new fields of %s for mapping version %d in task %s", name, searchMappingVersion, task.Task)
+	return nil
+}
+
+type migrationTaskStatus struct {
+	Completed bool           `json:"completed"`
+	Error     map[string]any `json:"error"`
+	Response  struct {
+		Failures []json.RawMessage `json:"failures"`
+	} `json:"response"`
+}
+
+// succeeded reports whether a completed task updated every event.
+func (s *migrationTaskStatus) succeeded() bool {
+	return s.Completed && s.Error == nil && len(s.Response.Failures) == 0
+}
+
+// migrationTask returns the status of a task, or nil when it is not known
+// any more, as when its node restarted before it completed.
+func (c *ElasticsearchClient) migrationTask(ctx context.Context, task string) (*migrationTaskStatus, error) {
+	var status migrationTaskStatus
+	err := c.callJSON(ctx, http.MethodGet, "/_tasks/"+url.PathEscape(task), nil, &status)
+	if isElasticsearchNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check task %s: %w", task, err)
+	}
+	return &status, nil
+}
+
+// indexMappingMeta is what the _meta of an index mapping records.
+type indexMappingMeta struct {
+	// MappingVersion is 0 for indices from before versions were recorded.
+	MappingVersion int `json:"mapping_version"`
+	// MigrationTask is the task filling the fields an older version lacked.
+	MigrationTask string `json:"migration_task"`
+}
+
+// mappingMetas returns the mapping _meta of every index behind the read
+// alias.
+func (c *ElasticsearchClient) mappingMetas(ctx context.Context) (map[string]indexMappingMeta, error) {
+	var result map[string]struct {
+		Mappings struct {
+			Meta indexMappingMeta `json:"_meta"`
+		} `json:"mappings"`
+	}
+	err := c.callJSON(ctx, http.MethodGet, "/"+c.readAlias+"/_mapping", nil, &result)
+	if isElasticsearchNotFound(err) {
+		return map[string]indexMappingMeta{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	metas := make(map[string]indexMappingMeta, len(result))
+	for name, index := range result {
+		metas[name] = index.Mappings.Meta
+	}
+	return metas, nil
+}
+
+// bootstrapIndexName uses date math, which rollover evaluates again, so every
+// backing index is named after the day or month it was created.
+func (c *ElasticsearchClient) bootstrapIndexName() string {
+	if c.period == IndexPeriodMonthly {
+		return "<" + c.index + "-{now/M{yyyy.MM}}-000001>"
+	}
+	return "<" + c.index + "-{now/d}-000001>"
+}
+
+// rollover rolls the write alias over once the write index is old or large
+// enough, or at once when force is set.
+func (c *ElasticsearchClient) rollover(ctx context.Context, force bool) (string, error) {
+	conditions := map[string]any{"max_age": fmt.Sprintf("%ds", int64(c.rolloverMaxAge.Seconds()))}
+	if c.rolloverMaxSize != "" {
+		conditions["max_size"] = c.rolloverMaxSize
+	}
+	var body any = map[string]any{"conditions": conditions}
+	if force {
+		body = nil
+	}
+
+	var result struct {
+		RolledOver bool   `json:"rolled_over"`
+		NewIndex   string `json:"new_index"`
+	}
+	if err := c.callJSON(ctx, http.MethodPost, "/"+c.writeAlias+"/_rollover", body, &result); err != nil {
+		return "", fmt.Errorf("rollover failed: %w", err)
+	}
+	if !result.RolledOver {
+		return "", nil
+	}
+	return result.NewIndex, nil
+}
+
+func (c *ElasticsearchClient) refreshCatalog(ctx context.Context) error {
+	writeIndices, err := c.aliasIndices(ctx, c.writeAlias)
+	if err != nil {
+		return err
+	}
+	write := ""
+	for name, isWrite := range writeIndices {
+		if isWrite || len(writeIndices) == 1 {
+			write = name
+		}
+	}
+
+	request := map[string]any{
+		"size": 0,
+		"aggs": map[string]any{
+			"indices": map[string]any{
+				"terms": map[string]any{"field": "_index", "size": 10000},
+				"aggs": map[string]any{
+					"min_time": map[string]any{"min": map[string]any{"field": "timestamp"}},
+					"max_time": map[string]any{"max": map[string]any{"field": "timestamp"}},
+				},
+			},
+		},
+	}
+	var result struct {
+		Aggregations struct {
+			Indices struct {
+				Buckets []struct {
+					Key     string `json:"key"`
+					MinTime struct {
+						Value *float64 `json:"value"`
+					} `json:"min_time"`
+					MaxTime struct {
+						Value *float64 `json:"value"`
+					} `json:"max_time"`
+				} `json:"buckets"`
+			} `json:"indices"`
+		} `json:"aggregations"`
+	}
+	if err := c.callJSON(ctx, http.MethodPost, "/"+c.readAlias+"/_search?ignore_unavailable=true", request, &result); err != nil {
+		return fmt.Errorf("failed to list search indices: %w", err)
+	}
+
+	indices := make([]searchIndex, 0, len(result.Aggregations.Indices.Buckets))
+	for _, bucket := range result.Aggregations.Indices.Buckets {
+		if bucket.MinTime.Value == nil || bucket.MaxTime.Value == nil {
+			continue
+		}
+		indices = append(indices, searchIndex{
+			Name:    bucket.Key,
+			MinTime: time.UnixMilli(int64(*bucket.MinTime.Value)).UTC(),
+			MaxTime: time.UnixMilli(int64(*bucket.MaxTime.Value)).UTC(),
+		})
+	}
+
+	c.catalog.mu.Lock()
+	defer c.catalog.mu.Unlock()
+	c.catalog.loaded = true
+	c.catalog.write = write
+	c.catalog.indices = indices
+	return nil
+}
+
+func (c *ElasticsearchClient) deleteExpiredIndices(ctx context.Context, now time.Time) ([]string, error) {
+	if c.retention <= 0 {
+		return nil, nil
+	}
+	cutoff := now.Add(-c.retention)
+
+	c.catalog.mu.RLock()
+	var expired []string
+	for _, index := range c.catalog.indices {
+		if index.Name != c.catalog.write && index.MaxTime.Before(cutoff) {
+			expired = append(expired, index.Name)
+		}
+	}
+	c.catalog.mu.RUnlock()
+
+	var deleted []string
+	for _, name := range expired {
+		if err := c.callJSON(ctx, http.MethodDelete, "/"+name, nil, nil); err != nil && !isElasticsearchNotFound(err) {
+			return deleted, fmt.Errorf("failed to delete %s: %w", name, err)
+		}
+		log.Printf("Deleted search index %s past its retention", name)
+		deleted = append(deleted, name)
+	}
+
+	if len(deleted) > 0 {
+		c.catalog.mu.Lock()
+		c.catalog.indices = slices.DeleteFunc(c.catalog.indices, func(index searchIndex) bool {
+			return slices.Contains(deleted, index.Name)
+		})
+		c.catalog.mu.Unlock()
+	}
+	return deleted, nil
+}
+
+// prunedIndices are the backing indices a search of a time range can skip:
+// those the catalog knows to hold only events outside it. The write index in
+// the catalog is never skipped, since it may still be growing.
+//
+// Searches go through the read alias and only leave these out, so the
+// catalog being behind costs pruning rather than results: an index it does
+// not know yet, like one another instance rolled over to, is searched, and
+// one taken out of the read alias is not.
+func (c *ElasticsearchClient) prunedIndices(from, to *time.Time) []string {
+	c.catalog.mu.RLock()
+	defer c.catalog.mu.RUnlock()
+
+	if !c.catalog.loaded || c.catalog.write == "" || (from == nil && to == nil) {
+		return nil
+	}
+
+	var pruned []string
+	for _, index := range c.catalog.indices {
+		if index.Name == c.catalog.write {
+			continue
+		}
+		if (from != nil && index.MaxTime.Before(*from)) || (to != nil && index.MinTime.After(*to)) {
+			pruned = append(pruned, index.Name)
+		}
+	}
+	return pruned
+}
+
+// pruneQuery leaves the pruned indices out of a query on the read alias.
+// Elasticsearch rewrites the _index filter per shard, so their shards are
+// skipped before the query runs on them.
+func (c *ElasticsearchClient) pruneQuery(query any, from, to *time.Time) any {
+	pruned := c.prunedIndices(from, to)
+	if len(pruned) == 0 {
+		return query
+	}
+	return map[string]any{"bool": map[string]any{
+		"must":     []any{query},
+		"must_not": []any{map[string]any{"terms": map[string]any{"_index": pruned}}},
+	}}
+}
+
+// aliasIndices returns the indices behind an alias and whether each is its
+// write index.
+func (c *ElasticsearchClient) aliasIndices(ctx context.Context, alias string) (map[string]bool, error) {
+	var result map[string]struct {
+		Aliases map[string]struct {
+			IsWriteIndex bool `json:"is_write_index"`
+		} `json:"aliases"`
+	}
+	err := c.callJSON(ctx, http.MethodGet, "/_alias/"+alias, nil, &result)
+	if isElasticsearchNotFound(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	indices := make(map[string]bool, len(result))
+	for name, index := range result {
+		indices[name] = index.Aliases[alias].IsWriteIndex
+	}
+	return indices, nil
+}
+
+type elasticsearchStatusError struct {
+	status int
+	body   string
+}
+
+func (e *elasticsearchStatusError) Error() string {
+	return fmt.Sprintf("elasticsearch returned %d: %s", e.status, e.body)
+}
+
+func isElasticsearchNotFound(err error) bool {
+	statusErr, ok := err.(*elasticsearchStatusError)
+	return ok && statusErr.status == http.StatusNotFound
+}
+
+// callJSON sends body as JSON and decodes a successful response into out.
+func (c *ElasticsearchClient) callJSON(ctx context.Context, method, path string, body, out any) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+
+	resp, err := c.doRequest(ctx, method, path, payload, map[string]string{
+		"Content-Type": "application/json",
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return &elasticsearchStatusError{status: resp.StatusCode, body: strings.TrimSpace(string(data))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// eventIndexSettings defines the analyzers of the prefix subfields. Every
+// prefix of a whole value, lowercased, is indexed, and a search is matched
+// against them as one lowercased token.
+func eventIndexSettings() map[string]any {
+	return map[string]any{
+		"analysis": map[string]any{
+			"filter": map[string]any{
+				"event_prefix_edge": map[string]any{"type": "edge_ngram", "min_gram": 1, "max_gram": suggestPrefixLength},
+			},
+			"analyzer": map[string]any{
+				"event_prefix": map[string]any{
+					"type":      "custom",
+					"tokenizer": "keyword",
+					"filter":    []string{"lowercase", "event_prefix_edge"},
+				},
+				"event_prefix_search": map[string]any{
+					"type":      "custom",
+					"tokenizer": "keyword",
+					"filter":    []string{"lowercase"},
+				},
+			},
+		},
+	}
+}
+
+func eventIndexMapping() map[string]any {
+	textWithKeyword := func() map[string]any {
+		return map[string]any{
+			"type": "text",
+			"fields": map[string]any{
+				"keyword": map[string]any{"type": "keyword"},
+				"prefix": map[string]any{
+					"type":            "text",
+					"analyzer":        "event_prefix",
+					"search_analyzer": "event_prefix_search",
+				},
+			},
+		}
+	}
+
+	return map[string]any{
+		"_meta": map[string]any{"mapping_version": searchMappingVersion},
+		"properties": map[string]any{
+			"id":        map[string]any{"type": "long"},
+			"user_id":   textWithKeyword(),
+			"action":    textWithKeyword(),
+			"element":   textWithKeyword(),
+			"duration":  map[string]any{"type": "float"},
+			"timestamp": map[string]any{"type": "date"},
+		},
+	}
+}
@@ -0,0 +1,267 @@
+package database
+
+import (
+	"analytics-backend/models"
+	"analytics-backend/searchql"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PostgresSearch searches the events table itself. Text queries match
+// tsvector columns generated from user_id, action and element, so nothing
+// has to be indexed separately.
+type PostgresSearch struct{}
+
+func (PostgresSearch) Name() string {
+	return SearchSourcePostgres
+}
+
+func (PostgresSearch) SearchEvents(ctx context.Context, params SearchEventsParams) (*SearchEventsResponse, error) {
+	return searchEventsPostgres(ctx, params)
+}
+
+// IndexEvents does nothing; the tsvector columns are kept up to date by
+// Postgres.
+func (PostgresSearch) IndexEvents(ctx context.Context, events []models.Event) error {
+	return nil
+}
+
+// DeleteEvents does nothing; the events are deleted from the table itself.
+func (PostgresSearch) DeleteEvents(ctx context.Context, r EventRange) error {
+	return nil
+}
+
+// EnsurePostgresSearch adds the tsvector columns and their GIN indexes to
+// the events table. Adding a column rewrites the table, so on a large one the
+// first start with the Postgres search backend takes a while and holds up
+// writes until it is done. The statements run on one connection without the
+// statement timeout, which would otherwise cancel them, and the indexes are
+// built concurrently so they do not block writes once the columns exist.
+func EnsurePostgresSearch(ctx context.Context) error {
+	err := DB.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SET statement_timeout = 0").Error; err != nil {
+			return err
+		}
+		defer conn.Exec("RESET statement_timeout")
+
+		for _, field := range searchql.TextFields {
+			column := searchql.TextSearchColumn(field)
+			index := "idx_events_" + column
+			if err := conn.Exec(fmt.Sprintf(`ALTER TABLE events ADD COLUMN IF NOT EXISTS %s tsvector
+				GENERATED ALWAYS AS (to_tsvector('%s', coalesce(%s, ''))) STORED`, column, searchql.TextSearchConfig, field)).Error; err != nil {
+				return fmt.Errorf("failed to add %s to events: %w", column, err)
+			}
+			// A concurrent build that was interrupted leaves an invalid index
+			// behind, which IF NOT EXISTS would keep.
+			if err := dropInvalidIndex(conn, index); err != nil {
+				return err
+			}
+			if err := conn.Exec(fmt.Sprintf("CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON events USING GIN (%s)", index, column)).Error; err != nil {
+				return fmt.Errorf("failed to index %s: %w", column, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("Postgres full-text search columns are ready")
+	return nil
+}
+
+func dropInvalidIndex(conn *gorm.DB, index string) error {
+	var invalid int64
+	err := conn.Raw(`SELECT count(*) FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE c.relname = ? AND NOT i.indisvalid`, index).Scan(&invalid).Error
+	if err != nil {
+		return fmt.Errorf("failed to check %s: %w", index, err)
+	}
+	if invalid == 0 {
+		return nil
+	}
+	log.Printf("Rebuilding invalid index %s", index)
+	if err := conn.Exec("DROP INDEX CONCURRENTLY IF EXISTS " + index).Error; err != nil {
+		return fmt.Errorf("failed to drop invalid index %s: %w", index, err)
+	}
+	return nil
+}
+
+// postgresTextFilter is the condition for a search's q. A plain q is read as
+// a web search, so all its words must match and quoted phrases and -words
+// work as they do in search engines.
+func postgresTextFilter(query string) (string, []any, error) {
+	if query == "" {
+		return "", nil, nil
+	}
+	if searchql.IsQuery(query) {
+		node, err := searchql.Parse(query)
+		if err != nil {
+			return "", nil, err
+		}
+		where, args := searchql.CompileSQL(node)
+		return where, args, nil
+	}
+
+	where, args := searchql.TextSearchSQL("websearch_to_tsquery", query)
+	if id, err := strconv.ParseInt(query, 10, 64); err == nil {
+		where = "(" + where + " OR id = ?)"
+		args = append(args, id)
+	}
+	return where, args, nil
+}
+
+func searchEventsPostgres(ctx context.Context, params SearchEventsParams) (response *SearchEventsResponse, err error) {
+	started := time.Now()
+	defer func() {
+		observeDBOperation("postgres", "search", "events", started, err)
+	}()
+
+	pageWhere, pageArgs, size, err := searchPage(params)
+	if err != nil {
+		return nil, err
+	}
+	where, args := structuredSearchFilters(params)
+	textWhere, textArgs, err := postgresTextFilter(params.Query)
+	if err != nil {
+		return nil, err
+	}
+	if textWhere != "" {
+		pageWhere += " AND " + textWhere
+		pageArgs = append(pageArgs, textArgs...)
+		where += " AND " + textWhere
+		args = append(args, textArgs...)
+	}
+
+	response = &SearchEventsResponse{Items: []models.Event{}, Source: SearchSourcePostgres}
+	err = postgresBackend.retry(ctx, func(ctx context.Context) error {
+		response.Items = response.Items[:0]
+		err := DB.WithContext(ctx).
+			Where(pageWhere, pageArgs...).
+			Order(searchOrderBy(params)).
+			Limit(size).
+			Find(&response.Items).Error
+		if err != nil {
+			return err
+		}
+		if err := DB.WithContext(ctx).Table("events").Where(where, args...).Count(&response.Total).Error; err != nil {
+			return err
+		}
+		response.Facets, err = postgresFacets(ctx, params, where, args)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response.NextCursor = nextSearchCursor(response, size)
+	response.TookMS = int(time.Since(started).Milliseconds())
+	return response, nil
+}
+
+// postgresFacets computes the facets asked for over every matching event,
+// like the Elasticsearch aggregations.
+func postgresFacets(ctx context.Context, params SearchEventsParams, where string, args []any) (*SearchFacets, error) {
+	if len(params.Facets) == 0 {
+		return nil, nil
+	}
+
+	facets := &SearchFacets{}
+	size := clampFacetSize(params.FacetSize)
+	for _, facet := range params.Facets {
+		var err error
+		switch facet {
+		case FacetAction:
+			facets.Action, err = postgresTermsFacet(ctx, "action", where, args, size)
+		case FacetElement:
+			facets.Element, err = postgresTermsFacet(ctx, "element", where, args, size)
+		case FacetUserID:
+			facets.UserID, err = postgresTermsFacet(ctx, "user_id", where, args, size)
+		case FacetHistogram:
+			facets.Histogram, err = postgresHistogram(ctx, where, args)
+		case FacetDuration:
+			facets.Duration = &DurationFacets{}
+			err = DB.WithContext(ctx).Table("events").Where(where, args...).
+				Select("COUNT(duration) AS count, MIN(duration) AS min, MAX(duration) AS max, AVG(duration) AS avg, COALESCE(SUM(duration), 0) AS sum").
+				Scan(facets.Duration).Error
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute %s facet: %w", facet, err)
+		}
+	}
+	return facets, nil
+}
+
+func postgresTermsFacet(ctx context.Context, column, where string, args []any, size int) ([]FacetBucket, error) {
+	buckets := []FacetBucket{}
+	err := DB.WithContext(ctx).Table("events").Where(where, args...).
+		Select(column + " AS value, COUNT(*) AS count").
+		Group(column).
+		Order("count DESC").Order("value").
+		Limit(size).
+		Scan(&buckets).Error
+	return buckets, err
+}
+
+// histogramIntervals are tried in order until the matching events fit in
+// histogramBuckets of them, like auto_date_histogram.
+var histogramIntervals = []struct {
+	name   string
+	unit   string
+	length time.Duration
+}{
+	{"1h", "hour", time.Hour},
+	{"1d", "day", 24 * time.Hour},
+	{"7d", "week", 7 * 24 * time.Hour},
+	{"1M", "month", 31 * 24 * time.Hour},
+	{"1y", "year", 366 * 24 * time.Hour},
+}
+
+const histogramBuckets = 30
+
+func histogramInterval(span time.Duration) (name, unit string) {
+	for _, interval := range histogramIntervals {
+		if span < interval.length*histogramBuckets {
+			return interval.name, interval.unit
+		}
+	}
+	last := histogramIntervals[len(histogramIntervals)-1]
+	return last.name, last.unit
+}
+
+func postgresHistogram(ctx context.Context, where string, args []any) (*DateHistogram, error) {
+	var bounds struct {
+		Oldest *time.Time
+		Newest *time.Time
+	}
+	err := DB.WithContext(ctx).Table("events").Where(where, args...).
+		Select("MIN(timestamp) AS oldest, MAX(timestamp) AS newest").
+		Scan(&bounds).Error
+	if err != nil {
+		return nil, err
+	}
+	histogram := &DateHistogram{Interval: histogramIntervals[0].name, Buckets: []HistogramBucket{}}
+	if bounds.Oldest == nil {
+		return histogram, nil
+	}
+
+	var unit string
+	histogram.Interval, unit = histogramInterval(bounds.Newest.Sub(*bounds.Oldest))
+	var rows []struct {
+		Start time.Time
+		Count int64
+	}
+	err = DB.WithContext(ctx).Table("events").Where(where, args...).
+		Select(fmt.Sprintf("date_trunc('%s', timestamp AT TIME ZONE 'UTC') AS start, COUNT(*) AS count", unit)).
+		Group("start").
+		Order("start").
+		Scan(&rows).Error
+	for _, row := range rows {
+		histogram.Buckets = append(histogram.Buckets, HistogramBucket{Start: row.Start.UTC(), Count: row.Count})
+	}
+	return histogram, err
+}
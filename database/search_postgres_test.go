@@ -0,0 +1,54 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostgresTextFilter(t *testing.T) {
+	where, args, err := postgresTextFilter("42")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(where, "websearch_to_tsquery('simple', ?)") || !strings.HasSuffix(where, " OR id = ?)") {
+		t.Fatalf("expected a web search of the text columns or the id, got %q", where)
+	}
+	if len(args) != 4 || args[0] != "42" || args[3] != int64(42) {
+		t.Fatalf("unexpected args %#v", args)
+	}
+
+	where, args, err = postgresTextFilter("action:click element:signup*")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if where != `(action = ? AND element LIKE ? ESCAPE '\')` || len(args) != 2 || args[1] != "signup%" {
+		t.Fatalf("expected the query language to be compiled, got %q %#v", where, args)
+	}
+
+	if _, _, err := postgresTextFilter("action:(click"); err == nil {
+		t.Fatal("expected an invalid query to be rejected")
+	}
+	if where, _, _ := postgresTextFilter(""); where != "" {
+		t.Fatalf("expected no condition without a query, got %q", where)
+	}
+}
+
+func TestHistogramIntervalFitsThirtyBuckets(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		span time.Duration
+		want string
+	}{
+		{10 * time.Hour, "1h"},
+		{3 * day, "1d"},
+		{60 * day, "7d"},
+		{2 * 365 * day, "1M"},
+		{40 * 365 * day, "1y"},
+	}
+	for _, test := range tests {
+		if got, _ := histogramInterval(test.span); got != test.want {
+			t.Errorf("histogramInterval(%s) = %s, want %s", test.span, got, test.want)
+		}
+	}
+}
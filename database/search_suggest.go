@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SuggestFields are the fields values can be suggested for.
+var SuggestFields = []string{FacetAction, FacetElement, FacetUserID}
+
+type SearchSuggestions struct {
+	Field       string        `json:"field"`
+	Prefix      string        `json:"prefix"`
+	Suggestions []FacetBucket `json:"suggestions"`
+	TookMS      int           `json:"took_ms"`
+}
+
+// SuggestSearchValues returns the most common values of field that start with
+// prefix, ignoring case, with their event counts.
+func SuggestSearchValues(ctx context.Context, field, prefix string, size int) (*SearchSuggestions, error) {
+	if ES == nil {
+		return nil, fmt.Errorf("elasticsearch client not initialized")
+	}
+	return ES.suggestValues(ctx, field, prefix, size)
+}
+
+func (c *ElasticsearchClient) suggestValues(ctx context.Context, field, prefix string, size int) (suggestions *SearchSuggestions, err error) {
+	started := time.Now()
+	defer func() {
+		observeDBOperation("elasticsearch", "suggest", c.index, started, err)
+	}()
+
+	var result struct {
+		Took         int `json:"took"`
+		Aggregations struct {
+			Values termsAggregation `json:"values"`
+		} `json:"aggregations"`
+	}
+	err = c.callJSON(ctx, http.MethodPost, "/"+c.readAlias+"/_search?ignore_unavailable=true&request_cache=true", buildSuggestRequest(field, prefix, size), &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SearchSuggestions{
+		Field:       field,
+		Prefix:      prefix,
+		Suggestions: result.Aggregations.Values.buckets(),
+		TookMS:      result.Took,
+	}, nil
+}
+
+func buildSuggestRequest(field, prefix string, size int) map[string]any {
+	var query any = map[string]any{"match_all": map[string]any{}}
+	if runes := []rune(prefix); len(runes) > suggestPrefixLength {
+		// Longer prefixes are not indexed, so the events are found by their
+		// first suggestPrefixLength runes and then narrowed to the values
+		// starting with the whole prefix.
+		query = map[string]any{"bool": map[string]any{
+			"must": map[string]any{"match": map[string]any{field + ".prefix": map[string]any{"query": string(runes[:suggestPrefixLength])}}},
+			"filter": map[string]any{"prefix": map[string]any{field + ".keyword": map[string]any{
+				"value":            prefix,
+				"case_insensitive": true,
+			}}},
+		}}
+	} else if prefix != "" {
+		query = map[string]any{"match": map[string]any{field + ".prefix": map[string]any{"query": prefix}}}
+	}
+
+	return map[string]any{
+		"size":  0,
+		"query": query,
+		"aggs": map[string]any{
+			"values": map[string]any{"terms": map[string]any{"field": field + ".keyword", "size": size}},
+		},
+	}
+}
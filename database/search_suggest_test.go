@@ -0,0 +1,176 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuildSuggestRequestMatchesPrefixSubfield(t *testing.T) {
+	request := buildSuggestRequest(FacetElement, "Checkout", 5)
+	match := request["query"].(map[string]any)["match"].(map[string]any)
+	if query := match["element.prefix"].(map[string]any)["query"]; query != "Checkout" {
+		t.Fatalf("expected the prefix subfield to be matched, got %v", query)
+	}
+
+	long := strings.Repeat("a", suggestPrefixLength+5)
+	request = buildSuggestRequest(FacetElement, long, 5)
+	query := request["query"].(map[string]any)["bool"].(map[string]any)
+	match = query["must"].(map[string]any)["match"].(map[string]any)
+	if cut := match["element.prefix"].(map[string]any)["query"].(string); len(cut) != suggestPrefixLength {
+		t.Fatalf("expected the indexed prefix to be cut to %d characters, got %d", suggestPrefixLength, len(cut))
+	}
+	filter := query["filter"].(map[string]any)["prefix"].(map[string]any)["element.keyword"].(map[string]any)
+	if filter["value"] != long || filter["case_insensitive"] != true {
+		t.Fatalf("expected the values to be narrowed to the whole prefix, got %v", filter)
+	}
+
+	terms := request["aggs"].(map[string]any)["values"].(map[string]any)["terms"].(map[string]any)
+	if terms["field"] != "element.keyword" || terms["size"] != 5 {
+		t.Fatalf("unexpected terms aggregation %#v", terms)
+	}
+
+	if _, ok := buildSuggestRequest(FacetAction, "", 5)["query"].(map[string]any)["match_all"]; !ok {
+		t.Fatal("expected an empty prefix to suggest the most common values")
+	}
+}
+
+func TestMigrateOldIndexStartsUpdatingOneOutdatedIndex(t *testing.T) {
+	var calls []string
+	var metas []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/events-search-read/_mapping":
+			fmt.Fprintf(w, `{
+				"events-search-2026.05.01-000001": {"mappings": {}},
+				"events-search-2026.05.02-000002": {"mappings": {"_meta": {"mapping_version": %d}}},
+				"events-search-2026.05.03-000003": {"mappings": {}}
+			}`, searchMappingVersion)
+		case "/_alias/events-search-write":
+			fmt.Fprint(w, `{"events-search-2026.05.03-000003": {"aliases": {"events-search-write": {"is_write_index": true}}}}`)
+		case "/events-search-2026.05.01-000001/_mapping":
+			var mapping map[string]any
+			json.NewDecoder(r.Body).Decode(&mapping)
+			metas = append(metas, mapping["_meta"].(map[string]any))
+			fmt.Fprint(w, `{}`)
+		case "/events-search-2026.05.01-000001/_update_by_query":
+			fmt.Fprint(w, `{"task": "node:1"}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	client := &ElasticsearchClient{baseURL: server.URL, index: "events-search", readAlias: "events-search-read", writeAlias: "events-search-write", httpClient: server.Client()}
+
+	migrated, err := client.migrateOldIndex(context.Background())
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if migrated != "" {
+		t.Fatalf("expected the index to count as migrated only once its task completes, got %q", migrated)
+	}
+
+	want := []string{
+		"POST /events-search-2026.05.01-000001/_close",
+		"PUT /events-search-2026.05.01-000001/_settings",
+		"POST /events-search-2026.05.01-000001/_open",
+		"PUT /events-search-2026.05.01-000001/_mapping",
+		"POST /events-search-2026.05.01-000001/_update_by_query",
+		"PUT /events-search-2026.05.01-000001/_mapping",
+	}
+	if got := calls[2:]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("unexpected migration steps\n got %v\nwant %v", got, want)
+	}
+	if len(metas) != 2 || metas[0]["mapping_version"] != float64(0) || metas[1]["migration_task"] != "node:1" {
+		t.Fatalf("expected the old version to be kept with the task recorded, got %v", metas)
+	}
+}
+
+func TestMigrateOldIndexWaitsForItsTaskBeforeBumpingTheVersion(t *testing.T) {
+	const old = "events-search-2026.10.01-000001"
+	cases := []struct {
+		name     string
+		meta     string
+		task     int
+		taskBody string
+		migrated string
+		requests []string
+	}{
+		{
+			name:     "running",
+			meta:     `{"mapping_version":1,"migration_task":"node:1"}`,
+			task:     200,
+			taskBody: `{"completed":false}`,
+		},
+		{
+			name:     "failed",
+			meta:     `{"mapping_version":1,"migration_task":"node:1"}`,
+			task:     200,
+			taskBody: `{"completed":true,"response":{"failures":[{"id":"7"}]}}`,
+			requests: []string{"POST /" + old + "/_update_by_query", "PUT /" + old + "/_mapping v1 node:2"},
+		},
+		{
+			name:     "lost with its node",
+			meta:     `{"mapping_version":1,"migration_task":"node:1"}`,
+			task:     404,
+			requests: []string{"POST /" + old + "/_update_by_query", "PUT /" + old + "/_mapping v1 node:2"},
+		},
+		{
+			name:     "completed",
+			meta:     `{"mapping_version":1,"migration_task":"node:1"}`,
+			task:     200,
+			taskBody: `{"completed":true,"response":{"failures":[]}}`,
+			migrated: old,
+			requests: []string{"PUT /" + old + "/_mapping v2"},
+		},
+	}
+
+	for _, c := range cases {
+		var requests []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/events-search-read/_mapping":
+				fmt.Fprintf(w, `{%q:{"mappings":{"_meta":%s}}}`, old, c.meta)
+			case r.URL.Path == "/_alias/events-search-write":
+				fmt.Fprint(w, `{"events-search-2026.10.18-000001":{"aliases":{"events-search-write":{"is_write_index":true}}}}`)
+			case r.URL.Path == "/_tasks/node:1":
+				w.WriteHeader(c.task)
+				fmt.Fprint(w, c.taskBody)
+			case strings.HasSuffix(r.URL.Path, "/_update_by_query"):
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				fmt.Fprint(w, `{"task":"node:2"}`)
+			case strings.HasSuffix(r.URL.Path, "/_mapping"):
+				var mapping struct {
+					Meta indexMappingMeta `json:"_meta"`
+				}
+				json.NewDecoder(r.Body).Decode(&mapping)
+				request := fmt.Sprintf("%s %s v%d", r.Method, r.URL.Path, mapping.Meta.MappingVersion)
+				if mapping.Meta.MigrationTask != "" {
+					request += " " + mapping.Meta.MigrationTask
+				}
+				requests = append(requests, request)
+				fmt.Fprint(w, `{}`)
+			default:
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				fmt.Fprint(w, `{}`)
+			}
+		}))
+
+		client := &ElasticsearchClient{baseURL: server.URL, index: "events-search", readAlias: "events-search-read", writeAlias: "events-search-write", httpClient: server.Client()}
+		migrated, err := client.migrateOldIndex(context.Background())
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if migrated != c.migrated || strings.Join(requests, ", ") != strings.Join(c.requests, ", ") {
+			t.Errorf("%s: expected %q after %v, got %q after %v", c.name, c.migrated, c.requests, migrated, requests)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/metrics"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	shardCount = 0
+	ShardLease = 30 * time.Second
+)
+
+const (
+	shardLeaseKeyPrefix   = "shard-lease:"
+	shardMembersKeyPrefix = "shard-members:"
+	shardClaimBatch       = int64(1000)
+)
+
+// Renewing or releasing a lease only succeeds for its current holder, so a
+// worker whose lease already moved on cannot take it back.
+var renewShardLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseShardLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// ConfigureSharding replaces the events stream with shards that events are
+// routed to by user. Shard 0 keeps the events stream, so turning sharding on
+// does not strand what is already queued. It must run after ConfigureLanes.
+func ConfigureSharding(cfg config.ShardingConfig) error {
+	if cfg.Shards <= 0 {
+		return nil
+	}
+	if len(lanes) > 1 {
+		return fmt.Errorf("sharding cannot be combined with lanes")
+	}
+	if cfg.Lease > 0 {
+		ShardLease = cfg.Lease
+	}
+
+	shards := make([]Lane, 0, cfg.Shards)
+	for i := 0; i < cfg.Shards; i++ {
+		stream := StreamName
+		if i > 0 {
+			stream = fmt.Sprintf("%s:shard:%d", StreamName, i)
+		}
+		shards = append(shards, Lane{Name: fmt.Sprintf("shard-%d", i), Stream: stream, Weight: 1})
+	}
+
+	lanes = shards
+	defaultLane = 0
+	shardCount = cfg.Shards
+	log.Printf("Sharding events by user across %d streams", shardCount)
+	return nil
+}
+
+func Sharded() bool {
+	return shardCount > 0
+}
+
+// shardFor returns the index of the shard a user's events go to.
+func shardFor(userID string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(userID))
+	return int(hash.Sum32() % uint32(shardCount))
+}
+
+// ShardReader reads only the shards this consumer holds a lease on. Every
+// ShardLease/3, whether it is reading new or pending messages, it renews its
+// leases and rebalances: a consumer holding more than its fair share of the
+// live consumers releases the extra shards, and one holding fewer takes free
+// ones. A shard taken over starts with the messages its previous owner left
+// unacknowledged, so its order is kept.
+type ShardReader struct {
+	group     string
+	consumer  string
+	count     int64
+	operation string
+	leases    shardLeases
+
+	owned      []string
+	claimed    []string
+	buffered   []redis.XStream
+	rebalanced time.Time
+}
+
+func NewShardReader(group, consumer string, count int64, operation string) *ShardReader {
+	return &ShardReader{group: group, consumer: consumer, count: count, operation: operation, leases: redisShardLeases{}}
+}
+
+func (r *ShardReader) Read() (string, []redis.XMessage, error) {
+	if err := r.rebalanceIfDue(Ctx); err != nil {
+		return lanes[defaultLane].Stream, nil, err
+	}
+
+	stream, messages, err := r.drainClaimed(Ctx)
+	if err != nil || len(messages) > 0 {
+		return stream, messages, err
+	}
+
+	if len(r.buffered) > 0 {
+		next := r.buffered[0]
+		r.buffered = r.buffered[1:]
+		return next.Stream, next.Messages, nil
+	}
+
+	readable := r.readable()
+	if len(readable) == 0 {
+		time.Sleep(BlockTimeMs)
+		return lanes[defaultLane].Stream, nil, nil
+	}
+
+	results, err := readGroupStreams(r.group, r.consumer, readable, r.count, r.operation)
+	if err != nil || len(results) == 0 {
+		return readable[0], nil, err
+	}
+	r.buffered = results[1:]
+	return results[0].Stream, results[0].Messages, nil
+}
+
+// readable is the owned shards new messages can be read from: those not
+// still waiting on their previous owner's pending messages.
+func (r *ShardReader) readable() []string {
+	return slices.DeleteFunc(slices.Clone(r.owned), func(s string) bool { return slices.Contains(r.claimed, s) })
+}
+
+// drainClaimed returns what the previous owners of the shards picked up left
+// pending. Their messages are only claimed once idle for a whole lease, so
+// one still being handled by a consumer that just lost the shard is not
+// handled twice. Nothing new is read from a shard until it is drained.
+func (r *ShardReader) drainClaimed(ctx context.Context) (string, []redis.XMessage, error) {
+	for i := 0; i < len(r.claimed); {
+		stream := r.claimed[i]
+		if err := r.leases.claim(ctx, stream, r.group, r.consumer); err != nil {
+			return stream, nil, err
+		}
+		messages, err := ReadPendingStreamGroup(stream, r.group, r.consumer, "0", r.count, r.operation)
+		if err != nil || len(messages) > 0 {
+			return stream, messages, err
+		}
+		elsewhere, err := r.leases.pendingElsewhere(ctx, stream, r.group, r.consumer)
+		if err != nil {
+			return stream, nil, err
+		}
+		if elsewhere > 0 {
+			i++
+			continue
+		}
+		r.claimed = slices.Delete(r.claimed, i, i+1)
+	}
+	return lanes[defaultLane].Stream, nil, nil
+}
+
+// ReadPending returns unacknowledged messages of this consumer from the first
+// owned shard that has any.
+func (r *ShardReader) ReadPending() (string, []redis.XMessage, error) {
+	r.buffered = nil
+	if err := r.rebalanceIfDue(Ctx); err != nil {
+		return lanes[defaultLane].Stream, nil, err
+	}
+	for _, stream := range r.owned {
+		messages, err := ReadPendingStreamGroup(stream, r.group, r.consumer, "0", r.count, r.operation)
+		if err != nil || len(messages) > 0 {
+			return stream, messages, err
+		}
+	}
+	return lanes[defaultLane].Stream, nil, nil
+}
+
+// Holds reports whether this consumer still holds the lease on stream,
+// renewing it if so. A batch is only committed while its shard is held, so a
+// consumer that lost the shard leaves the batch to the new owner.
+func (r *ShardReader) Holds(stream string) (bool, error) {
+	if !slices.Contains(r.owned, stream) {
+		return false, nil
+	}
+	renewed, err := r.leases.renew(Ctx, r.leaseKey(stream), r.consumer)
+	if err != nil || renewed {
+		return renewed, err
+	}
+	r.lost(stream)
+	return false, nil
+}
+
+// Close gives up every lease and leaves the membership, so the other
+// consumers take the shards over on their next rebalance.
+func (r *ShardReader) Close() error {
+	ctx := context.Background()
+	for _, stream := range r.owned {
+		r.release(ctx, stream)
+	}
+	r.owned, r.claimed, r.buffered = nil, nil, nil
+	metrics.ShardsOwned.DeleteLabelValues(r.group, r.consumer)
+	return r.leases.leave(ctx, r.group, r.consumer)
+}
+
+func (r *ShardReader) rebalanceIfDue(ctx context.Context) error {
+	if time.Since(r.rebalanced) < ShardLease/3 {
+		return nil
+	}
+	return r.rebalance(ctx)
+}
+
+func (r *ShardReader) rebalance(ctx context.Context) error {
+	started := time.Now()
+	err := r.rebalanceLeases(ctx)
+	observeRedisOperation("rebalance_shards", r.group, started, err)
+	metrics.ShardsOwned.WithLabelValues(r.group, r.consumer).Set(float64(len(r.owned)))
+	return err
+}
+
+func (r *ShardReader) rebalanceLeases(ctx context.Context) error {
+	live, err := r.leases.join(ctx, r.group, r.consumer)
+	if err != nil {
+		return err
+	}
+	r.rebalanced = time.Now()
+
+	for _, stream := range slices.Clone(r.owned) {
+		renewed, err := r.leases.renew(ctx, r.leaseKey(stream), r.consumer)
+		if err != nil {
+			return err
+		}
+		if !renewed {
+			r.lost(stream)
+		}
+	}
+
+	fair := fairShare(shardCount, live)
+	for len(r.owned) > fair {
+		stream := r.owned[len(r.owned)-1]
+		r.owned = r.owned[:len(r.owned)-1]
+		r.release(ctx, stream)
+	}
+
+	for _, lane := range lanes {
+		if len(r.owned) >= fair {
+			break
+		}
+		if slices.Contains(r.owned, lane.Stream) {
+			continue
+		}
+		acquired, err := r.leases.acquire(ctx, r.leaseKey(lane.Stream), r.consumer)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			continue
+		}
+		log.Printf("Consumer %s acquired %s", r.consumer, lane.Stream)
+		metrics.ShardLeaseChanges.WithLabelValues(lane.Name, "acquired").Inc()
+		r.owned = append(r.owned, lane.Stream)
+		r.claimed = append(r.claimed, lane.Stream)
+	}
+	return nil
+}
+
+// fairShare is how many shards each of live consumers should hold, rounded
+// up so every shard has an owner.
+func fairShare(shards, live int) int {
+	live = max(live, 1)
+	return (shards + live - 1) / live
+}
+
+func (r *ShardReader) lost(stream string) {
+	log.Printf("Consumer %s lost its lease on %s", r.consumer, stream)
+	metrics.ShardLeaseChanges.WithLabelValues(LaneName(stream), "lost").Inc()
+	r.owned = slices.DeleteFunc(r.owned, func(s string) bool { return s == stream })
+	r.forget(stream)
+}
+
+func (r *ShardReader) release(ctx context.Context, stream string) {
+	r.forget(stream)
+	if err := r.leases.release(ctx, r.leaseKey(stream), r.consumer); err != nil {
+		log.Printf("Failed to release lease on %s: %v", stream, err)
+		return
+	}
+	log.Printf("Consumer %s released %s", r.consumer, stream)
+	metrics.ShardLeaseChanges.WithLabelValues(LaneName(stream), "released").Inc()
+}
+
+// forget drops what was buffered or left to drain for a shard. Those messages
+// stay pending and are claimed by the shard's next owner.
+func (r *ShardReader) forget(stream string) {
+	r.claimed = slices.DeleteFunc(r.claimed, func(s string) bool { return s == stream })
+	r.buffered = slices.DeleteFunc(r.buffered, func(s redis.XStream) bool { return s.Stream == stream })
+}
+
+func (r *ShardReader) leaseKey(stream string) string {
+	return shardLeaseKeyPrefix + r.group + ":" + stream
+}
+
+// shardLeases holds the state consumers share to split the shards: the live
+// members of each group, the lease on each shard and the messages pending for
+// each consumer.
+type shardLeases interface {
+	// join marks consumer live for another lease and returns how many
+	// consumers of the group are.
+	join(ctx context.Context, group, consumer string) (int, error)
+	leave(ctx context.Context, group, consumer string) error
+	acquire(ctx context.Context, key, consumer string) (bool, error)
+	renew(ctx context.Context, key, consumer string) (bool, error)
+	release(ctx context.Context, key, consumer string) error
+	// claim moves the messages of stream that other consumers left idle for a
+	// whole lease to consumer.
+	claim(ctx context.Context, stream, group, consumer string) error
+	// pendingElsewhere counts the messages of stream pending for other
+	// consumers.
+	pendingElsewhere(ctx context.Context, stream, group, consumer string) (int64, error)
+}
+
+type redisShardLeases struct{}
+
+func (redisShardLeases) join(ctx context.Context, group, consumer string) (int, error) {
+	now := time.Now().UnixMilli()
+	membersKey := shardMembersKeyPrefix + group
+
+	pipe := Rdb.TxPipeline()
+	pipe.ZAdd(ctx, membersKey, redis.Z{Score: float64(now + ShardLease.Milliseconds()), Member: consumer})
+	pipe.ZRemRangeByScore(ctx, membersKey, "-inf", fmt.Sprint(now))
+	live := pipe.ZCard(ctx, membersKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(live.Val()), nil
+}
+
+func (redisShardLeases) leave(ctx context.Context, group, consumer string) error {
+	return Rdb.ZRem(ctx, shardMembersKeyPrefix+group, consumer).Err()
+}
+
+func (redisShardLeases) acquire(ctx context.Context, key, consumer string) (bool, error) {
+	return Rdb.SetNX(ctx, key, consumer, ShardLease).Result()
+}
+
+func (redisShardLeases) renew(ctx context.Context, key, consumer string) (bool, error) {
+	renewed, err := renewShardLeaseScript.Run(ctx, Rdb, []string{key}, consumer, ShardLease.Milliseconds()).Int()
+	return renewed == 1, err
+}
+
+func (redisShardLeases) release(ctx context.Context, key, consumer string) error {
+	return releaseShardLeaseScript.Run(ctx, Rdb, []string{key}, consumer).Err()
+}
+
+func (redisShardLeases) claim(ctx context.Context, stream, group, consumer string) error {
+	start := "0-0"
+	for {
+		_, next, err := Rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: consumer,
+			MinIdle:  ShardLease,
+			Start:    start,
+			Count:    shardClaimBatch,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		if next == "0-0" {
+			return nil
+		}
+		start = next
+	}
+}
+
+func (redisShardLeases) pendingElsewhere(ctx context.Context, stream, group, consumer string) (int64, error) {
+	pending, err := Rdb.XPending(ctx, stream, group).Result()
+	if err != nil {
+		return 0, err
+	}
+	return pending.Count - pending.Consumers[consumer], nil
+}
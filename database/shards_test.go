@@ -0,0 +1,197 @@
+package database
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/models"
+	"context"
+	"slices"
+	"testing"
+)
+
+func configureTestShards(t *testing.T, shards int) {
+	t.Helper()
+	previous, previousDefault, previousCount := lanes, defaultLane, shardCount
+	t.Cleanup(func() { lanes, defaultLane, shardCount = previous, previousDefault, previousCount })
+
+	if err := ConfigureSharding(config.ShardingConfig{Shards: shards}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRouteEventKeepsEachUserOnOneShard(t *testing.T) {
+	configureTestShards(t, 4)
+
+	if lanes[0].Stream != StreamName {
+		t.Fatalf("expected shard 0 to keep the events stream, got %s", lanes[0].Stream)
+	}
+
+	used := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		user := "user-" + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		stream := RouteEvent(models.Event{UserId: user, Action: "click"}).Stream
+		if again := RouteEvent(models.Event{UserId: user, Action: "purchase"}).Stream; again != stream {
+			t.Fatalf("expected %s to stay on %s, got %s", user, stream, again)
+		}
+		used[stream] = true
+	}
+	if len(used) != 4 {
+		t.Fatalf("expected users to spread over all 4 shards, got %v", used)
+	}
+}
+
+func TestConfigureShardingRejectsLanes(t *testing.T) {
+	configureTestLanes(t)
+	previousCount := shardCount
+	defer func() { shardCount = previousCount }()
+
+	if err := ConfigureSharding(config.ShardingConfig{Shards: 4}); err == nil {
+		t.Fatal("expected sharding with lanes to be rejected")
+	}
+	if Sharded() {
+		t.Fatal("expected sharding to stay off")
+	}
+}
+
+type fakeShardLeases struct {
+	members map[string]bool
+	holders map[string]string
+}
+
+func newFakeShardLeases() *fakeShardLeases {
+	return &fakeShardLeases{members: map[string]bool{}, holders: map[string]string{}}
+}
+
+func (f *fakeShardLeases) join(ctx context.Context, group, consumer string) (int, error) {
+	f.members[consumer] = true
+	return len(f.members), nil
+}
+
+func (f *fakeShardLeases) leave(ctx context.Context, group, consumer string) error {
+	delete(f.members, consumer)
+	return nil
+}
+
+func (f *fakeShardLeases) acquire(ctx context.Context, key, consumer string) (bool, error) {
+	if _, held := f.holders[key]; held {
+		return false, nil
+	}
+	f.holders[key] = consumer
+	return true, nil
+}
+
+func (f *fakeShardLeases) renew(ctx context.Context, key, consumer string) (bool, error) {
+	return f.holders[key] == consumer, nil
+}
+
+func (f *fakeShardLeases) release(ctx context.Context, key, consumer string) error {
+	if f.holders[key] == consumer {
+		delete(f.holders, key)
+	}
+	return nil
+}
+
+func (f *fakeShardLeases) claim(ctx context.Context, stream, group, consumer string) error {
+	return nil
+}
+
+func (f *fakeShardLeases) pendingElsewhere(ctx context.Context, stream, group, consumer string) (int64, error) {
+	return 0, nil
+}
+
+func newTestShardReader(consumer string, leases shardLeases) *ShardReader {
+	reader := NewShardReader(GroupName, consumer, 10, "read_group")
+	reader.leases = leases
+	return reader
+}
+
+func TestFairShareRoundsUp(t *testing.T) {
+	cases := []struct{ shards, live, want int }{{4, 0, 4}, {4, 1, 4}, {4, 3, 2}, {4, 4, 1}, {5, 2, 3}, {2, 5, 1}}
+	for _, c := range cases {
+		if got := fairShare(c.shards, c.live); got != c.want {
+			t.Errorf("fairShare(%d, %d): expected %d, got %d", c.shards, c.live, c.want, got)
+		}
+	}
+}
+
+func TestRebalanceLeasesSplitsShardsFairly(t *testing.T) {
+	configureTestShards(t, 4)
+	leases := newFakeShardLeases()
+	a := newTestShardReader("a", leases)
+	b := newTestShardReader("b", leases)
+
+	if err := a.rebalanceLeases(context.Background()); err != nil {
+		t.Fatalf("rebalance a: %v", err)
+	}
+	if len(a.owned) != 4 {
+		t.Fatalf("expected a lone consumer to take every shard, got %v", a.owned)
+	}
+
+	// b joins while a holds everything, so it gets nothing until a gives up
+	// its extra shards on its next rebalance.
+	if err := b.rebalanceLeases(context.Background()); err != nil {
+		t.Fatalf("rebalance b: %v", err)
+	}
+	if len(b.owned) != 0 {
+		t.Fatalf("expected b to find no free shard, got %v", b.owned)
+	}
+	if err := a.rebalanceLeases(context.Background()); err != nil {
+		t.Fatalf("rebalance a: %v", err)
+	}
+	if err := b.rebalanceLeases(context.Background()); err != nil {
+		t.Fatalf("rebalance b: %v", err)
+	}
+
+	if len(a.owned) != 2 || len(b.owned) != 2 {
+		t.Fatalf("expected 2 shards each, got %v and %v", a.owned, b.owned)
+	}
+	for _, stream := range b.owned {
+		if slices.Contains(a.owned, stream) {
+			t.Fatalf("expected %s to have one owner, got both", stream)
+		}
+	}
+}
+
+func TestRebalanceLeasesDrainsTakenOverShardsFirst(t *testing.T) {
+	configureTestShards(t, 2)
+	leases := newFakeShardLeases()
+	a := newTestShardReader("a", leases)
+
+	if err := a.rebalanceLeases(context.Background()); err != nil {
+		t.Fatalf("rebalance: %v", err)
+	}
+	if !slices.Equal(a.claimed, a.owned) {
+		t.Fatalf("expected every acquired shard to be drained of its previous owner's messages, got %v of %v", a.claimed, a.owned)
+	}
+	if readable := a.readable(); len(readable) != 0 {
+		t.Fatalf("expected no new messages to be read before the shards are drained, got %v", readable)
+	}
+
+	a.claimed = a.claimed[1:]
+	if readable := a.readable(); !slices.Equal(readable, a.owned[:1]) {
+		t.Fatalf("expected only the drained shard to be readable, got %v", readable)
+	}
+}
+
+func TestShardReaderStopsHoldingLostLease(t *testing.T) {
+	configureTestShards(t, 2)
+	leases := newFakeShardLeases()
+	a := newTestShardReader("a", leases)
+	if err := a.rebalanceLeases(context.Background()); err != nil {
+		t.Fatalf("rebalance: %v", err)
+	}
+
+	// The lease expired, say while a was stuck retrying, and b took it.
+	lost := a.owned[0]
+	leases.holders[a.leaseKey(lost)] = "b"
+
+	held, err := a.Holds(lost)
+	if err != nil || held {
+		t.Fatalf("expected a to no longer hold %s, got %v %v", lost, held, err)
+	}
+	if slices.Contains(a.owned, lost) || slices.Contains(a.claimed, lost) {
+		t.Fatalf("expected %s to be dropped, got %v %v", lost, a.owned, a.claimed)
+	}
+	if held, err := a.Holds(a.owned[0]); err != nil || !held {
+		t.Fatalf("expected a to still hold %s, got %v %v", a.owned[0], held, err)
+	}
+}
@@ -0,0 +1,158 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const sketchKeyPrefix = "sketch:users"
+
+// sketchAll stands in for "any action" or "any element" in a sketch key.
+const sketchAll = "*"
+
+type sketchResolution struct {
+	name string
+	size time.Duration
+	ttl  time.Duration
+}
+
+// Ordered from finest to coarsest. Finer sketches expire sooner; ranges older
+// than a resolution's TTL are answered from the next coarser one.
+var sketchResolutions = []sketchResolution{
+	{name: "minute", size: time.Minute, ttl: 48 * time.Hour},
+	{name: "hour", size: time.Hour, ttl: 90 * 24 * time.Hour},
+	{name: "day", size: 24 * time.Hour},
+}
+
+// UniqueUsersMaxRange is the longest range unique users are counted over. It
+// bounds the number of sketches merged by one count to a few hundred.
+var UniqueUsersMaxRange = 366 * 24 * time.Hour
+
+var ErrUniqueUsersRangeTooLong = fmt.Errorf("the range can be at most %d days", int(UniqueUsersMaxRange/(24*time.Hour)))
+
+type UserSketchUpdate struct {
+	Action  string
+	Element string
+	Window  time.Time
+	UserIDs []string
+}
+
+type sketchBucket struct {
+	resolution sketchResolution
+	start      time.Time
+}
+
+func sketchKey(resolution, action, element string, bucket time.Time) string {
+	return fmt.Sprintf("%s:%s:%s:%s:%d",
+		sketchKeyPrefix,
+		resolution,
+		url.QueryEscape(action),
+		url.QueryEscape(element),
+		bucket.Unix(),
+	)
+}
+
+func AddUserSketches(ctx context.Context, updates []UserSketchUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	started := time.Now()
+	pipe := Rdb.Pipeline()
+	for _, update := range updates {
+		if len(update.UserIDs) == 0 {
+			continue
+		}
+
+		members := make([]any, 0, len(update.UserIDs))
+		for _, userID := range update.UserIDs {
+			members = append(members, userID)
+		}
+
+		scopes := [][2]string{
+			{update.Action, update.Element},
+			{update.Action, sketchAll},
+			{sketchAll, update.Element},
+			{sketchAll, sketchAll},
+		}
+
+		for _, resolution := range sketchResolutions {
+			bucket := update.Window.UTC().Truncate(resolution.size)
+			for _, scope := range scopes {
+				key := sketchKey(resolution.name, scope[0], scope[1], bucket)
+				pipe.PFAdd(ctx, key, members...)
+				if resolution.ttl > 0 {
+					pipe.ExpireAt(ctx, key, bucket.Add(resolution.size+resolution.ttl))
+				}
+			}
+		}
+	}
+
+	_, err := pipe.Exec(ctx)
+	observeRedisOperation("add_user_sketches", sketchKeyPrefix, started, err)
+	return err
+}
+
+func CountUniqueUsers(ctx context.Context, action, element string, from, to time.Time) (int64, error) {
+	if to.Sub(from) > UniqueUsersMaxRange {
+		return 0, ErrUniqueUsersRangeTooLong
+	}
+	if action == "" {
+		action = sketchAll
+	}
+	if element == "" {
+		element = sketchAll
+	}
+
+	buckets := planSketchBuckets(from, to, time.Now())
+	if len(buckets) == 0 {
+		return 0, nil
+	}
+
+	keys := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		keys = append(keys, sketchKey(bucket.resolution.name, action, element, bucket.start))
+	}
+
+	started := time.Now()
+	count, err := Rdb.PFCount(ctx, keys...).Result()
+	observeRedisOperation("count_user_sketches", sketchKeyPrefix, started, err)
+	return count, err
+}
+
+// planSketchBuckets covers [from, to) with as few sketch buckets as possible,
+// using the finest resolution that has not yet expired at each point.
+func planSketchBuckets(from, to, now time.Time) []sketchBucket {
+	var buckets []sketchBucket
+
+	cursor := from.UTC()
+	end := to.UTC()
+	for cursor.Before(end) {
+		level := finestSketchResolution(cursor, now)
+		cursor = cursor.Truncate(sketchResolutions[level].size)
+
+		for level+1 < len(sketchResolutions) {
+			next := sketchResolutions[level+1]
+			if !cursor.Truncate(next.size).Equal(cursor) || cursor.Add(next.size).After(end) {
+				break
+			}
+			level++
+		}
+
+		buckets = append(buckets, sketchBucket{resolution: sketchResolutions[level], start: cursor})
+		cursor = cursor.Add(sketchResolutions[level].size)
+	}
+
+	return buckets
+}
+
+func finestSketchResolution(at, now time.Time) int {
+	for i, resolution := range sketchResolutions {
+		if resolution.ttl == 0 || now.Sub(at) < resolution.ttl {
+			return i
+		}
+	}
+	return len(sketchResolutions) - 1
+}
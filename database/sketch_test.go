@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPlanSketchBucketsUsesCoarsestAlignedResolution(t *testing.T) {
+	now := time.Date(2026, 4, 10, 12, 0, 0, 0, time.UTC)
+	from := time.Date(2026, 4, 9, 22, 30, 0, 0, time.UTC)
+	to := time.Date(2026, 4, 10, 1, 15, 0, 0, time.UTC)
+
+	buckets := planSketchBuckets(from, to, now)
+
+	counts := map[string]int{}
+	for _, bucket := range buckets {
+		counts[bucket.resolution.name]++
+	}
+
+	// 22:30-23:00 and 01:00-01:15 in minutes, 23:00 and 00:00 in hours.
+	if counts["minute"] != 45 {
+		t.Fatalf("expected 45 minute buckets, got %d", counts["minute"])
+	}
+	if counts["hour"] != 2 {
+		t.Fatalf("expected 2 hour buckets, got %d", counts["hour"])
+	}
+	if counts["day"] != 0 {
+		t.Fatalf("expected no day buckets, got %d", counts["day"])
+	}
+
+	last := buckets[len(buckets)-1]
+	if end := last.start.Add(last.resolution.size); !end.Equal(to) {
+		t.Fatalf("expected plan to end at %s, got %s", to, end)
+	}
+}
+
+func TestPlanSketchBucketsFallsBackWhenFineSketchesExpired(t *testing.T) {
+	now := time.Date(2026, 4, 10, 12, 0, 0, 0, time.UTC)
+	from := time.Date(2026, 3, 1, 10, 30, 0, 0, time.UTC)
+	to := time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC)
+
+	buckets := planSketchBuckets(from, to, now)
+
+	for _, bucket := range buckets {
+		if bucket.resolution.name == "minute" {
+			t.Fatalf("expected expired minute sketches to be skipped, got bucket at %s", bucket.start)
+		}
+	}
+	if buckets[0].start != time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC) {
+		t.Fatalf("expected first bucket to start on the hour, got %s", buckets[0].start)
+	}
+
+	days := 0
+	for _, bucket := range buckets {
+		if bucket.resolution.name == "day" {
+			days++
+		}
+	}
+	if days != 1 {
+		t.Fatalf("expected 1 day bucket, got %d", days)
+	}
+}
+
+func TestCountUniqueUsersRejectsRangesLongerThanTheCap(t *testing.T) {
+	to := time.Date(2026, 4, 10, 0, 0, 0, 0, time.UTC)
+	// Rejected before Redis is asked.
+	if _, err := CountUniqueUsers(context.Background(), "", "", to.Add(-UniqueUsersMaxRange-time.Hour), to); !errors.Is(err, ErrUniqueUsersRangeTooLong) {
+		t.Fatalf("expected the range to be rejected, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"analytics-backend/metrics"
 	"analytics-backend/models"
 	"context"
 	"log"
@@ -20,78 +21,134 @@ func AddToStream(stream models.Event) error {
 	return AddToStreamWithContext(Ctx, stream)
 }
 
+// AddToStreamWithContext adds an event to the stream of the lane it is
+// routed to.
 func AddToStreamWithContext(ctx context.Context, stream models.Event) error {
+	lane := RouteEvent(stream)
 	started := time.Now()
 	_, err := Rdb.XAdd(ctx, &redis.XAddArgs{
-		Stream: StreamName,
-		Values: map[string]interface{}{
-			"id":        stream.ID,
-			"user_id":   stream.UserId,
-			"action":    stream.Action,
-			"element":   stream.Element,
-			"duration":  stream.Duration,
-			"timestamp": stream.Timestamp.Format(time.RFC3339Nano),
-		},
+		Stream: lane.Stream,
+		Values: EncodeEvent(stream),
 	}).Result()
 
 	if err != nil {
 		log.Printf("Failed to add to stream: %v", err)
+	} else {
+		metrics.LaneEventsRouted.WithLabelValues(lane.Name).Inc()
 	}
-	observeRedisOperation("add_to_stream", StreamName, started, err)
+	observeRedisOperation("add_to_stream", lane.Stream, started, err)
 
 	return err
 }
 
 func EnsureConsumerGroup() error {
-	err := Rdb.XGroupCreateMkStream(Ctx, StreamName, GroupName, "$").Err()
-	if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
-		return err
+	return ensureLaneGroups(GroupName, "$")
+}
+
+// NewEventReader reads every lane, or with sharding on only the shards the
+// consumer holds a lease on. Aggregators acknowledge every batch as soon as
+// it is committed, so one holding a message for LaneClaimIdle has stopped,
+// and the message is taken over.
+func NewEventReader(consumer string) EventReader {
+	if Sharded() {
+		return NewShardReader(GroupName, consumer, BatchSize, "read_group")
+	}
+	return NewLaneReader(GroupName, consumer, BatchSize, "read_group").ClaimingIdle(LaneClaimIdle)
+}
+
+func AckMessage(stream string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	started := time.Now()
+	err := Rdb.XAck(Ctx, stream, GroupName, ids...).Err()
+	if err != nil {
+		log.Printf("Failed to acknowledge messages: %v", err)
 	}
-	return nil
+	observeRedisOperation("ack_group", stream, started, err)
+
+	return err
 }
 
-func ReadFromGroup(consumer string) ([]redis.XMessage, error) {
+// DeleteConsumer removes a consumer from its group. Deleting a consumer drops
+// its pending entries, so consumers that still own messages are left in place.
+func DeleteConsumer(stream, group, consumer string) (bool, error) {
+	started := time.Now()
+	pending, err := Rdb.XPendingExt(Ctx, &redis.XPendingExtArgs{
+		Stream:   stream,
+		Group:    group,
+		Start:    "-",
+		End:      "+",
+		Count:    1,
+		Consumer: consumer,
+	}).Result()
+	if err != nil {
+		observeRedisOperation("delete_consumer", stream, started, err)
+		return false, err
+	}
+	if len(pending) > 0 {
+		observeRedisOperation("delete_consumer", stream, started, nil)
+		return false, nil
+	}
+
+	err = Rdb.XGroupDelConsumer(Ctx, stream, group, consumer).Err()
+	observeRedisOperation("delete_consumer", stream, started, err)
+	return err == nil, err
+}
+
+// ReadStreamGroup reads new messages for any stream and consumer group.
+// Callers pass their own operation name so metrics stay distinguishable.
+func ReadStreamGroup(stream, group, consumer string, count int64, block time.Duration, operation string) ([]redis.XMessage, error) {
+	return readStreamGroup(stream, group, consumer, ">", count, block, operation)
+}
+
+// ReadPendingStreamGroup returns messages after the given ID that were
+// delivered to this consumer but never acknowledged, e.g. after a crash.
+// Reading history never blocks.
+func ReadPendingStreamGroup(stream, group, consumer, after string, count int64, operation string) ([]redis.XMessage, error) {
+	return readStreamGroup(stream, group, consumer, after, count, -1, operation)
+}
+
+func readStreamGroup(stream, group, consumer, start string, count int64, block time.Duration, operation string) ([]redis.XMessage, error) {
 	started := time.Now()
 	results, err := Rdb.XReadGroup(Ctx, &redis.XReadGroupArgs{
-		Group:    GroupName,
+		Group:    group,
 		Consumer: consumer,
-		Streams:  []string{StreamName, ">"},
-		Count:    BatchSize,
-		Block:    BlockTimeMs,
+		Streams:  []string{stream, start},
+		Count:    count,
+		Block:    block,
 		NoAck:    false,
 	}).Result()
-
 	if err != nil {
-
 		if err == redis.Nil {
-			observeRedisOperation("read_group", StreamName, started, nil)
+			observeRedisOperation(operation, stream, started, nil)
 			return []redis.XMessage{}, nil
 		}
-		log.Printf("Failed to read from group: %v", err)
-		observeRedisOperation("read_group", StreamName, started, err)
+		log.Printf("Failed to read %s/%s: %v", stream, group, err)
+		observeRedisOperation(operation, stream, started, err)
 		return nil, err
 	}
 
 	var messages []redis.XMessage
-	for _, stream := range results {
-		messages = append(messages, stream.Messages...)
+	for _, result := range results {
+		messages = append(messages, result.Messages...)
 	}
-	observeRedisOperation("read_group", StreamName, started, nil)
+	observeRedisOperation(operation, stream, started, nil)
 	return messages, nil
 }
 
-func AckMessage(ids ...string) error {
+func AckStreamGroup(stream, group, operation string, ids ...string) error {
 	if len(ids) == 0 {
 		return nil
 	}
 
 	started := time.Now()
-	err := Rdb.XAck(Ctx, StreamName, GroupName, ids...).Err()
+	err := Rdb.XAck(Ctx, stream, group, ids...).Err()
 	if err != nil {
-		log.Printf("Failed to acknowledge messages: %v", err)
+		log.Printf("Failed to acknowledge %s/%s messages: %v", stream, group, err)
 	}
-	observeRedisOperation("ack_group", StreamName, started, err)
-
+	observeRedisOperation(operation, stream, started, err)
 	return err
 }
 
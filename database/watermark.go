@@ -0,0 +1,116 @@
+package database
+
+import (
+	"analytics-backend/metrics"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const watermarkKeyPrefix = "watermark:"
+
+// Only ever moves the stored watermark forward, so concurrent workers
+// cannot rewind it with an older batch.
+var advanceWatermarkScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+local candidate = tonumber(ARGV[1])
+if candidate > current then
+	redis.call("SET", KEYS[1], ARGV[1])
+	return candidate
+end
+return current
+`)
+
+func watermarkKey(stream string) string {
+	return watermarkKeyPrefix + stream
+}
+
+func GetWatermark(ctx context.Context, stream string) (time.Time, error) {
+	started := time.Now()
+	millis, err := Rdb.Get(ctx, watermarkKey(stream)).Int64()
+	if err == redis.Nil {
+		observeRedisOperation("get_watermark", stream, started, nil)
+		return time.Time{}, nil
+	}
+	observeRedisOperation("get_watermark", stream, started, err)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(millis).UTC(), nil
+}
+
+func AdvanceWatermark(ctx context.Context, stream string, eventTime time.Time) (time.Time, error) {
+	started := time.Now()
+	millis, err := advanceWatermarkScript.Run(ctx, Rdb, []string{watermarkKey(stream)}, eventTime.UnixMilli()).Int64()
+	observeRedisOperation("advance_watermark", stream, started, err)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	watermark := time.UnixMilli(millis).UTC()
+	metrics.StreamWatermark.WithLabelValues(stream).Set(float64(watermark.Unix()))
+	return watermark, nil
+}
+
+// FinalizationWatermark is the lowest watermark of the group's streams, the
+// point every one of them has passed, so a window is only finalized once no
+// stream can still deliver on-time events for it. A stream the group has
+// caught up on, going by the last collected snapshot, does not hold the
+// others back. It is zero while a stream with a backlog has no watermark yet.
+func FinalizationWatermark(ctx context.Context, group string, streams []string) (time.Time, error) {
+	if len(streams) == 0 {
+		return time.Time{}, nil
+	}
+	keys := make([]string, 0, len(streams))
+	for _, stream := range streams {
+		keys = append(keys, watermarkKey(stream))
+	}
+
+	started := time.Now()
+	values, err := Rdb.MGet(ctx, keys...).Result()
+	observeRedisOperation("get_watermark", "watermarks", started, err)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	watermarks := make([]time.Time, len(streams))
+	caughtUp := make([]bool, len(streams))
+	for i, stream := range streams {
+		if value, ok := values[i].(string); ok {
+			if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+				watermarks[i] = time.UnixMilli(millis).UTC()
+			}
+		}
+		snapshot, ok := GetStreamSnapshot(stream, group)
+		caughtUp[i] = ok && snapshot.Backlog() == 0
+	}
+	return lowestWatermark(watermarks, caughtUp), nil
+}
+
+// lowestWatermark is the lowest watermark of the streams with a backlog, or
+// of all of them when every stream is caught up.
+func lowestWatermark(watermarks []time.Time, caughtUp []bool) time.Time {
+	var lowest, lowestCaughtUp time.Time
+	busy := false
+	for i, watermark := range watermarks {
+		if caughtUp[i] {
+			if !watermark.IsZero() && (lowestCaughtUp.IsZero() || watermark.Before(lowestCaughtUp)) {
+				lowestCaughtUp = watermark
+			}
+			continue
+		}
+		if watermark.IsZero() {
+			return time.Time{}
+		}
+		if !busy || watermark.Before(lowest) {
+			lowest = watermark
+		}
+		busy = true
+	}
+	if !busy {
+		return lowestCaughtUp
+	}
+	return lowest
+}
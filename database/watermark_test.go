@@ -0,0 +1,31 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLowestWatermarkWaitsForEveryStreamWithBacklog(t *testing.T) {
+	base := time.Date(2026, 4, 10, 12, 0, 0, 0, time.UTC)
+
+	// The bulk lane lags behind, so windows are only final up to it.
+	got := lowestWatermark([]time.Time{base, base.Add(-time.Minute), base.Add(-time.Second)}, []bool{false, false, false})
+	if !got.Equal(base.Add(-time.Minute)) {
+		t.Errorf("expected the lagging stream's watermark, got %s", got)
+	}
+
+	// A caught-up stream with an old watermark does not hold the others back.
+	got = lowestWatermark([]time.Time{base, base.Add(-time.Hour)}, []bool{false, true})
+	if !got.Equal(base) {
+		t.Errorf("expected the caught-up stream to be skipped, got %s", got)
+	}
+
+	// A stream with a backlog but no watermark yet finalizes nothing.
+	if got = lowestWatermark([]time.Time{base, {}}, []bool{false, false}); !got.IsZero() {
+		t.Errorf("expected no watermark, got %s", got)
+	}
+
+	if got = lowestWatermark([]time.Time{base, base.Add(-time.Hour)}, []bool{true, true}); !got.Equal(base.Add(-time.Hour)) {
+		t.Errorf("expected the lowest watermark when every stream is caught up, got %s", got)
+	}
+}
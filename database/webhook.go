@@ -0,0 +1,141 @@
+package database
+
+import (
+	"analytics-backend/models"
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	WebhookGroupName        = "webhook-dispatchers"
+	WebhookBatchSize        = int64(500)
+	WebhookDeadLetterPrefix = "webhooks:dead:"
+	WebhookDeadLetterMaxLen = int64(10000)
+)
+
+type WebhookDeadLetter struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Reason   string          `json:"reason"`
+	Attempts int             `json:"attempts"`
+	EventIDs string          `json:"event_ids"`
+	FailedAt time.Time       `json:"failed_at"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+func EnsureWebhookGroup() error {
+	return ensureLaneGroups(WebhookGroupName, "$")
+}
+
+func NewWebhookReader(consumer string) *LaneReader {
+	return NewLaneReader(WebhookGroupName, consumer, WebhookBatchSize, "read_webhook_events")
+}
+
+func AckWebhookEvents(stream string, ids ...string) error {
+	return AckStreamGroup(stream, WebhookGroupName, "ack_webhook_events", ids...)
+}
+
+func CreateWebhookDestination(ctx context.Context, destination *models.WebhookDestination) error {
+	started := time.Now()
+	err := DB.WithContext(ctx).Create(destination).Error
+	observeDBOperation("postgres", "create", "webhook_destinations", started, err)
+	return err
+}
+
+func ListWebhookDestinations(ctx context.Context) ([]models.WebhookDestination, error) {
+	started := time.Now()
+	var destinations []models.WebhookDestination
+	err := DB.WithContext(ctx).Order("id asc").Find(&destinations).Error
+	observeDBOperation("postgres", "select", "webhook_destinations", started, err)
+	return destinations, err
+}
+
+func ListEnabledWebhookDestinations(ctx context.Context) ([]models.WebhookDestination, error) {
+	started := time.Now()
+	var destinations []models.WebhookDestination
+	err := DB.WithContext(ctx).Where("enabled = ?", true).Order("id asc").Find(&destinations).Error
+	observeDBOperation("postgres", "select", "webhook_destinations", started, err)
+	return destinations, err
+}
+
+func GetWebhookDestination(ctx context.Context, id uint) (*models.WebhookDestination, error) {
+	started := time.Now()
+	var destination models.WebhookDestination
+	err := DB.WithContext(ctx).First(&destination, id).Error
+	observeDBOperation("postgres", "select", "webhook_destinations", started, err)
+	if err != nil {
+		return nil, err
+	}
+	return &destination, nil
+}
+
+func UpdateWebhookDestination(ctx context.Context, destination *models.WebhookDestination) error {
+	started := time.Now()
+	err := DB.WithContext(ctx).Save(destination).Error
+	observeDBOperation("postgres", "update", "webhook_destinations", started, err)
+	return err
+}
+
+func DeleteWebhookDestination(ctx context.Context, id uint) (bool, error) {
+	started := time.Now()
+	result := DB.WithContext(ctx).Delete(&models.WebhookDestination{}, id)
+	observeDBOperation("postgres", "delete", "webhook_destinations", started, result.Error)
+	return result.RowsAffected > 0, result.Error
+}
+
+func webhookDeadLetterStream(destinationID uint) string {
+	return WebhookDeadLetterPrefix + strconv.FormatUint(uint64(destinationID), 10)
+}
+
+func AddWebhookDeadLetter(ctx context.Context, destination models.WebhookDestination, payload []byte, eventIDs string, reason string, attempts int) error {
+	stream := webhookDeadLetterStream(destination.ID)
+	started := time.Now()
+	err := Rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: WebhookDeadLetterMaxLen,
+		Approx: true,
+		Values: map[string]any{
+			"url":       destination.URL,
+			"reason":    reason,
+			"attempts":  attempts,
+			"event_ids": eventIDs,
+			"payload":   payload,
+			"failed_at": time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}).Err()
+	observeRedisOperation("add_webhook_dead_letter", stream, started, err)
+	return err
+}
+
+func ListWebhookDeadLetters(ctx context.Context, destinationID uint, count int64) ([]WebhookDeadLetter, error) {
+	stream := webhookDeadLetterStream(destinationID)
+	started := time.Now()
+	messages, err := Rdb.XRevRangeN(ctx, stream, "+", "-", count).Result()
+	observeRedisOperation("list_webhook_dead_letters", stream, started, err)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]WebhookDeadLetter, 0, len(messages))
+	for _, msg := range messages {
+		letter := WebhookDeadLetter{ID: msg.ID}
+		letter.Reason, _ = msg.Values["reason"].(string)
+		letter.EventIDs, _ = msg.Values["event_ids"].(string)
+		letter.URL, _ = msg.Values["url"].(string)
+		if attempts, ok := msg.Values["attempts"].(string); ok {
+			letter.Attempts, _ = strconv.Atoi(attempts)
+		}
+		if failedAt, ok := msg.Values["failed_at"].(string); ok {
+			letter.FailedAt, _ = time.Parse(time.RFC3339Nano, failedAt)
+		}
+		if payload, ok := msg.Values["payload"].(string); ok && json.Valid([]byte(payload)) {
+			letter.Payload = json.RawMessage(payload)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
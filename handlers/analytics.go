@@ -20,7 +20,7 @@ const FetchLimit = 1000000
 func GetAnalyticsSequential(c *gin.Context) {
 	events, err := database.GetEvents(FetchLimit)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -48,7 +48,7 @@ func GetAnalyticsSequential(c *gin.Context) {
 func GetAnalyticsMapReduce(c *gin.Context) {
 	events, err := database.GetEvents(FetchLimit)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
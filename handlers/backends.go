@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"analytics-backend/database"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetBackends reports the circuit breaker of every backend. It answers 503
+// while any breaker is open.
+func GetBackends(c *gin.Context) {
+	statuses := database.BackendStatuses()
+	code := 200
+	for _, status := range statuses {
+		if status.State == database.BreakerOpen {
+			code = 503
+		}
+	}
+	c.JSON(code, gin.H{"backends": statuses})
+}
+
+// errorStatus is 503 for calls rejected by an open circuit breaker or needing
+// a backend that is down, so clients can tell an outage from a failed request.
+func errorStatus(err error) int {
+	if errors.Is(err, database.ErrCircuitOpen) || errors.Is(err, database.ErrFullTextUnavailable) {
+		return 503
+	}
+	return 500
+}
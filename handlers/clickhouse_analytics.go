@@ -14,7 +14,7 @@ func GetAnalyticsClickHouse(c *gin.Context) {
 
 	results, err := database.GetAnalyticsFromClickHouse(ctx)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
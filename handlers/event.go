@@ -4,6 +4,7 @@ import (
 	"analytics-backend/database"
 	"analytics-backend/metrics"
 	"analytics-backend/models"
+	"analytics-backend/transform"
 	"analytics-backend/utils"
 	"context"
 	"time"
@@ -26,12 +27,20 @@ func GetEvent(c *gin.Context) {
 		event.Timestamp = time.Now()
 	}
 
+	result := transform.Apply(event)
+	if result.Dropped {
+		metrics.EventsDropped.Inc()
+		c.JSON(202, gin.H{"status": "dropped", "event": event, "rules": result.Matched})
+		return
+	}
+	event = result.Event
+
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
 	if err := database.AddToStreamWithContext(ctx, event); err != nil {
 		metrics.EventsFailed.WithLabelValues("ingest").Inc()
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"analytics-backend/utils"
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventPresence is whether one store has an event. Error is set instead when
+// the store could not be asked.
+type eventPresence struct {
+	Found   bool     `json:"found"`
+	Backend string   `json:"backend,omitempty"`
+	Indices []string `json:"indices,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type eventLookup struct {
+	ID          int64                       `json:"id"`
+	Decoded     utils.DecodedID             `json:"decoded"`
+	Event       *models.Event               `json:"event"`
+	Stores      map[string]eventPresence    `json:"stores"`
+	Streams     []database.EventStreamEntry `json:"streams"`
+	Outbox      []database.EventOutboxEntry `json:"outbox"`
+	DeadLetters []database.EventDeadLetter  `json:"dead_letters"`
+	Errors      map[string]string           `json:"errors,omitempty"`
+	FoundIn     []string                    `json:"found_in"`
+	MissingFrom []string                    `json:"missing_from"`
+	Unavailable []string                    `json:"unavailable,omitempty"`
+	Pending     bool                        `json:"pending"`
+}
+
+// eventLookupTimeout bounds each store's lookup, so a slow one cannot use up
+// the time of the others.
+var eventLookupTimeout = 5 * time.Second
+
+// LookupEvent reports where an event is: Postgres, ClickHouse, the search
+// index and the recent feed, plus any stream entries, outbox entries and
+// dead letters still holding it. The stores are asked concurrently. It
+// answers 404 when the event is nowhere, or 503 when it was not found but
+// some store could not be asked.
+func LookupEvent(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(400, gin.H{"error": "invalid event id"})
+		return
+	}
+
+	lookup := eventLookup{
+		ID:          id,
+		Decoded:     utils.DecodeID(id),
+		Stores:      map[string]eventPresence{},
+		Errors:      map[string]string{},
+		FoundIn:     []string{},
+		MissingFrom: []string{},
+	}
+	since := lookup.Decoded.Time.Add(-database.EventLookupSkew)
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	lookupAsync := func(lookupStore func(ctx context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(c.Request.Context(), eventLookupTimeout)
+			defer cancel()
+			lookupStore(ctx)
+		}()
+	}
+	setStore := func(store string, found bool, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookup.Stores[store] = presence(found, err)
+	}
+	setError := func(source string, err error) {
+		if err == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		lookup.Errors[source] = err.Error()
+	}
+
+	lookupAsync(func(ctx context.Context) {
+		event, err := database.FindEvent(ctx, id)
+		mu.Lock()
+		lookup.Event = event
+		mu.Unlock()
+		setStore("postgres", event != nil, err)
+		if !database.UsesElasticsearch() {
+			// The Postgres backend searches the events table itself.
+			setStore("search", event != nil, err)
+		}
+
+		// ClickHouse narrows its lookup with the stored event, since the id
+		// alone is not in its sort key.
+		lookupAsync(func(ctx context.Context) {
+			found, err := database.ClickHouseHasEvent(ctx, id, event)
+			setStore("clickhouse", found, err)
+		})
+	})
+	if database.UsesElasticsearch() {
+		lookupAsync(func(ctx context.Context) {
+			indices, err := database.IndicesHoldingEvent(ctx, id)
+			setStore("search", len(indices) > 0, err)
+			mu.Lock()
+			defer mu.Unlock()
+			search := lookup.Stores["search"]
+			search.Indices = indices
+			lookup.Stores["search"] = search
+		})
+	}
+	lookupAsync(func(ctx context.Context) {
+		found, err := database.RecentFeedHasEvent(ctx, id)
+		setStore("recent_feed", found, err)
+	})
+	// An incomplete scan still returns what it found.
+	lookupAsync(func(ctx context.Context) {
+		streams, err := database.FindEventStreamEntries(ctx, id, since)
+		mu.Lock()
+		lookup.Streams = streams
+		mu.Unlock()
+		setError("streams", err)
+	})
+	lookupAsync(func(ctx context.Context) {
+		outbox, err := database.FindEventOutboxEntries(ctx, id, since)
+		mu.Lock()
+		lookup.Outbox = outbox
+		mu.Unlock()
+		setError("outbox", err)
+	})
+	lookupAsync(func(ctx context.Context) {
+		deadLetters, err := database.FindEventDeadLetters(ctx, id, since)
+		mu.Lock()
+		lookup.DeadLetters = deadLetters
+		mu.Unlock()
+		setError("dead_letters", err)
+	})
+	wg.Wait()
+
+	search := lookup.Stores["search"]
+	search.Backend = database.SearchSourcePostgres
+	if database.UsesElasticsearch() {
+		search.Backend = database.SearchSourceElasticsearch
+	}
+	lookup.Stores["search"] = search
+
+	summarizeEventLookup(&lookup)
+	c.JSON(eventLookupStatus(&lookup), lookup)
+}
+
+// eventLookupStatus is 200 when the event was found somewhere. Otherwise it
+// is 404, unless a store could not be asked and may have it.
+func eventLookupStatus(lookup *eventLookup) int {
+	switch {
+	case len(lookup.FoundIn) > 0:
+		return 200
+	case len(lookup.Unavailable) > 0:
+		return 503
+	default:
+		return 404
+	}
+}
+
+func presence(found bool, err error) eventPresence {
+	if err != nil {
+		return eventPresence{Error: err.Error()}
+	}
+	return eventPresence{Found: found}
+}
+
+// eventStores is the order stores are listed in found_in and missing_from.
+var eventStores = []string{"postgres", "clickhouse", "search", "recent_feed"}
+
+// summarizeEventLookup lists where the event was found and which stores are
+// missing it. Streams, the outbox and dead letters only count where they hold
+// it, since an event is expected to leave them. The event is pending while a
+// stream entry or outbox entry still has to be handled.
+func summarizeEventLookup(lookup *eventLookup) {
+	for _, store := range eventStores {
+		presence := lookup.Stores[store]
+		switch {
+		case presence.Error != "":
+			lookup.Unavailable = append(lookup.Unavailable, store)
+		case presence.Found:
+			lookup.FoundIn = append(lookup.FoundIn, store)
+		default:
+			lookup.MissingFrom = append(lookup.MissingFrom, store)
+		}
+	}
+
+	for _, entry := range lookup.Streams {
+		lookup.FoundIn = appendOnce(lookup.FoundIn, "stream:"+entry.Stream)
+		for _, group := range entry.Groups {
+			if group.Status != database.StreamEntryAcked {
+				lookup.Pending = true
+			}
+		}
+	}
+	if len(lookup.Outbox) > 0 {
+		lookup.FoundIn = append(lookup.FoundIn, "outbox")
+		lookup.Pending = true
+	}
+	for _, deadLetter := range lookup.DeadLetters {
+		lookup.FoundIn = appendOnce(lookup.FoundIn, "dead_letter:"+deadLetter.Stream)
+	}
+	for _, source := range []string{"streams", "outbox", "dead_letters"} {
+		if _, failed := lookup.Errors[source]; failed {
+			lookup.Unavailable = append(lookup.Unavailable, source)
+		}
+	}
+}
+
+func appendOnce(values []string, value string) []string {
+	if slices.Contains(values, value) {
+		return values
+	}
+	return append(values, value)
+}
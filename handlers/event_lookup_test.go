@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"analytics-backend/database"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLookupEvent_BadRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.GET("/events/recent", GetRecentFeed)
+	r.GET("/events/:id", LookupEvent)
+
+	for _, id := range []string{"abc", "0", "-5"} {
+		req, _ := http.NewRequest("GET", "/events/"+id, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != 400 {
+			t.Errorf("Expected status 400 for %q, got %d", id, w.Code)
+		}
+	}
+}
+
+func TestSummarizeEventLookup(t *testing.T) {
+	lookup := eventLookup{
+		Stores: map[string]eventPresence{
+			"postgres":    {Found: true},
+			"clickhouse":  {},
+			"search":      {Error: "elasticsearch: circuit breaker is open"},
+			"recent_feed": {Found: true},
+		},
+		Streams: []database.EventStreamEntry{{
+			Stream: "events",
+			Groups: []database.EventStreamGroup{
+				{Group: "event-group", Status: database.StreamEntryAcked},
+				{Group: "webhook-dispatchers", Status: database.StreamEntryPending},
+			},
+		}},
+		DeadLetters: []database.EventDeadLetter{{Stream: "webhooks:dead:1"}, {Stream: "webhooks:dead:1"}},
+		Errors:      map[string]string{"outbox": "timeout"},
+		FoundIn:     []string{},
+		MissingFrom: []string{},
+	}
+
+	summarizeEventLookup(&lookup)
+
+	if want := []string{"postgres", "recent_feed", "stream:events", "dead_letter:webhooks:dead:1"}; !slices.Equal(lookup.FoundIn, want) {
+		t.Errorf("Expected found_in %v, got %v", want, lookup.FoundIn)
+	}
+	if want := []string{"clickhouse"}; !slices.Equal(lookup.MissingFrom, want) {
+		t.Errorf("Expected missing_from %v, got %v", want, lookup.MissingFrom)
+	}
+	if want := []string{"search", "outbox"}; !slices.Equal(lookup.Unavailable, want) {
+		t.Errorf("Expected unavailable %v, got %v", want, lookup.Unavailable)
+	}
+	if !lookup.Pending {
+		t.Error("Expected the event to be pending while a group has not acknowledged it")
+	}
+}
+
+func TestEventLookupStatus(t *testing.T) {
+	cases := []struct {
+		name        string
+		foundIn     []string
+		unavailable []string
+		want        int
+	}{
+		{"found", []string{"postgres"}, []string{"clickhouse"}, 200},
+		{"nowhere", nil, nil, 404},
+		// An incomplete stream scan is listed as unavailable too.
+		{"not found while a store was unavailable", nil, []string{"postgres", "streams"}, 503},
+	}
+	for _, c := range cases {
+		lookup := eventLookup{FoundIn: c.foundIn, Unavailable: c.unavailable}
+		if got := eventLookupStatus(&lookup); got != c.want {
+			t.Errorf("%s: expected %d, got %d", c.name, c.want, got)
+		}
+	}
+}
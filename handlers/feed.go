@@ -16,7 +16,7 @@ func GetRecentFeed(c *gin.Context) {
 
 	rawEvents, err := database.GetRecentFeed(ctx)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -8,7 +8,7 @@ import (
 func FetchEvents(c *gin.Context) {
 	events, err := database.GetEvents(50)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(200, gin.H{"events": events})
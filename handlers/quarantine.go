@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"analytics-backend/database"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListQuarantinedMessages pages through quarantined stream messages, newest
+// first. Pass the returned next cursor as before to get the following page.
+func ListQuarantinedMessages(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	count, _ := strconv.ParseInt(c.DefaultQuery("count", "50"), 10, 64)
+	if count <= 0 || count > 500 {
+		count = 50
+	}
+
+	messages, next, err := database.ListQuarantinedMessages(ctx, database.QuarantineFilter{
+		Stream: c.Query("stream"),
+		Group:  c.Query("group"),
+		Before: c.Query("before"),
+		Count:  count,
+	})
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"messages": messages, "next": next})
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"analytics-backend/sinks"
+	"analytics-backend/worker"
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type replayJobRequest struct {
+	Source        string    `json:"source"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Actions       []string  `json:"actions"`
+	UserIDs       []string  `json:"user_ids"`
+	Targets       []string  `json:"targets"`
+	Rate          int       `json:"rate"`
+	DeleteDerived bool      `json:"delete_derived"`
+}
+
+// CreateReplayJob queues a replay. The replay scheduler picks it up and
+// enqueues its events for the replay workers.
+func CreateReplayJob(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var req replayJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	job := models.ReplayJob{
+		Source:        req.Source,
+		RangeStart:    req.From,
+		RangeEnd:      req.To,
+		Actions:       req.Actions,
+		UserIDs:       req.UserIDs,
+		Targets:       req.Targets,
+		Rate:          req.Rate,
+		DeleteDerived: req.DeleteDerived,
+	}
+	if err := worker.PrepareReplayJob(&job, sinks.Active); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.CreateReplayJob(ctx, &job); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(201, job)
+}
+
+func ListReplayJobs(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	jobs, err := database.ListReplayJobs(ctx, limit)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"jobs": jobs})
+}
+
+func GetReplayJob(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	job, ok := loadReplayJob(ctx, c)
+	if !ok {
+		return
+	}
+	c.JSON(200, job)
+}
+
+func PauseReplayJob(c *gin.Context) {
+	transitionReplayJob(c, []string{database.ReplayStatusPending, database.ReplayStatusRunning}, database.ReplayStatusPaused)
+}
+
+// ResumeReplayJob requeues a paused or failed job; it continues from its
+// checkpoint.
+func ResumeReplayJob(c *gin.Context) {
+	transitionReplayJob(c, []string{database.ReplayStatusPaused, database.ReplayStatusFailed}, database.ReplayStatusPending)
+}
+
+// CancelReplayJob stops a job for good. Entries it already enqueued are
+// skipped by the replay workers.
+func CancelReplayJob(c *gin.Context) {
+	transitionReplayJob(c, []string{
+		database.ReplayStatusPending,
+		database.ReplayStatusRunning,
+		database.ReplayStatusDraining,
+		database.ReplayStatusPaused,
+		database.ReplayStatusFailed,
+	}, database.ReplayStatusCancelled)
+}
+
+func transitionReplayJob(c *gin.Context, from []string, status string) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	job, ok := loadReplayJob(ctx, c)
+	if !ok {
+		return
+	}
+
+	changed, err := database.TransitionReplayJob(ctx, job.ID, from, status)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if !changed {
+		c.JSON(409, gin.H{"error": "cannot move a " + job.Status + " job to " + status})
+		return
+	}
+
+	job, ok = loadReplayJob(ctx, c)
+	if !ok {
+		return
+	}
+	c.JSON(200, job)
+}
+
+func loadReplayJob(ctx context.Context, c *gin.Context) (*models.ReplayJob, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid replay job id"})
+		return nil, false
+	}
+
+	job, err := database.GetReplayJob(ctx, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "replay job not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return job, true
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"analytics-backend/utils"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type savedSearchRequest struct {
+	Name                 string `json:"name" binding:"required"`
+	Query                string `json:"q"`
+	Action               string `json:"action"`
+	UserID               string `json:"user_id"`
+	From                 string `json:"from"`
+	To                   string `json:"to"`
+	Size                 int    `json:"size"`
+	IntervalSeconds      int    `json:"interval_seconds"`
+	WebhookDestinationID *uint  `json:"webhook_destination_id"`
+	Enabled              *bool  `json:"enabled"`
+}
+
+// validate checks the request and, for a scheduled search, that its webhook
+// destination exists.
+func (r savedSearchRequest) validate(ctx context.Context) (gin.H, error) {
+	if invalid := invalidSearchQuery(strings.TrimSpace(r.Query)); invalid != nil {
+		return invalid, nil
+	}
+	for name, raw := range map[string]string{"from": r.From, "to": r.To} {
+		if raw == "" {
+			continue
+		}
+		if _, err := parseSearchTime(raw); err != nil {
+			return gin.H{"error": fmt.Sprintf("invalid %s timestamp", name)}, nil
+		}
+	}
+	if r.Size < 0 || r.Size > 100 {
+		return gin.H{"error": "size must be between 0 and 100"}, nil
+	}
+	if r.IntervalSeconds < 0 {
+		return gin.H{"error": "interval_seconds must not be negative"}, nil
+	}
+	if r.IntervalSeconds > 0 && r.WebhookDestinationID == nil {
+		return gin.H{"error": "a scheduled search needs a webhook_destination_id"}, nil
+	}
+
+	if r.WebhookDestinationID != nil {
+		_, err := database.GetWebhookDestination(ctx, *r.WebhookDestinationID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return gin.H{"error": "webhook destination not found"}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (r savedSearchRequest) apply(search *models.SavedSearch, now time.Time) {
+	search.Name = r.Name
+	search.Query = strings.TrimSpace(r.Query)
+	search.Action = strings.TrimSpace(r.Action)
+	search.UserID = strings.TrimSpace(r.UserID)
+	search.From, search.To = nil, nil
+	if from, err := parseSearchTime(r.From); err == nil {
+		search.From = &from
+	}
+	if to, err := parseSearchTime(r.To); err == nil {
+		search.To = &to
+	}
+	search.Size = r.Size
+	search.IntervalSeconds = r.IntervalSeconds
+	search.WebhookDestinationID = r.WebhookDestinationID
+	if r.Enabled != nil {
+		search.Enabled = *r.Enabled
+	}
+
+	// A newly scheduled search only notifies about events from now on,
+	// rather than about everything that already matches.
+	if search.IntervalSeconds > 0 && search.HighWaterTimestamp.IsZero() {
+		search.HighWaterTimestamp = now
+		search.HighWaterID = utils.FirstIDAt(now)
+	}
+	search.NextRunAt = now
+}
+
+func CreateSavedSearch(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var req savedSearchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if invalid, err := req.validate(ctx); invalid != nil || err != nil {
+		respondInvalidSavedSearch(c, invalid, err)
+		return
+	}
+
+	search := models.SavedSearch{Enabled: true}
+	req.apply(&search, time.Now())
+	if err := database.CreateSavedSearch(ctx, &search); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(201, search)
+}
+
+func ListSavedSearches(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	searches, err := database.ListSavedSearches(ctx)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"searches": searches})
+}
+
+func GetSavedSearch(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	search, ok := loadSavedSearch(ctx, c)
+	if !ok {
+		return
+	}
+	c.JSON(200, search)
+}
+
+func UpdateSavedSearch(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	search, ok := loadSavedSearch(ctx, c)
+	if !ok {
+		return
+	}
+
+	var req savedSearchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if invalid, err := req.validate(ctx); invalid != nil || err != nil {
+		respondInvalidSavedSearch(c, invalid, err)
+		return
+	}
+
+	req.apply(search, time.Now())
+	if err := database.UpdateSavedSearch(ctx, search); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, search)
+}
+
+func DeleteSavedSearch(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid search id"})
+		return
+	}
+
+	deleted, err := database.DeleteSavedSearch(ctx, uint(id))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(404, gin.H{"error": "search not found"})
+		return
+	}
+	c.Status(204)
+}
+
+// RunSavedSearch runs a saved search and returns a page of its results, like
+// GET /search/events. It does not move the high-water mark.
+func RunSavedSearch(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	search, ok := loadSavedSearch(ctx, c)
+	if !ok {
+		return
+	}
+
+	params := database.SavedSearchParams(search)
+	params.Cursor = strings.TrimSpace(c.Query("cursor"))
+	results, err := database.SearchEvents(ctx, params)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, results)
+}
+
+func respondInvalidSavedSearch(c *gin.Context, invalid gin.H, err error) {
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(400, invalid)
+}
+
+func loadSavedSearch(ctx context.Context, c *gin.Context) (*models.SavedSearch, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid search id"})
+		return nil, false
+	}
+
+	search, err := database.GetSavedSearch(ctx, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "search not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return search, true
+}
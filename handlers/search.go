@@ -3,8 +3,11 @@ package handlers
 import (
 	"analytics-backend/database"
 	"analytics-backend/metrics"
+	"analytics-backend/searchql"
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -25,21 +28,81 @@ func SearchEvents(c *gin.Context) {
 	defer cancel()
 
 	size, _ := strconv.Atoi(c.DefaultQuery("size", "20"))
+	facetSize, _ := strconv.Atoi(c.DefaultQuery("facet_size", "10"))
 
+	facets, err := parseSearchFacets(c.Query("facets"))
+	if err != nil {
+		status = "invalid_request"
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	params, invalid := searchFilterParams(c)
+	if invalid != nil {
+		status = "invalid_request"
+		c.JSON(400, invalid)
+		return
+	}
+	params.Size = size
+	params.Cursor = strings.TrimSpace(c.Query("cursor"))
+	params.Facets = facets
+	params.FacetSize = facetSize
+
+	results, err := database.SearchEvents(ctx, params)
+	if err != nil {
+		status = "error"
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if results != nil && results.Source != "" {
+		source = results.Source
+	}
+
+	c.JSON(200, results)
+}
+
+// SuggestSearchValues completes a prefix typed into the search box to the
+// most common matching values of a field.
+func SuggestSearchValues(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	field := c.Query("field")
+	if !slices.Contains(database.SuggestFields, field) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("field must be one of %s", strings.Join(database.SuggestFields, ", "))})
+		return
+	}
+
+	size, _ := strconv.Atoi(c.DefaultQuery("size", "10"))
+	if size <= 0 || size > 50 {
+		size = 10
+	}
+
+	suggestions, err := database.SuggestSearchValues(ctx, field, strings.TrimSpace(c.Query("prefix")), size)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, suggestions)
+}
+
+// searchFilterParams reads q, action, user_id, from and to, or returns the
+// error response when one of them is invalid.
+func searchFilterParams(c *gin.Context) (database.SearchEventsParams, gin.H) {
 	params := database.SearchEventsParams{
 		Query:  strings.TrimSpace(c.Query("q")),
 		Action: strings.TrimSpace(c.Query("action")),
 		UserID: strings.TrimSpace(c.Query("user_id")),
-		Size:   size,
-		Cursor: strings.TrimSpace(c.Query("cursor")),
+	}
+
+	if invalid := invalidSearchQuery(params.Query); invalid != nil {
+		return params, invalid
 	}
 
 	if from := strings.TrimSpace(c.Query("from")); from != "" {
 		parsed, err := parseSearchTime(from)
 		if err != nil {
-			status = "invalid_request"
-			c.JSON(400, gin.H{"error": "invalid from timestamp"})
-			return
+			return params, gin.H{"error": "invalid from timestamp"}
 		}
 		params.From = &parsed
 	}
@@ -47,24 +110,49 @@ func SearchEvents(c *gin.Context) {
 	if to := strings.TrimSpace(c.Query("to")); to != "" {
 		parsed, err := parseSearchTime(to)
 		if err != nil {
-			status = "invalid_request"
-			c.JSON(400, gin.H{"error": "invalid to timestamp"})
-			return
+			return params, gin.H{"error": "invalid to timestamp"}
 		}
 		params.To = &parsed
 	}
+	return params, nil
+}
 
-	results, err := database.SearchEvents(ctx, params)
-	if err != nil {
-		status = "error"
-		c.JSON(500, gin.H{"error": err.Error()})
-		return
+// invalidSearchQuery returns the error response for a q that does not parse,
+// or nil when it is fine.
+func invalidSearchQuery(q string) gin.H {
+	if !searchql.IsQuery(q) {
+		return nil
 	}
-	if results != nil && results.Source != "" {
-		source = results.Source
+	_, err := searchql.Parse(q)
+	var parseErr *searchql.ParseError
+	if errors.As(err, &parseErr) {
+		return gin.H{"error": parseErr.Message, "position": parseErr.Pos}
 	}
+	if err != nil {
+		return gin.H{"error": err.Error()}
+	}
+	return nil
+}
 
-	c.JSON(200, results)
+// parseSearchFacets reads a comma separated list of facet names, where "all"
+// asks for every facet.
+func parseSearchFacets(raw string) ([]string, error) {
+	var facets []string
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+		case name == "all":
+			return database.SearchFacetNames, nil
+		case slices.Contains(database.SearchFacetNames, name):
+			if !slices.Contains(facets, name) {
+				facets = append(facets, name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown facet %q", name)
+		}
+	}
+	return facets, nil
 }
 
 func parseSearchTime(raw string) (time.Time, error) {
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+)
+
+// exportWriteTimeout bounds writing one page of an export, replacing the
+// server's write timeout, which an export outlasts.
+const exportWriteTimeout = time.Minute
+
+// ExportSearchEvents streams every event matching a search as CSV or NDJSON,
+// newest first. It takes the filters of GET /search/events, plus format,
+// columns and limit, and compresses the response when the client accepts
+// gzip. Closing the connection stops the export.
+func ExportSearchEvents(c *gin.Context) {
+	format := c.DefaultQuery("format", exportFormatNDJSON)
+	if format != exportFormatCSV && format != exportFormatNDJSON {
+		c.JSON(400, gin.H{"error": "format must be csv or ndjson"})
+		return
+	}
+
+	columns, err := parseExportColumns(c.Query("columns"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := database.SearchExportMaxRows
+	if raw := c.Query("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > database.SearchExportMaxRows {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", database.SearchExportMaxRows)})
+			return
+		}
+	}
+
+	params, invalid := searchFilterParams(c)
+	if invalid != nil {
+		c.JSON(400, invalid)
+		return
+	}
+
+	var writer *eventExportWriter
+	start := func(total int64) error {
+		c.Header("Content-Type", map[string]string{exportFormatCSV: "text/csv", exportFormatNDJSON: "application/x-ndjson"}[format])
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"events.%s\"", format))
+		c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+		c.Header("X-Export-Truncated", strconv.FormatBool(total > int64(limit)))
+		c.Header("Vary", "Accept-Encoding")
+		gzipped := strings.Contains(c.GetHeader("Accept-Encoding"), "gzip")
+		if gzipped {
+			c.Header("Content-Encoding", "gzip")
+		}
+		c.Status(200)
+
+		writer = newEventExportWriter(c.Writer, format, columns, gzipped)
+		return writer.writeHeader()
+	}
+
+	controller := http.NewResponseController(c.Writer)
+	exported, err := database.ExportSearchEvents(c.Request.Context(), params, limit, func(page database.SearchExportPage) error {
+		controller.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+		if writer == nil {
+			if err := start(page.Total); err != nil {
+				return err
+			}
+		}
+		for _, event := range page.Events {
+			if err := writer.write(event); err != nil {
+				return err
+			}
+		}
+		metrics.SearchExportedEvents.Add(float64(len(page.Events)))
+		return writer.flush()
+	})
+
+	switch {
+	case err != nil && writer == nil:
+		metrics.SearchExports.WithLabelValues(format, "error").Inc()
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		// The status is already sent, so a failed export can only end early.
+		// X-Total-Count tells the client it is incomplete.
+		status := "error"
+		if c.Request.Context().Err() != nil {
+			status = "cancelled"
+		}
+		metrics.SearchExports.WithLabelValues(format, status).Inc()
+		log.Printf("Search export stopped after %d events: %v", exported, err)
+		return
+	case writer == nil:
+		if err := start(0); err != nil {
+			return
+		}
+	}
+
+	metrics.SearchExports.WithLabelValues(format, "success").Inc()
+	if err := writer.close(); err != nil {
+		log.Printf("Failed to finish search export: %v", err)
+	}
+}
+
+// parseExportColumns reads a comma separated list of event fields, defaulting
+// to all of them.
+func parseExportColumns(raw string) ([]string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return models.EventFields, nil
+	}
+
+	var columns []string
+	for _, column := range strings.Split(raw, ",") {
+		column = strings.TrimSpace(column)
+		if !slices.Contains(models.EventFields, column) {
+			return nil, fmt.Errorf("unknown column %q", column)
+		}
+		if !slices.Contains(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+	return columns, nil
+}
+
+type eventExportWriter struct {
+	format  string
+	columns []string
+	flusher http.Flusher
+	gzip    *gzip.Writer
+	csv     *csv.Writer
+	out     io.Writer
+	line    bytes.Buffer
+}
+
+func newEventExportWriter(w gin.ResponseWriter, format string, columns []string, gzipped bool) *eventExportWriter {
+	writer := &eventExportWriter{format: format, columns: columns, flusher: w, out: w}
+	if gzipped {
+		writer.gzip = gzip.NewWriter(w)
+		writer.out = writer.gzip
+	}
+	if format == exportFormatCSV {
+		writer.csv = csv.NewWriter(writer.out)
+	}
+	return writer
+}
+
+func (w *eventExportWriter) writeHeader() error {
+	if w.csv == nil {
+		return nil
+	}
+	return w.csv.Write(w.columns)
+}
+
+func (w *eventExportWriter) write(event models.Event) error {
+	if w.csv != nil {
+		record := make([]string, 0, len(w.columns))
+		for _, column := range w.columns {
+			value, _ := event.FieldValue(column)
+			record = append(record, value)
+		}
+		return w.csv.Write(record)
+	}
+
+	// Written by hand to keep the columns in the order they were asked for.
+	w.line.Reset()
+	w.line.WriteByte('{')
+	for i, column := range w.columns {
+		if i > 0 {
+			w.line.WriteByte(',')
+		}
+		key, _ := json.Marshal(column)
+		value, err := json.Marshal(exportValue(event, column))
+		if err != nil {
+			return err
+		}
+		w.line.Write(key)
+		w.line.WriteByte(':')
+		w.line.Write(value)
+	}
+	w.line.WriteString("}\n")
+	_, err := w.out.Write(w.line.Bytes())
+	return err
+}
+
+func (w *eventExportWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if w.gzip != nil {
+		if err := w.gzip.Flush(); err != nil {
+			return err
+		}
+	}
+	w.flusher.Flush()
+	return nil
+}
+
+func (w *eventExportWriter) close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if w.gzip != nil {
+		return w.gzip.Close()
+	}
+	return nil
+}
+
+// exportValue keeps numbers as JSON numbers, where FieldValue formats every
+// field as a string.
+func exportValue(event models.Event, column string) any {
+	switch column {
+	case "id":
+		return event.ID
+	case "duration":
+		return event.Duration
+	}
+	value, _ := event.FieldValue(column)
+	return value
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"analytics-backend/sinks"
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetSinks(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	statuses := sinks.Active.Health(ctx)
+	healthy := true
+	for _, status := range statuses {
+		if !status.Healthy && !status.Optional {
+			healthy = false
+		}
+	}
+
+	code := 200
+	if !healthy {
+		code = 503
+	}
+	c.JSON(code, gin.H{"healthy": healthy, "sinks": statuses, "available_types": sinks.RegisteredTypes()})
+}
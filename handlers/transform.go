@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"analytics-backend/models"
+	"analytics-backend/transform"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type transformDryRunRequest struct {
+	Event models.Event `json:"event"`
+	Rules string       `json:"rules"`
+}
+
+// GetTransforms shows the rules applied at ingestion. Events published again
+// by a replay or an archive restore were transformed when they were first
+// ingested and are not run through the rules again.
+func GetTransforms(c *gin.Context) {
+	source, loadedAt := transform.Status()
+	c.JSON(200, gin.H{
+		"source":    source,
+		"loaded_at": loadedAt,
+		"rules":     transform.Active().Rules(),
+	})
+}
+
+// DryRunTransform applies the active rules, or the YAML rules sent in the
+// request, to a sample event without ingesting it or counting rule hits.
+func DryRunTransform(c *gin.Context) {
+	var req transformDryRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	pipeline := transform.Active()
+	if req.Rules != "" {
+		parsed, err := transform.Parse([]byte(req.Rules))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		pipeline = parsed
+	}
+
+	if req.Event.Timestamp.IsZero() {
+		req.Event.Timestamp = time.Now()
+	}
+
+	result := pipeline.DryRun(req.Event)
+	c.JSON(200, gin.H{
+		"input":         req.Event,
+		"output":        result.Event,
+		"dropped":       result.Dropped,
+		"matched_rules": result.Matched,
+		"errors":        result.Errors,
+	})
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"analytics-backend/database"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetUniqueUsers(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	to := time.Now().UTC()
+	if raw := strings.TrimSpace(c.Query("to")); raw != "" {
+		parsed, err := parseSearchTime(raw)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "invalid to timestamp"})
+			return
+		}
+		to = parsed
+	}
+
+	from := to.Add(-24 * time.Hour)
+	if raw := strings.TrimSpace(c.Query("from")); raw != "" {
+		parsed, err := parseSearchTime(raw)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "invalid from timestamp"})
+			return
+		}
+		from = parsed
+	}
+
+	if !from.Before(to) {
+		c.JSON(400, gin.H{"error": "from must be before to"})
+		return
+	}
+	if to.Sub(from) > database.UniqueUsersMaxRange {
+		c.JSON(400, gin.H{"error": database.ErrUniqueUsersRangeTooLong.Error()})
+		return
+	}
+
+	action := strings.TrimSpace(c.Query("action"))
+	element := strings.TrimSpace(c.Query("element"))
+
+	count, err := database.CountUniqueUsers(ctx, action, element, from, to)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"action":       action,
+		"element":      element,
+		"from":         from,
+		"to":           to,
+		"unique_users": count,
+		"approximate":  true,
+	})
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetUniqueUsers_RejectsRangesLongerThanAYear(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.GET("/analytics/unique-users", GetUniqueUsers)
+
+	req, _ := http.NewRequest("GET", "/analytics/unique-users?from=2020-01-01&to=2026-01-01", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "366 days") {
+		t.Errorf("Expected status 400 for the range, got %d %s", w.Code, w.Body.String())
+	}
+}
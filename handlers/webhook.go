@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type webhookDestinationRequest struct {
+	Name        string            `json:"name" binding:"required"`
+	URL         string            `json:"url" binding:"required"`
+	Secret      string            `json:"secret"`
+	Actions     []string          `json:"actions"`
+	Elements    []string          `json:"elements"`
+	Properties  map[string]string `json:"properties"`
+	BatchSize   int               `json:"batch_size"`
+	MaxAttempts int               `json:"max_attempts"`
+	Enabled     *bool             `json:"enabled"`
+}
+
+func (r webhookDestinationRequest) validate() error {
+	parsed, err := url.Parse(r.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if r.BatchSize < 0 || r.MaxAttempts < 0 {
+		return fmt.Errorf("batch_size and max_attempts must not be negative")
+	}
+
+	patterns := append(append([]string{}, r.Actions...), r.Elements...)
+	for field, pattern := range r.Properties {
+		if !slices.Contains(models.EventFields, field) {
+			return fmt.Errorf("unknown property %q", field)
+		}
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (r webhookDestinationRequest) apply(destination *models.WebhookDestination) {
+	destination.Name = r.Name
+	destination.URL = r.URL
+	destination.Actions = r.Actions
+	destination.Elements = r.Elements
+	destination.Properties = r.Properties
+	destination.BatchSize = r.BatchSize
+	destination.MaxAttempts = r.MaxAttempts
+	if r.Secret != "" {
+		destination.Secret = r.Secret
+	}
+	if r.Enabled != nil {
+		destination.Enabled = *r.Enabled
+	}
+}
+
+func CreateWebhookDestination(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var req webhookDestinationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	destination := models.WebhookDestination{Enabled: true}
+	req.apply(&destination)
+	if destination.Secret == "" {
+		secret, err := generateWebhookSecret()
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		destination.Secret = secret
+	}
+
+	if err := database.CreateWebhookDestination(ctx, &destination); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// The secret is only ever returned once, when the destination is created.
+	c.JSON(201, gin.H{"destination": destination, "secret": destination.Secret})
+}
+
+func ListWebhookDestinations(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	destinations, err := database.ListWebhookDestinations(ctx)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"destinations": destinations})
+}
+
+func GetWebhookDestination(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	destination, ok := loadWebhookDestination(ctx, c)
+	if !ok {
+		return
+	}
+	c.JSON(200, destination)
+}
+
+func UpdateWebhookDestination(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	destination, ok := loadWebhookDestination(ctx, c)
+	if !ok {
+		return
+	}
+
+	var req webhookDestinationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	req.apply(destination)
+	if err := database.UpdateWebhookDestination(ctx, destination); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, destination)
+}
+
+func DeleteWebhookDestination(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid destination id"})
+		return
+	}
+
+	deleted, err := database.DeleteWebhookDestination(ctx, uint(id))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(404, gin.H{"error": "destination not found"})
+		return
+	}
+	c.Status(204)
+}
+
+func ListWebhookDeadLetters(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	destination, ok := loadWebhookDestination(ctx, c)
+	if !ok {
+		return
+	}
+
+	count, _ := strconv.ParseInt(c.DefaultQuery("count", "50"), 10, 64)
+	if count <= 0 || count > 500 {
+		count = 50
+	}
+
+	letters, err := database.ListWebhookDeadLetters(ctx, destination.ID, count)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"dead_letters": letters})
+}
+
+func loadWebhookDestination(ctx context.Context, c *gin.Context) (*models.WebhookDestination, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid destination id"})
+		return nil, false
+	}
+
+	destination, err := database.GetWebhookDestination(ctx, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "destination not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return destination, true
+}
+
+func generateWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
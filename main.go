@@ -1,18 +1,21 @@
 package main
 
 import (
+	"analytics-backend/archive"
 	"analytics-backend/config"
 	"analytics-backend/database"
 	"analytics-backend/handlers"
 	"analytics-backend/metrics"
+	"analytics-backend/sinks"
+	"analytics-backend/transform"
 	"analytics-backend/utils"
 	"analytics-backend/worker"
 	"context"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,49 +23,209 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var ctx = context.Background()
-
 func main() {
 	cfg, err := config.LoadConfig("config.yaml")
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	database.ConfigureBackends(cfg.Backends)
 	database.InitRedis(cfg.Redis)
 	database.Initdb(cfg.Postgres)
 	database.InitClickHouse(cfg.ClickHouse)
-	if err := database.InitElasticsearch(cfg.Elasticsearch); err != nil {
-		log.Fatalf("Failed to initialize Elasticsearch: %v", err)
+	if err := database.ConfigureSearchFallback(cfg.Elasticsearch); err != nil {
+		log.Fatalf("Failed to configure search fallback: %v", err)
+	}
+	database.ConfigureSearchExport(cfg.Elasticsearch)
+	if err := database.InitSearch(cfg.Search, cfg.Elasticsearch); err != nil {
+		log.Fatalf("Failed to initialize search: %v", err)
 	}
 	utils.InitSnowflake(1)
+	worker.ConfigureAggregation(cfg.Aggregation)
+	worker.ConfigureWorkerBackoff(cfg.Workers)
+	worker.ConfigureOutbox(cfg.Outbox)
+	worker.ConfigureReplay(cfg.Replay)
+	worker.ConfigureRetention(cfg.Retention)
+	worker.ConfigureSearchIndices(cfg.Elasticsearch)
+	worker.ConfigureSavedSearches(cfg.SavedSearches)
+	if err := sinks.Init(cfg.Sinks); err != nil {
+		log.Fatalf("Failed to configure sinks: %v", err)
+	}
 
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	defer stopReload()
+	if err := transform.Init(reloadCtx, cfg.Transforms.Path, cfg.Transforms.ReloadInterval); err != nil {
+		log.Fatalf("Failed to load transform rules: %v", err)
+	}
+
+	if err := database.ConfigureLanes(cfg.Lanes); err != nil {
+		log.Fatalf("Failed to configure lanes: %v", err)
+	}
+	if err := database.ConfigureSharding(cfg.Sharding); err != nil {
+		log.Fatalf("Failed to configure sharding: %v", err)
+	}
 	if err := database.EnsureConsumerGroup(); err != nil {
 		log.Fatalf("Failed to create consumer group: %v", err)
 	}
 	if err := database.EnsureIndexerGroup(); err != nil {
 		log.Fatalf("Failed to create indexer group: %v", err)
 	}
+	if err := database.EnsureReplayGroup(); err != nil {
+		log.Fatalf("Failed to create replay group: %v", err)
+	}
+	if cfg.Webhooks.Enabled {
+		if err := database.EnsureWebhookGroup(); err != nil {
+			log.Fatalf("Failed to create webhook group: %v", err)
+		}
+		worker.ConfigureWebhooks(cfg.Webhooks)
+	}
+	var archiveStorage archive.Storage
+	if cfg.Archive.Enabled {
+		archiveStorage, err = archive.NewStorage(context.Background(), cfg.Archive)
+		if err != nil {
+			log.Fatalf("Failed to configure archive storage: %v", err)
+		}
+		if err := database.EnsureArchiveGroup(); err != nil {
+			log.Fatalf("Failed to create archive group: %v", err)
+		}
+		worker.ConfigureArchive(cfg.Archive)
+	}
 	log.Println("Consumer group created successfully")
-	go database.StartMetricsCollector(ctx)
 
-	log.Println("Starting 4 background workers...")
-	for i := 0; i < 4; i++ {
-		workerName := fmt.Sprintf("worker-%d", i+1)
-		eventStore := &worker.DefaultEventStore{Consumer: workerName}
-		go worker.StartAggregatorWorker(workerName, eventStore)
+	collectorCtx, stopCollector := context.WithCancel(context.Background())
+	collectorDone := make(chan struct{})
+	go func() {
+		defer close(collectorDone)
+		database.StartMetricsCollector(collectorCtx)
+	}()
+	searchHealthDone := make(chan struct{})
+	go func() {
+		defer close(searchHealthDone)
+		database.StartSearchHealthChecks(collectorCtx)
+	}()
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+
+	var laneStreams []string
+	for _, lane := range database.Lanes() {
+		laneStreams = append(laneStreams, lane.Stream)
+	}
+
+	pools := []worker.PoolSpec{
+		{
+			Kind:       "aggregator",
+			NamePrefix: "worker",
+			Streams:    laneStreams,
+			Group:      database.GroupName,
+			Config:     poolConfig(cfg.Workers.Aggregators, 4),
+			Run: func(ctx context.Context, workerName string) {
+				worker.StartAggregatorWorker(ctx, workerName, &worker.DefaultEventStore{Consumer: workerName})
+			},
+		},
+		{
+			Kind:       "outbox",
+			NamePrefix: "outbox-relay",
+			Config:     poolConfig(config.WorkerPoolConfig{}, max(cfg.Outbox.Relays, 1)),
+			Run: func(ctx context.Context, workerName string) {
+				worker.StartOutboxRelay(ctx, workerName, &worker.DefaultOutboxStore{})
+			},
+		},
+		{
+			Kind:       "indexer",
+			NamePrefix: "indexer",
+			Stream:     database.IndexStreamName,
+			Group:      database.IndexGroupName,
+			Config:     poolConfig(cfg.Workers.Indexers, 2),
+			Run: func(ctx context.Context, workerName string) {
+				worker.StartSearchIndexerWorker(ctx, workerName, &worker.DefaultIndexStore{Consumer: workerName})
+			},
+		},
 	}
-	log.Println("Starting 2 search indexer workers...")
-	for i := 0; i < 2; i++ {
-		workerName := fmt.Sprintf("indexer-%d", i+1)
-		indexStore := &worker.DefaultIndexStore{Consumer: workerName}
-		go worker.StartSearchIndexerWorker(workerName, indexStore)
+	pools = append(pools,
+		worker.PoolSpec{
+			Kind:       "replay_scheduler",
+			NamePrefix: "replay-scheduler",
+			Config:     poolConfig(config.WorkerPoolConfig{}, 1),
+			Run: func(ctx context.Context, workerName string) {
+				worker.StartReplayScheduler(ctx, workerName, &worker.DefaultReplayJobStore{Storage: archiveStorage})
+			},
+		},
+		worker.PoolSpec{
+			Kind:       "replay",
+			NamePrefix: "replay",
+			Stream:     database.ReplayStreamName,
+			Group:      database.ReplayGroupName,
+			Config:     poolConfig(config.WorkerPoolConfig{}, max(cfg.Replay.Workers, 1)),
+			Run: func(ctx context.Context, workerName string) {
+				worker.StartReplayWorker(ctx, workerName, &worker.DefaultReplayStore{Consumer: workerName})
+			},
+		},
+		worker.PoolSpec{
+			Kind:       "stream_trimmer",
+			NamePrefix: "stream-trimmer",
+			Config:     poolConfig(config.WorkerPoolConfig{}, 1),
+			Run: func(ctx context.Context, workerName string) {
+				worker.StartStreamTrimmer(ctx, workerName, &worker.DefaultStreamTrimStore{})
+			},
+		},
+		worker.PoolSpec{
+			Kind:       "saved_search_scheduler",
+			NamePrefix: "saved-search-scheduler",
+			Config:     poolConfig(config.WorkerPoolConfig{}, 1),
+			Run: func(ctx context.Context, workerName string) {
+				worker.StartSavedSearchScheduler(ctx, workerName, &worker.DefaultSavedSearchStore{})
+			},
+		},
+	)
+	if database.UsesElasticsearch() {
+		pools = append(pools, worker.PoolSpec{
+			Kind:       "search_index_maintainer",
+			NamePrefix: "search-index-maintainer",
+			Config:     poolConfig(config.WorkerPoolConfig{}, 1),
+			Run: func(ctx context.Context, workerName string) {
+				worker.StartSearchIndexMaintainer(ctx, workerName, &worker.DefaultSearchIndexStore{})
+			},
+		})
+	}
+	if cfg.Webhooks.Enabled {
+		pools = append(pools, worker.PoolSpec{
+			Kind:       "webhook",
+			NamePrefix: "webhook",
+			Streams:    laneStreams,
+			Group:      database.WebhookGroupName,
+			Config:     poolConfig(config.WorkerPoolConfig{}, max(cfg.Webhooks.Workers, 1)),
+			Run: func(ctx context.Context, workerName string) {
+				worker.StartWebhookWorker(ctx, workerName, &worker.DefaultWebhookStore{Consumer: workerName})
+			},
+		})
+	}
+
+	if cfg.Archive.Enabled {
+		pools = append(pools, worker.PoolSpec{
+			Kind:       "archiver",
+			NamePrefix: "archiver",
+			Streams:    laneStreams,
+			Group:      database.ArchiveGroupName,
+			Config:     poolConfig(config.WorkerPoolConfig{}, max(cfg.Archive.Workers, 1)),
+			Run: func(ctx context.Context, workerName string) {
+				worker.StartArchiverWorker(ctx, workerName, &worker.DefaultArchiveStore{Consumer: workerName, Storage: archiveStorage})
+			},
+		})
 	}
 
+	supervisor := worker.NewSupervisor(cfg.Workers.CheckInterval, pools...)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		supervisor.Run(workerCtx)
+	}()
+
 	router := gin.Default()
 
 	router.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		c.Header("Access-Control-Allow-Headers", "Content-Type")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -76,15 +239,44 @@ func main() {
 	router.MaxMultipartMemory = 32 << 20
 
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/sinks", handlers.GetSinks)
+	router.GET("/backends", handlers.GetBackends)
+	router.GET("/quarantine", handlers.ListQuarantinedMessages)
+	router.GET("/transforms", handlers.GetTransforms)
+	router.POST("/transforms/dry-run", handlers.DryRunTransform)
 
 	router.POST("/event", handlers.GetEvent)
 	router.GET("/events", handlers.FetchEvents)
 	router.GET("/events/recent", handlers.GetRecentFeed)
 	router.GET("/events/stream", handlers.GetEventsStream)
+	router.GET("/events/:id", handlers.LookupEvent)
 	router.GET("/search/events", handlers.SearchEvents)
+	router.GET("/search/events/export", handlers.ExportSearchEvents)
+	router.GET("/search/suggest", handlers.SuggestSearchValues)
+	router.POST("/searches", handlers.CreateSavedSearch)
+	router.GET("/searches", handlers.ListSavedSearches)
+	router.GET("/searches/:id", handlers.GetSavedSearch)
+	router.PUT("/searches/:id", handlers.UpdateSavedSearch)
+	router.DELETE("/searches/:id", handlers.DeleteSavedSearch)
+	router.POST("/searches/:id/run", handlers.RunSavedSearch)
 	router.GET("/analytics/clickhouse", handlers.GetAnalyticsClickHouse)
 	router.GET("/analytics/sequential", handlers.GetAnalyticsSequential)
 	router.GET("/analytics/mapreduce", handlers.GetAnalyticsMapReduce)
+	router.GET("/analytics/unique-users", handlers.GetUniqueUsers)
+
+	router.POST("/webhooks", handlers.CreateWebhookDestination)
+	router.GET("/webhooks", handlers.ListWebhookDestinations)
+	router.GET("/webhooks/:id", handlers.GetWebhookDestination)
+	router.PUT("/webhooks/:id", handlers.UpdateWebhookDestination)
+	router.DELETE("/webhooks/:id", handlers.DeleteWebhookDestination)
+	router.GET("/webhooks/:id/dead-letters", handlers.ListWebhookDeadLetters)
+
+	router.POST("/admin/replays", handlers.CreateReplayJob)
+	router.GET("/admin/replays", handlers.ListReplayJobs)
+	router.GET("/admin/replays/:id", handlers.GetReplayJob)
+	router.POST("/admin/replays/:id/pause", handlers.PauseReplayJob)
+	router.POST("/admin/replays/:id/resume", handlers.ResumeReplayJob)
+	router.POST("/admin/replays/:id/cancel", handlers.CancelReplayJob)
 
 	srv := &http.Server{
 		Addr:           ":8080",
@@ -108,12 +300,68 @@ func main() {
 
 	log.Println("Shutting down server...")
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	shutdownTimeout := cfg.Server.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 30 * time.Second
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
+	log.Println("Stopping workers...")
+	stopWorkers()
+	workerTimeout := cfg.Server.WorkerShutdownTimeout
+	if workerTimeout <= 0 {
+		workerTimeout = 20 * time.Second
+	}
+	if waitTimeout(&workers, workerTimeout) {
+		log.Println("All workers stopped")
+	} else {
+		log.Printf("Workers did not stop within %s, continuing shutdown", workerTimeout)
+	}
+
+	stopCollector()
+	<-collectorDone
+	<-searchHealthDone
+
+	database.CloseElasticsearch()
+	if err := database.CloseClickHouse(); err != nil {
+		log.Printf("Failed to close ClickHouse: %v", err)
+	}
+	if err := database.ClosePostgres(); err != nil {
+		log.Printf("Failed to close Postgres: %v", err)
+	}
+	if err := database.CloseRedis(); err != nil {
+		log.Printf("Failed to close Redis: %v", err)
+	}
+
 	log.Println("Server exited gracefully")
 }
+
+// poolConfig falls back to a fixed pool of the given size when no bounds are
+// configured, which matches the worker counts used before autoscaling.
+func poolConfig(cfg config.WorkerPoolConfig, fixed int) config.WorkerPoolConfig {
+	if cfg.Min <= 0 && cfg.Max <= 0 {
+		cfg.Min = fixed
+		cfg.Max = fixed
+	}
+	return cfg
+}
+
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
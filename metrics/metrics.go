@@ -49,6 +49,125 @@ var (
 		Help: "Total number of aggregated event records created",
 	})
 
+	StreamWatermark = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analytics_stream_watermark_seconds",
+		Help: "Event-time watermark per stream as a Unix timestamp",
+	}, []string{"stream"})
+
+	LateEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_late_events_total",
+		Help: "Total number of events that arrived after their window was finalized",
+	}, []string{"stream", "policy"})
+
+	EventLateness = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "analytics_event_lateness_seconds",
+		Help:    "How far behind the watermark late events arrived, in seconds",
+		Buckets: []float64{1, 5, 15, 30, 60, 300, 900, 3600, 21600, 86400},
+	}, []string{"stream"})
+
+	WindowsFinalized = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_windows_finalized_total",
+		Help: "Total number of aggregated rows marked as finalized",
+	})
+
+	SinkWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "analytics_sink_write_duration_seconds",
+		Help:    "Time spent writing a batch to a sink",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	}, []string{"sink"})
+
+	SinkEventsWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_sink_events_written_total",
+		Help: "Total number of events written to each sink",
+	}, []string{"sink"})
+
+	SinkWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_sink_write_failures_total",
+		Help: "Total number of failed sink batch writes",
+	}, []string{"sink"})
+
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_webhook_deliveries_total",
+		Help: "Webhook delivery attempts by destination and outcome",
+	}, []string{"destination", "status"})
+
+	WebhookDeliveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "analytics_webhook_delivery_duration_seconds",
+		Help:    "Webhook HTTP request duration in seconds",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"destination"})
+
+	WebhookEventsDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_webhook_events_delivered_total",
+		Help: "Total number of events successfully delivered to each webhook destination",
+	}, []string{"destination"})
+
+	ArchiveFilesWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_archive_files_written_total",
+		Help: "Total number of Parquet files written to the archive",
+	})
+
+	ArchiveRowsWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_archive_rows_written_total",
+		Help: "Total number of events written to archive files",
+	})
+
+	ArchiveBytesWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_archive_bytes_written_total",
+		Help: "Total size of archive files written in bytes",
+	})
+
+	ArchiveWriteFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_archive_write_failures_total",
+		Help: "Total number of archive files that failed to write",
+	})
+
+	ArchiveBufferedRows = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "analytics_archive_buffered_rows",
+		Help: "Events read by archivers but not yet written to a file",
+	})
+
+	TransformRuleHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_transform_rule_hits_total",
+		Help: "Total number of events matched by each transform rule",
+	}, []string{"rule"})
+
+	TransformErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_transform_errors_total",
+		Help: "Transform actions skipped because they produced an invalid value",
+	}, []string{"rule"})
+
+	TransformReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_transform_reloads_total",
+		Help: "Transform rule file loads by outcome",
+	}, []string{"status"})
+
+	EventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_events_dropped_total",
+		Help: "Total number of events dropped by transform rules at ingestion",
+	})
+
+	OutboxPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "analytics_outbox_pending",
+		Help: "Committed batches not yet written to every relayed sink",
+	})
+
+	OutboxEntriesRelayed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_outbox_entries_relayed_total",
+		Help: "Total number of outbox entries written to all of their sinks",
+	})
+
+	OutboxRelayFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_outbox_relay_failures_total",
+		Help: "Outbox relay attempts that failed on a required sink",
+	}, []string{"sink"})
+
+	OutboxRelayLag = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "analytics_outbox_relay_lag_seconds",
+		Help:    "Time from a batch commit until every relayed sink has it",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	})
+
 	SearchQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "analytics_search_query_duration_seconds",
 		Help:    "Search endpoint duration in seconds",
@@ -97,6 +216,11 @@ var (
 		Help: "Number of pending messages in a Redis consumer group",
 	}, []string{"stream", "group"})
 
+	StreamLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analytics_stream_group_lag",
+		Help: "Number of stream entries not yet delivered to a Redis consumer group",
+	}, []string{"stream", "group"})
+
 	StreamConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "analytics_stream_consumer_pending",
 		Help: "Pending messages assigned to a specific Redis stream consumer",
@@ -138,4 +262,159 @@ var (
 		Name: "analytics_worker_iterations_total",
 		Help: "Total number of worker loop iterations by type",
 	}, []string{"worker_type"})
+
+	WorkerTarget = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analytics_worker_target",
+		Help: "Number of worker goroutines the supervisor is aiming for by type",
+	}, []string{"worker_type"})
+
+	WorkerRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_worker_restarts_total",
+		Help: "Total number of worker goroutines restarted after a panic",
+	}, []string{"worker_type"})
+
+	WorkerScaleEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_worker_scale_events_total",
+		Help: "Total number of supervisor scaling decisions by type and direction",
+	}, []string{"worker_type", "direction"})
+
+	ReplayEventsEnqueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_replay_events_enqueued_total",
+		Help: "Total number of historical events enqueued for replay",
+	})
+
+	ReplayEventsWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_replay_events_written_total",
+		Help: "Total number of replayed events written by target",
+	}, []string{"target"})
+
+	ReplayFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_replay_failures_total",
+		Help: "Total number of replay failures by stage",
+	}, []string{"stage"})
+
+	LaneEventsRouted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_lane_events_routed_total",
+		Help: "Total number of ingested events routed to each priority lane",
+	}, []string{"lane"})
+
+	LaneEventsRead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_lane_events_read_total",
+		Help: "Total number of events read from each priority lane by consumer group",
+	}, []string{"lane", "group"})
+
+	LaneBacklog = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analytics_lane_backlog",
+		Help: "Pending plus undelivered messages of a priority lane by consumer group",
+	}, []string{"lane", "group"})
+
+	LaneLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analytics_lane_lag",
+		Help: "Entries of a priority lane not yet delivered to a consumer group",
+	}, []string{"lane", "group"})
+
+	BackendBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analytics_backend_breaker_state",
+		Help: "Circuit breaker state by backend (0 closed, 1 half-open, 2 open)",
+	}, []string{"backend"})
+
+	BackendBreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_backend_breaker_transitions_total",
+		Help: "Total number of circuit breaker state changes by backend and new state",
+	}, []string{"backend", "state"})
+
+	BackendRejectedCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_backend_rejected_calls_total",
+		Help: "Total number of backend calls rejected by an open circuit breaker",
+	}, []string{"backend"})
+
+	BackendRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_backend_retries_total",
+		Help: "Total number of backend calls retried after a failure",
+	}, []string{"backend"})
+
+	QuarantinedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_quarantined_messages_total",
+		Help: "Total number of stream entries quarantined because they could not be decoded",
+	}, []string{"stream", "group", "field"})
+
+	StreamTrimmedEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_stream_trimmed_entries_total",
+		Help: "Total number of acknowledged entries trimmed from a stream",
+	}, []string{"stream"})
+
+	StreamTrimmedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_stream_trimmed_bytes_total",
+		Help: "Estimated bytes of Redis memory reclaimed by trimming a stream",
+	}, []string{"stream"})
+
+	StreamMemoryBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analytics_stream_memory_bytes",
+		Help: "Estimated Redis memory used by a stream after its last trim",
+	}, []string{"stream"})
+
+	StreamRetentionFloorAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analytics_stream_retention_floor_age_seconds",
+		Help: "Age of the oldest stream entry some consumer group still needs",
+	}, []string{"stream"})
+
+	StreamRetentionHeld = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analytics_stream_retention_held",
+		Help: "Whether a consumer group kept the last trim from reaching the retention policy (1) or not (0)",
+	}, []string{"stream"})
+
+	ShardsOwned = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "analytics_shards_owned",
+		Help: "Number of event shards a consumer holds a lease on",
+	}, []string{"group", "consumer"})
+
+	ShardLeaseChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_shard_lease_changes_total",
+		Help: "Total number of shard leases acquired, released or lost",
+	}, []string{"shard", "event"})
+
+	SearchIndexRollovers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_search_index_rollovers_total",
+		Help: "Total number of times the search write alias was rolled over to a new index",
+	})
+
+	SearchIndicesDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_search_indices_deleted_total",
+		Help: "Total number of search indices deleted past their retention",
+	})
+
+	SearchIndexMigrations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_search_index_migrations_total",
+		Help: "Total number of search indices migrated to the current mapping",
+	})
+
+	SearchIndices = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "analytics_search_indices",
+		Help: "Number of search backing indices holding events",
+	})
+
+	SearchBackendHealthy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "analytics_search_backend_healthy",
+		Help: "Whether searches go to Elasticsearch (1) or the fallback source (0)",
+	})
+
+	SavedSearchRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_saved_search_runs_total",
+		Help: "Total number of scheduled saved search runs by result",
+	}, []string{"result"})
+
+	SavedSearchNotifiedEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_saved_search_notified_events_total",
+		Help: "Total number of new events sent in saved search notifications",
+	})
+
+	SearchExports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "analytics_search_exports_total",
+		Help: "Total number of search exports by format and status",
+	}, []string{"format", "status"})
+
+	SearchExportedEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "analytics_search_exported_events_total",
+		Help: "Total number of events written by search exports",
+	})
 )
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var EventFields = []string{"id", "user_id", "action", "element", "duration", "timestamp"}
+
+// FieldValue returns an event field by its JSON name, formatted as a string,
+// so rules and filters can address fields without a switch of their own.
+func (e Event) FieldValue(name string) (string, bool) {
+	switch name {
+	case "id":
+		return strconv.FormatInt(e.ID, 10), true
+	case "user_id":
+		return e.UserId, true
+	case "action":
+		return e.Action, true
+	case "element":
+		return e.Element, true
+	case "duration":
+		return strconv.FormatFloat(e.Duration, 'f', -1, 64), true
+	case "timestamp":
+		return e.Timestamp.UTC().Format(time.RFC3339Nano), true
+	default:
+		return "", false
+	}
+}
+
+// SetFieldValue is the inverse of FieldValue. The id is assigned at ingestion
+// and cannot be set this way.
+func (e *Event) SetFieldValue(name, value string) error {
+	switch name {
+	case "user_id":
+		e.UserId = value
+	case "action":
+		e.Action = value
+	case "element":
+		e.Element = value
+	case "duration":
+		duration, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("duration must be a number: %w", err)
+		}
+		e.Duration = duration
+	case "timestamp":
+		timestamp, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return fmt.Errorf("timestamp must be RFC3339: %w", err)
+		}
+		e.Timestamp = timestamp
+	default:
+		return fmt.Errorf("field %q cannot be set", name)
+	}
+	return nil
+}
@@ -17,11 +17,159 @@ type AggregatedEvent struct {
 	Element   string    `json:"element" gorm:"index;size:100"`
 	Count     int       `json:"count" gorm:"default:1"`
 	Window    time.Time `json:"window" gorm:"index"`
+	Finalized bool      `json:"finalized" gorm:"index;default:false"`
+	Late      bool      `json:"late" gorm:"default:false"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
-type UserEventMap struct {
-	ID                uint   `gorm:"primaryKey" json:"id"`
-	AggregatedEventID uint   `json:"aggregated_event_id" gorm:"index"`
-	UserID            string `json:"user_id" gorm:"index;size:255"`
+type LateEvent struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	EventID    int64     `json:"event_id" gorm:"index"`
+	Stream     string    `json:"stream" gorm:"size:100"`
+	UserId     string    `json:"user_id" gorm:"size:255"`
+	Action     string    `json:"action" gorm:"index;size:100"`
+	Element    string    `json:"element" gorm:"size:100"`
+	Duration   float64   `json:"duration"`
+	Timestamp  time.Time `json:"timestamp" gorm:"index"`
+	Watermark  time.Time `json:"watermark"`
+	Lateness   float64   `json:"lateness_seconds"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+type WebhookDestination struct {
+	ID          uint              `gorm:"primaryKey" json:"id"`
+	Name        string            `json:"name" gorm:"uniqueIndex;size:100"`
+	URL         string            `json:"url" gorm:"size:2048"`
+	Secret      string            `json:"-" gorm:"size:255"`
+	Actions     []string          `json:"actions" gorm:"serializer:json"`
+	Elements    []string          `json:"elements" gorm:"serializer:json"`
+	Properties  map[string]string `json:"properties" gorm:"serializer:json"`
+	BatchSize   int               `json:"batch_size"`
+	MaxAttempts int               `json:"max_attempts"`
+	Enabled     bool              `json:"enabled"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+type ArchiveFile struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Path         string    `json:"path" gorm:"uniqueIndex;size:1024"`
+	Storage      string    `json:"storage" gorm:"size:20"`
+	Hour         time.Time `json:"hour" gorm:"index"`
+	Action       string    `json:"action" gorm:"index;size:100"`
+	Rows         int       `json:"rows"`
+	Bytes        int64     `json:"bytes"`
+	MinTimestamp time.Time `json:"min_timestamp" gorm:"index"`
+	MaxTimestamp time.Time `json:"max_timestamp" gorm:"index"`
+	Checksum     string    `json:"checksum" gorm:"size:64"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// OutboxEntry records a batch committed to Postgres whose remaining sinks
+// are written by the outbox relay. CompletedSinks lets a retry skip sinks
+// that already have the batch.
+type OutboxEntry struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	BatchKey       string     `json:"batch_key" gorm:"uniqueIndex;size:64"`
+	Stream         string     `json:"stream" gorm:"size:100"`
+	Events         []Event    `json:"events" gorm:"serializer:json"`
+	PendingSinks   []string   `json:"pending_sinks" gorm:"serializer:json"`
+	CompletedSinks []string   `json:"completed_sinks" gorm:"serializer:json"`
+	Attempts       int        `json:"attempts"`
+	LastError      string     `json:"last_error" gorm:"size:1024"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at" gorm:"index"`
+	LockedUntil    time.Time  `json:"locked_until"`
+	CompletedAt    *time.Time `json:"completed_at" gorm:"index"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// ReplayJob reprocesses a range of historical events into selected targets.
+// The cursor fields hold the last event (or archive file) that was enqueued,
+// so an interrupted job resumes right after it.
+type ReplayJob struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	Source          string     `json:"source" gorm:"size:20"`
+	RangeStart      time.Time  `json:"from"`
+	RangeEnd        time.Time  `json:"to"`
+	Actions         []string   `json:"actions" gorm:"serializer:json"`
+	UserIDs         []string   `json:"user_ids" gorm:"serializer:json"`
+	Targets         []string   `json:"targets" gorm:"serializer:json"`
+	DeleteDerived   bool       `json:"delete_derived"`
+	DerivedDeleted  bool       `json:"derived_deleted"`
+	Rate            int        `json:"rate"`
+	Status          string     `json:"status" gorm:"index;size:20"`
+	CursorTimestamp time.Time  `json:"cursor_timestamp"`
+	CursorID        int64      `json:"cursor_id"`
+	CursorPath      string     `json:"cursor_path" gorm:"size:1024"`
+	Enqueued        int64      `json:"enqueued"`
+	Processed       int64      `json:"processed"`
+	LastError       string     `json:"last_error" gorm:"size:1024"`
+	LeasedUntil     time.Time  `json:"leased_until"`
+	StartedAt       *time.Time `json:"started_at"`
+	CompletedAt     *time.Time `json:"completed_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// SavedSearch is a named event search. With an interval and a webhook
+// destination it runs on a schedule and notifies about events newer than its
+// high-water mark, the newest event it has already notified about.
+type SavedSearch struct {
+	ID                   uint       `gorm:"primaryKey" json:"id"`
+	Name                 string     `json:"name" gorm:"uniqueIndex;size:100"`
+	Query                string     `json:"q" gorm:"size:2048"`
+	Action               string     `json:"action" gorm:"size:100"`
+	UserID               string     `json:"user_id" gorm:"size:255"`
+	From                 *time.Time `json:"from"`
+	To                   *time.Time `json:"to"`
+	Size                 int        `json:"size"`
+	IntervalSeconds      int        `json:"interval_seconds"`
+	WebhookDestinationID *uint      `json:"webhook_destination_id"`
+	Enabled              bool       `json:"enabled"`
+	HighWaterTimestamp   time.Time  `json:"high_water_timestamp"`
+	HighWaterID          int64      `json:"high_water_id"`
+	NextRunAt            time.Time  `json:"next_run_at" gorm:"index"`
+	LeasedUntil          time.Time  `json:"-"`
+	LastRunAt            *time.Time `json:"last_run_at"`
+	LastMatches          int        `json:"last_matches"`
+	LastError            string     `json:"last_error" gorm:"size:1024"`
+	CreatedAt            time.Time  `json:"created_at"`
+	UpdatedAt            time.Time  `json:"updated_at"`
+}
+
+// ReindexJob rebuilds the search index from Postgres or the current search
+// indices. A full job builds new backing indices, one per day or month of
+// events, and then swaps the search aliases over to them with Target, the
+// one for its cutoff, as the write index; a job with a range writes into the
+// current indices.
+// Each slice covers part of the range and records the last event it indexed,
+// so an interrupted job resumes where it stopped.
+type ReindexJob struct {
+	ID             uint           `gorm:"primaryKey" json:"id"`
+	Source         string         `json:"source" gorm:"size:20"`
+	Full           bool           `json:"full"`
+	RangeStart     time.Time      `json:"from"`
+	RangeEnd       time.Time      `json:"to"`
+	Target         string         `json:"target" gorm:"size:255"`
+	Targets        []string       `json:"targets" gorm:"serializer:json"`
+	SourceIndices  []string       `json:"source_indices" gorm:"serializer:json"`
+	MappingVersion int            `json:"mapping_version"`
+	Slices         []ReindexSlice `json:"slices" gorm:"serializer:json"`
+	Status         string         `json:"status" gorm:"index;size:20"`
+	Expected       int64          `json:"expected"`
+	Indexed        int64          `json:"indexed"`
+	LastError      string         `json:"last_error" gorm:"size:1024"`
+	LeasedUntil    time.Time      `json:"leased_until"`
+	CompletedAt    *time.Time     `json:"completed_at"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+}
+
+type ReindexSlice struct {
+	From            time.Time `json:"from"`
+	To              time.Time `json:"to"`
+	CursorTimestamp time.Time `json:"cursor_timestamp"`
+	CursorID        int64     `json:"cursor_id"`
+	Indexed         int64     `json:"indexed"`
+	Done            bool      `json:"done"`
 }
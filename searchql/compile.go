@@ -0,0 +1,157 @@
+package searchql
+
+import (
+	"strconv"
+	"time"
+)
+
+// TextFields are searched by terms without a field.
+var TextFields = []string{"user_id", "action", "element"}
+
+// Compile turns a parsed query into an Elasticsearch query clause. Text
+// fields are matched exactly and by wildcard against their keyword
+// subfields, and by phrase against the analyzed fields.
+func Compile(node Node) map[string]any {
+	switch n := node.(type) {
+	case And:
+		return boolQuery("must", compileAll(n.Children))
+	case Or:
+		return anyOf(compileAll(n.Children))
+	case Not:
+		return boolQuery("must_not", []any{Compile(n.Child)})
+	case Range:
+		return compileRange(n)
+	case Term:
+		if n.Field == "" {
+			return compileBareTerm(n)
+		}
+		return compileTerm(n)
+	}
+	return map[string]any{"match_none": map[string]any{}}
+}
+
+func compileAll(nodes []Node) []any {
+	clauses := make([]any, 0, len(nodes))
+	for _, node := range nodes {
+		clauses = append(clauses, Compile(node))
+	}
+	return clauses
+}
+
+func boolQuery(occur string, clauses []any) map[string]any {
+	return map[string]any{"bool": map[string]any{occur: clauses}}
+}
+
+func anyOf(clauses []any) map[string]any {
+	return map[string]any{"bool": map[string]any{"should": clauses, "minimum_should_match": 1}}
+}
+
+func compileTerm(t Term) map[string]any {
+	switch Fields[t.Field] {
+	case integerField:
+		value, _ := strconv.ParseInt(t.Value, 10, 64)
+		return map[string]any{"term": map[string]any{t.Field: value}}
+	case numberField:
+		value, _ := strconv.ParseFloat(t.Value, 64)
+		return map[string]any{"term": map[string]any{t.Field: value}}
+	case dateField:
+		return compileRange(Range{Field: t.Field, From: t.Value, To: t.Value, IncludeFrom: true, IncludeTo: true})
+	}
+
+	switch {
+	case t.Phrase:
+		return map[string]any{"match_phrase": map[string]any{t.Field: t.Value}}
+	case t.Wildcard:
+		return map[string]any{"wildcard": map[string]any{t.Field + ".keyword": map[string]any{"value": t.Value}}}
+	}
+	return map[string]any{"term": map[string]any{t.Field + ".keyword": t.Value}}
+}
+
+// compileBareTerm searches the text fields the same way a plain q does, so a
+// word means the same inside and outside an expression.
+func compileBareTerm(t Term) map[string]any {
+	if t.Wildcard {
+		clauses := make([]any, 0, len(TextFields))
+		for _, field := range TextFields {
+			clauses = append(clauses, compileTerm(Term{Field: field, Value: t.Value, Wildcard: true}))
+		}
+		return anyOf(clauses)
+	}
+
+	match := map[string]any{"query": t.Value, "fields": TextFields}
+	if t.Phrase {
+		match["type"] = "phrase"
+	}
+	textSearch := map[string]any{"multi_match": match}
+	if id, err := strconv.ParseInt(t.Value, 10, 64); err == nil && !t.Phrase {
+		return anyOf([]any{textSearch, map[string]any{"term": map[string]any{"id": id}}})
+	}
+	return textSearch
+}
+
+func compileRange(r Range) map[string]any {
+	bounds := map[string]any{}
+	lower, upper := rangeBounds(r)
+	for _, b := range []*bound{lower, upper} {
+		if b == nil {
+			continue
+		}
+		value := b.value
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(time.RFC3339Nano)
+		}
+		bounds[b.op] = value
+	}
+	return map[string]any{"range": map[string]any{r.Field: bounds}}
+}
+
+// bound is one side of a range. op is gt, gte, lt or lte.
+type bound struct {
+	op    string
+	value any
+}
+
+// rangeBounds reads the sides of a range, nil where it is open. Dates are
+// read as times.
+func rangeBounds(r Range) (lower, upper *bound) {
+	if r.From != "" {
+		lower = &bound{op: "gt", value: rangeValue(r.Field, r.From)}
+		if r.IncludeFrom {
+			lower.op = "gte"
+		}
+		if t, day, _ := ParseTime(r.From); Fields[r.Field] == dateField && day {
+			// A day is the whole day: from it includes its start, after it
+			// starts at the next one.
+			lower = &bound{op: "gte", value: t}
+			if !r.IncludeFrom {
+				lower.value = t.AddDate(0, 0, 1)
+			}
+		}
+	}
+	if r.To != "" {
+		upper = &bound{op: "lt", value: rangeValue(r.Field, r.To)}
+		if r.IncludeTo {
+			upper.op = "lte"
+		}
+		if t, day, _ := ParseTime(r.To); Fields[r.Field] == dateField && day {
+			upper = &bound{op: "lt", value: t}
+			if r.IncludeTo {
+				upper.value = t.AddDate(0, 0, 1)
+			}
+		}
+	}
+	return lower, upper
+}
+
+func rangeValue(field, value string) any {
+	switch Fields[field] {
+	case integerField:
+		parsed, _ := strconv.ParseInt(value, 10, 64)
+		return parsed
+	case numberField:
+		parsed, _ := strconv.ParseFloat(value, 64)
+		return parsed
+	}
+	t, _, _ := ParseTime(value)
+	return t
+}
@@ -0,0 +1,488 @@
+// Package searchql parses the query language of GET /search/events:
+//
+//	action:click AND element:signup* AND duration:>2.5 NOT user_id:test_*
+//
+// Terms are field:value pairs or bare words matched against the text fields.
+// Terms next to each other must all match; AND, OR, NOT (or a leading -) and
+// parentheses combine them. Values may be quoted phrases, contain * and ?
+// wildcards, or be ranges written as >, >=, <, <= or [from TO to].
+package searchql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A query may be at most MaxQueryLength bytes long, and nest groups and
+// negations at most MaxQueryDepth deep, which bounds the recursion of parsing
+// and compiling it.
+const (
+	MaxQueryLength = 4096
+	MaxQueryDepth  = 32
+)
+
+type fieldKind int
+
+const (
+	textField fieldKind = iota
+	integerField
+	numberField
+	dateField
+)
+
+// Fields are the fields a query may name and how their values are read.
+var Fields = map[string]fieldKind{
+	"id":        integerField,
+	"user_id":   textField,
+	"action":    textField,
+	"element":   textField,
+	"duration":  numberField,
+	"timestamp": dateField,
+}
+
+// ParseError points at the byte offset in the query where parsing failed.
+type ParseError struct {
+	Pos     int
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("at position %d: %s", e.Pos, e.Message)
+}
+
+type Node interface {
+	node()
+}
+
+type And struct{ Children []Node }
+
+type Or struct{ Children []Node }
+
+type Not struct{ Child Node }
+
+// Term matches a value. An empty Field matches the text fields.
+type Term struct {
+	Field    string
+	Value    string
+	Phrase   bool
+	Wildcard bool
+}
+
+// Range bounds a field. An empty From or To leaves that side open.
+type Range struct {
+	Field       string
+	From, To    string
+	IncludeFrom bool
+	IncludeTo   bool
+}
+
+func (And) node()   {}
+func (Or) node()    {}
+func (Not) node()   {}
+func (Term) node()  {}
+func (Range) node() {}
+
+// IsQuery reports whether q uses any of the query language, as opposed to
+// being plain words searched across the text fields.
+func IsQuery(q string) bool {
+	if strings.ContainsAny(q, `:"()[]*?`) {
+		return true
+	}
+	for _, word := range strings.Fields(q) {
+		if word == "AND" || word == "OR" || word == "NOT" || strings.HasPrefix(word, "-") {
+			return true
+		}
+	}
+	return false
+}
+
+func Parse(q string) (Node, error) {
+	if len(q) > MaxQueryLength {
+		return nil, &ParseError{Pos: MaxQueryLength, Message: fmt.Sprintf("query is longer than %d bytes", MaxQueryLength)}
+	}
+	tokens, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, end: len(q)}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := p.peek(); ok {
+		if tok.kind == tokenRParen {
+			return nil, p.errorAt(tok.pos, "unmatched )")
+		}
+		return nil, p.errorAt(tok.pos, fmt.Sprintf("unexpected %q", tok.text))
+	}
+	return node, nil
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenPhrase
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(q string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == '[':
+			tokens = append(tokens, token{kind: tokenLBracket, text: "[", pos: i})
+			i++
+		case c == ']':
+			tokens = append(tokens, token{kind: tokenRBracket, text: "]", pos: i})
+			i++
+		case c == '"':
+			var phrase strings.Builder
+			start := i
+			for i++; ; i++ {
+				if i >= len(q) {
+					return nil, &ParseError{Pos: start, Message: "unterminated quoted phrase"}
+				}
+				if q[i] == '\\' && i+1 < len(q) {
+					i++
+					phrase.WriteByte(q[i])
+					continue
+				}
+				if q[i] == '"' {
+					break
+				}
+				phrase.WriteByte(q[i])
+			}
+			tokens = append(tokens, token{kind: tokenPhrase, text: phrase.String(), pos: start})
+			i++
+		default:
+			start := i
+			for i < len(q) && !strings.ContainsRune(" \t\n()[]\"", rune(q[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: q[start:i], pos: start})
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	next   int
+	end    int
+	depth  int
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.next >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.next], true
+}
+
+func (p *parser) peekWord(word string) bool {
+	tok, ok := p.peek()
+	return ok && tok.kind == tokenWord && tok.text == word
+}
+
+func (p *parser) errorAt(pos int, message string) error {
+	return &ParseError{Pos: pos, Message: message}
+}
+
+// nest enters a group or negation at pos, unless the query already nests
+// MaxQueryDepth of them there.
+func (p *parser) nest(pos int) error {
+	if p.depth == MaxQueryDepth {
+		return p.errorAt(pos, fmt.Sprintf("query nests more than %d groups and negations", MaxQueryDepth))
+	}
+	p.depth++
+	return nil
+}
+
+func (p *parser) parseOr() (Node, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []Node{first}
+	for p.peekWord("OR") {
+		p.next++
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return Or{Children: children}, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []Node{first}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind == tokenRParen || p.peekWord("OR") {
+			break
+		}
+		if p.peekWord("AND") {
+			p.next++
+		}
+		next, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return And{Children: children}, nil
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, p.errorAt(p.end, "expected a term")
+	}
+
+	// A lone - negates the phrase or group right after it, as in -"a b".
+	negatesNext := tok.text == "-" && p.next+1 < len(p.tokens) && p.tokens[p.next+1].pos == tok.pos+1
+	if tok.kind == tokenWord && (tok.text == "NOT" || negatesNext) {
+		if err := p.nest(tok.pos); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		p.next++
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Child: child}, nil
+	}
+	if tok.kind == tokenWord && len(tok.text) > 1 && tok.text[0] == '-' {
+		if err := p.nest(tok.pos); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		p.tokens[p.next] = token{kind: tokenWord, text: tok.text[1:], pos: tok.pos + 1}
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Child: child}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	tok, _ := p.peek()
+	switch tok.kind {
+	case tokenLParen:
+		if err := p.nest(tok.pos); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		p.next++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing, ok := p.peek()
+		if !ok || closing.kind != tokenRParen {
+			return nil, p.errorAt(tok.pos, "unmatched (")
+		}
+		p.next++
+		return node, nil
+	case tokenPhrase:
+		p.next++
+		return Term{Value: tok.text, Phrase: true}, nil
+	case tokenWord:
+		p.next++
+		if tok.text == "AND" || tok.text == "OR" || tok.text == "TO" {
+			return nil, p.errorAt(tok.pos, fmt.Sprintf("expected a term before %s", tok.text))
+		}
+		return p.parseTerm(tok)
+	}
+	return nil, p.errorAt(tok.pos, fmt.Sprintf("unexpected %q", tok.text))
+}
+
+func (p *parser) parseTerm(tok token) (Node, error) {
+	field, value, qualified := strings.Cut(tok.text, ":")
+	if !qualified || !isFieldName(field) {
+		return bareTerm(tok.text), nil
+	}
+
+	kind, known := Fields[field]
+	if !known {
+		return nil, p.errorAt(tok.pos, fmt.Sprintf("unknown field %q", field))
+	}
+	valuePos := tok.pos + len(field) + 1
+
+	if value == "" {
+		next, ok := p.peek()
+		switch {
+		case ok && next.kind == tokenPhrase && next.pos == valuePos:
+			p.next++
+			if kind != textField {
+				return nil, p.errorAt(next.pos, fmt.Sprintf("%s does not take a quoted phrase", field))
+			}
+			return Term{Field: field, Value: next.text, Phrase: true}, nil
+		case ok && next.kind == tokenLBracket && next.pos == valuePos:
+			p.next++
+			return p.parseBracketRange(field, kind, next.pos)
+		}
+		return nil, p.errorAt(valuePos, fmt.Sprintf("expected a value after %s:", field))
+	}
+
+	for _, op := range []string{">=", "<=", ">", "<"} {
+		if bound, ok := strings.CutPrefix(value, op); ok {
+			boundPos := valuePos + len(op)
+			if bound == "" {
+				return nil, p.errorAt(boundPos, fmt.Sprintf("expected a value after %s", op))
+			}
+			if kind == textField {
+				return nil, p.errorAt(valuePos, fmt.Sprintf("%s does not take a range", field))
+			}
+			if err := checkValue(field, kind, bound, boundPos); err != nil {
+				return nil, err
+			}
+			r := Range{Field: field}
+			if op[0] == '>' {
+				r.From, r.IncludeFrom = bound, op == ">="
+			} else {
+				r.To, r.IncludeTo = bound, op == "<="
+			}
+			return r, nil
+		}
+	}
+
+	wildcard := strings.ContainsAny(value, "*?")
+	if wildcard && kind != textField {
+		return nil, p.errorAt(valuePos, fmt.Sprintf("%s does not take wildcards", field))
+	}
+	if !wildcard {
+		if err := checkValue(field, kind, value, valuePos); err != nil {
+			return nil, err
+		}
+	}
+	return Term{Field: field, Value: value, Wildcard: wildcard}, nil
+}
+
+// parseBracketRange reads "from TO to]" after the opening bracket; * leaves a
+// side open.
+func (p *parser) parseBracketRange(field string, kind fieldKind, open int) (Node, error) {
+	if kind == textField {
+		return nil, p.errorAt(open, fmt.Sprintf("%s does not take a range", field))
+	}
+
+	var parts []token
+	for {
+		tok, ok := p.peek()
+		if !ok {
+			return nil, p.errorAt(open, "unterminated range, expected ]")
+		}
+		p.next++
+		if tok.kind == tokenRBracket {
+			break
+		}
+		if tok.kind != tokenWord {
+			return nil, p.errorAt(tok.pos, fmt.Sprintf("unexpected %q in range", tok.text))
+		}
+		parts = append(parts, tok)
+	}
+	if len(parts) != 3 || parts[1].text != "TO" {
+		return nil, p.errorAt(open, "expected a range like [from TO to]")
+	}
+
+	r := Range{Field: field, IncludeFrom: true, IncludeTo: true}
+	for i, bound := range []token{parts[0], parts[2]} {
+		if bound.text == "*" {
+			continue
+		}
+		if err := checkValue(field, kind, bound.text, bound.pos); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			r.From = bound.text
+		} else {
+			r.To = bound.text
+		}
+	}
+	return r, nil
+}
+
+func bareTerm(value string) Term {
+	return Term{Value: value, Wildcard: strings.ContainsAny(value, "*?")}
+}
+
+func isFieldName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r != '_' && !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkValue(field string, kind fieldKind, value string, pos int) error {
+	var err error
+	switch kind {
+	case integerField:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case numberField:
+		_, err = strconv.ParseFloat(value, 64)
+	case dateField:
+		_, _, err = ParseTime(value)
+	}
+	if err != nil {
+		return &ParseError{Pos: pos, Message: fmt.Sprintf("%q is not a valid %s", value, field)}
+	}
+	return nil
+}
+
+var timeLayouts = []string{time.RFC3339Nano, time.RFC3339, "2006-01-02T15:04"}
+
+// ParseTime reads a timestamp or a date. A date reports true and stands for
+// the whole UTC day.
+func ParseTime(value string) (time.Time, bool, error) {
+	for _, layout := range timeLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed.UTC(), false, nil
+		}
+	}
+	parsed, err := time.Parse("2006-01-02", value)
+	return parsed, true, err
+}
@@ -0,0 +1,157 @@
+package searchql
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func compileJSON(t *testing.T, q string) string {
+	t.Helper()
+	node, err := Parse(q)
+	if err != nil {
+		t.Fatalf("parse %q: %v", q, err)
+	}
+	data, err := json.Marshal(Compile(node))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return string(data)
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{
+			query: `action:click element:signup*`,
+			want:  `{"bool":{"must":[{"term":{"action.keyword":"click"}},{"wildcard":{"element.keyword":{"value":"signup*"}}}]}}`,
+		},
+		{
+			query: `action:click OR NOT -user_id:"test user"`,
+			want:  `{"bool":{"minimum_should_match":1,"should":[{"term":{"action.keyword":"click"}},{"bool":{"must_not":[{"bool":{"must_not":[{"match_phrase":{"user_id":"test user"}}]}}]}}]}}`,
+		},
+		{
+			query: `duration:>=2.5 AND id:[10 TO *]`,
+			want:  `{"bool":{"must":[{"range":{"duration":{"gte":2.5}}},{"range":{"id":{"gte":10}}}]}}`,
+		},
+		{
+			query: `timestamp:[2025-01-01 TO 2025-01-31]`,
+			want:  `{"range":{"timestamp":{"gte":"2025-01-01T00:00:00Z","lt":"2025-02-01T00:00:00Z"}}}`,
+		},
+		{
+			query: `timestamp:<2025-01-01T10:00:00Z`,
+			want:  `{"range":{"timestamp":{"lt":"2025-01-01T10:00:00Z"}}}`,
+		},
+		{
+			query: `(signup OR 42) -"dark mode"`,
+			want:  `{"bool":{"must":[{"bool":{"minimum_should_match":1,"should":[{"multi_match":{"fields":["user_id","action","element"],"query":"signup"}},{"bool":{"minimum_should_match":1,"should":[{"multi_match":{"fields":["user_id","action","element"],"query":"42"}},{"term":{"id":42}}]}}]}},{"bool":{"must_not":[{"multi_match":{"fields":["user_id","action","element"],"query":"dark mode","type":"phrase"}}]}}]}}`,
+		},
+	}
+
+	for _, test := range tests {
+		if got := compileJSON(t, test.query); got != test.want {
+			t.Errorf("Compile(%q)\n got %s\nwant %s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestCompileSQL(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		args  string
+	}{
+		{
+			query: `action:click -element:sign_up*`,
+			want:  `(action = ? AND NOT element LIKE ? ESCAPE '\')`,
+			args:  `["click","sign\\_up%"]`,
+		},
+		{
+			query: `timestamp:2025-01-31 OR 42`,
+			want:  `((timestamp >= ? AND timestamp < ?) OR ((user_id_tsv @@ plainto_tsquery('simple', ?) OR action_tsv @@ plainto_tsquery('simple', ?) OR element_tsv @@ plainto_tsquery('simple', ?)) OR id = ?))`,
+			args:  `["2025-01-31T00:00:00Z","2025-02-01T00:00:00Z","42","42","42",42]`,
+		},
+		{
+			query: `user_id:"test user" duration:<=2.5`,
+			want:  `(user_id_tsv @@ phraseto_tsquery('simple', ?) AND (duration <= ?))`,
+			args:  `["test user",2.5]`,
+		},
+	}
+
+	for _, test := range tests {
+		node, err := Parse(test.query)
+		if err != nil {
+			t.Fatalf("parse %q: %v", test.query, err)
+		}
+		got, args := CompileSQL(node)
+		data, _ := json.Marshal(args)
+		if got != test.want || string(data) != test.args {
+			t.Errorf("CompileSQL(%q)\n got %s %s\nwant %s %s", test.query, got, data, test.want, test.args)
+		}
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{query: `colour:red`, pos: 0},
+		{query: `action:click AND`, pos: 16},
+		{query: `(action:click`, pos: 0},
+		{query: `action:click)`, pos: 12},
+		{query: `duration:>fast`, pos: 10},
+		{query: `id:abc*`, pos: 3},
+		{query: `element:[a TO b]`, pos: 8},
+		{query: `timestamp:[2025-01-01 TO soon]`, pos: 25},
+		{query: `user_id:"unterminated`, pos: 8},
+		{query: `action: click`, pos: 7},
+		{query: strings.Repeat("(", 40) + "a" + strings.Repeat(")", 40), pos: 32},
+		{query: strings.Repeat("NOT ", 40) + "a", pos: 128},
+		{query: strings.Repeat("-", 40) + "a", pos: 32},
+		{query: strings.Repeat("a ", MaxQueryLength), pos: MaxQueryLength},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.query)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Parse(%q) error = %v, want a ParseError", test.query, err)
+			continue
+		}
+		if parseErr.Pos != test.pos {
+			t.Errorf("Parse(%q) position = %d, want %d (%s)", test.query, parseErr.Pos, test.pos, parseErr.Message)
+		}
+	}
+}
+
+func TestParseAcceptsQueriesAtTheLimits(t *testing.T) {
+	nested := strings.Repeat("(", MaxQueryDepth-1) + "NOT a" + strings.Repeat(")", MaxQueryDepth-1)
+	if _, err := Parse(nested); err != nil {
+		t.Errorf("Parse of a query %d levels deep: %v", MaxQueryDepth, err)
+	}
+	long := strings.Repeat("a", MaxQueryLength)
+	if _, err := Parse(long); err != nil {
+		t.Errorf("Parse of a query %d bytes long: %v", MaxQueryLength, err)
+	}
+}
+
+func TestIsQuery(t *testing.T) {
+	for q, want := range map[string]bool{
+		"signup button":   false,
+		"12345":           false,
+		"action:click":    true,
+		"sign*":           true,
+		`"dark mode"`:     true,
+		"click OR submit": true,
+		"-test":           true,
+		"click or submit": false,
+	} {
+		if got := IsQuery(q); got != want {
+			t.Errorf("IsQuery(%q) = %v, want %v", q, got, want)
+		}
+	}
+}
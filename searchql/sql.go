@@ -0,0 +1,146 @@
+package searchql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// TextSearchColumn names the tsvector column holding a text field's words.
+func TextSearchColumn(field string) string {
+	return field + "_tsv"
+}
+
+// TextSearchConfig is the Postgres text search configuration the tsvector
+// columns are built with. Like the Elasticsearch standard analyzer, it
+// lowercases words without stemming them.
+const TextSearchConfig = "simple"
+
+var sqlOperators = map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+
+// CompileSQL turns a parsed query into a Postgres condition on the events
+// table and its arguments. It matches what Compile matches: exact values and
+// wildcards against the columns, and words and phrases against their tsvector
+// columns.
+func CompileSQL(node Node) (string, []any) {
+	switch n := node.(type) {
+	case And:
+		return joinSQL(n.Children, " AND ")
+	case Or:
+		return joinSQL(n.Children, " OR ")
+	case Not:
+		condition, args := CompileSQL(n.Child)
+		return "NOT " + condition, args
+	case Range:
+		return compileRangeSQL(n)
+	case Term:
+		if n.Field == "" {
+			return compileBareTermSQL(n)
+		}
+		return compileTermSQL(n)
+	}
+	return "FALSE", nil
+}
+
+func joinSQL(nodes []Node, separator string) (string, []any) {
+	conditions := make([]string, 0, len(nodes))
+	var args []any
+	for _, node := range nodes {
+		condition, nodeArgs := CompileSQL(node)
+		conditions = append(conditions, condition)
+		args = append(args, nodeArgs...)
+	}
+	return "(" + strings.Join(conditions, separator) + ")", args
+}
+
+func compileTermSQL(t Term) (string, []any) {
+	switch Fields[t.Field] {
+	case integerField:
+		value, _ := strconv.ParseInt(t.Value, 10, 64)
+		return t.Field + " = ?", []any{value}
+	case numberField:
+		value, _ := strconv.ParseFloat(t.Value, 64)
+		return t.Field + " = ?", []any{value}
+	case dateField:
+		return compileRangeSQL(Range{Field: t.Field, From: t.Value, To: t.Value, IncludeFrom: true, IncludeTo: true})
+	}
+
+	switch {
+	case t.Phrase:
+		return TextSearchColumn(t.Field) + " @@ phraseto_tsquery('" + TextSearchConfig + "', ?)", []any{t.Value}
+	case t.Wildcard:
+		return t.Field + ` LIKE ? ESCAPE '\'`, []any{likePattern(t.Value)}
+	}
+	return t.Field + " = ?", []any{t.Value}
+}
+
+// compileBareTermSQL searches the text fields the same way a plain q does.
+func compileBareTermSQL(t Term) (string, []any) {
+	if t.Wildcard {
+		conditions := make([]string, 0, len(TextFields))
+		var args []any
+		for _, field := range TextFields {
+			condition, fieldArgs := compileTermSQL(Term{Field: field, Value: t.Value, Wildcard: true})
+			conditions = append(conditions, condition)
+			args = append(args, fieldArgs...)
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")", args
+	}
+
+	function := "plainto_tsquery"
+	if t.Phrase {
+		function = "phraseto_tsquery"
+	}
+	condition, args := TextSearchSQL(function, t.Value)
+	if id, err := strconv.ParseInt(t.Value, 10, 64); err == nil && !t.Phrase {
+		return "(" + condition + " OR id = ?)", append(args, id)
+	}
+	return condition, args
+}
+
+// TextSearchSQL matches value, read by the tsquery function, in any of the
+// text fields.
+func TextSearchSQL(function, value string) (string, []any) {
+	conditions := make([]string, 0, len(TextFields))
+	args := make([]any, 0, len(TextFields))
+	for _, field := range TextFields {
+		conditions = append(conditions, TextSearchColumn(field)+" @@ "+function+"('"+TextSearchConfig+"', ?)")
+		args = append(args, value)
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+func compileRangeSQL(r Range) (string, []any) {
+	lower, upper := rangeBounds(r)
+	var conditions []string
+	var args []any
+	for _, b := range []*bound{lower, upper} {
+		if b != nil {
+			conditions = append(conditions, r.Field+" "+sqlOperators[b.op]+" ?")
+			args = append(args, b.value)
+		}
+	}
+	if len(conditions) == 0 {
+		return "TRUE", nil
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")", args
+}
+
+// likePattern turns * and ? wildcards into a LIKE pattern, escaping the
+// characters LIKE treats specially.
+func likePattern(value string) string {
+	var pattern strings.Builder
+	for _, r := range value {
+		switch r {
+		case '*':
+			pattern.WriteByte('%')
+		case '?':
+			pattern.WriteByte('_')
+		case '%', '_', '\\':
+			pattern.WriteByte('\\')
+			pattern.WriteRune(r)
+		default:
+			pattern.WriteRune(r)
+		}
+	}
+	return pattern.String()
+}
@@ -0,0 +1,40 @@
+package sinks
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"context"
+)
+
+func init() {
+	Register("clickhouse", func(cfg config.SinkConfig) (Sink, error) {
+		return &ClickHouseSink{name: cfg.Name}, nil
+	})
+}
+
+type ClickHouseSink struct {
+	name string
+}
+
+func (s *ClickHouseSink) Name() string {
+	return s.name
+}
+
+func (s *ClickHouseSink) Write(ctx context.Context, events []models.Event) error {
+	ctx = database.WithClickHouseDedupToken(ctx, BatchKey(ctx))
+	if err := database.BatchInsertToClickHouseWithContext(ctx, events); err != nil {
+		metrics.EventsFailed.WithLabelValues("clickhouse_insert").Inc()
+		return err
+	}
+	return nil
+}
+
+func (s *ClickHouseSink) DeleteRange(ctx context.Context, r database.EventRange) error {
+	return database.DeleteClickHouseEvents(ctx, r)
+}
+
+func (s *ClickHouseSink) Health(ctx context.Context) error {
+	return database.PingClickHouse(ctx)
+}
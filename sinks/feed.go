@@ -0,0 +1,46 @@
+package sinks
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+func init() {
+	Register("feed", func(cfg config.SinkConfig) (Sink, error) {
+		return &FeedSink{name: cfg.Name}, nil
+	})
+}
+
+// FeedSink pushes events to the recent feed and publishes them to SSE
+// subscribers.
+type FeedSink struct {
+	name string
+}
+
+func (s *FeedSink) Name() string {
+	return s.name
+}
+
+func (s *FeedSink) Write(ctx context.Context, events []models.Event) error {
+	for _, event := range events {
+		jsonBytes, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		if err := database.PushToRecentFeed(ctx, jsonBytes, event.ID); err != nil {
+			return fmt.Errorf("push event %d to recent feed: %w", event.ID, err)
+		}
+		if err := database.PublishEvent(ctx, jsonBytes); err != nil {
+			return fmt.Errorf("publish event %d: %w", event.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *FeedSink) Health(ctx context.Context) error {
+	return database.PingRedis(ctx)
+}
@@ -0,0 +1,35 @@
+package sinks
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"context"
+)
+
+func init() {
+	Register("index", func(cfg config.SinkConfig) (Sink, error) {
+		return &IndexSink{name: cfg.Name}, nil
+	})
+}
+
+// IndexSink queues events for the search indexer workers.
+type IndexSink struct {
+	name string
+}
+
+func (s *IndexSink) Name() string {
+	return s.name
+}
+
+func (s *IndexSink) Write(ctx context.Context, events []models.Event) error {
+	return database.EnqueueEventsForIndexing(ctx, events)
+}
+
+func (s *IndexSink) DeleteRange(ctx context.Context, r database.EventRange) error {
+	return database.DeleteIndexedEvents(ctx, r)
+}
+
+func (s *IndexSink) Health(ctx context.Context) error {
+	return database.PingRedis(ctx)
+}
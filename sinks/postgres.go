@@ -0,0 +1,38 @@
+package sinks
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"context"
+
+	"gorm.io/gorm"
+)
+
+func init() {
+	Register("postgres", func(cfg config.SinkConfig) (Sink, error) {
+		return &PostgresSink{name: cfg.Name}, nil
+	})
+}
+
+type PostgresSink struct {
+	name string
+}
+
+func (s *PostgresSink) Name() string {
+	return s.name
+}
+
+// Write skips events that already exist, so replaying archived events into
+// Postgres only restores the missing ones.
+func (s *PostgresSink) Write(ctx context.Context, events []models.Event) error {
+	return database.BatchAddToDatabaseTx(ctx, database.DB, events)
+}
+
+func (s *PostgresSink) WriteInTx(ctx context.Context, tx *gorm.DB, events []models.Event) error {
+	return database.BatchAddToDatabaseTx(ctx, tx, events)
+}
+
+func (s *PostgresSink) Health(ctx context.Context) error {
+	return database.PingPostgres(ctx)
+}
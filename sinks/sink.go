@@ -0,0 +1,317 @@
+package sinks
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, events []models.Event) error
+	Health(ctx context.Context) error
+}
+
+// Transactional sinks write into the same Postgres transaction as the
+// aggregated rows of a batch instead of being driven by the outbox relay.
+type Transactional interface {
+	Sink
+	WriteInTx(ctx context.Context, tx *gorm.DB, events []models.Event) error
+}
+
+// Purger sinks can delete what they hold for a range of events, which lets a
+// replay replace data instead of duplicating it.
+type Purger interface {
+	Sink
+	DeleteRange(ctx context.Context, r database.EventRange) error
+}
+
+type batchKeyContextKey struct{}
+
+// WithBatchKey tags a write with the outbox batch it belongs to so sinks
+// that support it can deduplicate retried writes.
+func WithBatchKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, batchKeyContextKey{}, key)
+}
+
+func BatchKey(ctx context.Context) string {
+	key, _ := ctx.Value(batchKeyContextKey{}).(string)
+	return key
+}
+
+type Factory func(cfg config.SinkConfig) (Sink, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+// Register makes a sink type available to config. It is meant to be called
+// from an init function in the file that implements the sink.
+func Register(sinkType string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, exists := factories[sinkType]; exists {
+		panic(fmt.Sprintf("sink type %q registered twice", sinkType))
+	}
+	factories[sinkType] = factory
+}
+
+func RegisteredTypes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	types := make([]string, 0, len(factories))
+	for sinkType := range factories {
+		types = append(types, sinkType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// DefaultConfigs is used when config.yaml has no sinks section and matches
+// the destinations the pipeline has always written to.
+func DefaultConfigs() []config.SinkConfig {
+	return []config.SinkConfig{
+		{Name: "postgres"},
+		{Name: "clickhouse"},
+		{Name: "feed"},
+		{Name: "index", Optional: true},
+	}
+}
+
+type entry struct {
+	sink     Sink
+	optional bool
+}
+
+type Set struct {
+	entries []entry
+}
+
+var Active *Set
+
+func Init(cfgs []config.SinkConfig) error {
+	set, err := Build(cfgs)
+	if err != nil {
+		return err
+	}
+	Active = set
+	return nil
+}
+
+func Build(cfgs []config.SinkConfig) (*Set, error) {
+	if len(cfgs) == 0 {
+		cfgs = DefaultConfigs()
+	}
+
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	set := &Set{}
+	seen := map[string]bool{}
+	for _, cfg := range cfgs {
+		if !cfg.IsEnabled() {
+			continue
+		}
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("sink name is required")
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("sink %q configured twice", cfg.Name)
+		}
+		seen[cfg.Name] = true
+
+		factory, ok := factories[cfg.SinkType()]
+		if !ok {
+			return nil, fmt.Errorf("unknown sink type %q for sink %q", cfg.SinkType(), cfg.Name)
+		}
+
+		sink, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build sink %q: %w", cfg.Name, err)
+		}
+		set.entries = append(set.entries, entry{sink: sink, optional: cfg.Optional})
+		log.Printf("Enabled sink %s (%s)", cfg.Name, cfg.SinkType())
+	}
+
+	return set, nil
+}
+
+func NewSet(required []Sink, optional []Sink) *Set {
+	set := &Set{}
+	for _, sink := range required {
+		set.entries = append(set.entries, entry{sink: sink})
+	}
+	for _, sink := range optional {
+		set.entries = append(set.entries, entry{sink: sink, optional: true})
+	}
+	return set
+}
+
+// Write sends events to every sink in configured order. A failing required
+// sink stops the write so the batch is retried; optional sink failures are
+// logged and skipped.
+func (s *Set) Write(ctx context.Context, events []models.Event) error {
+	if s == nil || len(events) == 0 {
+		return nil
+	}
+
+	for _, e := range s.entries {
+		if err := e.write(ctx, events); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e entry) write(ctx context.Context, events []models.Event) error {
+	started := time.Now()
+	err := e.sink.Write(ctx, events)
+	metrics.SinkWriteDuration.WithLabelValues(e.sink.Name()).Observe(time.Since(started).Seconds())
+	if err == nil {
+		metrics.SinkEventsWritten.WithLabelValues(e.sink.Name()).Add(float64(len(events)))
+		return nil
+	}
+
+	metrics.SinkWriteFailures.WithLabelValues(e.sink.Name()).Inc()
+	if e.optional {
+		log.Printf("Optional sink %s failed: %v", e.sink.Name(), err)
+		return nil
+	}
+	return fmt.Errorf("sink %s: %w", e.sink.Name(), err)
+}
+
+// WriteInTx writes events to every transactional sink inside tx, so they
+// commit or roll back together with the batch.
+func (s *Set) WriteInTx(ctx context.Context, tx *gorm.DB, events []models.Event) error {
+	if s == nil || len(events) == 0 {
+		return nil
+	}
+
+	for _, e := range s.entries {
+		transactional, ok := e.sink.(Transactional)
+		if !ok {
+			continue
+		}
+
+		started := time.Now()
+		err := transactional.WriteInTx(ctx, tx, events)
+		metrics.SinkWriteDuration.WithLabelValues(e.sink.Name()).Observe(time.Since(started).Seconds())
+		if err != nil {
+			metrics.SinkWriteFailures.WithLabelValues(e.sink.Name()).Inc()
+			return fmt.Errorf("sink %s: %w", e.sink.Name(), err)
+		}
+		metrics.SinkEventsWritten.WithLabelValues(e.sink.Name()).Add(float64(len(events)))
+	}
+	return nil
+}
+
+// Relayed lists the sinks that are not written inside the batch transaction
+// and are instead driven by the outbox relay, in configured order.
+func (s *Set) Relayed() []string {
+	if s == nil {
+		return nil
+	}
+
+	var names []string
+	for _, e := range s.entries {
+		if _, ok := e.sink.(Transactional); !ok {
+			names = append(names, e.sink.Name())
+		}
+	}
+	return names
+}
+
+// WriteSink writes events to one sink by name. Optional sink failures are
+// logged and reported as success, like in Write. A sink that is no longer
+// configured is skipped.
+func (s *Set) WriteSink(ctx context.Context, name string, events []models.Event) error {
+	if s == nil {
+		return nil
+	}
+
+	for _, e := range s.entries {
+		if e.sink.Name() == name {
+			return e.write(ctx, events)
+		}
+	}
+	log.Printf("Skipping sink %s because it is no longer configured", name)
+	return nil
+}
+
+func (s *Set) Has(name string) bool {
+	return s.find(name) != nil
+}
+
+// DeleteRange deletes a range from one sink by name. It reports false when
+// the sink does not support deleting.
+func (s *Set) DeleteRange(ctx context.Context, name string, r database.EventRange) (bool, error) {
+	sink := s.find(name)
+	purger, ok := sink.(Purger)
+	if !ok {
+		return false, nil
+	}
+	if err := purger.DeleteRange(ctx, r); err != nil {
+		return true, fmt.Errorf("sink %s: %w", name, err)
+	}
+	return true, nil
+}
+
+func (s *Set) find(name string) Sink {
+	if s == nil {
+		return nil
+	}
+	for _, e := range s.entries {
+		if e.sink.Name() == name {
+			return e.sink
+		}
+	}
+	return nil
+}
+
+func (s *Set) Sinks() []Sink {
+	if s == nil {
+		return nil
+	}
+	result := make([]Sink, 0, len(s.entries))
+	for _, e := range s.entries {
+		result = append(result, e.sink)
+	}
+	return result
+}
+
+type Status struct {
+	Name     string `json:"name"`
+	Optional bool   `json:"optional"`
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (s *Set) Health(ctx context.Context) []Status {
+	if s == nil {
+		return nil
+	}
+
+	statuses := make([]Status, 0, len(s.entries))
+	for _, e := range s.entries {
+		status := Status{Name: e.sink.Name(), Optional: e.optional, Healthy: true}
+		if err := e.sink.Health(ctx); err != nil {
+			status.Healthy = false
+			status.Error = err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
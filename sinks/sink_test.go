@@ -0,0 +1,104 @@
+package sinks
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/models"
+	"context"
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+type fakeSink struct {
+	name   string
+	err    error
+	writes int
+}
+
+func (f *fakeSink) Name() string {
+	return f.name
+}
+
+func (f *fakeSink) Write(ctx context.Context, events []models.Event) error {
+	f.writes++
+	return f.err
+}
+
+func (f *fakeSink) Health(ctx context.Context) error {
+	return f.err
+}
+
+func TestSetWriteStopsOnRequiredFailure(t *testing.T) {
+	failing := &fakeSink{name: "clickhouse", err: errors.New("down")}
+	after := &fakeSink{name: "feed"}
+	set := NewSet([]Sink{failing, after}, nil)
+
+	if err := set.Write(context.Background(), []models.Event{{ID: 1}}); err == nil {
+		t.Fatal("expected required sink failure to be returned")
+	}
+	if after.writes != 0 {
+		t.Fatal("expected sinks after a failed required sink to be skipped")
+	}
+}
+
+func TestSetWriteSkipsOptionalFailure(t *testing.T) {
+	required := &fakeSink{name: "postgres"}
+	optional := &fakeSink{name: "index", err: errors.New("down")}
+	set := NewSet([]Sink{required}, []Sink{optional})
+
+	if err := set.Write(context.Background(), []models.Event{{ID: 1}}); err != nil {
+		t.Fatalf("expected optional sink failure to be ignored, got %v", err)
+	}
+	if required.writes != 1 || optional.writes != 1 {
+		t.Fatalf("expected both sinks to be written once, got %d and %d", required.writes, optional.writes)
+	}
+}
+
+func TestBuildHonoursEnabledAndRejectsUnknownTypes(t *testing.T) {
+	disabled := false
+	set, err := Build([]config.SinkConfig{
+		{Name: "postgres"},
+		{Name: "archive-pg", Type: "postgres"},
+		{Name: "clickhouse", Enabled: &disabled},
+	})
+	if err != nil {
+		t.Fatalf("build sinks: %v", err)
+	}
+	if got := len(set.Sinks()); got != 2 {
+		t.Fatalf("expected 2 enabled sinks, got %d", got)
+	}
+
+	if _, err := Build([]config.SinkConfig{{Name: "nope"}}); err == nil {
+		t.Fatal("expected unknown sink type to fail")
+	}
+}
+
+type fakeTxSink struct {
+	fakeSink
+	txWrites int
+}
+
+func (f *fakeTxSink) WriteInTx(ctx context.Context, tx *gorm.DB, events []models.Event) error {
+	f.txWrites++
+	return f.err
+}
+
+func TestSetSplitsTransactionalAndRelayedSinks(t *testing.T) {
+	postgres := &fakeTxSink{fakeSink: fakeSink{name: "postgres"}}
+	clickhouse := &fakeSink{name: "clickhouse"}
+	index := &fakeSink{name: "index"}
+	set := NewSet([]Sink{postgres, clickhouse}, []Sink{index})
+
+	relayed := set.Relayed()
+	if len(relayed) != 2 || relayed[0] != "clickhouse" || relayed[1] != "index" {
+		t.Fatalf("expected clickhouse and index to be relayed, got %v", relayed)
+	}
+
+	if err := set.WriteInTx(context.Background(), nil, []models.Event{{ID: 1}}); err != nil {
+		t.Fatalf("WriteInTx failed: %v", err)
+	}
+	if postgres.txWrites != 1 || clickhouse.writes != 0 || index.writes != 0 {
+		t.Fatal("expected only the transactional sink to be written in the transaction")
+	}
+}
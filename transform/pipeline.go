@@ -0,0 +1,137 @@
+package transform
+
+import (
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type Pipeline struct {
+	ruleset Ruleset
+	rules   []compiledRule
+}
+
+type compiledRule struct {
+	name    string
+	globs   []fieldGlob
+	regexes []fieldRegex
+	steps   []step
+}
+
+type fieldGlob struct {
+	field   string
+	pattern string
+}
+
+type fieldRegex struct {
+	field string
+	re    *regexp.Regexp
+}
+
+type step struct {
+	kind   string
+	field  string
+	from   string
+	value  string
+	values map[string]string
+	re     *regexp.Regexp
+}
+
+type Result struct {
+	Event   models.Event `json:"event"`
+	Dropped bool         `json:"dropped"`
+	Matched []string     `json:"matched_rules"`
+	Errors  []string     `json:"errors,omitempty"`
+}
+
+func (p *Pipeline) Rules() []Rule {
+	if p == nil {
+		return nil
+	}
+	return p.ruleset.Rules
+}
+
+// Apply runs every rule in order on the event and counts rule hits.
+func (p *Pipeline) Apply(event models.Event) Result {
+	return p.apply(event, true)
+}
+
+// DryRun is Apply without touching metrics.
+func (p *Pipeline) DryRun(event models.Event) Result {
+	return p.apply(event, false)
+}
+
+func (p *Pipeline) apply(event models.Event, record bool) Result {
+	result := Result{Event: event}
+	if p == nil {
+		return result
+	}
+
+	for _, rule := range p.rules {
+		if !rule.matches(result.Event) {
+			continue
+		}
+		result.Matched = append(result.Matched, rule.name)
+		if record {
+			metrics.TransformRuleHits.WithLabelValues(rule.name).Inc()
+		}
+
+		for _, step := range rule.steps {
+			if step.kind == "drop" {
+				result.Dropped = true
+				return result
+			}
+			// A step that produces an invalid value, such as copying a
+			// non-numeric field into duration, is skipped rather than
+			// rejecting the event.
+			if err := step.apply(&result.Event); err != nil {
+				result.Errors = append(result.Errors, rule.name+": "+err.Error())
+				if record {
+					metrics.TransformErrors.WithLabelValues(rule.name).Inc()
+				}
+			}
+		}
+	}
+	return result
+}
+
+func (r compiledRule) matches(event models.Event) bool {
+	for _, glob := range r.globs {
+		value, _ := event.FieldValue(glob.field)
+		if matched, _ := path.Match(glob.pattern, value); !matched {
+			return false
+		}
+	}
+	for _, regex := range r.regexes {
+		value, _ := event.FieldValue(regex.field)
+		if !regex.re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s step) apply(event *models.Event) error {
+	current, _ := event.FieldValue(s.field)
+
+	switch s.kind {
+	case "rename":
+		renamed, ok := s.values[current]
+		if !ok {
+			return nil
+		}
+		return event.SetFieldValue(s.field, renamed)
+	case "set":
+		return event.SetFieldValue(s.field, s.value)
+	case "copy":
+		value, _ := event.FieldValue(s.from)
+		return event.SetFieldValue(s.field, value)
+	case "regex_replace":
+		return event.SetFieldValue(s.field, s.re.ReplaceAllString(current, s.value))
+	case "lowercase":
+		return event.SetFieldValue(s.field, strings.ToLower(current))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package transform
+
+import (
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	activeMu sync.RWMutex
+	active   *Pipeline
+	loadedAt time.Time
+	source   string
+)
+
+func Active() *Pipeline {
+	activeMu.RLock()
+	defer activeMu.RUnlock()
+	return active
+}
+
+func Status() (string, time.Time) {
+	activeMu.RLock()
+	defer activeMu.RUnlock()
+	return source, loadedAt
+}
+
+func SetActive(pipeline *Pipeline) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	active = pipeline
+	loadedAt = time.Now()
+}
+
+// Apply runs the active rules on an event. With no rules loaded the event is
+// returned unchanged.
+func Apply(event models.Event) Result {
+	return Active().Apply(event)
+}
+
+// Load reads and compiles the rules file. A missing file means no rules.
+func Load(path string) (*Pipeline, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Pipeline{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Init loads the rules once and, if interval is positive, keeps polling the
+// file until ctx is cancelled. A file that fails to compile is logged and the
+// previous rules stay active.
+func Init(ctx context.Context, path string, interval time.Duration) error {
+	activeMu.Lock()
+	source = path
+	activeMu.Unlock()
+
+	if path == "" {
+		SetActive(&Pipeline{})
+		return nil
+	}
+
+	modified := fileVersion(path)
+	pipeline, err := Load(path)
+	if err != nil {
+		metrics.TransformReloads.WithLabelValues("error").Inc()
+		return err
+	}
+	SetActive(pipeline)
+	metrics.TransformReloads.WithLabelValues("success").Inc()
+	log.Printf("Loaded %d transform rules from %s", len(pipeline.rules), path)
+
+	if interval > 0 {
+		go watch(ctx, path, interval, modified)
+	}
+	return nil
+}
+
+func watch(ctx context.Context, path string, interval time.Duration, modified fileStamp) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := fileVersion(path)
+			if current == modified {
+				continue
+			}
+			modified = current
+
+			pipeline, err := Load(path)
+			if err != nil {
+				metrics.TransformReloads.WithLabelValues("error").Inc()
+				log.Printf("Keeping previous transform rules, failed to reload %s: %v", path, err)
+				continue
+			}
+			SetActive(pipeline)
+			metrics.TransformReloads.WithLabelValues("success").Inc()
+			log.Printf("Reloaded %d transform rules from %s", len(pipeline.rules), path)
+		}
+	}
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func fileVersion(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size(), exists: true}
+}
@@ -0,0 +1,196 @@
+package transform
+
+import (
+	"analytics-backend/models"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Ruleset struct {
+	Rules []Rule `yaml:"rules" json:"rules"`
+}
+
+// Rule runs its actions, in order, on events that satisfy every condition.
+// Match values are path.Match globs; MatchRegex values are regular expressions.
+type Rule struct {
+	Name       string            `yaml:"name" json:"name"`
+	Match      map[string]string `yaml:"match" json:"match,omitempty"`
+	MatchRegex map[string]string `yaml:"match_regex" json:"match_regex,omitempty"`
+	Actions    []Action          `yaml:"actions" json:"actions"`
+}
+
+// Action holds exactly one operation.
+type Action struct {
+	Rename       *RenameAction       `yaml:"rename" json:"rename,omitempty"`
+	Set          *SetAction          `yaml:"set" json:"set,omitempty"`
+	Copy         *CopyAction         `yaml:"copy" json:"copy,omitempty"`
+	RegexReplace *RegexReplaceAction `yaml:"regex_replace" json:"regex_replace,omitempty"`
+	Lowercase    string              `yaml:"lowercase" json:"lowercase,omitempty"`
+	Drop         bool                `yaml:"drop" json:"drop,omitempty"`
+}
+
+// RenameAction maps old values of a field to new ones, e.g. btn_click -> click.
+type RenameAction struct {
+	Field  string            `yaml:"field" json:"field"`
+	Values map[string]string `yaml:"values" json:"values"`
+}
+
+type SetAction struct {
+	Field string `yaml:"field" json:"field"`
+	Value string `yaml:"value" json:"value"`
+}
+
+type CopyAction struct {
+	From string `yaml:"from" json:"from"`
+	To   string `yaml:"to" json:"to"`
+}
+
+type RegexReplaceAction struct {
+	Field       string `yaml:"field" json:"field"`
+	Pattern     string `yaml:"pattern" json:"pattern"`
+	Replacement string `yaml:"replacement" json:"replacement"`
+}
+
+func Parse(data []byte) (*Pipeline, error) {
+	var ruleset Ruleset
+	if err := yaml.Unmarshal(data, &ruleset); err != nil {
+		return nil, fmt.Errorf("failed to parse transform rules: %w", err)
+	}
+	return Compile(ruleset)
+}
+
+func Compile(ruleset Ruleset) (*Pipeline, error) {
+	pipeline := &Pipeline{ruleset: ruleset}
+	seen := map[string]bool{}
+
+	for i, rule := range ruleset.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d: name is required", i+1)
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("rule %q defined twice", rule.Name)
+		}
+		seen[rule.Name] = true
+
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		pipeline.rules = append(pipeline.rules, compiled)
+	}
+
+	return pipeline, nil
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	compiled := compiledRule{name: rule.Name}
+	if len(rule.Actions) == 0 {
+		return compiled, fmt.Errorf("at least one action is required")
+	}
+
+	for field, pattern := range rule.Match {
+		if err := readableField(field); err != nil {
+			return compiled, err
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return compiled, fmt.Errorf("invalid match pattern %q", pattern)
+		}
+		compiled.globs = append(compiled.globs, fieldGlob{field: field, pattern: pattern})
+	}
+	for field, pattern := range rule.MatchRegex {
+		if err := readableField(field); err != nil {
+			return compiled, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid match_regex for %s: %w", field, err)
+		}
+		compiled.regexes = append(compiled.regexes, fieldRegex{field: field, re: re})
+	}
+
+	for i, action := range rule.Actions {
+		step, err := compileAction(action)
+		if err != nil {
+			return compiled, fmt.Errorf("action %d: %w", i+1, err)
+		}
+		compiled.steps = append(compiled.steps, step)
+	}
+	return compiled, nil
+}
+
+func compileAction(action Action) (step, error) {
+	var steps []step
+
+	if action.Rename != nil {
+		if err := writableField(action.Rename.Field); err != nil {
+			return step{}, err
+		}
+		if len(action.Rename.Values) == 0 {
+			return step{}, fmt.Errorf("rename needs at least one value")
+		}
+		steps = append(steps, step{kind: "rename", field: action.Rename.Field, values: action.Rename.Values})
+	}
+	if action.Set != nil {
+		if err := writableField(action.Set.Field); err != nil {
+			return step{}, err
+		}
+		if err := (&models.Event{}).SetFieldValue(action.Set.Field, action.Set.Value); err != nil {
+			return step{}, err
+		}
+		steps = append(steps, step{kind: "set", field: action.Set.Field, value: action.Set.Value})
+	}
+	if action.Copy != nil {
+		if err := readableField(action.Copy.From); err != nil {
+			return step{}, err
+		}
+		if err := writableField(action.Copy.To); err != nil {
+			return step{}, err
+		}
+		steps = append(steps, step{kind: "copy", from: action.Copy.From, field: action.Copy.To})
+	}
+	if action.RegexReplace != nil {
+		if err := writableField(action.RegexReplace.Field); err != nil {
+			return step{}, err
+		}
+		re, err := regexp.Compile(action.RegexReplace.Pattern)
+		if err != nil {
+			return step{}, fmt.Errorf("invalid regex_replace pattern: %w", err)
+		}
+		steps = append(steps, step{kind: "regex_replace", field: action.RegexReplace.Field, re: re, value: action.RegexReplace.Replacement})
+	}
+	if action.Lowercase != "" {
+		if err := writableField(action.Lowercase); err != nil {
+			return step{}, err
+		}
+		steps = append(steps, step{kind: "lowercase", field: action.Lowercase})
+	}
+	if action.Drop {
+		steps = append(steps, step{kind: "drop"})
+	}
+
+	if len(steps) != 1 {
+		return step{}, fmt.Errorf("each action must have exactly one of rename, set, copy, regex_replace, lowercase or drop")
+	}
+	return steps[0], nil
+}
+
+func readableField(field string) error {
+	if !slices.Contains(models.EventFields, field) {
+		return fmt.Errorf("unknown field %q", field)
+	}
+	return nil
+}
+
+func writableField(field string) error {
+	if err := readableField(field); err != nil {
+		return err
+	}
+	if field == "id" {
+		return fmt.Errorf("field id cannot be changed")
+	}
+	return nil
+}
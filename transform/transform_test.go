@@ -0,0 +1,133 @@
+package transform
+
+import (
+	"analytics-backend/models"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testRules = `
+rules:
+  - name: rename-btn-click
+    match:
+      action: btn_click
+    actions:
+      - rename: {field: action, values: {btn_click: click}}
+  - name: lowercase-element
+    actions:
+      - lowercase: element
+  - name: element-from-action
+    match:
+      element: ""
+    actions:
+      - copy: {from: action, to: element}
+  - name: strip-suffix
+    match_regex:
+      element: "_[0-9]+$"
+    actions:
+      - regex_replace: {field: element, pattern: "_[0-9]+$", replacement: ""}
+  - name: drop-test-users
+    match:
+      user_id: "test_*"
+    actions:
+      - drop: true
+  - name: never-reached-for-dropped
+    actions:
+      - set: {field: duration, value: "1"}
+`
+
+func TestPipeline_AppliesRulesInOrder(t *testing.T) {
+	pipeline, err := Parse([]byte(testRules))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	result := pipeline.DryRun(models.Event{UserId: "u1", Action: "btn_click", Element: "Signup_Button_42"})
+	if result.Dropped {
+		t.Fatal("event should not be dropped")
+	}
+	if result.Event.Action != "click" || result.Event.Element != "signup_button" || result.Event.Duration != 1 {
+		t.Errorf("unexpected result: %+v", result.Event)
+	}
+	want := []string{"rename-btn-click", "lowercase-element", "strip-suffix", "never-reached-for-dropped"}
+	if len(result.Matched) != len(want) {
+		t.Fatalf("expected rules %v, got %v", want, result.Matched)
+	}
+	for i := range want {
+		if result.Matched[i] != want[i] {
+			t.Errorf("expected rules %v, got %v", want, result.Matched)
+		}
+	}
+
+	copied := pipeline.DryRun(models.Event{UserId: "u2", Action: "view"})
+	if copied.Event.Element != "view" {
+		t.Errorf("expected element copied from action, got %q", copied.Event.Element)
+	}
+
+	dropped := pipeline.DryRun(models.Event{UserId: "test_42", Action: "click", Element: "x"})
+	if !dropped.Dropped || dropped.Event.Duration != 0 {
+		t.Errorf("expected test user to be dropped before later rules, got %+v", dropped)
+	}
+}
+
+func TestCompile_RejectsInvalidRules(t *testing.T) {
+	cases := map[string]string{
+		"unknown field":   "rules: [{name: a, match: {colour: red}, actions: [{drop: true}]}]",
+		"two operations":  "rules: [{name: a, actions: [{drop: true, lowercase: action}]}]",
+		"no operation":    "rules: [{name: a, actions: [{}]}]",
+		"id is read-only": "rules: [{name: a, actions: [{set: {field: id, value: '1'}}]}]",
+		"bad regex":       "rules: [{name: a, actions: [{regex_replace: {field: action, pattern: '('}}]}]",
+		"bad set value":   "rules: [{name: a, actions: [{set: {field: duration, value: fast}}]}]",
+		"duplicate name":  "rules: [{name: a, actions: [{drop: true}]}, {name: a, actions: [{drop: true}]}]",
+	}
+	for name, rules := range cases {
+		if _, err := Parse([]byte(rules)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestInit_ReloadsChangedFileAndKeepsRulesOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transforms.yaml")
+	write := func(content string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+	base := time.Now().Add(-time.Hour)
+	write("rules: [{name: a, actions: [{lowercase: action}]}]", base)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := Init(ctx, path, 10*time.Millisecond); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if got := Apply(models.Event{Action: "CLICK"}).Event.Action; got != "click" {
+		t.Fatalf("expected initial rules to apply, got %q", got)
+	}
+
+	write("rules: [{name: b, actions: [{set: {field: action, value: replaced}}]}]", base.Add(time.Minute))
+	waitFor(t, func() bool { return Apply(models.Event{Action: "CLICK"}).Event.Action == "replaced" })
+
+	write("rules: [{name: broken", base.Add(2*time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if got := Apply(models.Event{Action: "CLICK"}).Event.Action; got != "replaced" {
+		t.Errorf("expected previous rules to stay active after a bad reload, got %q", got)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"log"
 	"sync"
+	"time"
 
 	"github.com/bwmarrin/snowflake"
 )
@@ -29,3 +30,31 @@ func GenerateID() int64 {
 	}
 	return node.Generate().Int64()
 }
+
+// DecodedID is what a Snowflake ID records about where it was generated.
+type DecodedID struct {
+	Time time.Time `json:"time"`
+	Node int64     `json:"node"`
+	Step int64     `json:"step"`
+}
+
+// DecodeID reads the generation time, node and per-millisecond sequence
+// number out of an ID made by GenerateID.
+func DecodeID(id int64) DecodedID {
+	sf := snowflake.ParseInt64(id)
+	return DecodedID{
+		Time: time.UnixMilli(sf.Time()).UTC(),
+		Node: sf.Node(),
+		Step: sf.Step(),
+	}
+}
+
+// FirstIDAt returns the lowest ID GenerateID can make at t, so every ID made
+// before t is lower and every ID made from t on is at least this. It is 0 for
+// times before the Snowflake epoch.
+func FirstIDAt(t time.Time) int64 {
+	if t.UnixMilli() < snowflake.Epoch {
+		return 0
+	}
+	return (t.UnixMilli() - snowflake.Epoch) << (snowflake.NodeBits + snowflake.StepBits)
+}
@@ -52,3 +52,32 @@ func TestGenerateID_Concurrent(t *testing.T) {
 		idMap[id] = true
 	}
 }
+
+func TestDecodeID(t *testing.T) {
+	InitSnowflake(1)
+
+	before := time.Now().Truncate(time.Millisecond)
+	decoded := DecodeID(GenerateID())
+	after := time.Now()
+
+	if decoded.Node != 1 {
+		t.Errorf("Expected node 1, got %d", decoded.Node)
+	}
+	if decoded.Time.Before(before) || decoded.Time.After(after) {
+		t.Errorf("Expected a time between %v and %v, got %v", before, after, decoded.Time)
+	}
+}
+
+func TestFirstIDAt_SplitsIDsByGenerationTime(t *testing.T) {
+	InitSnowflake(1)
+
+	id := GenerateID()
+	generated := DecodeID(id).Time
+
+	if FirstIDAt(generated) > id || FirstIDAt(generated.Add(time.Millisecond)) <= id {
+		t.Errorf("expected %d to fall between the first IDs of %s and the next millisecond", id, generated)
+	}
+	if decoded := DecodeID(FirstIDAt(generated)); !decoded.Time.Equal(generated) || decoded.Step != 0 || decoded.Node != 0 {
+		t.Errorf("expected the first ID of %s, got %+v", generated, decoded)
+	}
+}
@@ -4,21 +4,28 @@ import (
 	"analytics-backend/database"
 	"analytics-backend/metrics"
 	"analytics-backend/models"
+	"analytics-backend/sinks"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
-	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
 )
 
 const AggregationWindow = 5 * time.Second
 
+var errStreamNotHeld = errors.New("consumer no longer holds the shard")
+
 type AggregationKey struct {
 	Action  string
 	Element string
 	Window  time.Time
+	Late    bool
 }
 
 type AggregatedData struct {
@@ -26,79 +33,139 @@ type AggregatedData struct {
 	Element string
 	UserIDs []string
 	Window  time.Time
+	Late    bool
 }
 
 type EventStore interface {
-	ReadFromGroup() ([]redis.XMessage, error)
-	BatchAddToDatabase(events []models.Event) error
-	BatchCreateAggregatedEvents(aggEvents []*models.AggregatedEvent) error
-	BatchInsertToClickHouse(events []models.Event) error
-	BatchCreateUserEventMaps(userMaps []models.UserEventMap) error
-	EnqueueEventsForIndexing(ctx context.Context, events []models.Event) error
-	PushToRecentFeed(ctx context.Context, data []byte, id int64) error
-	PublishEvent(ctx context.Context, data []byte) error
-	AckMessage(ids ...string) error
+	ReadFromGroup() (string, []redis.XMessage, error)
+	ReadPendingFromGroup() (string, []redis.XMessage, error)
+	HoldsStream(stream string) (bool, error)
+	CommitBatch(ctx context.Context, batch database.OutboxBatch) (bool, error)
+	AddUserSketches(ctx context.Context, updates []database.UserSketchUpdate) error
+	GetWatermark(ctx context.Context, stream string) (time.Time, error)
+	AdvanceWatermark(ctx context.Context, stream string, eventTime time.Time) (time.Time, error)
+	FinalizationWatermark(ctx context.Context) (time.Time, error)
+	FinalizeWindows(ctx context.Context, through time.Time) (int64, error)
+	AckMessage(stream string, ids ...string) error
+	Quarantine(stream string, msg redis.XMessage, reason error) error
+	DeregisterConsumer() error
 }
 
 type DefaultEventStore struct {
 	Consumer string
+	Sinks    *sinks.Set
+	reader   database.EventReader
+}
+
+func (s *DefaultEventStore) eventReader() database.EventReader {
+	if s.reader == nil {
+		s.reader = database.NewEventReader(s.Consumer)
+	}
+	return s.reader
+}
+
+func (s *DefaultEventStore) ReadFromGroup() (string, []redis.XMessage, error) {
+	return s.eventReader().Read()
+}
+
+func (s *DefaultEventStore) ReadPendingFromGroup() (string, []redis.XMessage, error) {
+	return s.eventReader().ReadPending()
 }
 
-func (s *DefaultEventStore) ReadFromGroup() ([]redis.XMessage, error) {
-	return database.ReadFromGroup(s.Consumer)
+func (s *DefaultEventStore) HoldsStream(stream string) (bool, error) {
+	return s.eventReader().Holds(stream)
 }
 
-func (s *DefaultEventStore) BatchAddToDatabase(events []models.Event) error {
-	return database.BatchAddToDatabase(events)
+// CommitBatch writes the batch and its transactional sinks in one Postgres
+// transaction and leaves the remaining sinks to the outbox relay.
+func (s *DefaultEventStore) CommitBatch(ctx context.Context, batch database.OutboxBatch) (bool, error) {
+	set := s.Sinks
+	if set == nil {
+		set = sinks.Active
+	}
+
+	batch.Sinks = set.Relayed()
+	return database.CommitBatch(ctx, batch, func(tx *gorm.DB) error {
+		return set.WriteInTx(ctx, tx, batch.Events)
+	})
 }
 
-func (s *DefaultEventStore) BatchCreateAggregatedEvents(aggEvents []*models.AggregatedEvent) error {
-	return database.BatchCreateAggregatedEvents(aggEvents)
+func (s *DefaultEventStore) AddUserSketches(ctx context.Context, updates []database.UserSketchUpdate) error {
+	return database.AddUserSketches(ctx, updates)
 }
 
-func (s *DefaultEventStore) BatchInsertToClickHouse(events []models.Event) error {
-	return database.BatchInsertToClickHouse(events)
+// Each lane or shard stream keeps its own watermark, so a lane that lags
+// behind by design, or a shard changing owners, does not make its on-time
+// events late.
+func (s *DefaultEventStore) GetWatermark(ctx context.Context, stream string) (time.Time, error) {
+	return database.GetWatermark(ctx, stream)
 }
 
-func (s *DefaultEventStore) BatchCreateUserEventMaps(userMaps []models.UserEventMap) error {
-	return database.BatchCreateUserEventMaps(userMaps)
+func (s *DefaultEventStore) AdvanceWatermark(ctx context.Context, stream string, eventTime time.Time) (time.Time, error) {
+	return database.AdvanceWatermark(ctx, stream, eventTime)
 }
 
-func (s *DefaultEventStore) EnqueueEventsForIndexing(ctx context.Context, events []models.Event) error {
-	return database.EnqueueEventsForIndexing(ctx, events)
+func (s *DefaultEventStore) FinalizationWatermark(ctx context.Context) (time.Time, error) {
+	return database.FinalizationWatermark(ctx, database.GroupName, database.LaneStreams())
 }
 
-func (s *DefaultEventStore) PushToRecentFeed(ctx context.Context, data []byte, id int64) error {
-	return database.PushToRecentFeed(ctx, data, id)
+func (s *DefaultEventStore) FinalizeWindows(ctx context.Context, through time.Time) (int64, error) {
+	return database.FinalizeWindows(ctx, through)
 }
 
-func (s *DefaultEventStore) AckMessage(ids ...string) error {
-	return database.AckMessage(ids...)
+func (s *DefaultEventStore) AckMessage(stream string, ids ...string) error {
+	return database.AckMessage(stream, ids...)
 }
 
-func (s *DefaultEventStore) PublishEvent(ctx context.Context, data []byte) error {
-	return database.PublishEvent(ctx, data)
+func (s *DefaultEventStore) Quarantine(stream string, msg redis.XMessage, reason error) error {
+	return database.QuarantineMessage(database.Ctx, stream, database.GroupName, msg, reason)
 }
 
-func StartAggregatorWorker(workerName string, store EventStore) {
+func (s *DefaultEventStore) DeregisterConsumer() error {
+	if err := s.eventReader().Close(); err != nil {
+		return err
+	}
+	return database.DeleteLaneConsumer(database.GroupName, s.Consumer)
+}
+
+func StartAggregatorWorker(ctx context.Context, workerName string, store EventStore) {
 	log.Printf("Starting aggregator worker %s...", workerName)
 	metrics.ActiveWorkers.WithLabelValues("aggregator").Inc()
 	defer metrics.ActiveWorkers.WithLabelValues("aggregator").Dec()
 
-	for {
+	// Messages left unacked by a previous run or a failed batch are only
+	// redelivered by reading this consumer's pending list, so that is drained
+	// first on start and after every error.
+	retryPending := true
+	var backoff errorBackoff
+	for ctx.Err() == nil {
 		metrics.WorkerIterations.WithLabelValues("aggregator").Inc()
-		if err := processAggregatedBatch(store); err != nil {
+
+		var err error
+		if retryPending {
+			retryPending, err = processPendingBatch(store)
+		} else {
+			err = processAggregatedBatch(store)
+		}
+		if err != nil {
+			retryPending = true
 			metrics.EventsFailed.WithLabelValues("aggregation").Inc()
 			log.Printf("Error processing aggregated batch: %v", err)
-			time.Sleep(1 * time.Second)
-			continue
+			backoff.wait(ctx)
+		} else {
+			backoff.reset()
 		}
 	}
+
+	if err := store.DeregisterConsumer(); err != nil {
+		log.Printf("Failed to deregister aggregator worker %s: %v", workerName, err)
+	}
+	log.Printf("Aggregator worker %s stopped", workerName)
 }
 
 func processAggregatedBatch(store EventStore) error {
 	start := time.Now()
-	result, err := store.ReadFromGroup()
+	stream, result, err := store.ReadFromGroup()
 	if err != nil {
 		return err
 	}
@@ -107,24 +174,88 @@ func processAggregatedBatch(store EventStore) error {
 		return nil
 	}
 
+	return aggregateMessages(store, start, stream, result)
+}
+
+// processPendingBatch re-runs the oldest unacked messages of this consumer.
+// It reports whether there was anything pending.
+func processPendingBatch(store EventStore) (bool, error) {
+	start := time.Now()
+	stream, result, err := store.ReadPendingFromGroup()
+	if err != nil {
+		return true, err
+	}
+	if len(result) == 0 {
+		return false, nil
+	}
+
+	log.Printf("Retrying %d pending events from %s", len(result), stream)
+	return true, aggregateMessages(store, start, stream, result)
+}
+
+func aggregateMessages(store EventStore, start time.Time, stream string, result []redis.XMessage) error {
 	metrics.AggregationBatchSize.Observe(float64(len(result)))
 	log.Printf("Aggregating batch of %d events", len(result))
 
+	watermark, err := store.GetWatermark(database.Ctx, stream)
+	if err != nil {
+		log.Printf("Failed to read watermark: %v", err)
+		return err
+	}
+
 	eventGroups := make(map[AggregationKey]*AggregatedData)
 	var messageIDs []string
 	var decodedEvents []models.Event
+	var lateEvents []models.LateEvent
+	var eventTimes []time.Time
+	var malformed []malformedMessage
 
 	for _, msg := range result {
-		event := parseEvent(msg)
+		messageIDs = append(messageIDs, msg.ID)
+		event, err := database.DecodeEvent(msg.Values)
+		if err != nil {
+			malformed = append(malformed, malformedMessage{msg: msg, err: err})
+			continue
+		}
 
-		decodedEvents = append(decodedEvents, event)
+		eventTimes = append(eventTimes, event.Timestamp)
 
 		window := event.Timestamp.Truncate(AggregationWindow)
 
+		late := isWindowFinalized(window, watermark)
+		if late {
+			lateness := watermark.Sub(window.Add(AggregationWindow))
+			metrics.LateEvents.WithLabelValues(stream, LatePolicy).Inc()
+			metrics.EventLateness.WithLabelValues(stream).Observe(lateness.Seconds())
+
+			switch LatePolicy {
+			case LatePolicyDrop:
+				continue
+			case LatePolicyLateTable:
+				lateEvents = append(lateEvents, models.LateEvent{
+					EventID:    event.ID,
+					Stream:     stream,
+					UserId:     event.UserId,
+					Action:     event.Action,
+					Element:    event.Element,
+					Duration:   event.Duration,
+					Timestamp:  event.Timestamp,
+					Watermark:  watermark,
+					Lateness:   lateness.Seconds(),
+					ReceivedAt: start,
+				})
+				continue
+			}
+		}
+
+		// Only events the late policy keeps go on to the sinks as raw events.
+		decodedEvents = append(decodedEvents, event)
+
 		key := AggregationKey{
 			Action:  event.Action,
 			Element: event.Element,
 			Window:  window,
+			Late:    late,
 		}
 
 		if existing, found := eventGroups[key]; found {
@@ -135,125 +266,130 @@ func processAggregatedBatch(store EventStore) error {
 				Element: event.Element,
 				UserIDs: []string{event.UserId},
 				Window:  window,
+				Late:    late,
 			}
 		}
-
-		messageIDs = append(messageIDs, msg.ID)
 	}
 
 	log.Printf("Aggregated %d events into %d unique action-element pairs",
 		len(result), len(eventGroups))
 
-	var allUserMaps []models.UserEventMap
-
 	var aggEvents []*models.AggregatedEvent
-	var userIDsList [][]string
+	var sketchUpdates []database.UserSketchUpdate
 
+	// Late rows are finalized by FinalizeWindows too, once every stream has
+	// passed their window, since other lanes or shards may still write it.
 	for _, data := range eventGroups {
 		aggEvent := &models.AggregatedEvent{
 			Action:  data.Action,
 			Element: data.Element,
 			Count:   len(data.UserIDs),
 			Window:  data.Window,
+			Late:    data.Late,
 		}
 		aggEvents = append(aggEvents, aggEvent)
-		userIDsList = append(userIDsList, data.UserIDs)
+		sketchUpdates = append(sketchUpdates, database.UserSketchUpdate{
+			Action:  data.Action,
+			Element: data.Element,
+			Window:  data.Window,
+			UserIDs: data.UserIDs,
+		})
 	}
 
-	if err := store.BatchCreateAggregatedEvents(aggEvents); err != nil {
-		log.Printf("Failed to batch create aggregated events: %v", err)
+	batch := database.OutboxBatch{
+		Key:        outboxBatchKey(stream, messageIDs),
+		Stream:     stream,
+		Aggregated: aggEvents,
+		LateEvents: lateEvents,
+		Events:     decodedEvents,
+	}
+	// With sharding, a consumer that lost the shard while handling the batch
+	// leaves it pending; the new owner claims it once it has been idle for a
+	// whole lease.
+	held, err := store.HoldsStream(stream)
+	if err != nil {
 		return err
 	}
+	if !held {
+		return fmt.Errorf("%w: %s", errStreamNotHeld, stream)
+	}
 
-	if err := store.BatchAddToDatabase(decodedEvents); err != nil {
-		log.Printf("Failed to batch insert raw events to Postgres: %v", err)
+	committed, err := store.CommitBatch(database.Ctx, batch)
+	if err != nil {
+		log.Printf("Failed to commit batch: %v", err)
 		return err
 	}
-
-	for i, aggEvent := range aggEvents {
-		userIDs := userIDsList[i]
-		for _, userID := range userIDs {
-			allUserMaps = append(allUserMaps, models.UserEventMap{
-				AggregatedEventID: aggEvent.ID,
-				UserID:            userID,
-			})
-		}
+	if committed {
+		metrics.AggregatedEventsCreated.Add(float64(len(aggEvents)))
+		notifyOutboxRelay()
+	} else {
+		log.Printf("Batch %s was already committed, finishing it without rewriting", batch.Key)
 	}
 
-	if err := store.BatchInsertToClickHouse(decodedEvents); err != nil {
-		log.Printf("Failed to insert batch to ClickHouse: %v", err)
-		metrics.EventsFailed.WithLabelValues("clickhouse_insert").Inc()
+	// Sketch updates are idempotent, so repeating them for a batch that was
+	// committed before a crash is harmless.
+
+	if err := store.AddUserSketches(database.Ctx, sketchUpdates); err != nil {
+		log.Printf("Failed to update user sketches: %v", err)
 		return err
 	}
 
-	if err := store.BatchCreateUserEventMaps(allUserMaps); err != nil {
-		log.Printf("Failed to create user event maps: %v", err)
+	if _, err := store.AdvanceWatermark(database.Ctx, stream, watermarkCandidate(eventTimes, time.Now())); err != nil {
+		log.Printf("Failed to advance watermark: %v", err)
 		return err
 	}
-
-	for _, event := range decodedEvents {
-		if jsonBytes, err := json.Marshal(event); err == nil {
-			if err := store.PushToRecentFeed(database.Ctx, jsonBytes, event.ID); err != nil {
-				log.Printf("Failed to push event %d to recent feed: %v", event.ID, err)
-				return err
-			}
-			if err := store.PublishEvent(database.Ctx, jsonBytes); err != nil {
-				log.Printf("Failed to publish event %d: %v", event.ID, err)
-				return err
-			}
+	// Windows are shared by every stream, so they are only finalized once
+	// all of them are past.
+	lowWatermark, err := store.FinalizationWatermark(database.Ctx)
+	if err != nil {
+		log.Printf("Failed to read watermarks: %v", err)
+		return err
+	}
+	if !lowWatermark.IsZero() {
+		finalized, err := store.FinalizeWindows(database.Ctx, finalizedThrough(lowWatermark))
+		if err != nil {
+			log.Printf("Failed to finalize windows: %v", err)
+			return err
 		}
+		metrics.WindowsFinalized.Add(float64(finalized))
 	}
 
-	if err := store.EnqueueEventsForIndexing(database.Ctx, decodedEvents); err != nil {
-		log.Printf("Failed to enqueue events for indexing: %v", err)
+	// Malformed messages are only quarantined once the rest of the batch is
+	// done, so a batch retried after a failure does not quarantine them again.
+	for _, m := range malformed {
+		log.Printf("Quarantining malformed message %s from %s: %v", m.msg.ID, stream, m.err)
+		if err := store.Quarantine(stream, m.msg, m.err); err != nil {
+			return err
+		}
 	}
 
-	if err := store.AckMessage(messageIDs...); err != nil {
+	if err := store.AckMessage(stream, messageIDs...); err != nil {
 		log.Printf("Failed to ack messages: %v", err)
 		return err
 	}
 
 	log.Printf("Successfully processed and aggregated %d events", len(result))
 
+	recordBatchLatency("aggregator", time.Since(start))
 	metrics.EventProcessingDuration.Observe(time.Since(start).Seconds())
 	metrics.EventsProcessed.Add(float64(len(result)))
-	metrics.AggregatedEventsCreated.Add(float64(len(aggEvents)))
 
 	return nil
 }
 
-func parseEvent(msg redis.XMessage) models.Event {
-	values := msg.Values
-
-	userID, _ := values["user_id"].(string)
-	action, _ := values["action"].(string)
-	element, _ := values["element"].(string)
-
-	var duration float64
-	if d, ok := values["duration"].(string); ok {
-		duration, _ = strconv.ParseFloat(d, 64)
-	} else if d, ok := values["duration"].(float64); ok {
-		duration = d
-	}
-
-	var timestamp time.Time
-	if tStr, ok := values["timestamp"].(string); ok {
-		timestamp, _ = time.Parse(time.RFC3339, tStr)
-	} else {
-		timestamp = time.Now()
-	}
-
-	var id int64
-	if idStr, ok := values["id"].(string); ok {
-		id, _ = strconv.ParseInt(idStr, 10, 64)
-	}
+type malformedMessage struct {
+	msg redis.XMessage
+	err error
+}
 
-	return models.Event{
-		ID:        id,
-		UserId:    userID,
-		Action:    action,
-		Element:   element,
-		Duration:  duration,
-		Timestamp: timestamp,
+// outboxBatchKey identifies a batch by the stream entries it contains. A batch
+// redelivered from the pending list after a crash gets the same key.
+func outboxBatchKey(stream string, messageIDs []string) string {
+	hash := sha256.New()
+	hash.Write([]byte(stream))
+	for _, id := range messageIDs {
+		hash.Write([]byte{0})
+		hash.Write([]byte(id))
 	}
+	return hex.EncodeToString(hash.Sum(nil))
 }
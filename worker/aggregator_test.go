@@ -1,9 +1,11 @@
 package worker
 
 import (
+	"analytics-backend/database"
 	"analytics-backend/models"
 	"context"
 	"errors"
+	"slices"
 	"testing"
 	"time"
 
@@ -11,80 +13,156 @@ import (
 )
 
 type MockEventStore struct {
-	ReadFromGroupFunc               func() ([]redis.XMessage, error)
-	BatchAddToDatabaseFunc          func(events []models.Event) error
-	BatchCreateAggregatedEventsFunc func(aggEvents []*models.AggregatedEvent) error
-	BatchInsertToClickHouseFunc     func(events []models.Event) error
-	BatchCreateUserEventMapsFunc    func(userMaps []models.UserEventMap) error
-	EnqueueEventsForIndexingFunc    func(ctx context.Context, events []models.Event) error
-	PushToRecentFeedFunc            func(ctx context.Context, data []byte, id int64) error
-	PublishEventFunc                func(ctx context.Context, data []byte) error
-	AckMessageFunc                  func(ids ...string) error
+	ReadFromGroupFunc         func() ([]redis.XMessage, error)
+	ReadPendingFromGroupFunc  func() ([]redis.XMessage, error)
+	HoldsStreamFunc           func(stream string) (bool, error)
+	CommitBatchFunc           func(ctx context.Context, batch database.OutboxBatch) (bool, error)
+	AddUserSketchesFunc       func(ctx context.Context, updates []database.UserSketchUpdate) error
+	GetWatermarkFunc          func(ctx context.Context, stream string) (time.Time, error)
+	AdvanceWatermarkFunc      func(ctx context.Context, stream string, eventTime time.Time) (time.Time, error)
+	FinalizationWatermarkFunc func(ctx context.Context) (time.Time, error)
+	FinalizeWindowsFunc       func(ctx context.Context, through time.Time) (int64, error)
+	AckMessageFunc            func(ids ...string) error
+	QuarantineFunc            func(stream string, msg redis.XMessage, reason error) error
+	DeregisterConsumerFunc    func() error
 }
 
-func (m *MockEventStore) ReadFromGroup() ([]redis.XMessage, error) {
+type mockSink struct {
+	name      string
+	writeFunc func(events []models.Event) error
+}
+
+func (m *mockSink) Name() string {
+	return m.name
+}
+
+func (m *mockSink) Write(ctx context.Context, events []models.Event) error {
+	if m.writeFunc != nil {
+		return m.writeFunc(events)
+	}
+	return nil
+}
+
+func (m *mockSink) Health(ctx context.Context) error {
+	return nil
+}
+
+func (m *MockEventStore) ReadFromGroup() (string, []redis.XMessage, error) {
 	if m.ReadFromGroupFunc != nil {
-		return m.ReadFromGroupFunc()
+		messages, err := m.ReadFromGroupFunc()
+		return database.StreamName, messages, err
 	}
-	return nil, nil
+	return database.StreamName, nil, nil
 }
 
-func (m *MockEventStore) BatchCreateAggregatedEvents(aggEvents []*models.AggregatedEvent) error {
-	if m.BatchCreateAggregatedEventsFunc != nil {
-		return m.BatchCreateAggregatedEventsFunc(aggEvents)
+func (m *MockEventStore) ReadPendingFromGroup() (string, []redis.XMessage, error) {
+	if m.ReadPendingFromGroupFunc != nil {
+		messages, err := m.ReadPendingFromGroupFunc()
+		return database.StreamName, messages, err
 	}
-	return nil
+	return database.StreamName, nil, nil
 }
 
-func (m *MockEventStore) BatchAddToDatabase(events []models.Event) error {
-	if m.BatchAddToDatabaseFunc != nil {
-		return m.BatchAddToDatabaseFunc(events)
+func (m *MockEventStore) HoldsStream(stream string) (bool, error) {
+	if m.HoldsStreamFunc != nil {
+		return m.HoldsStreamFunc(stream)
 	}
-	return nil
+	return true, nil
 }
 
-func (m *MockEventStore) BatchInsertToClickHouse(events []models.Event) error {
-	if m.BatchInsertToClickHouseFunc != nil {
-		return m.BatchInsertToClickHouseFunc(events)
+func (m *MockEventStore) CommitBatch(ctx context.Context, batch database.OutboxBatch) (bool, error) {
+	if m.CommitBatchFunc != nil {
+		return m.CommitBatchFunc(ctx, batch)
 	}
-	return nil
+	return true, nil
 }
 
-func (m *MockEventStore) BatchCreateUserEventMaps(userMaps []models.UserEventMap) error {
-	if m.BatchCreateUserEventMapsFunc != nil {
-		return m.BatchCreateUserEventMapsFunc(userMaps)
+func (m *MockEventStore) AddUserSketches(ctx context.Context, updates []database.UserSketchUpdate) error {
+	if m.AddUserSketchesFunc != nil {
+		return m.AddUserSketchesFunc(ctx, updates)
 	}
 	return nil
 }
 
-func (m *MockEventStore) EnqueueEventsForIndexing(ctx context.Context, events []models.Event) error {
-	if m.EnqueueEventsForIndexingFunc != nil {
-		return m.EnqueueEventsForIndexingFunc(ctx, events)
+func (m *MockEventStore) GetWatermark(ctx context.Context, stream string) (time.Time, error) {
+	if m.GetWatermarkFunc != nil {
+		return m.GetWatermarkFunc(ctx, stream)
 	}
-	return nil
+	return time.Time{}, nil
 }
 
-func (m *MockEventStore) PushToRecentFeed(ctx context.Context, data []byte, id int64) error {
-	if m.PushToRecentFeedFunc != nil {
-		return m.PushToRecentFeedFunc(ctx, data, id)
+func (m *MockEventStore) AdvanceWatermark(ctx context.Context, stream string, eventTime time.Time) (time.Time, error) {
+	if m.AdvanceWatermarkFunc != nil {
+		return m.AdvanceWatermarkFunc(ctx, stream, eventTime)
 	}
-	return nil
+	return eventTime, nil
 }
 
-func (m *MockEventStore) PublishEvent(ctx context.Context, data []byte) error {
-	if m.PublishEventFunc != nil {
-		return m.PublishEventFunc(ctx, data)
+func (m *MockEventStore) FinalizationWatermark(ctx context.Context) (time.Time, error) {
+	if m.FinalizationWatermarkFunc != nil {
+		return m.FinalizationWatermarkFunc(ctx)
 	}
-	return nil
+	return time.Time{}, nil
+}
+
+func (m *MockEventStore) FinalizeWindows(ctx context.Context, through time.Time) (int64, error) {
+	if m.FinalizeWindowsFunc != nil {
+		return m.FinalizeWindowsFunc(ctx, through)
+	}
+	return 0, nil
 }
 
-func (m *MockEventStore) AckMessage(ids ...string) error {
+func (m *MockEventStore) AckMessage(stream string, ids ...string) error {
 	if m.AckMessageFunc != nil {
 		return m.AckMessageFunc(ids...)
 	}
 	return nil
 }
 
+func (m *MockEventStore) Quarantine(stream string, msg redis.XMessage, reason error) error {
+	if m.QuarantineFunc != nil {
+		return m.QuarantineFunc(stream, msg, reason)
+	}
+	return nil
+}
+
+func (m *MockEventStore) DeregisterConsumer() error {
+	if m.DeregisterConsumerFunc != nil {
+		return m.DeregisterConsumerFunc()
+	}
+	return nil
+}
+
+func TestStartAggregatorWorker_StopsAndDeregistersOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	deregistered := false
+	mockStore := &MockEventStore{
+		ReadFromGroupFunc: func() ([]redis.XMessage, error) {
+			cancel()
+			return []redis.XMessage{}, nil
+		},
+		DeregisterConsumerFunc: func() error {
+			deregistered = true
+			return nil
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		StartAggregatorWorker(ctx, "worker-test", mockStore)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected worker to stop after context cancellation")
+	}
+	if !deregistered {
+		t.Fatal("expected worker to deregister its consumer on shutdown")
+	}
+}
+
 func TestProcessAggregatedBatch_Success(t *testing.T) {
 	mockStore := &MockEventStore{
 		ReadFromGroupFunc: func() ([]redis.XMessage, error) {
@@ -92,6 +170,7 @@ func TestProcessAggregatedBatch_Success(t *testing.T) {
 				{
 					ID: "1-0",
 					Values: map[string]interface{}{
+						"id":        "1",
 						"user_id":   "user1",
 						"action":    "click",
 						"element":   "button1",
@@ -101,6 +180,7 @@ func TestProcessAggregatedBatch_Success(t *testing.T) {
 				{
 					ID: "2-0",
 					Values: map[string]interface{}{
+						"id":        "2",
 						"user_id":   "user2",
 						"action":    "click",
 						"element":   "button1",
@@ -109,38 +189,28 @@ func TestProcessAggregatedBatch_Success(t *testing.T) {
 				},
 			}, nil
 		},
-		BatchCreateAggregatedEventsFunc: func(aggEvents []*models.AggregatedEvent) error {
-			if len(aggEvents) != 1 {
-				t.Errorf("Expected 1 aggregated event, got %d", len(aggEvents))
-			}
-			if aggEvents[0].Count != 2 {
-				t.Errorf("Expected count 2, got %d", aggEvents[0].Count)
+		CommitBatchFunc: func(ctx context.Context, batch database.OutboxBatch) (bool, error) {
+			if len(batch.Aggregated) != 1 {
+				t.Errorf("Expected 1 aggregated event, got %d", len(batch.Aggregated))
 			}
-			aggEvents[0].ID = 100
-			return nil
-		},
-		BatchAddToDatabaseFunc: func(events []models.Event) error {
-			if len(events) != 2 {
-				t.Errorf("Expected 2 raw events, got %d", len(events))
+			if batch.Aggregated[0].Count != 2 {
+				t.Errorf("Expected count 2, got %d", batch.Aggregated[0].Count)
 			}
-			return nil
-		},
-		BatchCreateUserEventMapsFunc: func(userMaps []models.UserEventMap) error {
-			if len(userMaps) != 2 {
-				t.Errorf("Expected 2 user maps, got %d", len(userMaps))
+			if len(batch.Events) != 2 {
+				t.Errorf("Expected 2 events in the batch, got %d", len(batch.Events))
 			}
-			if userMaps[0].AggregatedEventID != 100 {
-				t.Errorf("Expected AggregatedEventID 100, got %d", userMaps[0].AggregatedEventID)
+			if batch.Key != outboxBatchKey(database.StreamName, []string{"1-0", "2-0"}) {
+				t.Errorf("Expected the batch key to be derived from the message ids, got %s", batch.Key)
 			}
-			return nil
+			return true, nil
 		},
-		EnqueueEventsForIndexingFunc: func(ctx context.Context, events []models.Event) error {
-			if len(events) != 2 {
-				t.Errorf("Expected 2 index events, got %d", len(events))
+		AddUserSketchesFunc: func(ctx context.Context, updates []database.UserSketchUpdate) error {
+			if len(updates) != 1 {
+				t.Errorf("Expected 1 sketch update, got %d", len(updates))
+			}
+			if len(updates[0].UserIDs) != 2 {
+				t.Errorf("Expected 2 user ids in sketch update, got %d", len(updates[0].UserIDs))
 			}
-			return nil
-		},
-		PublishEventFunc: func(ctx context.Context, data []byte) error {
 			return nil
 		},
 		AckMessageFunc: func(ids ...string) error {
@@ -157,6 +227,88 @@ func TestProcessAggregatedBatch_Success(t *testing.T) {
 	}
 }
 
+func TestProcessAggregatedBatch_QuarantinesMalformedMessages(t *testing.T) {
+	now := time.Now().Format(time.RFC3339Nano)
+	var quarantined []string
+	var acked []string
+	mockStore := &MockEventStore{
+		ReadFromGroupFunc: func() ([]redis.XMessage, error) {
+			return []redis.XMessage{
+				{ID: "1-0", Values: map[string]interface{}{"id": "1", "action": "click", "duration": "2.5", "timestamp": now}},
+				{ID: "2-0", Values: map[string]interface{}{"id": "2", "action": "click", "duration": "slow", "timestamp": now}},
+				{ID: "3-0", Values: map[string]interface{}{"id": "3", "action": "click", "timestamp": "yesterday"}},
+				{ID: "4-0", Values: map[string]interface{}{"action": "click", "timestamp": now}},
+			}, nil
+		},
+		QuarantineFunc: func(stream string, msg redis.XMessage, reason error) error {
+			var decodeErr *database.DecodeError
+			if !errors.As(reason, &decodeErr) {
+				t.Errorf("expected a decode error for %s, got %v", msg.ID, reason)
+			}
+			quarantined = append(quarantined, msg.ID)
+			return nil
+		},
+		CommitBatchFunc: func(ctx context.Context, batch database.OutboxBatch) (bool, error) {
+			if len(batch.Events) != 1 || batch.Events[0].Duration != 2.5 {
+				t.Errorf("expected only the valid event to be written, got %+v", batch.Events)
+			}
+			return true, nil
+		},
+		AckMessageFunc: func(ids ...string) error {
+			acked = append(acked, ids...)
+			return nil
+		},
+	}
+
+	if err := processAggregatedBatch(mockStore); err != nil {
+		t.Fatalf("processAggregatedBatch failed: %v", err)
+	}
+	if len(quarantined) != 3 {
+		t.Fatalf("expected 3 quarantined messages, got %v", quarantined)
+	}
+	if len(acked) != 4 {
+		t.Fatalf("expected quarantined messages to be acked with the batch, got %v", acked)
+	}
+}
+
+func TestProcessAggregatedBatch_QuarantinesMalformedMessagesOnlyOnceTheBatchCommits(t *testing.T) {
+	now := time.Now().Format(time.RFC3339Nano)
+	var quarantined []string
+	commits := 0
+	mockStore := &MockEventStore{
+		ReadPendingFromGroupFunc: func() ([]redis.XMessage, error) {
+			return []redis.XMessage{
+				{ID: "1-0", Values: map[string]interface{}{"id": "1", "action": "click", "duration": "2.5", "timestamp": now}},
+				{ID: "2-0", Values: map[string]interface{}{"id": "2", "action": "click", "duration": "slow", "timestamp": now}},
+			}, nil
+		},
+		QuarantineFunc: func(stream string, msg redis.XMessage, reason error) error {
+			quarantined = append(quarantined, msg.ID)
+			return nil
+		},
+		CommitBatchFunc: func(ctx context.Context, batch database.OutboxBatch) (bool, error) {
+			commits++
+			if commits == 1 {
+				return false, errors.New("postgres down")
+			}
+			return true, nil
+		},
+	}
+
+	if _, err := processPendingBatch(mockStore); err == nil {
+		t.Fatal("expected the first commit to fail")
+	}
+	if len(quarantined) != 0 {
+		t.Fatalf("expected nothing to be quarantined while the batch failed, got %v", quarantined)
+	}
+	if _, err := processPendingBatch(mockStore); err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	if !slices.Equal(quarantined, []string{"2-0"}) {
+		t.Fatalf("expected the malformed message to be quarantined once, got %v", quarantined)
+	}
+}
+
 func TestProcessAggregatedBatch_Empty(t *testing.T) {
 	mockStore := &MockEventStore{
 		ReadFromGroupFunc: func() ([]redis.XMessage, error) {
@@ -183,8 +335,9 @@ func TestProcessAggregatedBatch_ReadError(t *testing.T) {
 	}
 }
 
-func TestProcessAggregatedBatch_DoesNotAckOnClickHouseFailure(t *testing.T) {
+func TestProcessAggregatedBatch_DoesNotAckWhenCommitFails(t *testing.T) {
 	acked := false
+	sketched := false
 	mockStore := &MockEventStore{
 		ReadFromGroupFunc: func() ([]redis.XMessage, error) {
 			return []redis.XMessage{
@@ -200,12 +353,12 @@ func TestProcessAggregatedBatch_DoesNotAckOnClickHouseFailure(t *testing.T) {
 				},
 			}, nil
 		},
-		BatchCreateAggregatedEventsFunc: func(aggEvents []*models.AggregatedEvent) error {
-			aggEvents[0].ID = 100
-			return nil
+		CommitBatchFunc: func(ctx context.Context, batch database.OutboxBatch) (bool, error) {
+			return false, errors.New("postgres down")
 		},
-		BatchInsertToClickHouseFunc: func(events []models.Event) error {
-			return errors.New("clickhouse down")
+		AddUserSketchesFunc: func(ctx context.Context, updates []database.UserSketchUpdate) error {
+			sketched = true
+			return nil
 		},
 		AckMessageFunc: func(ids ...string) error {
 			acked = true
@@ -215,51 +368,200 @@ func TestProcessAggregatedBatch_DoesNotAckOnClickHouseFailure(t *testing.T) {
 
 	err := processAggregatedBatch(mockStore)
 	if err == nil {
-		t.Fatal("expected error when clickhouse insert fails")
+		t.Fatal("expected error when the batch transaction fails")
 	}
-	if acked {
-		t.Fatal("expected messages to remain unacked on clickhouse failure")
+	if acked || sketched {
+		t.Fatal("expected nothing after a failed commit")
 	}
 }
 
-func TestProcessAggregatedBatch_AcksEvenWhenIndexEnqueueFails(t *testing.T) {
-	acked := false
+func TestProcessPendingBatch_FinishesAlreadyCommittedBatch(t *testing.T) {
+	var acked []string
+	sketched := false
 	mockStore := &MockEventStore{
-		ReadFromGroupFunc: func() ([]redis.XMessage, error) {
+		ReadPendingFromGroupFunc: func() ([]redis.XMessage, error) {
 			return []redis.XMessage{
-				{
-					ID: "1-0",
-					Values: map[string]interface{}{
-						"id":        "123",
-						"user_id":   "user1",
-						"action":    "click",
-						"element":   "button1",
-						"timestamp": time.Now().Format(time.RFC3339),
-					},
-				},
+				{ID: "1-0", Values: map[string]interface{}{"id": "1", "user_id": "user1", "action": "click", "element": "button1", "timestamp": time.Now().Format(time.RFC3339)}},
 			}, nil
 		},
-		BatchCreateAggregatedEventsFunc: func(aggEvents []*models.AggregatedEvent) error {
-			aggEvents[0].ID = 100
-			return nil
+		CommitBatchFunc: func(ctx context.Context, batch database.OutboxBatch) (bool, error) {
+			return false, nil
 		},
-		EnqueueEventsForIndexingFunc: func(ctx context.Context, events []models.Event) error {
-			return errors.New("queue down")
+		AddUserSketchesFunc: func(ctx context.Context, updates []database.UserSketchUpdate) error {
+			sketched = true
+			return nil
 		},
-		PublishEventFunc: func(ctx context.Context, data []byte) error {
+		AckMessageFunc: func(ids ...string) error {
+			acked = append(acked, ids...)
 			return nil
 		},
+	}
+
+	pending, err := processPendingBatch(mockStore)
+	if err != nil {
+		t.Fatalf("processPendingBatch failed: %v", err)
+	}
+	if !pending {
+		t.Fatal("expected pending messages to be reported")
+	}
+	if !sketched || len(acked) != 1 || acked[0] != "1-0" {
+		t.Fatalf("expected the committed batch to be finished and acked, got %v", acked)
+	}
+}
+
+func TestProcessAggregatedBatch_RoutesLateEventsByPolicy(t *testing.T) {
+	previousPolicy := LatePolicy
+	defer func() { LatePolicy = previousPolicy }()
+
+	watermark := time.Date(2026, 4, 10, 12, 0, 0, 0, time.UTC)
+	lateTimestamp := watermark.Add(-10 * time.Minute)
+	onTimeTimestamp := watermark.Add(-time.Second)
+
+	var events []models.Event
+	newStore := func(aggregated *[]*models.AggregatedEvent, late *[]models.LateEvent) *MockEventStore {
+		return &MockEventStore{
+			ReadFromGroupFunc: func() ([]redis.XMessage, error) {
+				return []redis.XMessage{
+					{ID: "1-0", Values: map[string]interface{}{"id": "1", "user_id": "user1", "action": "click", "element": "button1", "timestamp": lateTimestamp.Format(time.RFC3339)}},
+					{ID: "2-0", Values: map[string]interface{}{"id": "2", "user_id": "user2", "action": "click", "element": "button1", "timestamp": onTimeTimestamp.Format(time.RFC3339)}},
+				}, nil
+			},
+			GetWatermarkFunc: func(ctx context.Context, stream string) (time.Time, error) {
+				return watermark, nil
+			},
+			CommitBatchFunc: func(ctx context.Context, batch database.OutboxBatch) (bool, error) {
+				*aggregated = batch.Aggregated
+				*late = batch.LateEvents
+				events = batch.Events
+				return true, nil
+			},
+		}
+	}
+
+	LatePolicy = LatePolicyLateTable
+	var aggregated []*models.AggregatedEvent
+	var late []models.LateEvent
+	if err := processAggregatedBatch(newStore(&aggregated, &late)); err != nil {
+		t.Fatalf("processAggregatedBatch failed: %v", err)
+	}
+	if len(late) != 1 || late[0].EventID != 1 {
+		t.Fatalf("expected event 1 in the late table, got %#v", late)
+	}
+	if len(aggregated) != 1 || aggregated[0].Late {
+		t.Fatalf("expected only the on-time event to be aggregated, got %#v", aggregated)
+	}
+	if len(events) != 1 || events[0].ID != 2 {
+		t.Fatalf("expected only the on-time event to be stored as a raw event, got %#v", events)
+	}
+
+	LatePolicy = LatePolicyDrop
+	aggregated, late = nil, nil
+	if err := processAggregatedBatch(newStore(&aggregated, &late)); err != nil {
+		t.Fatalf("processAggregatedBatch failed: %v", err)
+	}
+	if len(late) != 0 || len(aggregated) != 1 || len(events) != 1 || events[0].ID != 2 {
+		t.Fatalf("expected the late event to be dropped everywhere, got %#v %#v %#v", aggregated, late, events)
+	}
+
+	LatePolicy = LatePolicyUpdate
+	aggregated, late = nil, nil
+	if err := processAggregatedBatch(newStore(&aggregated, &late)); err != nil {
+		t.Fatalf("processAggregatedBatch failed: %v", err)
+	}
+	if len(late) != 0 {
+		t.Fatalf("expected no late table rows under update policy, got %d", len(late))
+	}
+	lateRows := 0
+	for _, agg := range aggregated {
+		if agg.Late {
+			lateRows++
+			if agg.Finalized {
+				t.Fatal("expected late update row to be left for FinalizeWindows")
+			}
+		}
+	}
+	if lateRows != 1 {
+		t.Fatalf("expected 1 late aggregated row, got %d", lateRows)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected both events to be stored as raw events under update policy, got %d", len(events))
+	}
+}
+
+func TestProcessAggregatedBatch_UsesTheBatchStreamWatermark(t *testing.T) {
+	const lane = "events:bulk"
+	now := time.Now().UTC()
+	bulkWatermark := now.Add(-time.Minute)
+	lowWatermark := now.Add(-2 * time.Minute)
+
+	messages := []redis.XMessage{
+		{ID: "1-0", Values: map[string]interface{}{"id": "1", "user_id": "user1", "action": "scroll", "element": "page", "timestamp": bulkWatermark.Add(-time.Second).Format(time.RFC3339Nano)}},
+	}
+
+	var read, advanced string
+	var through time.Time
+	var aggregated []*models.AggregatedEvent
+	store := &MockEventStore{
+		GetWatermarkFunc: func(ctx context.Context, stream string) (time.Time, error) {
+			read = stream
+			return bulkWatermark, nil
+		},
+		AdvanceWatermarkFunc: func(ctx context.Context, stream string, eventTime time.Time) (time.Time, error) {
+			advanced = stream
+			return bulkWatermark, nil
+		},
+		FinalizationWatermarkFunc: func(ctx context.Context) (time.Time, error) {
+			return lowWatermark, nil
+		},
+		FinalizeWindowsFunc: func(ctx context.Context, finalized time.Time) (int64, error) {
+			through = finalized
+			return 0, nil
+		},
+		CommitBatchFunc: func(ctx context.Context, batch database.OutboxBatch) (bool, error) {
+			aggregated = batch.Aggregated
+			return true, nil
+		},
+	}
+
+	if err := aggregateMessages(store, time.Now(), lane, messages); err != nil {
+		t.Fatalf("aggregateMessages failed: %v", err)
+	}
+	if read != lane || advanced != lane {
+		t.Fatalf("expected the watermark of %s, read %q and advanced %q", lane, read, advanced)
+	}
+	if len(aggregated) != 1 || aggregated[0].Late {
+		t.Fatalf("expected the event to be on time for its own lane, got %#v", aggregated)
+	}
+	if !through.Equal(finalizedThrough(lowWatermark)) {
+		t.Fatalf("expected windows to be finalized up to the lowest watermark, got %s", through)
+	}
+}
+
+func TestProcessAggregatedBatch_LeavesBatchPendingWhenShardIsLost(t *testing.T) {
+	committed, acked := false, false
+	mockStore := &MockEventStore{
+		ReadFromGroupFunc: func() ([]redis.XMessage, error) {
+			return []redis.XMessage{
+				{ID: "1-0", Values: map[string]interface{}{"id": "1", "user_id": "user1", "action": "click", "element": "button1", "timestamp": time.Now().UTC().Format(time.RFC3339)}},
+			}, nil
+		},
+		HoldsStreamFunc: func(stream string) (bool, error) {
+			return false, nil
+		},
+		CommitBatchFunc: func(ctx context.Context, batch database.OutboxBatch) (bool, error) {
+			committed = true
+			return true, nil
+		},
 		AckMessageFunc: func(ids ...string) error {
 			acked = true
 			return nil
 		},
 	}
 
-	err := processAggregatedBatch(mockStore)
-	if err != nil {
-		t.Fatalf("expected enqueue failure to be non-fatal, got %v", err)
+	if err := processAggregatedBatch(mockStore); !errors.Is(err, errStreamNotHeld) {
+		t.Fatalf("expected the lost shard to be reported, got %v", err)
 	}
-	if !acked {
-		t.Fatal("expected messages to be acked even when indexing enqueue fails")
+	if committed || acked {
+		t.Fatalf("expected the batch to be neither committed nor acked, got %v %v", committed, acked)
 	}
 }
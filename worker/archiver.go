@@ -0,0 +1,303 @@
+package worker
+
+import (
+	"analytics-backend/archive"
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ArchiveCloseDelay      = 2 * time.Minute
+	ArchiveMaxRowsPerFile  = 250000
+	ArchiveMaxBufferedRows = 1000000
+)
+
+type ArchiveStore interface {
+	ReadEvents() (string, []redis.XMessage, error)
+	ReadPendingEvents(stream, after string) ([]redis.XMessage, error)
+	PutFile(ctx context.Context, key string, data []byte) error
+	RecordFile(ctx context.Context, file *models.ArchiveFile) error
+	AckEvents(stream string, ids ...string) error
+	Quarantine(stream string, msg redis.XMessage, reason error) error
+	DeregisterConsumer() error
+}
+
+type DefaultArchiveStore struct {
+	Consumer string
+	Storage  archive.Storage
+	reader   *database.LaneReader
+}
+
+func (s *DefaultArchiveStore) ReadEvents() (string, []redis.XMessage, error) {
+	if s.reader == nil {
+		s.reader = database.NewArchiveReader(s.Consumer)
+	}
+	return s.reader.Read()
+}
+
+func (s *DefaultArchiveStore) ReadPendingEvents(stream, after string) ([]redis.XMessage, error) {
+	return database.ReadPendingArchiveEvents(stream, s.Consumer, after)
+}
+
+func (s *DefaultArchiveStore) PutFile(ctx context.Context, key string, data []byte) error {
+	return s.Storage.Put(ctx, key, data)
+}
+
+func (s *DefaultArchiveStore) RecordFile(ctx context.Context, file *models.ArchiveFile) error {
+	file.Storage = s.Storage.Name()
+	return database.RecordArchiveFile(ctx, file)
+}
+
+func (s *DefaultArchiveStore) AckEvents(stream string, ids ...string) error {
+	return database.AckArchiveEvents(stream, ids...)
+}
+
+func (s *DefaultArchiveStore) Quarantine(stream string, msg redis.XMessage, reason error) error {
+	return database.QuarantineMessage(database.Ctx, stream, database.ArchiveGroupName, msg, reason)
+}
+
+func (s *DefaultArchiveStore) DeregisterConsumer() error {
+	return database.DeleteLaneConsumer(database.ArchiveGroupName, s.Consumer)
+}
+
+func ConfigureArchive(cfg config.ArchiveConfig) {
+	if cfg.CloseDelay > 0 {
+		ArchiveCloseDelay = cfg.CloseDelay
+	}
+	if cfg.MaxRowsPerFile > 0 {
+		ArchiveMaxRowsPerFile = cfg.MaxRowsPerFile
+	}
+	if cfg.MaxBufferedRows > 0 {
+		ArchiveMaxBufferedRows = cfg.MaxBufferedRows
+	}
+}
+
+type archivePartition struct {
+	stream string
+	hour   time.Time
+	action string
+}
+
+type archiveBuffer struct {
+	events []models.Event
+	ids    []string
+}
+
+// archiver keeps events in memory per hour and action until the hour closes,
+// and only acknowledges them once their file is stored and in the manifest.
+type archiver struct {
+	store    ArchiveStore
+	buffers  map[archivePartition]*archiveBuffer
+	buffered int
+}
+
+func newArchiver(store ArchiveStore) *archiver {
+	return &archiver{store: store, buffers: map[archivePartition]*archiveBuffer{}}
+}
+
+func StartArchiverWorker(ctx context.Context, workerName string, store ArchiveStore) {
+	log.Printf("Starting archiver worker %s...", workerName)
+	metrics.ActiveWorkers.WithLabelValues("archiver").Inc()
+	defer metrics.ActiveWorkers.WithLabelValues("archiver").Dec()
+
+	a := newArchiver(store)
+	if err := a.recoverPending(); err != nil {
+		log.Printf("Failed to recover pending archive events for %s: %v", workerName, err)
+	}
+
+	var backoff errorBackoff
+	for ctx.Err() == nil {
+		metrics.WorkerIterations.WithLabelValues("archiver").Inc()
+		if err := a.processBatch(time.Now()); err != nil {
+			metrics.EventsFailed.WithLabelValues("archive").Inc()
+			log.Printf("Error processing archive batch for %s: %v", workerName, err)
+			backoff.wait(ctx)
+		} else {
+			backoff.reset()
+		}
+	}
+
+	if err := a.flushAll(); err != nil {
+		log.Printf("Archiver %s could not flush every partition, unwritten events stay pending: %v", workerName, err)
+	}
+	metrics.ArchiveBufferedRows.Sub(float64(a.buffered))
+
+	if err := store.DeregisterConsumer(); err != nil {
+		log.Printf("Failed to deregister archiver worker %s: %v", workerName, err)
+	}
+	log.Printf("Archiver worker %s stopped", workerName)
+}
+
+// recoverPending re-buffers messages this consumer read before a restart but
+// never acknowledged, so they land in a file instead of staying pending.
+func (a *archiver) recoverPending() error {
+	for _, lane := range database.Lanes() {
+		after := "0"
+		for {
+			messages, err := a.store.ReadPendingEvents(lane.Stream, after)
+			if err != nil {
+				return err
+			}
+			if len(messages) == 0 {
+				break
+			}
+			if err := a.add(lane.Stream, messages); err != nil {
+				return err
+			}
+			after = messages[len(messages)-1].ID
+		}
+	}
+	return nil
+}
+
+func (a *archiver) processBatch(now time.Time) error {
+	stream, messages, err := a.store.ReadEvents()
+	if err != nil {
+		return err
+	}
+	if err := a.add(stream, messages); err != nil {
+		return err
+	}
+	return a.flushDue(now)
+}
+
+func (a *archiver) add(stream string, messages []redis.XMessage) error {
+	var skipped []string
+	for _, msg := range messages {
+		if _, restored := msg.Values[database.RestoredField]; restored {
+			skipped = append(skipped, msg.ID)
+			continue
+		}
+
+		event, err := database.DecodeEvent(msg.Values)
+		if err != nil {
+			log.Printf("Quarantining malformed message %s from %s: %v", msg.ID, stream, err)
+			if err := a.store.Quarantine(stream, msg, err); err != nil {
+				return err
+			}
+			skipped = append(skipped, msg.ID)
+			continue
+		}
+
+		key := archivePartition{stream: stream, hour: event.Timestamp.UTC().Truncate(time.Hour), action: event.Action}
+		buffer, ok := a.buffers[key]
+		if !ok {
+			buffer = &archiveBuffer{}
+			a.buffers[key] = buffer
+		}
+		buffer.events = append(buffer.events, event)
+		buffer.ids = append(buffer.ids, msg.ID)
+		a.buffered++
+		metrics.ArchiveBufferedRows.Inc()
+	}
+	return a.store.AckEvents(stream, skipped...)
+}
+
+// flushDue writes partitions whose hour closed more than ArchiveCloseDelay
+// ago or that reached ArchiveMaxRowsPerFile. If too much is buffered overall,
+// everything is written early instead.
+func (a *archiver) flushDue(now time.Time) error {
+	if a.buffered > ArchiveMaxBufferedRows {
+		return a.flushAll()
+	}
+
+	var firstErr error
+	for key, buffer := range a.buffers {
+		closed := now.After(key.hour.Add(time.Hour + ArchiveCloseDelay))
+		if !closed && len(buffer.events) < ArchiveMaxRowsPerFile {
+			continue
+		}
+		if err := a.flush(key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (a *archiver) flushAll() error {
+	var firstErr error
+	for key := range a.buffers {
+		if err := a.flush(key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// flush keeps the buffer when any step fails. The retry rewrites the same
+// key, so a file stored before a manifest or ack failure is simply replaced.
+func (a *archiver) flush(key archivePartition) error {
+	buffer := a.buffers[key]
+	if buffer == nil || len(buffer.events) == 0 {
+		delete(a.buffers, key)
+		return nil
+	}
+
+	data, err := archive.Encode(buffer.events)
+	if err != nil {
+		metrics.ArchiveWriteFailures.Inc()
+		return err
+	}
+
+	// Entry IDs are only unique within a stream, so files from other lanes
+	// carry the lane name as well.
+	first := buffer.ids[0]
+	if !database.IsDefaultLane(key.stream) {
+		first = database.LaneName(key.stream) + "-" + first
+	}
+	path := archive.FileKey(key.hour, key.action, first)
+	if err := a.store.PutFile(database.Ctx, path, data); err != nil {
+		metrics.ArchiveWriteFailures.Inc()
+		return err
+	}
+
+	checksum := sha256.Sum256(data)
+	file := &models.ArchiveFile{
+		Path:     path,
+		Hour:     key.hour,
+		Action:   key.action,
+		Rows:     len(buffer.events),
+		Bytes:    int64(len(data)),
+		Checksum: hex.EncodeToString(checksum[:]),
+	}
+	file.MinTimestamp, file.MaxTimestamp = timestampRange(buffer.events)
+	if err := a.store.RecordFile(database.Ctx, file); err != nil {
+		metrics.ArchiveWriteFailures.Inc()
+		return err
+	}
+
+	if err := a.store.AckEvents(key.stream, buffer.ids...); err != nil {
+		return err
+	}
+
+	delete(a.buffers, key)
+	a.buffered -= len(buffer.events)
+	metrics.ArchiveBufferedRows.Sub(float64(len(buffer.events)))
+	metrics.ArchiveFilesWritten.Inc()
+	metrics.ArchiveRowsWritten.Add(float64(len(buffer.events)))
+	metrics.ArchiveBytesWritten.Add(float64(len(data)))
+	log.Printf("Archived %d events to %s", len(buffer.events), path)
+	return nil
+}
+
+func timestampRange(events []models.Event) (time.Time, time.Time) {
+	minTs, maxTs := events[0].Timestamp, events[0].Timestamp
+	for _, event := range events[1:] {
+		if event.Timestamp.Before(minTs) {
+			minTs = event.Timestamp
+		}
+		if event.Timestamp.After(maxTs) {
+			maxTs = event.Timestamp
+		}
+	}
+	return minTs, maxTs
+}
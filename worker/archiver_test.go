@@ -0,0 +1,140 @@
+package worker
+
+import (
+	"analytics-backend/archive"
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type MockArchiveStore struct {
+	Messages    []redis.XMessage
+	Files       map[string][]byte
+	Manifest    []models.ArchiveFile
+	Acked       []string
+	Quarantined []string
+	RecordErr   error
+}
+
+func (m *MockArchiveStore) ReadEvents() (string, []redis.XMessage, error) {
+	messages := m.Messages
+	m.Messages = nil
+	return database.StreamName, messages, nil
+}
+
+func (m *MockArchiveStore) ReadPendingEvents(stream, after string) ([]redis.XMessage, error) {
+	return nil, nil
+}
+
+func (m *MockArchiveStore) PutFile(ctx context.Context, key string, data []byte) error {
+	if m.Files == nil {
+		m.Files = map[string][]byte{}
+	}
+	m.Files[key] = data
+	return nil
+}
+
+func (m *MockArchiveStore) RecordFile(ctx context.Context, file *models.ArchiveFile) error {
+	if m.RecordErr != nil {
+		return m.RecordErr
+	}
+	m.Manifest = append(m.Manifest, *file)
+	return nil
+}
+
+func (m *MockArchiveStore) AckEvents(stream string, ids ...string) error {
+	m.Acked = append(m.Acked, ids...)
+	return nil
+}
+
+func (m *MockArchiveStore) Quarantine(stream string, msg redis.XMessage, reason error) error {
+	m.Quarantined = append(m.Quarantined, msg.ID)
+	return nil
+}
+
+func (m *MockArchiveStore) DeregisterConsumer() error {
+	return nil
+}
+
+func TestArchiver_FlushesClosedHoursPerAction(t *testing.T) {
+	now := time.Date(2024, 5, 1, 14, 30, 0, 0, time.UTC)
+	store := &MockArchiveStore{Messages: []redis.XMessage{
+		{ID: "1-0", Values: map[string]interface{}{"id": "1", "user_id": "u1", "action": "click", "timestamp": "2024-05-01T13:10:00Z"}},
+		{ID: "2-0", Values: map[string]interface{}{"id": "2", "user_id": "u2", "action": "view", "timestamp": "2024-05-01T13:20:00Z"}},
+		{ID: "3-0", Values: map[string]interface{}{"id": "3", "user_id": "u3", "action": "click", "timestamp": "2024-05-01T13:50:00Z"}},
+		{ID: "4-0", Values: map[string]interface{}{"id": "4", "user_id": "u4", "action": "click", "timestamp": "2024-05-01T14:05:00Z"}},
+		{ID: "5-0", Values: map[string]interface{}{"id": "5", "user_id": "u5", "action": "click", "timestamp": "2024-05-01T13:15:00Z", "restored": "1"}},
+	}}
+
+	a := newArchiver(store)
+	if err := a.processBatch(now); err != nil {
+		t.Fatalf("processBatch: %v", err)
+	}
+
+	if len(store.Manifest) != 2 {
+		t.Fatalf("expected 2 files for the closed hour, got %d", len(store.Manifest))
+	}
+
+	key := archive.FileKey(time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC), "click", "1-0")
+	data, ok := store.Files[key]
+	if !ok {
+		t.Fatalf("expected file %s, got %v", key, store.Manifest)
+	}
+	events, err := archive.Decode(data)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(events) != 2 || events[0].ID != 1 || events[1].ID != 3 {
+		t.Errorf("unexpected archived click events: %+v", events)
+	}
+
+	acked := map[string]bool{}
+	for _, id := range store.Acked {
+		acked[id] = true
+	}
+	for _, id := range []string{"1-0", "2-0", "3-0", "5-0"} {
+		if !acked[id] {
+			t.Errorf("expected %s to be acked", id)
+		}
+	}
+	if acked["4-0"] {
+		t.Error("event from the open hour should stay pending until its file is written")
+	}
+	if a.buffered != 1 {
+		t.Errorf("expected 1 buffered event, got %d", a.buffered)
+	}
+}
+
+func TestArchiver_KeepsBufferWhenManifestFails(t *testing.T) {
+	now := time.Date(2024, 5, 1, 14, 30, 0, 0, time.UTC)
+	store := &MockArchiveStore{
+		Messages: []redis.XMessage{
+			{ID: "1-0", Values: map[string]interface{}{"id": "1", "action": "click", "timestamp": "2024-05-01T13:10:00Z"}},
+		},
+		RecordErr: errors.New("postgres down"),
+	}
+
+	a := newArchiver(store)
+	if err := a.processBatch(now); err == nil {
+		t.Fatal("expected manifest error")
+	}
+	if len(store.Acked) != 0 {
+		t.Errorf("nothing should be acked before the manifest is written, got %v", store.Acked)
+	}
+
+	store.RecordErr = nil
+	if err := a.processBatch(now); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if len(store.Files) != 1 || len(store.Manifest) != 1 {
+		t.Errorf("expected the retry to rewrite the same file, got %d files and %d manifest rows", len(store.Files), len(store.Manifest))
+	}
+	if len(store.Acked) != 1 || store.Acked[0] != "1-0" {
+		t.Errorf("expected 1-0 to be acked after retry, got %v", store.Acked)
+	}
+}
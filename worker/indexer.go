@@ -4,8 +4,8 @@ import (
 	"analytics-backend/database"
 	"analytics-backend/metrics"
 	"analytics-backend/models"
+	"context"
 	"log"
-	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -13,8 +13,12 @@ import (
 
 type IndexStore interface {
 	ReadIndexJobs() ([]redis.XMessage, error)
+	ReadPendingIndexJobs() ([]redis.XMessage, error)
+	ClaimIdleIndexJobs() ([]redis.XMessage, error)
 	BulkIndexEvents(events []models.Event) error
 	AckIndexJobs(ids ...string) error
+	Quarantine(msg redis.XMessage, reason error) error
+	DeregisterConsumer() error
 }
 
 type DefaultIndexStore struct {
@@ -25,6 +29,14 @@ func (s *DefaultIndexStore) ReadIndexJobs() ([]redis.XMessage, error) {
 	return database.ReadIndexJobsFromGroup(s.Consumer)
 }
 
+func (s *DefaultIndexStore) ReadPendingIndexJobs() ([]redis.XMessage, error) {
+	return database.ReadPendingIndexJobs(s.Consumer)
+}
+
+func (s *DefaultIndexStore) ClaimIdleIndexJobs() ([]redis.XMessage, error) {
+	return database.ClaimIdleIndexJobs(s.Consumer)
+}
+
 func (s *DefaultIndexStore) BulkIndexEvents(events []models.Event) error {
 	return database.BulkIndexEvents(database.Ctx, events)
 }
@@ -33,20 +45,60 @@ func (s *DefaultIndexStore) AckIndexJobs(ids ...string) error {
 	return database.AckIndexJobs(ids...)
 }
 
-func StartSearchIndexerWorker(workerName string, store IndexStore) {
+func (s *DefaultIndexStore) Quarantine(msg redis.XMessage, reason error) error {
+	return database.QuarantineMessage(database.Ctx, database.IndexStreamName, database.IndexGroupName, msg, reason)
+}
+
+func (s *DefaultIndexStore) DeregisterConsumer() error {
+	removed, err := database.DeleteConsumer(database.IndexStreamName, database.IndexGroupName, s.Consumer)
+	if err == nil && !removed {
+		log.Printf("Keeping consumer %s registered because it still owns pending index jobs", s.Consumer)
+	}
+	return err
+}
+
+func StartSearchIndexerWorker(ctx context.Context, workerName string, store IndexStore) {
 	log.Printf("Starting search indexer worker %s...", workerName)
 	metrics.ActiveWorkers.WithLabelValues("indexer").Inc()
 	defer metrics.ActiveWorkers.WithLabelValues("indexer").Dec()
 
-	for {
+	// Like the aggregator, the indexer drains its own pending jobs first on
+	// start and after every error. Every LaneClaimIdle/2 it also takes over
+	// the jobs of indexers that stopped with jobs pending, which a smaller
+	// pool would otherwise never index.
+	retryPending := true
+	var claimedAt time.Time
+	var backoff errorBackoff
+	for ctx.Err() == nil {
 		metrics.WorkerIterations.WithLabelValues("indexer").Inc()
-		if err := processIndexBatch(store); err != nil {
+
+		var err error
+		switch {
+		case retryPending:
+			retryPending, err = processPendingIndexBatch(store)
+		case time.Since(claimedAt) >= database.LaneClaimIdle/2:
+			var claimed bool
+			claimed, err = processIdleIndexBatch(store)
+			if !claimed && err == nil {
+				claimedAt = time.Now()
+			}
+		default:
+			err = processIndexBatch(store)
+		}
+		if err != nil {
+			retryPending = true
 			metrics.SearchIndexFailures.WithLabelValues("batch").Inc()
 			log.Printf("Error processing index batch for %s: %v", workerName, err)
-			time.Sleep(time.Second)
-			continue
+			backoff.wait(ctx)
+		} else {
+			backoff.reset()
 		}
 	}
+
+	if err := store.DeregisterConsumer(); err != nil {
+		log.Printf("Failed to deregister search indexer worker %s: %v", workerName, err)
+	}
+	log.Printf("Search indexer worker %s stopped", workerName)
 }
 
 func processIndexBatch(store IndexStore) error {
@@ -58,16 +110,52 @@ func processIndexBatch(store IndexStore) error {
 	if len(messages) == 0 {
 		return nil
 	}
+	return indexMessages(store, started, messages)
+}
+
+// processPendingIndexBatch re-indexes the oldest unacked jobs of this
+// consumer. It reports whether there was anything pending.
+func processPendingIndexBatch(store IndexStore) (bool, error) {
+	started := time.Now()
+	messages, err := store.ReadPendingIndexJobs()
+	if err != nil {
+		return true, err
+	}
+	if len(messages) == 0 {
+		return false, nil
+	}
+
+	log.Printf("Retrying %d pending index jobs", len(messages))
+	return true, indexMessages(store, started, messages)
+}
+
+// processIdleIndexBatch indexes jobs taken over from other indexers. It
+// reports whether there were any, so claiming goes on until none are left.
+func processIdleIndexBatch(store IndexStore) (bool, error) {
+	started := time.Now()
+	messages, err := store.ClaimIdleIndexJobs()
+	if err != nil {
+		return false, err
+	}
+	if len(messages) == 0 {
+		return false, nil
+	}
+
+	log.Printf("Indexing %d index jobs taken over from stopped indexers", len(messages))
+	return true, indexMessages(store, started, messages)
+}
+
+func indexMessages(store IndexStore, started time.Time, messages []redis.XMessage) error {
 	metrics.SearchIndexBatchSize.Observe(float64(len(messages)))
 
 	events := make([]models.Event, 0, len(messages))
 	ackIDs := make([]string, 0, len(messages))
+	var malformed []malformedMessage
 
 	for _, msg := range messages {
-		event, err := parseIndexEvent(msg)
+		event, err := database.DecodeEvent(msg.Values)
 		if err != nil {
-			metrics.SearchIndexFailures.WithLabelValues("parse").Inc()
-			log.Printf("Dropping malformed index message %s: %v", msg.ID, err)
+			malformed = append(malformed, malformedMessage{msg: msg, err: err})
 			ackIDs = append(ackIDs, msg.ID)
 			continue
 		}
@@ -84,60 +172,22 @@ func processIndexBatch(store IndexStore) error {
 		metrics.SearchEventsIndexed.Add(float64(len(events)))
 	}
 
+	// As in the aggregator, a batch retried after a failed bulk request must
+	// not quarantine its malformed messages again.
+	for _, m := range malformed {
+		metrics.SearchIndexFailures.WithLabelValues("parse").Inc()
+		log.Printf("Quarantining malformed index message %s: %v", m.msg.ID, m.err)
+		if err := store.Quarantine(m.msg, m.err); err != nil {
+			return err
+		}
+	}
+
 	if err := store.AckIndexJobs(ackIDs...); err != nil {
 		metrics.SearchIndexFailures.WithLabelValues("ack").Inc()
 		return err
 	}
 
+	recordBatchLatency("indexer", time.Since(started))
 	metrics.SearchIndexDuration.Observe(time.Since(started).Seconds())
 	return nil
 }
-
-func parseIndexEvent(msg redis.XMessage) (models.Event, error) {
-	values := msg.Values
-
-	userID, _ := values["user_id"].(string)
-	action, _ := values["action"].(string)
-	element, _ := values["element"].(string)
-
-	var duration float64
-	if d, ok := values["duration"].(string); ok {
-		duration, _ = strconv.ParseFloat(d, 64)
-	} else if d, ok := values["duration"].(float64); ok {
-		duration = d
-	}
-
-	timestampString, ok := values["timestamp"].(string)
-	if !ok {
-		return models.Event{}, strconv.ErrSyntax
-	}
-
-	timestamp, err := time.Parse(time.RFC3339Nano, timestampString)
-	if err != nil {
-		return models.Event{}, err
-	}
-
-	var id int64
-	switch rawID := values["id"].(type) {
-	case string:
-		id, err = strconv.ParseInt(rawID, 10, 64)
-	case int64:
-		id = rawID
-	case float64:
-		id = int64(rawID)
-	default:
-		err = strconv.ErrSyntax
-	}
-	if err != nil {
-		return models.Event{}, err
-	}
-
-	return models.Event{
-		ID:        id,
-		UserId:    userID,
-		Action:    action,
-		Element:   element,
-		Duration:  duration,
-		Timestamp: timestamp,
-	}, nil
-}
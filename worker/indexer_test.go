@@ -2,7 +2,9 @@ package worker
 
 import (
 	"analytics-backend/models"
+	"context"
 	"errors"
+	"slices"
 	"testing"
 	"time"
 
@@ -10,9 +12,12 @@ import (
 )
 
 type MockIndexStore struct {
-	ReadIndexJobsFunc   func() ([]redis.XMessage, error)
-	BulkIndexEventsFunc func(events []models.Event) error
-	AckIndexJobsFunc    func(ids ...string) error
+	ReadIndexJobsFunc        func() ([]redis.XMessage, error)
+	ReadPendingIndexJobsFunc func() ([]redis.XMessage, error)
+	ClaimIdleIndexJobsFunc   func() ([]redis.XMessage, error)
+	BulkIndexEventsFunc      func(events []models.Event) error
+	AckIndexJobsFunc         func(ids ...string) error
+	QuarantineFunc           func(msg redis.XMessage, reason error) error
 }
 
 func (m *MockIndexStore) ReadIndexJobs() ([]redis.XMessage, error) {
@@ -22,6 +27,20 @@ func (m *MockIndexStore) ReadIndexJobs() ([]redis.XMessage, error) {
 	return nil, nil
 }
 
+func (m *MockIndexStore) ReadPendingIndexJobs() ([]redis.XMessage, error) {
+	if m.ReadPendingIndexJobsFunc != nil {
+		return m.ReadPendingIndexJobsFunc()
+	}
+	return nil, nil
+}
+
+func (m *MockIndexStore) ClaimIdleIndexJobs() ([]redis.XMessage, error) {
+	if m.ClaimIdleIndexJobsFunc != nil {
+		return m.ClaimIdleIndexJobsFunc()
+	}
+	return nil, nil
+}
+
 func (m *MockIndexStore) BulkIndexEvents(events []models.Event) error {
 	if m.BulkIndexEventsFunc != nil {
 		return m.BulkIndexEventsFunc(events)
@@ -36,6 +55,17 @@ func (m *MockIndexStore) AckIndexJobs(ids ...string) error {
 	return nil
 }
 
+func (m *MockIndexStore) Quarantine(msg redis.XMessage, reason error) error {
+	if m.QuarantineFunc != nil {
+		return m.QuarantineFunc(msg, reason)
+	}
+	return nil
+}
+
+func (m *MockIndexStore) DeregisterConsumer() error {
+	return nil
+}
+
 func TestProcessIndexBatch_AcksOnSuccess(t *testing.T) {
 	acked := false
 	store := &MockIndexStore{
@@ -114,3 +144,90 @@ func TestProcessIndexBatch_DoesNotAckOnIndexFailure(t *testing.T) {
 		t.Fatal("expected index job to remain unacked on failure")
 	}
 }
+
+func indexJob(id string) redis.XMessage {
+	return redis.XMessage{
+		ID: id,
+		Values: map[string]any{
+			"id":        "123",
+			"user_id":   "user-1",
+			"action":    "click",
+			"element":   "button",
+			"duration":  "12.5",
+			"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}
+}
+
+func TestStartSearchIndexerWorker_RetriesPendingAndTakesOverIdleJobsBeforeReadingNew(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first batch fails, stays pending and is indexed again before
+	// anything else. Then the jobs a stopped indexer left behind are taken
+	// over until none are left, and only then are new jobs read.
+	pending := []redis.XMessage{indexJob("1-0")}
+	idle := []redis.XMessage{indexJob("2-0")}
+	failures := 1
+	var acked []string
+	store := &MockIndexStore{
+		ReadPendingIndexJobsFunc: func() ([]redis.XMessage, error) {
+			return pending, nil
+		},
+		ClaimIdleIndexJobsFunc: func() ([]redis.XMessage, error) {
+			claimed := idle
+			idle = nil
+			return claimed, nil
+		},
+		ReadIndexJobsFunc: func() ([]redis.XMessage, error) {
+			cancel()
+			return nil, nil
+		},
+		BulkIndexEventsFunc: func(events []models.Event) error {
+			if failures > 0 {
+				failures--
+				return errors.New("elastic down")
+			}
+			return nil
+		},
+		AckIndexJobsFunc: func(ids ...string) error {
+			acked = append(acked, ids...)
+			if slices.Contains(ids, "1-0") {
+				pending = nil
+			}
+			return nil
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		StartSearchIndexerWorker(ctx, "indexer-test", store)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the indexer to stop after context cancellation")
+	}
+	if !slices.Equal(acked, []string{"1-0", "2-0"}) {
+		t.Fatalf("expected the pending job and then the idle one to be acked, got %v", acked)
+	}
+}
+
+func TestProcessPendingIndexBatch_ReportsWhetherAnythingWasPending(t *testing.T) {
+	store := &MockIndexStore{}
+	if pending, err := processPendingIndexBatch(store); pending || err != nil {
+		t.Fatalf("expected nothing pending, got %v %v", pending, err)
+	}
+
+	store.ReadPendingIndexJobsFunc = func() ([]redis.XMessage, error) {
+		return []redis.XMessage{indexJob("1-0")}, nil
+	}
+	store.BulkIndexEventsFunc = func(events []models.Event) error {
+		return errors.New("elastic down")
+	}
+	if pending, err := processPendingIndexBatch(store); !pending || err == nil {
+		t.Fatalf("expected the pending job to fail again, got %v %v", pending, err)
+	}
+}
@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"analytics-backend/config"
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+var (
+	WorkerInitialBackoff = time.Second
+	WorkerMaxBackoff     = 30 * time.Second
+)
+
+func ConfigureWorkerBackoff(cfg config.WorkersConfig) {
+	if cfg.InitialBackoff > 0 {
+		WorkerInitialBackoff = cfg.InitialBackoff
+	}
+	if cfg.MaxBackoff > 0 {
+		WorkerMaxBackoff = cfg.MaxBackoff
+	}
+}
+
+// sleepContext waits for d or until ctx is cancelled, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// jitter spreads retries over [d/2, d) so a failing backend or destination
+// is not hit by every worker at the same moment.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int64N(int64(half)))
+}
+
+// errorBackoff is how long a worker pauses after an error. It doubles with
+// each consecutive error, up to WorkerMaxBackoff, so a backend that is down
+// is not polled every second by every worker.
+type errorBackoff struct {
+	next time.Duration
+}
+
+func (b *errorBackoff) wait(ctx context.Context) {
+	if b.next <= 0 {
+		b.next = WorkerInitialBackoff
+	}
+	sleepContext(ctx, jitter(b.next))
+	b.next = min(b.next*2, WorkerMaxBackoff)
+}
+
+func (b *errorBackoff) reset() {
+	b.next = 0
+}
@@ -0,0 +1,210 @@
+package worker
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"analytics-backend/sinks"
+	"context"
+	"log"
+	"slices"
+	"time"
+)
+
+var (
+	OutboxPollInterval   = time.Second
+	OutboxBatchSize      = 20
+	OutboxLease          = time.Minute
+	OutboxInitialBackoff = time.Second
+	OutboxMaxBackoff     = 5 * time.Minute
+	OutboxRetention      = 24 * time.Hour
+)
+
+const outboxMaintenanceInterval = 30 * time.Second
+
+// outboxWake lets aggregators start the relay as soon as a batch commits
+// instead of waiting for the next poll.
+var outboxWake = make(chan struct{}, 1)
+
+func notifyOutboxRelay() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+type OutboxStore interface {
+	ClaimEntries(ctx context.Context, limit int) ([]models.OutboxEntry, error)
+	WriteSink(ctx context.Context, name string, events []models.Event) error
+	MarkSinkDone(ctx context.Context, id uint, completedSinks []string) error
+	Complete(ctx context.Context, id uint) error
+	Retry(ctx context.Context, id uint, reason string, retryAt time.Time) error
+	Purge(ctx context.Context, before time.Time) (int64, error)
+	CountPending(ctx context.Context) (int64, error)
+}
+
+type DefaultOutboxStore struct {
+	Sinks *sinks.Set
+}
+
+func (s *DefaultOutboxStore) ClaimEntries(ctx context.Context, limit int) ([]models.OutboxEntry, error) {
+	return database.ClaimOutboxEntries(ctx, limit, OutboxLease)
+}
+
+func (s *DefaultOutboxStore) WriteSink(ctx context.Context, name string, events []models.Event) error {
+	if s.Sinks != nil {
+		return s.Sinks.WriteSink(ctx, name, events)
+	}
+	return sinks.Active.WriteSink(ctx, name, events)
+}
+
+func (s *DefaultOutboxStore) MarkSinkDone(ctx context.Context, id uint, completedSinks []string) error {
+	return database.MarkOutboxSinkDone(ctx, id, completedSinks)
+}
+
+func (s *DefaultOutboxStore) Complete(ctx context.Context, id uint) error {
+	return database.CompleteOutboxEntry(ctx, id)
+}
+
+func (s *DefaultOutboxStore) Retry(ctx context.Context, id uint, reason string, retryAt time.Time) error {
+	return database.RetryOutboxEntry(ctx, id, reason, retryAt)
+}
+
+func (s *DefaultOutboxStore) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return database.PurgeCompletedOutbox(ctx, before)
+}
+
+func (s *DefaultOutboxStore) CountPending(ctx context.Context) (int64, error) {
+	return database.CountPendingOutbox(ctx)
+}
+
+func ConfigureOutbox(cfg config.OutboxConfig) {
+	if cfg.PollInterval > 0 {
+		OutboxPollInterval = cfg.PollInterval
+	}
+	if cfg.BatchSize > 0 {
+		OutboxBatchSize = cfg.BatchSize
+	}
+	if cfg.Lease > 0 {
+		OutboxLease = cfg.Lease
+	}
+	if cfg.InitialBackoff > 0 {
+		OutboxInitialBackoff = cfg.InitialBackoff
+	}
+	if cfg.MaxBackoff > 0 {
+		OutboxMaxBackoff = cfg.MaxBackoff
+	}
+	if cfg.Retention > 0 {
+		OutboxRetention = cfg.Retention
+	}
+}
+
+func StartOutboxRelay(ctx context.Context, workerName string, store OutboxStore) {
+	log.Printf("Starting outbox relay %s...", workerName)
+	metrics.ActiveWorkers.WithLabelValues("outbox").Inc()
+	defer metrics.ActiveWorkers.WithLabelValues("outbox").Dec()
+
+	var lastMaintenance time.Time
+	for ctx.Err() == nil {
+		metrics.WorkerIterations.WithLabelValues("outbox").Inc()
+
+		relayed, err := relayOutboxBatch(store, time.Now())
+		if err != nil {
+			log.Printf("Error relaying outbox for %s: %v", workerName, err)
+		}
+
+		if time.Since(lastMaintenance) >= outboxMaintenanceInterval {
+			maintainOutbox(store)
+			lastMaintenance = time.Now()
+		}
+
+		// A full batch probably means more is waiting, so only idle when the
+		// outbox looked drained.
+		if relayed < OutboxBatchSize || err != nil {
+			timer := time.NewTimer(OutboxPollInterval)
+			select {
+			case <-ctx.Done():
+			case <-outboxWake:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+	}
+
+	log.Printf("Outbox relay %s stopped", workerName)
+}
+
+func relayOutboxBatch(store OutboxStore, now time.Time) (int, error) {
+	started := time.Now()
+	entries, err := store.ClaimEntries(database.Ctx, OutboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	for _, entry := range entries {
+		if err := relayOutboxEntry(store, entry, now); err != nil {
+			log.Printf("Outbox entry %d will be retried: %v", entry.ID, err)
+		}
+	}
+
+	recordBatchLatency("outbox", time.Since(started))
+	return len(entries), nil
+}
+
+// relayOutboxEntry writes the entry to each pending sink it has not reached
+// yet, recording every success so a retry picks up where this one stopped.
+func relayOutboxEntry(store OutboxStore, entry models.OutboxEntry, now time.Time) error {
+	ctx := sinks.WithBatchKey(database.Ctx, entry.BatchKey)
+	completed := append([]string(nil), entry.CompletedSinks...)
+
+	for _, name := range entry.PendingSinks {
+		if slices.Contains(completed, name) {
+			continue
+		}
+
+		if err := store.WriteSink(ctx, name, entry.Events); err != nil {
+			metrics.OutboxRelayFailures.WithLabelValues(name).Inc()
+			retryAt := now.Add(outboxBackoff(entry.Attempts))
+			if retryErr := store.Retry(database.Ctx, entry.ID, err.Error(), retryAt); retryErr != nil {
+				log.Printf("Failed to schedule retry for outbox entry %d: %v", entry.ID, retryErr)
+			}
+			return err
+		}
+
+		completed = append(completed, name)
+		if err := store.MarkSinkDone(database.Ctx, entry.ID, completed); err != nil {
+			return err
+		}
+	}
+
+	if err := store.Complete(database.Ctx, entry.ID); err != nil {
+		return err
+	}
+	metrics.OutboxEntriesRelayed.Inc()
+	metrics.OutboxRelayLag.Observe(time.Since(entry.CreatedAt).Seconds())
+	return nil
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := OutboxInitialBackoff
+	for i := 1; i < attempts && backoff < OutboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return jitter(min(backoff, OutboxMaxBackoff))
+}
+
+func maintainOutbox(store OutboxStore) {
+	if purged, err := store.Purge(database.Ctx, time.Now().Add(-OutboxRetention)); err != nil {
+		log.Printf("Failed to purge completed outbox entries: %v", err)
+	} else if purged > 0 {
+		log.Printf("Purged %d completed outbox entries", purged)
+	}
+
+	if pending, err := store.CountPending(database.Ctx); err == nil {
+		metrics.OutboxPending.Set(float64(pending))
+	}
+}
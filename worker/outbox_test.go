@@ -0,0 +1,139 @@
+package worker
+
+import (
+	"analytics-backend/models"
+	"analytics-backend/sinks"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type MockOutboxStore struct {
+	Entries   []models.OutboxEntry
+	Sinks     *sinks.Set
+	Done      map[uint][]string
+	Completed []uint
+	Retried   map[uint]time.Time
+}
+
+func (m *MockOutboxStore) ClaimEntries(ctx context.Context, limit int) ([]models.OutboxEntry, error) {
+	entries := m.Entries
+	m.Entries = nil
+	return entries, nil
+}
+
+func (m *MockOutboxStore) WriteSink(ctx context.Context, name string, events []models.Event) error {
+	return m.Sinks.WriteSink(ctx, name, events)
+}
+
+func (m *MockOutboxStore) MarkSinkDone(ctx context.Context, id uint, completedSinks []string) error {
+	if m.Done == nil {
+		m.Done = map[uint][]string{}
+	}
+	m.Done[id] = completedSinks
+	return nil
+}
+
+func (m *MockOutboxStore) Complete(ctx context.Context, id uint) error {
+	m.Completed = append(m.Completed, id)
+	return nil
+}
+
+func (m *MockOutboxStore) Retry(ctx context.Context, id uint, reason string, retryAt time.Time) error {
+	if m.Retried == nil {
+		m.Retried = map[uint]time.Time{}
+	}
+	m.Retried[id] = retryAt
+	return nil
+}
+
+func (m *MockOutboxStore) Purge(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *MockOutboxStore) CountPending(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func TestRelayOutboxBatch_RetriesFromFailedSink(t *testing.T) {
+	var clickhouseWrites, feedWrites int
+	clickhouseDown := true
+	store := &MockOutboxStore{
+		Sinks: sinks.NewSet([]sinks.Sink{
+			&mockSink{name: "feed", writeFunc: func(events []models.Event) error {
+				feedWrites++
+				return nil
+			}},
+			&mockSink{name: "clickhouse", writeFunc: func(events []models.Event) error {
+				clickhouseWrites++
+				if clickhouseDown {
+					return errors.New("clickhouse down")
+				}
+				return nil
+			}},
+		}, nil),
+	}
+	entry := models.OutboxEntry{
+		ID:           7,
+		BatchKey:     "batch-7",
+		Events:       []models.Event{{ID: 1, Action: "click"}},
+		PendingSinks: []string{"feed", "clickhouse"},
+		Attempts:     1,
+	}
+
+	now := time.Now()
+	store.Entries = []models.OutboxEntry{entry}
+	if _, err := relayOutboxBatch(store, now); err != nil {
+		t.Fatalf("relayOutboxBatch failed: %v", err)
+	}
+	if len(store.Completed) != 0 {
+		t.Fatal("expected entry to stay open while clickhouse is down")
+	}
+	if retryAt, ok := store.Retried[7]; !ok || !retryAt.After(now) {
+		t.Fatalf("expected a future retry to be scheduled, got %v", store.Retried)
+	}
+	if got := store.Done[7]; len(got) != 1 || got[0] != "feed" {
+		t.Fatalf("expected feed to be recorded as done, got %v", got)
+	}
+
+	clickhouseDown = false
+	entry.CompletedSinks = store.Done[7]
+	entry.Attempts = 2
+	store.Entries = []models.OutboxEntry{entry}
+	if _, err := relayOutboxBatch(store, now); err != nil {
+		t.Fatalf("relayOutboxBatch failed: %v", err)
+	}
+	if feedWrites != 1 {
+		t.Fatalf("expected feed to be written once across retries, got %d", feedWrites)
+	}
+	if clickhouseWrites != 2 {
+		t.Fatalf("expected clickhouse to be retried, got %d writes", clickhouseWrites)
+	}
+	if len(store.Completed) != 1 || store.Completed[0] != 7 {
+		t.Fatalf("expected entry 7 to complete, got %v", store.Completed)
+	}
+}
+
+func TestRelayOutboxBatch_CompletesWhenOptionalSinkFails(t *testing.T) {
+	store := &MockOutboxStore{
+		Sinks: sinks.NewSet(
+			[]sinks.Sink{&mockSink{name: "clickhouse"}},
+			[]sinks.Sink{&mockSink{name: "index", writeFunc: func(events []models.Event) error {
+				return errors.New("queue down")
+			}}},
+		),
+		Entries: []models.OutboxEntry{{
+			ID:           3,
+			Events:       []models.Event{{ID: 1}},
+			PendingSinks: []string{"clickhouse", "index", "removed-sink"},
+		}},
+	}
+
+	if _, err := relayOutboxBatch(store, time.Now()); err != nil {
+		t.Fatalf("relayOutboxBatch failed: %v", err)
+	}
+	if len(store.Completed) != 1 || len(store.Retried) != 0 {
+		t.Fatalf("expected optional and removed sinks not to block completion, completed %v retried %v", store.Completed, store.Retried)
+	}
+}
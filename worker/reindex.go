@@ -0,0 +1,470 @@
+package worker
+
+import (
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"analytics-backend/utils"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ReindexBatchSize = 1000
+	ReindexLease     = time.Minute
+	// ReindexCatchUpMargin is how long before a full job started the events
+	// ingested are indexed again after the swap, to pick up those that were
+	// still on their way to the old indices when it started.
+	ReindexCatchUpMargin = 5 * time.Minute
+)
+
+// PrepareReindexJob validates a new job and splits its range into slices
+// that can be indexed in parallel.
+func PrepareReindexJob(job *models.ReindexJob, slices int) error {
+	if job.Source == "" {
+		job.Source = database.ReindexSourcePostgres
+	}
+	if job.Source != database.ReindexSourcePostgres && job.Source != database.ReindexSourceIndex {
+		return fmt.Errorf("source must be %q or %q", database.ReindexSourcePostgres, database.ReindexSourceIndex)
+	}
+	if !job.Full && job.Source != database.ReindexSourcePostgres {
+		// The events would be written back into the indices they came from.
+		return fmt.Errorf("a range can only be reindexed from %s", database.ReindexSourcePostgres)
+	}
+	if job.RangeStart.IsZero() || job.RangeEnd.Before(job.RangeStart) || (!job.Full && job.RangeEnd.Equal(job.RangeStart)) {
+		return fmt.Errorf("to must be after from")
+	}
+	if slices < 1 {
+		slices = 1
+	}
+
+	width := job.RangeEnd.Sub(job.RangeStart) / time.Duration(slices)
+	if width <= 0 {
+		slices = 1
+	}
+	job.Slices = make([]models.ReindexSlice, 0, slices)
+	for i := 0; i < slices; i++ {
+		slice := models.ReindexSlice{From: job.RangeStart.Add(time.Duration(i) * width), To: job.RangeStart.Add(time.Duration(i+1) * width)}
+		if i == slices-1 {
+			slice.To = job.RangeEnd
+		}
+		job.Slices = append(job.Slices, slice)
+	}
+
+	job.MappingVersion = database.SearchMappingVersion()
+	job.Status = database.ReindexStatusRunning
+	return nil
+}
+
+type ReindexStore interface {
+	Claim(ctx context.Context, id uint) (*models.ReindexJob, error)
+	Save(ctx context.Context, job *models.ReindexJob) error
+	Release(ctx context.Context, job *models.ReindexJob) error
+	ListEvents(ctx context.Context, job *models.ReindexJob, from, to, afterTimestamp time.Time, afterID int64, limit int) ([]models.Event, error)
+	ListIngestedEvents(ctx context.Context, job *models.ReindexJob, afterID int64, limit int) ([]models.Event, error)
+	Index(ctx context.Context, index string, events []models.Event) error
+	CountSource(ctx context.Context, job *models.ReindexJob, slice models.ReindexSlice) (int64, error)
+	CountTarget(ctx context.Context, index string, from, to time.Time) (int64, error)
+	CreateTarget(ctx context.Context, name string) error
+	FinishTarget(ctx context.Context, pattern string) error
+	SwapAliases(ctx context.Context, targets []string, write string) ([]string, error)
+}
+
+type DefaultReindexStore struct{}
+
+func (s *DefaultReindexStore) Claim(ctx context.Context, id uint) (*models.ReindexJob, error) {
+	return database.ClaimReindexJob(ctx, id, ReindexLease)
+}
+
+func (s *DefaultReindexStore) Save(ctx context.Context, job *models.ReindexJob) error {
+	return database.SaveReindexJob(ctx, job, ReindexLease)
+}
+
+func (s *DefaultReindexStore) Release(ctx context.Context, job *models.ReindexJob) error {
+	return database.SaveReindexJob(ctx, job, 0)
+}
+
+func (s *DefaultReindexStore) ListEvents(ctx context.Context, job *models.ReindexJob, from, to, afterTimestamp time.Time, afterID int64, limit int) ([]models.Event, error) {
+	if job.Source == database.ReindexSourceIndex {
+		return database.ListIndexedEventsAfter(ctx, job.SourceIndices, from, to, afterTimestamp, afterID, limit)
+	}
+	return database.ListEventsAfter(ctx, database.EventRange{From: from, To: to}, afterTimestamp, afterID, limit)
+}
+
+func (s *DefaultReindexStore) ListIngestedEvents(ctx context.Context, job *models.ReindexJob, afterID int64, limit int) ([]models.Event, error) {
+	if job.Source == database.ReindexSourceIndex {
+		return database.ListIndexedEventsIngestedAfter(ctx, job.SourceIndices, afterID, limit)
+	}
+	return database.ListEventsIngestedAfter(ctx, afterID, limit)
+}
+
+func (s *DefaultReindexStore) Index(ctx context.Context, index string, events []models.Event) error {
+	return database.BulkIndexEventsInto(ctx, index, events)
+}
+
+// CountSource counts the events a slice should have indexed. Events are read
+// from search indices without duplicates, so for those it is the number the
+// slice indexed.
+func (s *DefaultReindexStore) CountSource(ctx context.Context, job *models.ReindexJob, slice models.ReindexSlice) (int64, error) {
+	if job.Source == database.ReindexSourceIndex {
+		return slice.Indexed, nil
+	}
+	return database.CountEventsInRange(ctx, slice.From, slice.To)
+}
+
+func (s *DefaultReindexStore) CountTarget(ctx context.Context, index string, from, to time.Time) (int64, error) {
+	return database.CountIndexedEvents(ctx, index, from, to)
+}
+
+func (s *DefaultReindexStore) CreateTarget(ctx context.Context, name string) error {
+	return database.CreateReindexTarget(ctx, name)
+}
+
+func (s *DefaultReindexStore) FinishTarget(ctx context.Context, pattern string) error {
+	return database.FinishReindexTarget(ctx, pattern)
+}
+
+func (s *DefaultReindexStore) SwapAliases(ctx context.Context, targets []string, write string) ([]string, error) {
+	return database.SwapSearchAliases(ctx, targets, write)
+}
+
+// RunReindexJob indexes a claimed job's slices from their checkpoints, using
+// up to workers slices at a time, and checks the targets hold as many events
+// as the source. A full job then swaps the search aliases to its targets,
+// indexes the events stored since it started and counts again. It returns
+// nil once the job has completed.
+func RunReindexJob(ctx context.Context, store ReindexStore, job *models.ReindexJob, workers int) error {
+	err := runReindexJob(ctx, store, job, workers)
+	if err != nil && ctx.Err() == nil {
+		// A job that failed after the swap stays swapped, so resuming it only
+		// catches up.
+		if job.Status == database.ReindexStatusRunning {
+			job.Status = database.ReindexStatusFailed
+		}
+		job.LastError = err.Error()
+	}
+	// Released however it stopped, so it can be resumed straight away.
+	if releaseErr := store.Release(context.Background(), job); releaseErr != nil {
+		log.Printf("Failed to release reindex job %d: %v", job.ID, releaseErr)
+	}
+	return err
+}
+
+func runReindexJob(ctx context.Context, store ReindexStore, job *models.ReindexJob, workers int) error {
+	if job.Status == database.ReindexStatusRunning {
+		target := database.SearchWriteAlias()
+		if job.Full {
+			// The write index is the one for the cutoff, which new events go
+			// to after the swap, so it is created even when empty.
+			if job.Target == "" {
+				job.Target = database.ReindexTargetName(job.ID, job.RangeEnd)
+			}
+			target = database.ReindexTargetPattern(job.ID)
+			if err := createReindexTarget(ctx, store, job, job.Target, &sync.Mutex{}); err != nil {
+				return err
+			}
+		}
+		log.Printf("Reindexing %s - %s from %s into %s", job.RangeStart.Format(time.RFC3339), job.RangeEnd.Format(time.RFC3339), job.Source, target)
+
+		if err := indexReindexSlices(ctx, store, job, workers); err != nil {
+			return err
+		}
+		if err := verifyReindex(ctx, store, job, target); err != nil {
+			return err
+		}
+		if !job.Full {
+			return completeReindex(ctx, store, job)
+		}
+
+		previous, err := store.SwapAliases(ctx, job.Targets, job.Target)
+		if err != nil {
+			return err
+		}
+		// Every server searches through the read alias, so none reads the
+		// previous indices from here on, whatever its catalog still says.
+		log.Printf("Search aliases now point at %d indices writing to %s; %v are no longer searched and can be deleted", len(job.Targets), job.Target, previous)
+		job.Status = database.ReindexStatusSwapped
+		if job.Source == database.ReindexSourceIndex {
+			// Events stored while the job ran are caught up from every index
+			// that was searched until now, including any rolled over to.
+			job.SourceIndices = previous
+		}
+		if err := store.Save(ctx, job); err != nil {
+			return err
+		}
+	}
+
+	if job.Status == database.ReindexStatusSwapped {
+		if err := catchUpReindex(ctx, store, job); err != nil {
+			return err
+		}
+		if err := verifyCaughtUp(ctx, store, job); err != nil {
+			return err
+		}
+		return completeReindex(ctx, store, job)
+	}
+	return nil
+}
+
+// indexReindexSlices indexes the slices that are not done yet. Checkpoints
+// are saved one at a time, with each slice's progress up to its last indexed
+// page.
+func indexReindexSlices(ctx context.Context, store ReindexStore, job *models.ReindexJob, workers int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	semaphore := make(chan struct{}, max(workers, 1))
+	for i := range job.Slices {
+		mu.Lock()
+		done := job.Slices[i].Done
+		mu.Unlock()
+		if done {
+			continue
+		}
+
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			if err := indexReindexSlice(ctx, store, job, i, &mu); err != nil {
+				fail(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil && !errors.Is(firstErr, context.Canceled) {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+func indexReindexSlice(ctx context.Context, store ReindexStore, job *models.ReindexJob, i int, mu *sync.Mutex) error {
+	mu.Lock()
+	slice := job.Slices[i]
+	mu.Unlock()
+
+	for ctx.Err() == nil {
+		events, err := store.ListEvents(ctx, job, slice.From, slice.To, slice.CursorTimestamp, slice.CursorID, ReindexBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to read events from %s: %w", job.Source, err)
+		}
+		if len(events) > 0 {
+			if err := indexReindexEvents(ctx, store, job, events, mu); err != nil {
+				return err
+			}
+			last := events[len(events)-1]
+			slice.CursorTimestamp = last.Timestamp
+			slice.CursorID = last.ID
+			slice.Indexed += int64(len(events))
+		}
+		slice.Done = len(events) < ReindexBatchSize
+
+		mu.Lock()
+		job.Slices[i] = slice
+		job.Indexed += int64(len(events))
+		err = store.Save(ctx, job)
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if slice.Done {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// indexReindexEvents writes a page of events into the current indices for a
+// range job. A full job writes each event into its target for the event's
+// day or month, created the first time it is needed.
+func indexReindexEvents(ctx context.Context, store ReindexStore, job *models.ReindexJob, events []models.Event, mu *sync.Mutex) error {
+	if !job.Full {
+		target := database.SearchWriteAlias()
+		if err := store.Index(ctx, target, events); err != nil {
+			return fmt.Errorf("failed to index events into %s: %w", target, err)
+		}
+		return nil
+	}
+
+	var targets []string
+	byTarget := map[string][]models.Event{}
+	for _, event := range events {
+		target := database.ReindexTargetName(job.ID, event.Timestamp)
+		if _, ok := byTarget[target]; !ok {
+			targets = append(targets, target)
+		}
+		byTarget[target] = append(byTarget[target], event)
+	}
+	for _, target := range targets {
+		if err := createReindexTarget(ctx, store, job, target, mu); err != nil {
+			return err
+		}
+		if err := store.Index(ctx, target, byTarget[target]); err != nil {
+			return fmt.Errorf("failed to index events into %s: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// createReindexTarget creates a target of a full job the first time it is
+// used and records it on the job, which is what the swap adds to the aliases.
+func createReindexTarget(ctx context.Context, store ReindexStore, job *models.ReindexJob, target string, mu *sync.Mutex) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if slices.Contains(job.Targets, target) {
+		return nil
+	}
+	if err := store.CreateTarget(ctx, target); err != nil {
+		return fmt.Errorf("failed to create %s: %w", target, err)
+	}
+	job.Targets = append(job.Targets, target)
+	return store.Save(ctx, job)
+}
+
+// verifyReindex compares the number of events in each slice's range in the
+// target with the source. A full job's target must hold exactly the source's
+// events; a range job writes into indices that can hold other copies of
+// them, so it only needs at least as many. Only the slices that fall short
+// start over, so resuming the job indexes just their ranges again. The job is
+// saved after each slice, which keeps its lease while a long range is
+// counted.
+func verifyReindex(ctx context.Context, store ReindexStore, job *models.ReindexJob, target string) error {
+	if job.Full {
+		if err := store.FinishTarget(ctx, target); err != nil {
+			return err
+		}
+	}
+
+	countIn := target
+	if !job.Full {
+		countIn = database.SearchReadAlias()
+	}
+	var expected, indexed int64
+	mismatched := 0
+	for i, slice := range job.Slices {
+		sliceExpected, err := store.CountSource(ctx, job, slice)
+		if err != nil {
+			return fmt.Errorf("failed to count source events: %w", err)
+		}
+		sliceIndexed, err := store.CountTarget(ctx, countIn, slice.From, slice.To)
+		if err != nil {
+			return fmt.Errorf("failed to count indexed events: %w", err)
+		}
+		expected += sliceExpected
+		indexed += sliceIndexed
+
+		if sliceIndexed != sliceExpected && (job.Full || sliceIndexed < sliceExpected) {
+			log.Printf("%s holds %d events in %s - %s where %s has %d", countIn, sliceIndexed, slice.From.Format(time.RFC3339), slice.To.Format(time.RFC3339), job.Source, sliceExpected)
+			job.Indexed -= slice.Indexed
+			job.Slices[i] = models.ReindexSlice{From: slice.From, To: slice.To}
+			mismatched++
+		}
+		if err := store.Save(ctx, job); err != nil {
+			return err
+		}
+	}
+	job.Expected = expected
+
+	if mismatched > 0 {
+		return fmt.Errorf("%s holds %d events where %s has %d; %d of %d slices start over", countIn, indexed, job.Source, expected, mismatched, len(job.Slices))
+	}
+	log.Printf("Verified %d indexed events against %d in %s", indexed, expected, job.Source)
+	return store.Save(ctx, job)
+}
+
+// catchUpReindex indexes again every event ingested since shortly before a
+// full job started, in ingest order and whatever its timestamp. Events
+// stored while the job ran went to the old indices, late ones with a
+// timestamp in a slice that was already indexed among them. They are written
+// through the write alias, which updates those the new indices already hold
+// where they are. The job is saved after each page to keep its lease.
+func catchUpReindex(ctx context.Context, store ReindexStore, job *models.ReindexJob) error {
+	since := job.CreatedAt.Add(-ReindexCatchUpMargin)
+	afterID := utils.FirstIDAt(since)
+	target := database.SearchWriteAlias()
+
+	caughtUp := 0
+	for ctx.Err() == nil {
+		events, err := store.ListIngestedEvents(ctx, job, afterID, ReindexBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to read events from %s: %w", job.Source, err)
+		}
+		if len(events) == 0 {
+			log.Printf("Caught up %d events ingested since %s", caughtUp, since.Format(time.RFC3339))
+			return nil
+		}
+		if err := store.Index(ctx, target, events); err != nil {
+			return fmt.Errorf("failed to index events into %s: %w", target, err)
+		}
+		afterID = events[len(events)-1].ID
+		caughtUp += len(events)
+		if err := store.Save(ctx, job); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// verifyCaughtUp counts each slice's range again once a swapped job caught
+// up. The search indices now also receive new events, some with timestamps
+// in the range, so they must hold at least as many as the source. A job that
+// falls short stays swapped, and resuming it catches up again.
+func verifyCaughtUp(ctx context.Context, store ReindexStore, job *models.ReindexJob) error {
+	if err := store.FinishTarget(ctx, database.ReindexTargetPattern(job.ID)); err != nil {
+		return err
+	}
+
+	index := database.SearchReadAlias()
+	for _, slice := range job.Slices {
+		expected, err := store.CountSource(ctx, job, slice)
+		if err != nil {
+			return fmt.Errorf("failed to count source events: %w", err)
+		}
+		indexed, err := store.CountTarget(ctx, index, slice.From, slice.To)
+		if err != nil {
+			return fmt.Errorf("failed to count indexed events: %w", err)
+		}
+		if indexed < expected {
+			return fmt.Errorf("%s holds %d events in %s - %s after catching up where %s has %d", index, indexed, slice.From.Format(time.RFC3339), slice.To.Format(time.RFC3339), job.Source, expected)
+		}
+		if err := store.Save(ctx, job); err != nil {
+			return err
+		}
+	}
+	log.Printf("Verified the search indices after catching up")
+	return nil
+}
+
+func completeReindex(ctx context.Context, store ReindexStore, job *models.ReindexJob) error {
+	now := time.Now()
+	job.Status = database.ReindexStatusCompleted
+	job.CompletedAt = &now
+	return nil
+}
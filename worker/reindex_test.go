@@ -0,0 +1,375 @@
+package worker
+
+import (
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"analytics-backend/utils"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MockReindexStore keeps the ids indexed into each index. Until the aliases
+// are swapped the current indices are the index named "", like the aliases
+// without a client; after it they are the swapped targets. Events in
+// StoredDuringJob are stored when the aliases are swapped, like events that
+// reached the old indices while the job ran.
+type MockReindexStore struct {
+	mu              sync.Mutex
+	Events          []models.Event
+	StoredDuringJob []models.Event
+	Indexed         map[string][]int64
+	Lost            int64
+	Created         []string
+	Swapped         [][]string
+	Write           string
+	Saves           int
+	Released        int
+}
+
+func (m *MockReindexStore) Claim(ctx context.Context, id uint) (*models.ReindexJob, error) {
+	return nil, nil
+}
+
+func (m *MockReindexStore) Save(ctx context.Context, job *models.ReindexJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Saves++
+	return nil
+}
+
+func (m *MockReindexStore) Release(ctx context.Context, job *models.ReindexJob) error {
+	m.Released++
+	return nil
+}
+
+func (m *MockReindexStore) ListEvents(ctx context.Context, job *models.ReindexJob, from, to, afterTimestamp time.Time, afterID int64, limit int) ([]models.Event, error) {
+	events := append([]models.Event(nil), m.Events...)
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].Timestamp.Equal(events[j].Timestamp) {
+			return events[i].Timestamp.Before(events[j].Timestamp)
+		}
+		return events[i].ID < events[j].ID
+	})
+
+	var page []models.Event
+	for _, event := range events {
+		inRange := !event.Timestamp.Before(from) && event.Timestamp.Before(to)
+		after := event.Timestamp.After(afterTimestamp) ||
+			(event.Timestamp.Equal(afterTimestamp) && event.ID > afterID)
+		if inRange && after && len(page) < limit {
+			page = append(page, event)
+		}
+	}
+	return page, nil
+}
+
+func (m *MockReindexStore) ListIngestedEvents(ctx context.Context, job *models.ReindexJob, afterID int64, limit int) ([]models.Event, error) {
+	events := append([]models.Event(nil), m.Events...)
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+
+	var page []models.Event
+	for _, event := range events {
+		if event.ID > afterID && len(page) < limit {
+			page = append(page, event)
+		}
+	}
+	return page, nil
+}
+
+// Index writes into an index once per event. Writing through the write
+// alias updates an event where the current indices already hold it.
+func (m *MockReindexStore) Index(ctx context.Context, index string, events []models.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Indexed == nil {
+		m.Indexed = map[string][]int64{}
+	}
+	for _, event := range events {
+		if event.ID == m.Lost {
+			continue
+		}
+		target := index
+		if index == "" && m.Write != "" {
+			target = m.Write
+			if m.holds(m.resolve(""), event.ID) {
+				continue
+			}
+		}
+		if !m.holds([]string{target}, event.ID) {
+			m.Indexed[target] = append(m.Indexed[target], event.ID)
+		}
+	}
+	return nil
+}
+
+func (m *MockReindexStore) resolve(index string) []string {
+	switch {
+	case strings.HasSuffix(index, "*"):
+		var indices []string
+		for name := range m.Indexed {
+			if strings.HasPrefix(name, strings.TrimSuffix(index, "*")) {
+				indices = append(indices, name)
+			}
+		}
+		return indices
+	case index == "" && len(m.Swapped) > 0:
+		return m.Swapped[len(m.Swapped)-1]
+	default:
+		return []string{index}
+	}
+}
+
+func (m *MockReindexStore) holds(indices []string, id int64) bool {
+	for _, index := range indices {
+		for _, indexed := range m.Indexed[index] {
+			if indexed == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *MockReindexStore) CountSource(ctx context.Context, job *models.ReindexJob, slice models.ReindexSlice) (int64, error) {
+	var count int64
+	for _, event := range m.Events {
+		if !event.Timestamp.Before(slice.From) && event.Timestamp.Before(slice.To) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MockReindexStore) CountTarget(ctx context.Context, index string, from, to time.Time) (int64, error) {
+	timestamps := map[int64]time.Time{}
+	for _, event := range m.Events {
+		timestamps[event.ID] = event.Timestamp
+	}
+	var count int64
+	for _, name := range m.resolve(index) {
+		for _, id := range m.Indexed[name] {
+			timestamp := timestamps[id]
+			if !timestamp.Before(from) && timestamp.Before(to) {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func (m *MockReindexStore) CreateTarget(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Created = append(m.Created, name)
+	return nil
+}
+
+func (m *MockReindexStore) FinishTarget(ctx context.Context, pattern string) error {
+	return nil
+}
+
+func (m *MockReindexStore) SwapAliases(ctx context.Context, targets []string, write string) ([]string, error) {
+	m.Swapped = append(m.Swapped, append([]string(nil), targets...))
+	m.Write = write
+	m.Events = append(m.Events, m.StoredDuringJob...)
+	return []string{"events-search-000001"}, nil
+}
+
+func withReindexBatchSize(t *testing.T, size int) {
+	previous := ReindexBatchSize
+	ReindexBatchSize = size
+	t.Cleanup(func() { ReindexBatchSize = previous })
+}
+
+func reindexEvents(start time.Time, n int, step time.Duration) []models.Event {
+	events := make([]models.Event, 0, n)
+	for i := 0; i < n; i++ {
+		events = append(events, models.Event{ID: int64(i + 1), Timestamp: start.Add(time.Duration(i) * step)})
+	}
+	return events
+}
+
+func TestRunReindexJobBuildsPerDayTargetsSwapsAndCatchesUp(t *testing.T) {
+	withReindexBatchSize(t, 2)
+	start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	// Every 6 hours for two and a half days.
+	store := &MockReindexStore{Events: reindexEvents(start, 10, 6*time.Hour)}
+
+	job := &models.ReindexJob{ID: 7, Full: true, RangeStart: start, RangeEnd: start.Add(60 * time.Hour)}
+	if err := PrepareReindexJob(job, 4); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	if len(job.Slices) != 4 || !job.Slices[3].To.Equal(job.RangeEnd) {
+		t.Fatalf("expected 4 slices covering the range, got %+v", job.Slices)
+	}
+	store.StoredDuringJob = []models.Event{{ID: 11, Timestamp: job.RangeEnd.Add(time.Minute)}}
+
+	if err := RunReindexJob(context.Background(), store, job, 2); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	days := []string{
+		database.ReindexTargetName(7, start),
+		database.ReindexTargetName(7, start.Add(24*time.Hour)),
+		database.ReindexTargetName(7, start.Add(48*time.Hour)),
+	}
+	if job.Target != days[2] || store.Created[0] != days[2] {
+		t.Fatalf("expected the cutoff's day to be the write index, got %s and %v", job.Target, store.Created)
+	}
+	sort.Strings(store.Created)
+	if strings.Join(store.Created, ",") != strings.Join(days, ",") {
+		t.Fatalf("expected one target per day, got %v", store.Created)
+	}
+	if want := []int64{1, 2, 3, 4}; !sameIDs(store.Indexed[days[0]], want) {
+		t.Fatalf("expected the first day's events in %s, got %v", days[0], store.Indexed[days[0]])
+	}
+	if len(store.Swapped) != 1 || len(store.Swapped[0]) != 3 || store.Write != days[2] {
+		t.Fatalf("expected the aliases to be swapped to the three targets, got %v writing to %s", store.Swapped, store.Write)
+	}
+	if job.Status != database.ReindexStatusCompleted || job.Indexed != 10 || job.Expected != 10 {
+		t.Fatalf("expected a completed job with 10 of 10 events, got %s %d of %d", job.Status, job.Indexed, job.Expected)
+	}
+	if want := []int64{9, 10, 11}; !sameIDs(store.Indexed[days[2]], want) {
+		t.Fatalf("expected the event stored during the job in the write index, got %v", store.Indexed[days[2]])
+	}
+	if store.Released != 1 {
+		t.Fatalf("expected the job to be released once, got %d", store.Released)
+	}
+}
+
+func TestRunReindexJobCatchesUpLateEventsByIngestOrder(t *testing.T) {
+	withReindexBatchSize(t, 2)
+	start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	createdAt := start.Add(48 * time.Hour)
+	events := reindexEvents(start, 6, time.Hour)
+	for i := range events {
+		events[i].ID = utils.FirstIDAt(events[i].Timestamp)
+	}
+	// Ingested while the job ran with a timestamp in its first slice, which
+	// was already indexed by then.
+	late := models.Event{ID: utils.FirstIDAt(createdAt.Add(time.Minute)), Timestamp: start.Add(30 * time.Minute)}
+	store := &MockReindexStore{Events: events, StoredDuringJob: []models.Event{late}}
+
+	job := &models.ReindexJob{ID: 8, Full: true, RangeStart: start, RangeEnd: start.Add(6 * time.Hour), CreatedAt: createdAt}
+	if err := PrepareReindexJob(job, 2); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	if err := RunReindexJob(context.Background(), store, job, 1); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	if job.Status != database.ReindexStatusCompleted {
+		t.Fatalf("expected a completed job, got %s %q", job.Status, job.LastError)
+	}
+	if !store.holds(store.resolve(""), late.ID) {
+		t.Fatalf("expected the late event to be caught up, got %v", store.Indexed)
+	}
+}
+
+func TestRunReindexJobStaysSwappedWhenCatchUpFallsShort(t *testing.T) {
+	withReindexBatchSize(t, 2)
+	start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	late := models.Event{ID: 7, Timestamp: start.Add(30 * time.Minute)}
+	store := &MockReindexStore{Events: reindexEvents(start, 6, time.Hour), StoredDuringJob: []models.Event{late}, Lost: late.ID}
+
+	job := &models.ReindexJob{ID: 9, Full: true, RangeStart: start, RangeEnd: start.Add(6 * time.Hour)}
+	if err := PrepareReindexJob(job, 2); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	if err := RunReindexJob(context.Background(), store, job, 1); err == nil {
+		t.Fatal("expected the count after catching up to fail")
+	}
+	if job.Status != database.ReindexStatusSwapped || job.LastError == "" {
+		t.Fatalf("expected the job to stay swapped with its error, got %s %q", job.Status, job.LastError)
+	}
+}
+
+func sameIDs(got, want []int64) bool {
+	got = append([]int64(nil), got...)
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRunReindexJobResumesFromSliceCheckpoints(t *testing.T) {
+	withReindexBatchSize(t, 2)
+	start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	store := &MockReindexStore{Events: reindexEvents(start, 8, time.Hour)}
+
+	job := &models.ReindexJob{ID: 3, RangeStart: start, RangeEnd: start.Add(8 * time.Hour)}
+	if err := PrepareReindexJob(job, 2); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	job.Slices[0].Done = true
+	job.Slices[0].Indexed = 4
+	job.Slices[1].CursorTimestamp = start.Add(5 * time.Hour)
+	job.Slices[1].CursorID = 6
+	job.Slices[1].Indexed = 2
+	job.Indexed = 6
+	// A range job counts against the indices it wrote into.
+	store.Indexed = map[string][]int64{"": {1, 2, 3, 4, 5, 6}}
+
+	if err := RunReindexJob(context.Background(), store, job, 2); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	if got := store.Indexed[""]; len(got) != 8 || got[6] != 7 || got[7] != 8 {
+		t.Fatalf("expected only events 7 and 8 to be indexed again, got %v", got)
+	}
+	if len(store.Created) != 0 || len(store.Swapped) != 0 {
+		t.Fatalf("expected a range job to write into the current indices, got %v %v", store.Created, store.Swapped)
+	}
+	if job.Status != database.ReindexStatusCompleted || job.Indexed != 8 {
+		t.Fatalf("expected a completed job with 8 events, got %s %d", job.Status, job.Indexed)
+	}
+}
+
+func TestRunReindexJobFailsVerificationWithoutSwapping(t *testing.T) {
+	withReindexBatchSize(t, 5)
+	start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	// Lost from the second slice, so only that one starts over.
+	store := &MockReindexStore{Events: reindexEvents(start, 6, time.Hour), Lost: 5}
+
+	job := &models.ReindexJob{ID: 4, Full: true, RangeStart: start, RangeEnd: start.Add(6 * time.Hour)}
+	if err := PrepareReindexJob(job, 2); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+
+	if err := RunReindexJob(context.Background(), store, job, 1); err == nil {
+		t.Fatal("expected the job to fail verification")
+	}
+	if len(store.Swapped) != 0 {
+		t.Fatalf("expected the aliases to be left alone, got %v", store.Swapped)
+	}
+	if job.Status != database.ReindexStatusFailed || job.LastError == "" {
+		t.Fatalf("expected a failed job with its error, got %s %q", job.Status, job.LastError)
+	}
+	if first := job.Slices[0]; !first.Done || first.Indexed != 3 {
+		t.Fatalf("expected the verified slice to keep its checkpoint, got %+v", first)
+	}
+	if second := job.Slices[1]; second.Done || second.Indexed != 0 || !second.CursorTimestamp.IsZero() {
+		t.Fatalf("expected the short slice to start over, got %+v", second)
+	}
+	if job.Indexed != 3 {
+		t.Fatalf("expected only the verified slice's events to count, got %d", job.Indexed)
+	}
+}
+
+func TestPrepareReindexJobRejectsRangeFromIndex(t *testing.T) {
+	start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	job := &models.ReindexJob{Source: database.ReindexSourceIndex, RangeStart: start, RangeEnd: start.Add(time.Hour)}
+	if err := PrepareReindexJob(job, 1); err == nil {
+		t.Fatal("expected a range reindex from the search indices to be rejected")
+	}
+}
@@ -0,0 +1,627 @@
+package worker
+
+import (
+	"analytics-backend/archive"
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"analytics-backend/sinks"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+var (
+	ReplayBatchSize    = 500
+	ReplayDefaultRate  = 1000
+	ReplayPollInterval = 5 * time.Second
+	ReplayLease        = time.Minute
+)
+
+const (
+	ReplaySourcePostgres = "postgres"
+	ReplaySourceArchive  = "archive"
+
+	// ReplayTargetAggregates recomputes aggregated rows and user sketches
+	// instead of writing to a sink.
+	ReplayTargetAggregates = "aggregates"
+)
+
+// errReplayStopped means the job was paused or cancelled while it ran.
+var errReplayStopped = errors.New("replay job is no longer running")
+
+func ConfigureReplay(cfg config.ReplayConfig) {
+	if cfg.BatchSize > 0 {
+		ReplayBatchSize = cfg.BatchSize
+	}
+	if cfg.DefaultRate > 0 {
+		ReplayDefaultRate = cfg.DefaultRate
+	}
+	if cfg.PollInterval > 0 {
+		ReplayPollInterval = cfg.PollInterval
+	}
+	if cfg.Lease > 0 {
+		ReplayLease = cfg.Lease
+	}
+}
+
+// PrepareReplayJob validates a new job against the configured sinks and
+// fills in defaults.
+func PrepareReplayJob(job *models.ReplayJob, set *sinks.Set) error {
+	if job.Source == "" {
+		job.Source = ReplaySourcePostgres
+	}
+	if job.Source != ReplaySourcePostgres && job.Source != ReplaySourceArchive {
+		return fmt.Errorf("source must be %q or %q", ReplaySourcePostgres, ReplaySourceArchive)
+	}
+	if job.RangeStart.IsZero() || !job.RangeEnd.After(job.RangeStart) {
+		return fmt.Errorf("to must be after from")
+	}
+	if len(job.Targets) == 0 {
+		return fmt.Errorf("at least one target is required")
+	}
+
+	var targets []string
+	for _, target := range job.Targets {
+		if slices.Contains(targets, target) {
+			continue
+		}
+		if target != ReplayTargetAggregates && !set.Has(target) {
+			return fmt.Errorf("unknown target %q", target)
+		}
+		if target == "postgres" && job.Source == ReplaySourcePostgres {
+			return fmt.Errorf("events replayed from postgres are already in postgres")
+		}
+		targets = append(targets, target)
+	}
+	job.Targets = targets
+
+	if slices.Contains(job.Targets, ReplayTargetAggregates) {
+		// Aggregated rows cannot be split by user or deduplicated against
+		// what is already there, so they are only ever rebuilt in full.
+		if len(job.UserIDs) > 0 {
+			return fmt.Errorf("aggregates cannot be recomputed for a subset of users")
+		}
+		if !job.DeleteDerived {
+			return fmt.Errorf("recomputing aggregates requires delete_derived")
+		}
+		job.RangeStart = job.RangeStart.Truncate(AggregationWindow)
+		if end := job.RangeEnd.Truncate(AggregationWindow); end.Before(job.RangeEnd) {
+			job.RangeEnd = end.Add(AggregationWindow)
+		}
+	}
+
+	if job.Rate == 0 {
+		job.Rate = ReplayDefaultRate
+	}
+	job.Status = database.ReplayStatusPending
+	return nil
+}
+
+type ReplayJobStore interface {
+	ClaimJob(ctx context.Context, id uint) (*models.ReplayJob, error)
+	DeleteDerived(ctx context.Context, target string, r database.EventRange) (bool, error)
+	ListEvents(ctx context.Context, job *models.ReplayJob, limit int) ([]models.Event, error)
+	ListArchiveFiles(ctx context.Context, job *models.ReplayJob) ([]models.ArchiveFile, error)
+	ReadArchiveFile(ctx context.Context, file models.ArchiveFile) ([]models.Event, error)
+	Enqueue(ctx context.Context, job *models.ReplayJob, events []models.Event) error
+	Checkpoint(ctx context.Context, job *models.ReplayJob) (bool, error)
+	Finish(ctx context.Context, id uint) error
+	Fail(ctx context.Context, id uint, reason string) error
+}
+
+type DefaultReplayJobStore struct {
+	Sinks   *sinks.Set
+	Storage archive.Storage
+}
+
+func (s *DefaultReplayJobStore) sinkSet() *sinks.Set {
+	if s.Sinks != nil {
+		return s.Sinks
+	}
+	return sinks.Active
+}
+
+func (s *DefaultReplayJobStore) ClaimJob(ctx context.Context, id uint) (*models.ReplayJob, error) {
+	return database.ClaimReplayJob(ctx, id, ReplayLease)
+}
+
+func (s *DefaultReplayJobStore) DeleteDerived(ctx context.Context, target string, r database.EventRange) (bool, error) {
+	if target == ReplayTargetAggregates {
+		deleted, err := database.DeleteAggregatedEvents(ctx, r)
+		if err == nil {
+			log.Printf("Deleted %d aggregated rows before replay", deleted)
+		}
+		return true, err
+	}
+	return s.sinkSet().DeleteRange(ctx, target, r)
+}
+
+func (s *DefaultReplayJobStore) ListEvents(ctx context.Context, job *models.ReplayJob, limit int) ([]models.Event, error) {
+	return database.ListEventsAfter(ctx, database.ReplayJobRange(job), job.CursorTimestamp, job.CursorID, limit)
+}
+
+func (s *DefaultReplayJobStore) ListArchiveFiles(ctx context.Context, job *models.ReplayJob) ([]models.ArchiveFile, error) {
+	if s.Storage == nil {
+		return nil, fmt.Errorf("archive storage is not configured")
+	}
+	return database.ListArchiveFiles(ctx, job.RangeStart, job.RangeEnd, job.Actions)
+}
+
+func (s *DefaultReplayJobStore) ReadArchiveFile(ctx context.Context, file models.ArchiveFile) ([]models.Event, error) {
+	data, err := s.Storage.Get(ctx, file.Path)
+	if err != nil {
+		return nil, err
+	}
+	return archive.Decode(data)
+}
+
+func (s *DefaultReplayJobStore) Enqueue(ctx context.Context, job *models.ReplayJob, events []models.Event) error {
+	return database.EnqueueReplayEvents(ctx, job, events)
+}
+
+func (s *DefaultReplayJobStore) Checkpoint(ctx context.Context, job *models.ReplayJob) (bool, error) {
+	return database.SaveReplayCheckpoint(ctx, job, ReplayLease)
+}
+
+func (s *DefaultReplayJobStore) Finish(ctx context.Context, id uint) error {
+	return database.FinishReplayEnqueue(ctx, id)
+}
+
+func (s *DefaultReplayJobStore) Fail(ctx context.Context, id uint, reason string) error {
+	return database.FailReplayJob(ctx, id, reason)
+}
+
+// StartReplayScheduler runs pending replay jobs one at a time. A job left
+// running by an instance that went away is picked up once its lease expires
+// and resumes from its checkpoint.
+func StartReplayScheduler(ctx context.Context, workerName string, store ReplayJobStore) {
+	log.Printf("Starting replay scheduler %s...", workerName)
+	metrics.ActiveWorkers.WithLabelValues("replay_scheduler").Inc()
+	defer metrics.ActiveWorkers.WithLabelValues("replay_scheduler").Dec()
+
+	for ctx.Err() == nil {
+		metrics.WorkerIterations.WithLabelValues("replay_scheduler").Inc()
+
+		job, err := store.ClaimJob(ctx, 0)
+		if err != nil {
+			log.Printf("Failed to claim replay job: %v", err)
+		}
+		if job == nil {
+			sleepContext(ctx, ReplayPollInterval)
+			continue
+		}
+
+		if err := RunReplayJob(ctx, store, job); err != nil {
+			log.Printf("Replay job %d stopped: %v", job.ID, err)
+		}
+	}
+
+	log.Printf("Replay scheduler %s stopped", workerName)
+}
+
+// RunReplayJob enqueues a claimed job's events from its checkpoint onwards.
+// It returns nil when the job finished enqueuing or was paused or cancelled.
+func RunReplayJob(ctx context.Context, store ReplayJobStore, job *models.ReplayJob) error {
+	log.Printf("Running replay job %d from %s into %s", job.ID, job.Source, strings.Join(job.Targets, ", "))
+
+	err := deleteDerived(ctx, store, job)
+	if err == nil {
+		if job.Source == ReplaySourceArchive {
+			err = replayArchive(ctx, store, job)
+		} else {
+			err = replayPostgres(ctx, store, job)
+		}
+	}
+
+	switch {
+	case errors.Is(err, errReplayStopped):
+		log.Printf("Replay job %d is no longer running, stopping after %d events", job.ID, job.Enqueued)
+		return nil
+	case ctx.Err() != nil:
+		// Leave the job leased; it resumes from the checkpoint once the
+		// lease runs out.
+		return ctx.Err()
+	case err != nil:
+		metrics.ReplayFailures.WithLabelValues("enqueue").Inc()
+		if failErr := store.Fail(database.Ctx, job.ID, err.Error()); failErr != nil {
+			log.Printf("Failed to mark replay job %d as failed: %v", job.ID, failErr)
+		}
+		return err
+	}
+
+	log.Printf("Replay job %d enqueued %d events", job.ID, job.Enqueued)
+	return store.Finish(ctx, job.ID)
+}
+
+func deleteDerived(ctx context.Context, store ReplayJobStore, job *models.ReplayJob) error {
+	if !job.DeleteDerived || job.DerivedDeleted {
+		return nil
+	}
+
+	r := database.ReplayJobRange(job)
+	for _, target := range job.Targets {
+		deleted, err := store.DeleteDerived(ctx, target, r)
+		if err != nil {
+			metrics.ReplayFailures.WithLabelValues("delete").Inc()
+			return fmt.Errorf("failed to delete existing data from %s: %w", target, err)
+		}
+		if !deleted {
+			log.Printf("Target %s cannot delete existing data, replaying on top of it", target)
+		}
+	}
+
+	job.DerivedDeleted = true
+	return checkpointReplay(ctx, store, job)
+}
+
+func replayPostgres(ctx context.Context, store ReplayJobStore, job *models.ReplayJob) error {
+	for ctx.Err() == nil {
+		pageStarted := time.Now()
+		events, err := store.ListEvents(ctx, job, ReplayBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		if err := enqueueReplayPage(ctx, store, job, events); err != nil {
+			return err
+		}
+		last := events[len(events)-1]
+		job.CursorTimestamp = last.Timestamp
+		job.CursorID = last.ID
+		if err := checkpointReplay(ctx, store, job); err != nil {
+			return err
+		}
+		throttleReplay(ctx, job.Rate, len(events), pageStarted)
+	}
+	return ctx.Err()
+}
+
+// replayArchive checkpoints by file path, so an interrupted job re-enqueues
+// at most the file it was in the middle of.
+func replayArchive(ctx context.Context, store ReplayJobStore, job *models.ReplayJob) error {
+	files, err := store.ListArchiveFiles(ctx, job)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	r := database.ReplayJobRange(job)
+	// A redelivered batch can be archived twice under different keys.
+	seen := map[int64]bool{}
+	for _, file := range files {
+		if file.Path <= job.CursorPath {
+			continue
+		}
+
+		events, err := store.ReadArchiveFile(ctx, file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file.Path, err)
+		}
+
+		var matched []models.Event
+		for _, event := range events {
+			if !r.Contains(event) || (event.ID != 0 && seen[event.ID]) {
+				continue
+			}
+			seen[event.ID] = true
+			matched = append(matched, event)
+		}
+
+		for len(matched) > 0 {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			pageStarted := time.Now()
+			page := matched[:min(ReplayBatchSize, len(matched))]
+			matched = matched[len(page):]
+
+			if err := enqueueReplayPage(ctx, store, job, page); err != nil {
+				return err
+			}
+			if len(matched) > 0 {
+				if err := checkpointReplay(ctx, store, job); err != nil {
+					return err
+				}
+			}
+			throttleReplay(ctx, job.Rate, len(page), pageStarted)
+		}
+
+		job.CursorPath = file.Path
+		if err := checkpointReplay(ctx, store, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func enqueueReplayPage(ctx context.Context, store ReplayJobStore, job *models.ReplayJob, events []models.Event) error {
+	if err := store.Enqueue(ctx, job, events); err != nil {
+		return err
+	}
+	job.Enqueued += int64(len(events))
+	metrics.ReplayEventsEnqueued.Add(float64(len(events)))
+	return nil
+}
+
+func checkpointReplay(ctx context.Context, store ReplayJobStore, job *models.ReplayJob) error {
+	running, err := store.Checkpoint(ctx, job)
+	if err != nil {
+		return err
+	}
+	if !running {
+		return errReplayStopped
+	}
+	return nil
+}
+
+// throttleReplay holds a page back until it has taken as long as the rate
+// allows for that many events.
+func throttleReplay(ctx context.Context, rate, events int, started time.Time) {
+	if rate <= 0 {
+		return
+	}
+	budget := time.Duration(events) * time.Second / time.Duration(rate)
+	if wait := budget - time.Since(started); wait > 0 {
+		sleepContext(ctx, wait)
+	}
+}
+
+type ReplayStore interface {
+	ReadReplayEvents() ([]redis.XMessage, error)
+	ReadPendingReplayEvents() ([]redis.XMessage, error)
+	JobStatus(ctx context.Context, id uint) (string, error)
+	WriteSink(ctx context.Context, name string, events []models.Event) error
+	CommitAggregates(ctx context.Context, key string, aggregated []*models.AggregatedEvent) (bool, error)
+	AddUserSketches(ctx context.Context, updates []database.UserSketchUpdate) error
+	AddProgress(ctx context.Context, id uint, processed int) error
+	AckReplayEvents(ids ...string) error
+	Quarantine(msg redis.XMessage, reason error) error
+	DeregisterConsumer() error
+}
+
+type DefaultReplayStore struct {
+	Consumer string
+	Sinks    *sinks.Set
+}
+
+func (s *DefaultReplayStore) ReadReplayEvents() ([]redis.XMessage, error) {
+	return database.ReadReplayEventsFromGroup(s.Consumer)
+}
+
+func (s *DefaultReplayStore) ReadPendingReplayEvents() ([]redis.XMessage, error) {
+	return database.ReadPendingReplayEvents(s.Consumer)
+}
+
+// JobStatus returns an empty status for a job that no longer exists.
+func (s *DefaultReplayStore) JobStatus(ctx context.Context, id uint) (string, error) {
+	job, err := database.GetReplayJob(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return job.Status, nil
+}
+
+func (s *DefaultReplayStore) WriteSink(ctx context.Context, name string, events []models.Event) error {
+	if s.Sinks != nil {
+		return s.Sinks.WriteSink(ctx, name, events)
+	}
+	return sinks.Active.WriteSink(ctx, name, events)
+}
+
+// CommitAggregates goes through the outbox batch key so a redelivered replay
+// batch cannot add its aggregates twice.
+func (s *DefaultReplayStore) CommitAggregates(ctx context.Context, key string, aggregated []*models.AggregatedEvent) (bool, error) {
+	return database.CommitBatch(ctx, database.OutboxBatch{
+		Key:        key,
+		Stream:     database.ReplayStreamName,
+		Aggregated: aggregated,
+	}, nil)
+}
+
+func (s *DefaultReplayStore) AddUserSketches(ctx context.Context, updates []database.UserSketchUpdate) error {
+	return database.AddUserSketches(ctx, updates)
+}
+
+func (s *DefaultReplayStore) AddProgress(ctx context.Context, id uint, processed int) error {
+	return database.AddReplayProgress(ctx, id, processed)
+}
+
+func (s *DefaultReplayStore) Quarantine(msg redis.XMessage, reason error) error {
+	return database.QuarantineMessage(database.Ctx, database.ReplayStreamName, database.ReplayGroupName, msg, reason)
+}
+
+func (s *DefaultReplayStore) AckReplayEvents(ids ...string) error {
+	return database.AckReplayEvents(ids...)
+}
+
+func (s *DefaultReplayStore) DeregisterConsumer() error {
+	removed, err := database.DeleteConsumer(database.ReplayStreamName, database.ReplayGroupName, s.Consumer)
+	if err == nil && !removed {
+		log.Printf("Keeping consumer %s registered because it still owns pending replay events", s.Consumer)
+	}
+	return err
+}
+
+func StartReplayWorker(ctx context.Context, workerName string, store ReplayStore) {
+	log.Printf("Starting replay worker %s...", workerName)
+	metrics.ActiveWorkers.WithLabelValues("replay").Inc()
+	defer metrics.ActiveWorkers.WithLabelValues("replay").Dec()
+
+	retryPending := true
+	var backoff errorBackoff
+	for ctx.Err() == nil {
+		metrics.WorkerIterations.WithLabelValues("replay").Inc()
+
+		var (
+			messages []redis.XMessage
+			err      error
+		)
+		if retryPending {
+			messages, err = store.ReadPendingReplayEvents()
+			retryPending = len(messages) > 0
+		} else {
+			messages, err = store.ReadReplayEvents()
+		}
+		if err == nil && len(messages) > 0 {
+			err = processReplayBatch(store, messages)
+		}
+		if err != nil {
+			retryPending = true
+			metrics.ReplayFailures.WithLabelValues("write").Inc()
+			log.Printf("Error processing replay batch for %s: %v", workerName, err)
+			backoff.wait(ctx)
+		} else {
+			backoff.reset()
+		}
+	}
+
+	if err := store.DeregisterConsumer(); err != nil {
+		log.Printf("Failed to deregister replay worker %s: %v", workerName, err)
+	}
+	log.Printf("Replay worker %s stopped", workerName)
+}
+
+type replayGroup struct {
+	jobID    uint
+	targets  []string
+	messages []redis.XMessage
+}
+
+// processReplayBatch writes each job's events to that job's targets. Entries
+// of cancelled or deleted jobs are acknowledged without being written.
+func processReplayBatch(store ReplayStore, messages []redis.XMessage) error {
+	started := time.Now()
+
+	var groups []*replayGroup
+	byKey := map[string]*replayGroup{}
+	for _, msg := range messages {
+		jobValue, _ := msg.Values["job"].(string)
+		targetsValue, _ := msg.Values["targets"].(string)
+		key := jobValue + "|" + targetsValue
+		group, ok := byKey[key]
+		if !ok {
+			jobID, _ := strconv.ParseUint(jobValue, 10, 64)
+			group = &replayGroup{jobID: uint(jobID)}
+			if targetsValue != "" {
+				group.targets = strings.Split(targetsValue, ",")
+			}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.messages = append(group.messages, msg)
+	}
+
+	for _, group := range groups {
+		if err := processReplayGroup(store, group); err != nil {
+			return err
+		}
+	}
+
+	recordBatchLatency("replay", time.Since(started))
+	return nil
+}
+
+func processReplayGroup(store ReplayStore, group *replayGroup) error {
+	ids := make([]string, 0, len(group.messages))
+	events := make([]models.Event, 0, len(group.messages))
+	for _, msg := range group.messages {
+		ids = append(ids, msg.ID)
+		event, err := database.DecodeEvent(msg.Values)
+		if err != nil {
+			metrics.ReplayFailures.WithLabelValues("parse").Inc()
+			log.Printf("Quarantining malformed replay message %s: %v", msg.ID, err)
+			if err := store.Quarantine(msg, err); err != nil {
+				return err
+			}
+			continue
+		}
+		events = append(events, event)
+	}
+
+	status, err := store.JobStatus(database.Ctx, group.jobID)
+	if err != nil {
+		return err
+	}
+	if status == "" || status == database.ReplayStatusCancelled {
+		return store.AckReplayEvents(ids...)
+	}
+
+	key := outboxBatchKey(database.ReplayStreamName, ids)
+	ctx := sinks.WithBatchKey(database.Ctx, key)
+	for _, target := range group.targets {
+		if len(events) == 0 {
+			break
+		}
+		if target == ReplayTargetAggregates {
+			err = recomputeAggregates(store, key, events)
+		} else {
+			err = store.WriteSink(ctx, target, events)
+		}
+		if err != nil {
+			return fmt.Errorf("replay job %d target %s: %w", group.jobID, target, err)
+		}
+		metrics.ReplayEventsWritten.WithLabelValues(target).Add(float64(len(events)))
+	}
+
+	if err := store.AddProgress(database.Ctx, group.jobID, len(group.messages)); err != nil {
+		return err
+	}
+	return store.AckReplayEvents(ids...)
+}
+
+// recomputeAggregates rebuilds aggregated rows for replayed events. Replayed
+// ranges are historical, so their windows are written as finalized.
+func recomputeAggregates(store ReplayStore, key string, events []models.Event) error {
+	groups := map[AggregationKey]*AggregatedData{}
+	var keys []AggregationKey
+	for _, event := range events {
+		k := AggregationKey{Action: event.Action, Element: event.Element, Window: event.Timestamp.Truncate(AggregationWindow)}
+		if data, ok := groups[k]; ok {
+			data.UserIDs = append(data.UserIDs, event.UserId)
+			continue
+		}
+		groups[k] = &AggregatedData{Action: event.Action, Element: event.Element, Window: k.Window, UserIDs: []string{event.UserId}}
+		keys = append(keys, k)
+	}
+
+	aggregated := make([]*models.AggregatedEvent, 0, len(keys))
+	updates := make([]database.UserSketchUpdate, 0, len(keys))
+	for _, k := range keys {
+		data := groups[k]
+		aggregated = append(aggregated, &models.AggregatedEvent{
+			Action:    data.Action,
+			Element:   data.Element,
+			Count:     len(data.UserIDs),
+			Window:    data.Window,
+			Finalized: true,
+		})
+		updates = append(updates, database.UserSketchUpdate{
+			Action:  data.Action,
+			Element: data.Element,
+			Window:  data.Window,
+			UserIDs: data.UserIDs,
+		})
+	}
+
+	if _, err := store.CommitAggregates(database.Ctx, key, aggregated); err != nil {
+		return err
+	}
+	return store.AddUserSketches(database.Ctx, updates)
+}
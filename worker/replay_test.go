@@ -0,0 +1,255 @@
+package worker
+
+import (
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"analytics-backend/sinks"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type MockReplayJobStore struct {
+	Events      []models.Event
+	Deleted     []string
+	Enqueued    [][]models.Event
+	Checkpoints int
+	StopAfter   int
+	Finished    []uint
+	Failed      []uint
+}
+
+func (m *MockReplayJobStore) ClaimJob(ctx context.Context, id uint) (*models.ReplayJob, error) {
+	return nil, nil
+}
+
+func (m *MockReplayJobStore) DeleteDerived(ctx context.Context, target string, r database.EventRange) (bool, error) {
+	m.Deleted = append(m.Deleted, target)
+	return true, nil
+}
+
+func (m *MockReplayJobStore) ListEvents(ctx context.Context, job *models.ReplayJob, limit int) ([]models.Event, error) {
+	var page []models.Event
+	for _, event := range m.Events {
+		after := event.Timestamp.After(job.CursorTimestamp) ||
+			(event.Timestamp.Equal(job.CursorTimestamp) && event.ID > job.CursorID)
+		if after && len(page) < limit {
+			page = append(page, event)
+		}
+	}
+	return page, nil
+}
+
+func (m *MockReplayJobStore) ListArchiveFiles(ctx context.Context, job *models.ReplayJob) ([]models.ArchiveFile, error) {
+	return nil, nil
+}
+
+func (m *MockReplayJobStore) ReadArchiveFile(ctx context.Context, file models.ArchiveFile) ([]models.Event, error) {
+	return nil, nil
+}
+
+func (m *MockReplayJobStore) Enqueue(ctx context.Context, job *models.ReplayJob, events []models.Event) error {
+	m.Enqueued = append(m.Enqueued, events)
+	return nil
+}
+
+func (m *MockReplayJobStore) Checkpoint(ctx context.Context, job *models.ReplayJob) (bool, error) {
+	m.Checkpoints++
+	return m.StopAfter == 0 || m.Checkpoints < m.StopAfter, nil
+}
+
+func (m *MockReplayJobStore) Finish(ctx context.Context, id uint) error {
+	m.Finished = append(m.Finished, id)
+	return nil
+}
+
+func (m *MockReplayJobStore) Fail(ctx context.Context, id uint, reason string) error {
+	m.Failed = append(m.Failed, id)
+	return nil
+}
+
+type MockReplayStore struct {
+	Statuses    map[uint]string
+	Sinks       *sinks.Set
+	Aggregated  []*models.AggregatedEvent
+	Progress    map[uint]int
+	Acked       []string
+	Quarantined []string
+}
+
+func (m *MockReplayStore) ReadReplayEvents() ([]redis.XMessage, error) {
+	return nil, nil
+}
+
+func (m *MockReplayStore) ReadPendingReplayEvents() ([]redis.XMessage, error) {
+	return nil, nil
+}
+
+func (m *MockReplayStore) JobStatus(ctx context.Context, id uint) (string, error) {
+	return m.Statuses[id], nil
+}
+
+func (m *MockReplayStore) WriteSink(ctx context.Context, name string, events []models.Event) error {
+	return m.Sinks.WriteSink(ctx, name, events)
+}
+
+func (m *MockReplayStore) CommitAggregates(ctx context.Context, key string, aggregated []*models.AggregatedEvent) (bool, error) {
+	m.Aggregated = append(m.Aggregated, aggregated...)
+	return true, nil
+}
+
+func (m *MockReplayStore) AddUserSketches(ctx context.Context, updates []database.UserSketchUpdate) error {
+	return nil
+}
+
+func (m *MockReplayStore) AddProgress(ctx context.Context, id uint, processed int) error {
+	if m.Progress == nil {
+		m.Progress = map[uint]int{}
+	}
+	m.Progress[id] += processed
+	return nil
+}
+
+func (m *MockReplayStore) AckReplayEvents(ids ...string) error {
+	m.Acked = append(m.Acked, ids...)
+	return nil
+}
+
+func (m *MockReplayStore) Quarantine(msg redis.XMessage, reason error) error {
+	m.Quarantined = append(m.Quarantined, msg.ID)
+	return nil
+}
+
+func (m *MockReplayStore) DeregisterConsumer() error {
+	return nil
+}
+
+func replayTestEvents(n int) []models.Event {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := make([]models.Event, 0, n)
+	for i := 0; i < n; i++ {
+		events = append(events, models.Event{ID: int64(i + 1), Action: "click", Timestamp: base.Add(time.Duration(i) * time.Second)})
+	}
+	return events
+}
+
+func TestRunReplayJob_PagesFromCheckpoint(t *testing.T) {
+	previous := ReplayBatchSize
+	ReplayBatchSize = 2
+	defer func() { ReplayBatchSize = previous }()
+
+	events := replayTestEvents(5)
+	store := &MockReplayJobStore{Events: events}
+	job := &models.ReplayJob{
+		ID:              3,
+		Targets:         []string{"clickhouse"},
+		DeleteDerived:   true,
+		CursorTimestamp: events[0].Timestamp,
+		CursorID:        events[0].ID,
+	}
+
+	if err := RunReplayJob(context.Background(), store, job); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if job.Enqueued != 4 || len(store.Enqueued) != 2 {
+		t.Fatalf("expected 4 events in 2 pages after the checkpoint, got %d in %d", job.Enqueued, len(store.Enqueued))
+	}
+	if store.Enqueued[0][0].ID != 2 {
+		t.Fatalf("expected replay to resume after event 1, got %d", store.Enqueued[0][0].ID)
+	}
+	if job.CursorID != 5 {
+		t.Fatalf("expected cursor at the last event, got %d", job.CursorID)
+	}
+	if len(store.Deleted) != 1 || !job.DerivedDeleted {
+		t.Fatalf("expected derived data to be deleted once, got %v", store.Deleted)
+	}
+	if len(store.Finished) != 1 || len(store.Failed) != 0 {
+		t.Fatalf("expected job to finish, finished=%v failed=%v", store.Finished, store.Failed)
+	}
+}
+
+func TestRunReplayJob_StopsWhenPaused(t *testing.T) {
+	previous := ReplayBatchSize
+	ReplayBatchSize = 2
+	defer func() { ReplayBatchSize = previous }()
+
+	store := &MockReplayJobStore{Events: replayTestEvents(6), StopAfter: 2}
+	job := &models.ReplayJob{ID: 4, Targets: []string{"clickhouse"}}
+
+	if err := RunReplayJob(context.Background(), store, job); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(store.Enqueued) != 2 {
+		t.Fatalf("expected replay to stop at the paused checkpoint, got %d pages", len(store.Enqueued))
+	}
+	if len(store.Finished) != 0 || len(store.Failed) != 0 {
+		t.Fatalf("expected paused job to be left alone, finished=%v failed=%v", store.Finished, store.Failed)
+	}
+}
+
+func TestProcessReplayBatch_WritesTargetsAndSkipsCancelledJobs(t *testing.T) {
+	var written []models.Event
+	store := &MockReplayStore{
+		Statuses: map[uint]string{1: database.ReplayStatusRunning, 2: database.ReplayStatusCancelled},
+		Sinks: sinks.NewSet([]sinks.Sink{&mockSink{name: "clickhouse", writeFunc: func(events []models.Event) error {
+			written = append(written, events...)
+			return nil
+		}}}, nil),
+	}
+
+	timestamp := time.Date(2024, 1, 1, 0, 0, 7, 0, time.UTC).Format(time.RFC3339Nano)
+	message := func(id, job, targets string) redis.XMessage {
+		return redis.XMessage{ID: id, Values: map[string]interface{}{
+			"id": "1", "user_id": "u1", "action": "click", "element": "button",
+			"duration": "1", "timestamp": timestamp, "job": job, "targets": targets,
+		}}
+	}
+
+	err := processReplayBatch(store, []redis.XMessage{
+		message("1-0", "1", "clickhouse,aggregates"),
+		message("1-1", "1", "clickhouse,aggregates"),
+		message("1-2", "2", "clickhouse"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(written) != 2 {
+		t.Fatalf("expected only the running job's events in clickhouse, got %d", len(written))
+	}
+	if len(store.Aggregated) != 1 || store.Aggregated[0].Count != 2 || !store.Aggregated[0].Finalized {
+		t.Fatalf("expected one finalized aggregate with count 2, got %+v", store.Aggregated)
+	}
+	if store.Progress[1] != 2 || store.Progress[2] != 0 {
+		t.Fatalf("unexpected progress %v", store.Progress)
+	}
+	if len(store.Acked) != 3 {
+		t.Fatalf("expected all messages acked, got %v", store.Acked)
+	}
+}
+
+func TestPrepareReplayJob_AggregatesRequireFullRebuild(t *testing.T) {
+	set := sinks.NewSet([]sinks.Sink{&mockSink{name: "postgres"}}, nil)
+	from := time.Date(2024, 1, 1, 0, 0, 3, 0, time.UTC)
+
+	job := &models.ReplayJob{RangeStart: from, RangeEnd: from.Add(time.Minute), Targets: []string{ReplayTargetAggregates}}
+	if err := PrepareReplayJob(job, set); err == nil {
+		t.Fatal("expected aggregates without delete_derived to be rejected")
+	}
+
+	job.DeleteDerived = true
+	if err := PrepareReplayJob(job, set); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !job.RangeStart.Equal(from.Truncate(AggregationWindow)) || job.RangeEnd.Sub(job.RangeStart) != time.Minute+AggregationWindow {
+		t.Fatalf("expected range aligned to aggregation windows, got %s - %s", job.RangeStart, job.RangeEnd)
+	}
+
+	job = &models.ReplayJob{RangeStart: from, RangeEnd: from.Add(time.Minute), Targets: []string{"postgres"}}
+	if err := PrepareReplayJob(job, set); err == nil {
+		t.Fatal("expected replaying postgres into itself to be rejected")
+	}
+}
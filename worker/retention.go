@@ -0,0 +1,113 @@
+package worker
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"context"
+	"log"
+	"time"
+)
+
+var (
+	StreamTrimInterval = time.Minute
+	// StreamRetentionStuckAfter is how old the entry holding a trim back may
+	// get before the trimmer warns about the group holding it.
+	StreamRetentionStuckAfter = 15 * time.Minute
+	StreamRetention           config.StreamRetentionConfig
+	StreamRetentionFor        = map[string]config.StreamRetentionConfig{}
+)
+
+type StreamTrimStore interface {
+	Streams() []string
+	Trim(ctx context.Context, stream string, policy config.StreamRetentionConfig, now time.Time) (database.TrimResult, error)
+}
+
+type DefaultStreamTrimStore struct{}
+
+func (s *DefaultStreamTrimStore) Streams() []string {
+	return database.ConsumedStreams()
+}
+
+func (s *DefaultStreamTrimStore) Trim(ctx context.Context, stream string, policy config.StreamRetentionConfig, now time.Time) (database.TrimResult, error) {
+	return database.TrimStream(ctx, stream, policy, now)
+}
+
+func ConfigureRetention(cfg config.RetentionConfig) {
+	if cfg.Interval > 0 {
+		StreamTrimInterval = cfg.Interval
+	}
+	if cfg.StuckAfter > 0 {
+		StreamRetentionStuckAfter = cfg.StuckAfter
+	}
+	StreamRetention = cfg.Default
+	StreamRetentionFor = map[string]config.StreamRetentionConfig{}
+	for stream, policy := range cfg.Streams {
+		StreamRetentionFor[stream] = policy
+	}
+}
+
+func streamRetention(stream string) config.StreamRetentionConfig {
+	if policy, ok := StreamRetentionFor[stream]; ok {
+		return policy
+	}
+	return StreamRetention
+}
+
+// StartStreamTrimmer trims every consumed stream each StreamTrimInterval.
+// Trimming is idempotent, so running it on several instances is harmless.
+func StartStreamTrimmer(ctx context.Context, workerName string, store StreamTrimStore) {
+	log.Printf("Starting stream trimmer %s...", workerName)
+	metrics.ActiveWorkers.WithLabelValues("stream_trimmer").Inc()
+	defer metrics.ActiveWorkers.WithLabelValues("stream_trimmer").Dec()
+
+	for ctx.Err() == nil {
+		metrics.WorkerIterations.WithLabelValues("stream_trimmer").Inc()
+		trimStreams(ctx, store, time.Now())
+		sleepContext(ctx, StreamTrimInterval)
+	}
+
+	log.Printf("Stream trimmer %s stopped", workerName)
+}
+
+func trimStreams(ctx context.Context, store StreamTrimStore, now time.Time) {
+	for _, stream := range store.Streams() {
+		result, err := store.Trim(ctx, stream, streamRetention(stream), now)
+		if result.Memory > 0 {
+			metrics.StreamMemoryBytes.WithLabelValues(stream).Set(float64(result.Memory))
+		}
+		if result.Entries > 0 {
+			metrics.StreamTrimmedEntries.WithLabelValues(stream).Add(float64(result.Entries))
+			metrics.StreamTrimmedBytes.WithLabelValues(stream).Add(float64(result.Bytes))
+			log.Printf("Trimmed %d entries (%d bytes) from %s below %s", result.Entries, result.Bytes, stream, result.MinID)
+		}
+		if err != nil {
+			log.Printf("Failed to trim %s: %v", stream, err)
+		}
+		reportRetentionFloor(stream, result, now)
+	}
+}
+
+// reportRetentionFloor exports how old the entry holding the stream back is.
+// A group that never acknowledges an entry keeps the stream from being
+// trimmed past it, so that is logged once the entry is StreamRetentionStuckAfter
+// old.
+func reportRetentionFloor(stream string, result database.TrimResult, now time.Time) bool {
+	if result.Floor == "" {
+		return false
+	}
+	age := max(now.Sub(database.StreamIDTime(result.Floor)), 0)
+	metrics.StreamRetentionFloorAge.WithLabelValues(stream).Set(age.Seconds())
+	held := 0.0
+	if result.Held {
+		held = 1
+	}
+	metrics.StreamRetentionHeld.WithLabelValues(stream).Set(held)
+
+	if !result.Held || age < StreamRetentionStuckAfter {
+		return false
+	}
+	log.Printf("Retention of %s is held back by group %s, which has needed entry %s for %s; check its pending entries with XPENDING",
+		stream, result.FloorGroup, result.Floor, age.Truncate(time.Second))
+	return true
+}
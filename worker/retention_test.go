@@ -0,0 +1,78 @@
+package worker
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type MockStreamTrimStore struct {
+	StreamNames []string
+	Policies    map[string]config.StreamRetentionConfig
+	Fail        map[string]bool
+}
+
+func (m *MockStreamTrimStore) Streams() []string {
+	return m.StreamNames
+}
+
+func (m *MockStreamTrimStore) Trim(ctx context.Context, stream string, policy config.StreamRetentionConfig, now time.Time) (database.TrimResult, error) {
+	if m.Policies == nil {
+		m.Policies = map[string]config.StreamRetentionConfig{}
+	}
+	m.Policies[stream] = policy
+	if m.Fail[stream] {
+		return database.TrimResult{}, errors.New("redis unavailable")
+	}
+	return database.TrimResult{Entries: 10, Bytes: 1024, Memory: 4096}, nil
+}
+
+func TestTrimStreams_UsesPerStreamPolicies(t *testing.T) {
+	previous, previousFor := StreamRetention, StreamRetentionFor
+	defer func() { StreamRetention, StreamRetentionFor = previous, previousFor }()
+
+	ConfigureRetention(config.RetentionConfig{
+		Default: config.StreamRetentionConfig{MaxAge: time.Hour},
+		Streams: map[string]config.StreamRetentionConfig{"events:index": {MaxLen: 500}},
+	})
+	store := &MockStreamTrimStore{
+		StreamNames: []string{"events", "events:index", "events:replay"},
+		Fail:        map[string]bool{"events": true},
+	}
+
+	trimStreams(context.Background(), store, time.Now())
+
+	if len(store.Policies) != 3 {
+		t.Fatalf("expected every stream to be trimmed despite a failure, got %v", store.Policies)
+	}
+	if store.Policies["events:index"].MaxLen != 500 || store.Policies["events:index"].MaxAge != 0 {
+		t.Errorf("expected the events:index override, got %+v", store.Policies["events:index"])
+	}
+	if store.Policies["events:replay"].MaxAge != time.Hour {
+		t.Errorf("expected the default policy, got %+v", store.Policies["events:replay"])
+	}
+}
+
+func TestReportRetentionFloor_WarnsOnceTheHoldingEntryIsOld(t *testing.T) {
+	previous := StreamRetentionStuckAfter
+	defer func() { StreamRetentionStuckAfter = previous }()
+	StreamRetentionStuckAfter = 15 * time.Minute
+
+	now := time.UnixMilli(1700003600000)
+	old := database.TrimResult{Floor: "1700000000000-0", FloorGroup: "event-indexers", Held: true}
+	if !reportRetentionFloor("events:index", old, now) {
+		t.Error("expected an hour old entry holding the trim back to be reported")
+	}
+
+	recent := database.TrimResult{Floor: "1700003300000-0", FloorGroup: "event-indexers", Held: true}
+	if reportRetentionFloor("events:index", recent, now) {
+		t.Error("expected a recent entry not to be reported")
+	}
+	notHeld := database.TrimResult{Floor: "1700000000000-0", FloorGroup: "event-indexers"}
+	if reportRetentionFloor("events:index", notHeld, now) {
+		t.Error("expected a floor the policy does not reach not to be reported")
+	}
+}
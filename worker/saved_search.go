@@ -0,0 +1,230 @@
+package worker
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"analytics-backend/utils"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	SavedSearchPollInterval = 10 * time.Second
+	SavedSearchLease        = time.Minute
+	SavedSearchMaxMatches   = 100
+	SavedSearchClaimBatch   = 10
+	SavedSearchIndexGrace   = time.Minute
+)
+
+func ConfigureSavedSearches(cfg config.SavedSearchesConfig) {
+	if cfg.PollInterval > 0 {
+		SavedSearchPollInterval = cfg.PollInterval
+	}
+	if cfg.Lease > 0 {
+		SavedSearchLease = cfg.Lease
+	}
+	if cfg.MaxMatches > 0 {
+		SavedSearchMaxMatches = cfg.MaxMatches
+	}
+	if cfg.IndexGrace > 0 {
+		SavedSearchIndexGrace = cfg.IndexGrace
+	}
+}
+
+// SavedSearchNotification is the webhook body sent when a scheduled search
+// has new matches. Events holds the first of them in the order they were
+// ingested.
+type SavedSearchNotification struct {
+	SearchID  uint           `json:"search_id"`
+	Name      string         `json:"name"`
+	Matches   int            `json:"matches"`
+	Truncated bool           `json:"truncated"`
+	Events    []models.Event `json:"events"`
+	RunAt     time.Time      `json:"run_at"`
+}
+
+type SavedSearchStore interface {
+	ClaimDue(ctx context.Context, now time.Time) ([]models.SavedSearch, error)
+	Search(ctx context.Context, params database.SearchEventsParams) (*database.SearchEventsResponse, error)
+	Destination(ctx context.Context, id uint) (*models.WebhookDestination, error)
+	Notify(ctx context.Context, destination models.WebhookDestination, body []byte) error
+	SaveRun(ctx context.Context, search *models.SavedSearch) (bool, error)
+}
+
+type DefaultSavedSearchStore struct{}
+
+func (s *DefaultSavedSearchStore) ClaimDue(ctx context.Context, now time.Time) ([]models.SavedSearch, error) {
+	return database.ClaimDueSavedSearches(ctx, now, SavedSearchLease, SavedSearchClaimBatch)
+}
+
+func (s *DefaultSavedSearchStore) Search(ctx context.Context, params database.SearchEventsParams) (*database.SearchEventsResponse, error) {
+	return database.SearchEvents(ctx, params)
+}
+
+func (s *DefaultSavedSearchStore) Destination(ctx context.Context, id uint) (*models.WebhookDestination, error) {
+	return database.GetWebhookDestination(ctx, id)
+}
+
+func (s *DefaultSavedSearchStore) Notify(ctx context.Context, destination models.WebhookDestination, body []byte) error {
+	_, err := deliverWithRetry(ctx, destination, body)
+	return err
+}
+
+func (s *DefaultSavedSearchStore) SaveRun(ctx context.Context, search *models.SavedSearch) (bool, error) {
+	return database.SaveSavedSearchRun(ctx, search)
+}
+
+// StartSavedSearchScheduler runs due saved searches every
+// SavedSearchPollInterval. Searches are leased, so several instances can run
+// the scheduler without running a search twice.
+func StartSavedSearchScheduler(ctx context.Context, workerName string, store SavedSearchStore) {
+	log.Printf("Starting saved search scheduler %s...", workerName)
+	metrics.ActiveWorkers.WithLabelValues("saved_search_scheduler").Inc()
+	defer metrics.ActiveWorkers.WithLabelValues("saved_search_scheduler").Dec()
+
+	for ctx.Err() == nil {
+		metrics.WorkerIterations.WithLabelValues("saved_search_scheduler").Inc()
+
+		searches, err := store.ClaimDue(ctx, time.Now())
+		if err != nil {
+			log.Printf("Failed to claim saved searches: %v", err)
+		}
+		for i := range searches {
+			runSavedSearch(ctx, store, &searches[i], time.Now())
+		}
+		if len(searches) < SavedSearchClaimBatch {
+			sleepContext(ctx, SavedSearchPollInterval)
+		}
+	}
+
+	log.Printf("Saved search scheduler %s stopped", workerName)
+}
+
+// runSavedSearch notifies about the events ingested after the search's
+// high-water mark and moves the mark to the last event it delivered. The
+// mark only moves once the notification was delivered, so a failed run is
+// retried with the same events and a delivered event is never sent again.
+// When there were more events than fit in one notification, the search runs
+// again right away for the rest.
+func runSavedSearch(ctx context.Context, store SavedSearchStore, search *models.SavedSearch, now time.Time) {
+	matches, truncated, err := newSavedSearchMatches(ctx, store, search, now)
+	if err == nil && len(matches) > 0 {
+		err = notifySavedSearch(ctx, store, search, matches, truncated, now)
+	}
+
+	result := "empty"
+	search.LastError = ""
+	switch {
+	case err != nil:
+		result = "error"
+		search.LastError = truncateError(err.Error())
+		log.Printf("Saved search %d (%s) failed: %v", search.ID, search.Name, err)
+	case len(matches) > 0:
+		result = "matched"
+		last := matches[len(matches)-1]
+		search.HighWaterTimestamp = last.Timestamp
+		search.HighWaterID = last.ID
+		search.LastMatches = len(matches)
+		metrics.SavedSearchNotifiedEvents.Add(float64(len(matches)))
+		log.Printf("Saved search %d (%s) notified about %d new events", search.ID, search.Name, len(matches))
+	default:
+		search.LastMatches = 0
+	}
+	metrics.SavedSearchRuns.WithLabelValues(result).Inc()
+
+	search.LastRunAt = &now
+	search.NextRunAt = now.Add(time.Duration(search.IntervalSeconds) * time.Second)
+	if err == nil && truncated {
+		search.NextRunAt = now
+	}
+	saved, err := store.SaveRun(database.Ctx, search)
+	if err != nil {
+		log.Printf("Failed to save run of saved search %d: %v", search.ID, err)
+	} else if !saved {
+		log.Printf("Saved search %d was leased by another instance before its run was saved", search.ID)
+	}
+}
+
+// newSavedSearchMatches pages through the search in ingest order from the
+// high-water mark and returns up to SavedSearchMaxMatches events above it.
+// The mark is an event id rather than a timestamp, which comes from the
+// client, so late events are still new when they arrive. Events ingested
+// less than SavedSearchIndexGrace before now may not all be indexed yet, and
+// are left for a later run rather than passed over. truncated reports
+// whether there were more.
+func newSavedSearchMatches(ctx context.Context, store SavedSearchStore, search *models.SavedSearch, now time.Time) ([]models.Event, bool, error) {
+	params := database.SavedSearchParams(search)
+	params.Size = min(SavedSearchMaxMatches, 100)
+	params.Ascending = true
+	params.ByID = true
+	params.AfterID = savedSearchMark(search)
+	settled := utils.FirstIDAt(now.Add(-SavedSearchIndexGrace))
+
+	var matches []models.Event
+	for {
+		response, err := store.Search(ctx, params)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, event := range response.Items {
+			if event.ID >= settled {
+				return matches, false, nil
+			}
+			if len(matches) == SavedSearchMaxMatches {
+				return matches, true, nil
+			}
+			matches = append(matches, event)
+		}
+		if response.NextCursor == "" {
+			return matches, false, nil
+		}
+		params.Cursor = response.NextCursor
+	}
+}
+
+// savedSearchMark is the id above which events are new. A mark saved before
+// marks were ids has only its timestamp, which is taken as an ingest time.
+func savedSearchMark(search *models.SavedSearch) int64 {
+	if search.HighWaterID == 0 && !search.HighWaterTimestamp.IsZero() {
+		return utils.FirstIDAt(search.HighWaterTimestamp)
+	}
+	return search.HighWaterID
+}
+
+func notifySavedSearch(ctx context.Context, store SavedSearchStore, search *models.SavedSearch, matches []models.Event, truncated bool, now time.Time) error {
+	if search.WebhookDestinationID == nil {
+		return fmt.Errorf("no webhook destination")
+	}
+	destination, err := store.Destination(ctx, *search.WebhookDestinationID)
+	if err != nil {
+		return fmt.Errorf("failed to load webhook destination %d: %w", *search.WebhookDestinationID, err)
+	}
+	if !destination.Enabled {
+		return fmt.Errorf("webhook destination %s is disabled", destination.Name)
+	}
+
+	body, err := json.Marshal(SavedSearchNotification{
+		SearchID:  search.ID,
+		Name:      search.Name,
+		Matches:   len(matches),
+		Truncated: truncated,
+		Events:    matches,
+		RunAt:     now.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return store.Notify(ctx, *destination, body)
+}
+
+func truncateError(reason string) string {
+	if len(reason) > 1024 {
+		return reason[:1024]
+	}
+	return reason
+}
@@ -0,0 +1,204 @@
+package worker
+
+import (
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"analytics-backend/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// MockSavedSearchStore pages through Events, which are kept in id order like
+// the results of an ascending search by id.
+type MockSavedSearchStore struct {
+	Events     []models.Event
+	NotifyErr  error
+	Notified   []SavedSearchNotification
+	Saved      []models.SavedSearch
+	Searches   int
+	LastParams database.SearchEventsParams
+}
+
+func (m *MockSavedSearchStore) ClaimDue(ctx context.Context, now time.Time) ([]models.SavedSearch, error) {
+	return nil, nil
+}
+
+func (m *MockSavedSearchStore) Search(ctx context.Context, params database.SearchEventsParams) (*database.SearchEventsResponse, error) {
+	m.Searches++
+	m.LastParams = params
+	start, _ := strconv.Atoi(params.Cursor)
+
+	response := &database.SearchEventsResponse{}
+	for i := start; i < len(m.Events) && len(response.Items) < params.Size; i++ {
+		if m.Events[i].ID <= params.AfterID {
+			continue
+		}
+		response.Items = append(response.Items, m.Events[i])
+		if len(response.Items) == params.Size {
+			response.NextCursor = strconv.Itoa(i + 1)
+		}
+	}
+	return response, nil
+}
+
+func (m *MockSavedSearchStore) Destination(ctx context.Context, id uint) (*models.WebhookDestination, error) {
+	return &models.WebhookDestination{ID: id, Name: "on-call", Enabled: true}, nil
+}
+
+func (m *MockSavedSearchStore) Notify(ctx context.Context, destination models.WebhookDestination, body []byte) error {
+	if m.NotifyErr != nil {
+		return m.NotifyErr
+	}
+	var notification SavedSearchNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return err
+	}
+	m.Notified = append(m.Notified, notification)
+	return nil
+}
+
+func (m *MockSavedSearchStore) SaveRun(ctx context.Context, search *models.SavedSearch) (bool, error) {
+	m.Saved = append(m.Saved, *search)
+	return true, nil
+}
+
+func TestRunSavedSearch_NotifiesOnlyAboveHighWaterMark(t *testing.T) {
+	previous := SavedSearchMaxMatches
+	defer func() { SavedSearchMaxMatches = previous }()
+	SavedSearchMaxMatches = 2
+
+	base := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	destination := uint(1)
+	search := &models.SavedSearch{
+		ID:                   7,
+		Name:                 "checkout errors",
+		IntervalSeconds:      60,
+		WebhookDestinationID: &destination,
+		HighWaterTimestamp:   base,
+		HighWaterID:          10,
+	}
+	store := &MockSavedSearchStore{Events: []models.Event{
+		{ID: 8, Timestamp: base.Add(-time.Second)},
+		{ID: 9, Timestamp: base},
+		{ID: 10, Timestamp: base},
+		{ID: 12, Timestamp: base},
+		{ID: 13, Timestamp: base.Add(time.Second)},
+		{ID: 14, Timestamp: base.Add(2 * time.Second)},
+	}}
+
+	runSavedSearch(context.Background(), store, search, base.Add(time.Minute))
+
+	if len(store.Notified) != 1 {
+		t.Fatalf("expected one notification, got %d", len(store.Notified))
+	}
+	notification := store.Notified[0]
+	if notification.Matches != 2 || !notification.Truncated || notification.Events[0].ID != 12 || notification.Events[1].ID != 13 {
+		t.Fatalf("expected the first two of three new events, got %+v", notification)
+	}
+	if !store.LastParams.Ascending || !store.LastParams.ByID || store.LastParams.AfterID != 10 {
+		t.Errorf("expected the search to page in id order from the high-water mark, got %+v", store.LastParams)
+	}
+	if search.HighWaterID != 13 || !search.HighWaterTimestamp.Equal(base.Add(time.Second)) {
+		t.Errorf("expected the mark to move to the last event sent, got %d at %s", search.HighWaterID, search.HighWaterTimestamp)
+	}
+	if !search.NextRunAt.Equal(base.Add(time.Minute)) {
+		t.Errorf("expected a truncated run to run again right away, got %s", search.NextRunAt)
+	}
+
+	runSavedSearch(context.Background(), store, search, base.Add(time.Minute))
+	if len(store.Notified) != 2 {
+		t.Fatalf("expected the rest to be sent, got %d notifications", len(store.Notified))
+	}
+	if notification := store.Notified[1]; notification.Matches != 1 || notification.Truncated || notification.Events[0].ID != 14 {
+		t.Fatalf("expected the remaining event, got %+v", notification)
+	}
+	if !search.NextRunAt.Equal(base.Add(2 * time.Minute)) {
+		t.Errorf("expected the next run one interval later, got %s", search.NextRunAt)
+	}
+
+	runSavedSearch(context.Background(), store, search, base.Add(2*time.Minute))
+	if len(store.Notified) != 2 {
+		t.Fatalf("expected no notification without new events, got %d", len(store.Notified))
+	}
+	if search.LastMatches != 0 || search.LastError != "" {
+		t.Errorf("expected an empty run, got %d matches and error %q", search.LastMatches, search.LastError)
+	}
+}
+
+func TestRunSavedSearch_KeepsMarkWhenNotificationFails(t *testing.T) {
+	base := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	destination := uint(1)
+	search := &models.SavedSearch{
+		ID:                   7,
+		IntervalSeconds:      60,
+		WebhookDestinationID: &destination,
+		HighWaterTimestamp:   base,
+		HighWaterID:          10,
+	}
+	store := &MockSavedSearchStore{
+		Events:    []models.Event{{ID: 11, Timestamp: base.Add(time.Second)}},
+		NotifyErr: errors.New("webhook responded with 503"),
+	}
+
+	runSavedSearch(context.Background(), store, search, base.Add(time.Minute))
+
+	if search.HighWaterID != 10 || !search.HighWaterTimestamp.Equal(base) {
+		t.Errorf("expected the mark to stay put, got %d at %s", search.HighWaterID, search.HighWaterTimestamp)
+	}
+	if search.LastError == "" || len(store.Saved) != 1 {
+		t.Errorf("expected the failed run to be saved with its error, got %+v", store.Saved)
+	}
+}
+
+func TestRunSavedSearch_NotifiesLateEventsIngestedAfterTheMark(t *testing.T) {
+	base := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	destination := uint(1)
+	search := &models.SavedSearch{ID: 7, IntervalSeconds: 60, WebhookDestinationID: &destination}
+	first := models.Event{ID: utils.FirstIDAt(base), Timestamp: base}
+	store := &MockSavedSearchStore{Events: []models.Event{first}}
+
+	runSavedSearch(context.Background(), store, search, base.Add(5*time.Minute))
+	if search.HighWaterID != first.ID {
+		t.Fatalf("expected the mark to move to the first event, got %d", search.HighWaterID)
+	}
+
+	// A late event is ingested after the mark moved, with a timestamp from
+	// an hour before it.
+	late := models.Event{ID: utils.FirstIDAt(base.Add(time.Minute)), Timestamp: base.Add(-time.Hour)}
+	store.Events = append(store.Events, late)
+	runSavedSearch(context.Background(), store, search, base.Add(10*time.Minute))
+
+	if len(store.Notified) != 2 || store.Notified[1].Events[0].ID != late.ID {
+		t.Fatalf("expected the late event to be notified, got %+v", store.Notified)
+	}
+	if search.HighWaterID != late.ID {
+		t.Errorf("expected the mark to move to the late event, got %d", search.HighWaterID)
+	}
+}
+
+func TestRunSavedSearch_LeavesRecentlyIngestedEventsForALaterRun(t *testing.T) {
+	base := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	destination := uint(1)
+	search := &models.SavedSearch{ID: 7, IntervalSeconds: 60, WebhookDestinationID: &destination}
+	settled := models.Event{ID: utils.FirstIDAt(base.Add(-10 * time.Second)), Timestamp: base}
+	recent := models.Event{ID: utils.FirstIDAt(base.Add(50 * time.Second)), Timestamp: base}
+	store := &MockSavedSearchStore{Events: []models.Event{settled, recent}}
+
+	runSavedSearch(context.Background(), store, search, base.Add(SavedSearchIndexGrace))
+
+	if len(store.Notified) != 1 || store.Notified[0].Matches != 1 || store.Notified[0].Truncated {
+		t.Fatalf("expected only the event ingested before the grace window, got %+v", store.Notified)
+	}
+	if search.HighWaterID != settled.ID {
+		t.Errorf("expected the mark to stop before the recent event, got %d", search.HighWaterID)
+	}
+
+	runSavedSearch(context.Background(), store, search, base.Add(2*SavedSearchIndexGrace))
+	if len(store.Notified) != 2 || store.Notified[1].Events[0].ID != recent.ID {
+		t.Fatalf("expected the recent event once it settled, got %+v", store.Notified)
+	}
+}
@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"context"
+	"log"
+	"time"
+)
+
+var SearchIndexMaintenanceInterval = 5 * time.Minute
+
+type SearchIndexStore interface {
+	Maintain(ctx context.Context, now time.Time) (database.SearchIndexMaintenance, error)
+}
+
+type DefaultSearchIndexStore struct{}
+
+func (s *DefaultSearchIndexStore) Maintain(ctx context.Context, now time.Time) (database.SearchIndexMaintenance, error) {
+	return database.MaintainSearchIndices(ctx, now)
+}
+
+func ConfigureSearchIndices(cfg config.ElasticsearchConfig) {
+	if cfg.MaintenanceInterval > 0 {
+		SearchIndexMaintenanceInterval = cfg.MaintenanceInterval
+	}
+}
+
+// StartSearchIndexMaintainer rolls over and expires search indices every
+// SearchIndexMaintenanceInterval. Rollover only happens once its conditions
+// hold, so running it on several instances is harmless.
+func StartSearchIndexMaintainer(ctx context.Context, workerName string, store SearchIndexStore) {
+	log.Printf("Starting search index maintainer %s...", workerName)
+	metrics.ActiveWorkers.WithLabelValues("search_index_maintainer").Inc()
+	defer metrics.ActiveWorkers.WithLabelValues("search_index_maintainer").Dec()
+
+	for ctx.Err() == nil {
+		metrics.WorkerIterations.WithLabelValues("search_index_maintainer").Inc()
+		maintainSearchIndices(ctx, store, time.Now())
+		sleepContext(ctx, SearchIndexMaintenanceInterval)
+	}
+
+	log.Printf("Search index maintainer %s stopped", workerName)
+}
+
+func maintainSearchIndices(ctx context.Context, store SearchIndexStore, now time.Time) {
+	result, err := store.Maintain(ctx, now)
+	if result.RolledOver != "" {
+		log.Printf("Rolled search writes over to %s", result.RolledOver)
+		metrics.SearchIndexRollovers.Inc()
+	}
+	metrics.SearchIndicesDeleted.Add(float64(len(result.Deleted)))
+	if result.Migrated != "" {
+		metrics.SearchIndexMigrations.Inc()
+	}
+	if err != nil {
+		log.Printf("Failed to maintain search indices: %v", err)
+		return
+	}
+	metrics.SearchIndices.Set(float64(result.Indices))
+}
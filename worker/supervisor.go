@@ -0,0 +1,250 @@
+package worker
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const restartBackoff = time.Second
+
+type WorkerFunc func(ctx context.Context, workerName string)
+
+// PoolSpec describes a worker pool. Streams replaces Stream for groups that
+// read several streams, such as the priority lanes; their backlogs are added
+// up for autoscaling.
+type PoolSpec struct {
+	Kind       string
+	NamePrefix string
+	Stream     string
+	Streams    []string
+	Group      string
+	Config     config.WorkerPoolConfig
+	Run        WorkerFunc
+}
+
+type Supervisor struct {
+	interval time.Duration
+	pools    []*workerPool
+}
+
+type workerPool struct {
+	spec      PoolSpec
+	workers   []*supervisedWorker
+	stopped   map[string]*supervisedWorker
+	lastScale time.Time
+	wg        sync.WaitGroup
+}
+
+type supervisedWorker struct {
+	name   string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewSupervisor(interval time.Duration, specs ...PoolSpec) *Supervisor {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	supervisor := &Supervisor{interval: interval}
+	for _, spec := range specs {
+		if spec.Config.Min < 1 {
+			spec.Config.Min = 1
+		}
+		if spec.Config.Max < spec.Config.Min {
+			spec.Config.Max = spec.Config.Min
+		}
+		supervisor.pools = append(supervisor.pools, &workerPool{spec: spec})
+	}
+	return supervisor
+}
+
+// Run starts every pool at its minimum size and rescales on each tick. It
+// returns once ctx is cancelled and every worker has stopped.
+func (s *Supervisor) Run(ctx context.Context) {
+	for _, pool := range s.pools {
+		log.Printf("Starting %d %s workers...", pool.spec.Config.Min, pool.spec.Kind)
+		pool.resize(ctx, pool.spec.Config.Min)
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, pool := range s.pools {
+				pool.wg.Wait()
+			}
+			return
+		case <-ticker.C:
+			for _, pool := range s.pools {
+				pool.evaluate(ctx, time.Now())
+			}
+		}
+	}
+}
+
+func (p *workerPool) evaluate(ctx context.Context, now time.Time) {
+	streams := p.spec.Streams
+	if len(streams) == 0 && p.spec.Stream != "" {
+		streams = []string{p.spec.Stream}
+	}
+
+	var backlog int64
+	found := false
+	for _, stream := range streams {
+		if snapshot, ok := database.GetStreamSnapshot(stream, p.spec.Group); ok {
+			backlog += snapshot.Backlog()
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+
+	current := len(p.workers)
+	target := desiredWorkerCount(current, backlog, averageBatchLatency(p.spec.Kind), p.spec.Config)
+	if target == current {
+		return
+	}
+	if !p.lastScale.IsZero() && now.Sub(p.lastScale) < p.spec.Config.Cooldown {
+		return
+	}
+
+	direction := "up"
+	if target < current {
+		direction = "down"
+	}
+	log.Printf("Scaling %s workers %s from %d to %d (backlog %d)", p.spec.Kind, direction, current, target, backlog)
+	metrics.WorkerScaleEvents.WithLabelValues(p.spec.Kind, direction).Inc()
+
+	p.resize(ctx, target)
+	p.lastScale = now
+}
+
+// resize starts or stops workers from the end of the pool. A worker's name is
+// its consumer name, so a new worker takes the lowest free number and with
+// it the pending messages left by the last worker of that name. It waits for
+// that worker to stop first, so the two never read them at the same time.
+func (p *workerPool) resize(ctx context.Context, target int) {
+	if p.stopped == nil {
+		p.stopped = map[string]*supervisedWorker{}
+	}
+
+	for len(p.workers) < target {
+		name := fmt.Sprintf("%s-%d", p.spec.NamePrefix, len(p.workers)+1)
+		workerCtx, cancel := context.WithCancel(ctx)
+		worker := &supervisedWorker{name: name, cancel: cancel, done: make(chan struct{})}
+		p.workers = append(p.workers, worker)
+		previous := p.stopped[name]
+		delete(p.stopped, name)
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer close(worker.done)
+			if previous != nil {
+				select {
+				case <-previous.done:
+				case <-workerCtx.Done():
+					return
+				}
+			}
+			runWithRestart(workerCtx, p.spec.Kind, name, p.spec.Run)
+		}()
+	}
+
+	for len(p.workers) > target {
+		last := p.workers[len(p.workers)-1]
+		p.workers = p.workers[:len(p.workers)-1]
+		last.cancel()
+		p.stopped[last.name] = last
+	}
+
+	metrics.WorkerTarget.WithLabelValues(p.spec.Kind).Set(float64(target))
+}
+
+// runWithRestart keeps a worker running until ctx is cancelled, restarting it
+// after a panic instead of letting the panic take down the process.
+func runWithRestart(ctx context.Context, kind, name string, run WorkerFunc) {
+	for ctx.Err() == nil {
+		if !runRecovered(ctx, kind, name, run) {
+			return
+		}
+		metrics.WorkerRestarts.WithLabelValues(kind).Inc()
+		sleepContext(ctx, restartBackoff)
+	}
+}
+
+func runRecovered(ctx context.Context, kind, name string, run WorkerFunc) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s worker %s panicked: %v\n%s", kind, name, r, debug.Stack())
+			panicked = true
+		}
+	}()
+	run(ctx, name)
+	return false
+}
+
+func desiredWorkerCount(current int, backlog int64, latency time.Duration, cfg config.WorkerPoolConfig) int {
+	target := current
+
+	overloaded := cfg.ScaleUpBacklog > 0 && backlog > cfg.ScaleUpBacklog
+	if cfg.TargetBatchLatency > 0 && latency > cfg.TargetBatchLatency {
+		overloaded = true
+	}
+
+	idle := backlog <= cfg.ScaleDownBacklog
+	if cfg.TargetBatchLatency > 0 && latency > cfg.TargetBatchLatency/2 {
+		idle = false
+	}
+
+	switch {
+	case overloaded:
+		target++
+	case idle:
+		target--
+	}
+
+	if target < cfg.Min {
+		target = cfg.Min
+	}
+	if target > cfg.Max {
+		target = cfg.Max
+	}
+	return target
+}
+
+var (
+	batchLatencyMu sync.Mutex
+	batchLatencies = map[string]time.Duration{}
+)
+
+// recordBatchLatency keeps an exponentially weighted average so a single slow
+// batch does not trigger a scale-up on its own.
+func recordBatchLatency(kind string, latency time.Duration) {
+	batchLatencyMu.Lock()
+	defer batchLatencyMu.Unlock()
+
+	previous, ok := batchLatencies[kind]
+	if !ok {
+		batchLatencies[kind] = latency
+		return
+	}
+	batchLatencies[kind] = time.Duration(0.8*float64(previous) + 0.2*float64(latency))
+}
+
+func averageBatchLatency(kind string) time.Duration {
+	batchLatencyMu.Lock()
+	defer batchLatencyMu.Unlock()
+	return batchLatencies[kind]
+}
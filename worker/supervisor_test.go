@@ -0,0 +1,124 @@
+package worker
+
+import (
+	"analytics-backend/config"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDesiredWorkerCount(t *testing.T) {
+	cfg := config.WorkerPoolConfig{
+		Min:                2,
+		Max:                4,
+		ScaleUpBacklog:     1000,
+		ScaleDownBacklog:   100,
+		TargetBatchLatency: 2 * time.Second,
+	}
+
+	tests := []struct {
+		name    string
+		current int
+		backlog int64
+		latency time.Duration
+		want    int
+	}{
+		{name: "scales up on backlog", current: 2, backlog: 5000, latency: time.Second, want: 3},
+		{name: "scales up on latency", current: 2, backlog: 500, latency: 3 * time.Second, want: 3},
+		{name: "stays at max", current: 4, backlog: 5000, want: 4},
+		{name: "scales down when idle", current: 3, backlog: 10, latency: 100 * time.Millisecond, want: 2},
+		{name: "stays at min", current: 2, backlog: 0, want: 2},
+		{name: "holds between thresholds", current: 3, backlog: 500, latency: time.Second, want: 3},
+		{name: "holds when idle but slow", current: 3, backlog: 10, latency: 1500 * time.Millisecond, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := desiredWorkerCount(tt.current, tt.backlog, tt.latency, cfg); got != tt.want {
+				t.Fatalf("expected %d workers, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRunWithRestart_RestartsAfterPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		runWithRestart(ctx, "test", "test-1", func(ctx context.Context, workerName string) {
+			if runs.Add(1) == 1 {
+				panic("boom")
+			}
+			cancel()
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected worker to be restarted and then stop")
+	}
+	if runs.Load() != 2 {
+		t.Fatalf("expected 2 runs, got %d", runs.Load())
+	}
+}
+
+func TestWorkerPoolResize_ReusesNamesOnceTheirWorkerStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	running := map[string]int{}
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	pool := &workerPool{spec: PoolSpec{Kind: "test", NamePrefix: "agg", Run: func(ctx context.Context, workerName string) {
+		mu.Lock()
+		running[workerName]++
+		if running[workerName] > 1 {
+			t.Errorf("two workers named %s ran at once", workerName)
+		}
+		mu.Unlock()
+		started <- workerName
+
+		<-ctx.Done()
+		<-release
+		mu.Lock()
+		running[workerName]--
+		mu.Unlock()
+	}}}
+
+	pool.resize(ctx, 2)
+	<-started
+	<-started
+
+	// agg-2 is still finishing its batch when the pool grows again.
+	pool.resize(ctx, 1)
+	pool.resize(ctx, 2)
+	if got := pool.workers[1].name; got != "agg-2" {
+		t.Fatalf("expected the stopped worker's name to be reused, got %s", got)
+	}
+	select {
+	case name := <-started:
+		t.Fatalf("expected %s to wait for the stopped worker", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case name := <-started:
+		if name != "agg-2" {
+			t.Fatalf("expected agg-2 to start, got %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the new agg-2 to start once the old one stopped")
+	}
+
+	cancel()
+	pool.wg.Wait()
+}
@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"analytics-backend/config"
+	"log"
+	"time"
+)
+
+const (
+	LatePolicyUpdate    = "update"
+	LatePolicyLateTable = "late_table"
+	LatePolicyDrop      = "drop"
+)
+
+var (
+	AllowedLateness = 30 * time.Second
+	LatePolicy      = LatePolicyUpdate
+)
+
+func ConfigureAggregation(cfg config.AggregationConfig) {
+	if cfg.AllowedLateness > 0 {
+		AllowedLateness = cfg.AllowedLateness
+	}
+
+	switch cfg.LatePolicy {
+	case "":
+	case LatePolicyUpdate, LatePolicyLateTable, LatePolicyDrop:
+		LatePolicy = cfg.LatePolicy
+	default:
+		log.Printf("Unknown late policy %q, using %q", cfg.LatePolicy, LatePolicy)
+	}
+}
+
+// A window is final once the watermark has passed its end plus the allowed
+// lateness. Anything still arriving for it is late.
+func isWindowFinalized(window, watermark time.Time) bool {
+	if watermark.IsZero() {
+		return false
+	}
+	return !window.Add(AggregationWindow + AllowedLateness).After(watermark)
+}
+
+// finalizedThrough returns the start of the newest window that is final at
+// the given watermark.
+func finalizedThrough(watermark time.Time) time.Time {
+	return watermark.Add(-AggregationWindow - AllowedLateness).Truncate(AggregationWindow)
+}
+
+// Clients control event timestamps, so the watermark never runs ahead of the
+// wall clock; one bad timestamp would otherwise make every event late.
+func watermarkCandidate(events []time.Time, now time.Time) time.Time {
+	var latest time.Time
+	for _, ts := range events {
+		if ts.After(latest) {
+			latest = ts
+		}
+	}
+	if latest.After(now) {
+		return now
+	}
+	return latest
+}
@@ -0,0 +1,395 @@
+package worker
+
+import (
+	"analytics-backend/config"
+	"analytics-backend/database"
+	"analytics-backend/metrics"
+	"analytics-backend/models"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+)
+
+var (
+	WebhookClient         = &http.Client{Timeout: 10 * time.Second}
+	WebhookMaxAttempts    = 5
+	WebhookInitialBackoff = 500 * time.Millisecond
+	WebhookMaxBackoff     = 30 * time.Second
+	WebhookBatchSize      = 100
+)
+
+type WebhookStore interface {
+	ReadEvents() (string, []redis.XMessage, error)
+	ReadPendingEvents() (string, []redis.XMessage, error)
+	AckEvents(stream string, ids ...string) error
+	ListDestinations(ctx context.Context) ([]models.WebhookDestination, error)
+	DeadLetter(ctx context.Context, destination models.WebhookDestination, payload []byte, eventIDs string, reason string, attempts int) error
+	Quarantine(stream string, msg redis.XMessage, reason error) error
+	DeregisterConsumer() error
+}
+
+type DefaultWebhookStore struct {
+	Consumer string
+	reader   *database.LaneReader
+}
+
+func (s *DefaultWebhookStore) ReadEvents() (string, []redis.XMessage, error) {
+	if s.reader == nil {
+		s.reader = database.NewWebhookReader(s.Consumer)
+	}
+	return s.reader.Read()
+}
+
+func (s *DefaultWebhookStore) ReadPendingEvents() (string, []redis.XMessage, error) {
+	if s.reader == nil {
+		s.reader = database.NewWebhookReader(s.Consumer)
+	}
+	return s.reader.ReadPending()
+}
+
+func (s *DefaultWebhookStore) AckEvents(stream string, ids ...string) error {
+	return database.AckWebhookEvents(stream, ids...)
+}
+
+func (s *DefaultWebhookStore) Quarantine(stream string, msg redis.XMessage, reason error) error {
+	return database.QuarantineMessage(database.Ctx, stream, database.WebhookGroupName, msg, reason)
+}
+
+func (s *DefaultWebhookStore) ListDestinations(ctx context.Context) ([]models.WebhookDestination, error) {
+	return database.ListEnabledWebhookDestinations(ctx)
+}
+
+func (s *DefaultWebhookStore) DeadLetter(ctx context.Context, destination models.WebhookDestination, payload []byte, eventIDs string, reason string, attempts int) error {
+	return database.AddWebhookDeadLetter(ctx, destination, payload, eventIDs, reason, attempts)
+}
+
+func (s *DefaultWebhookStore) DeregisterConsumer() error {
+	return database.DeleteLaneConsumer(database.WebhookGroupName, s.Consumer)
+}
+
+type webhookPayload struct {
+	Destination string         `json:"destination"`
+	SentAt      time.Time      `json:"sent_at"`
+	Events      []models.Event `json:"events"`
+}
+
+func ConfigureWebhooks(cfg config.WebhooksConfig) {
+	if cfg.Timeout > 0 {
+		WebhookClient = &http.Client{Timeout: cfg.Timeout}
+	}
+	if cfg.MaxAttempts > 0 {
+		WebhookMaxAttempts = cfg.MaxAttempts
+	}
+	if cfg.InitialBackoff > 0 {
+		WebhookInitialBackoff = cfg.InitialBackoff
+	}
+	if cfg.MaxBackoff > 0 {
+		WebhookMaxBackoff = cfg.MaxBackoff
+	}
+}
+
+func StartWebhookWorker(ctx context.Context, workerName string, store WebhookStore) {
+	log.Printf("Starting webhook worker %s...", workerName)
+	metrics.ActiveWorkers.WithLabelValues("webhook").Inc()
+	defer metrics.ActiveWorkers.WithLabelValues("webhook").Dec()
+
+	// A batch is left unacked when a delivery is interrupted or cannot be
+	// dead-lettered, and only comes back by reading this consumer's pending
+	// list, so that is drained first on start and after every error. The
+	// destinations that did get it receive it again.
+	retryPending := true
+	var backoff errorBackoff
+	for ctx.Err() == nil {
+		metrics.WorkerIterations.WithLabelValues("webhook").Inc()
+
+		var err error
+		if retryPending {
+			retryPending, err = processPendingWebhookBatch(ctx, store)
+		} else {
+			err = processWebhookBatch(ctx, store)
+		}
+		if err != nil {
+			retryPending = true
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("Error processing webhook batch for %s: %v", workerName, err)
+			backoff.wait(ctx)
+		} else {
+			backoff.reset()
+		}
+	}
+
+	if err := store.DeregisterConsumer(); err != nil {
+		log.Printf("Failed to deregister webhook worker %s: %v", workerName, err)
+	}
+	log.Printf("Webhook worker %s stopped", workerName)
+}
+
+func processWebhookBatch(ctx context.Context, store WebhookStore) error {
+	started := time.Now()
+	stream, messages, err := store.ReadEvents()
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return deliverWebhookMessages(ctx, store, started, stream, messages)
+}
+
+// processPendingWebhookBatch delivers the oldest unacked messages of this
+// consumer again. It reports whether there was anything pending.
+func processPendingWebhookBatch(ctx context.Context, store WebhookStore) (bool, error) {
+	started := time.Now()
+	stream, messages, err := store.ReadPendingEvents()
+	if err != nil {
+		return true, err
+	}
+	if len(messages) == 0 {
+		return false, nil
+	}
+
+	log.Printf("Retrying %d pending webhook events from %s", len(messages), stream)
+	return true, deliverWebhookMessages(ctx, store, started, stream, messages)
+}
+
+// deliverWebhookMessages sends a batch to every matching destination and
+// acks it once each has either received or dead-lettered its events.
+func deliverWebhookMessages(ctx context.Context, store WebhookStore, started time.Time, stream string, messages []redis.XMessage) error {
+	destinations, err := store.ListDestinations(ctx)
+	if err != nil {
+		return err
+	}
+
+	events := make([]models.Event, 0, len(messages))
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+		event, err := database.DecodeEvent(msg.Values)
+		if err != nil {
+			log.Printf("Quarantining malformed message %s from %s: %v", msg.ID, stream, err)
+			if err := store.Quarantine(stream, msg, err); err != nil {
+				return err
+			}
+			continue
+		}
+		events = append(events, event)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(destinations))
+	for i, destination := range destinations {
+		matched := filterWebhookEvents(destination, events)
+		if len(matched) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = deliverToDestination(ctx, store, destination, matched)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if err := store.AckEvents(stream, ids...); err != nil {
+		return err
+	}
+
+	recordBatchLatency("webhook", time.Since(started))
+	return nil
+}
+
+func filterWebhookEvents(destination models.WebhookDestination, events []models.Event) []models.Event {
+	var matched []models.Event
+	for _, event := range events {
+		if webhookMatches(destination, event) {
+			matched = append(matched, event)
+		}
+	}
+	return matched
+}
+
+// webhookMatches applies a destination's filters. Every list or property
+// that is set must match; values support path.Match globs such as "sign*".
+func webhookMatches(destination models.WebhookDestination, event models.Event) bool {
+	if len(destination.Actions) > 0 && !matchesAnyPattern(destination.Actions, event.Action) {
+		return false
+	}
+	if len(destination.Elements) > 0 && !matchesAnyPattern(destination.Elements, event.Element) {
+		return false
+	}
+	for field, pattern := range destination.Properties {
+		value, ok := event.FieldValue(field)
+		if !ok || !matchesAnyPattern([]string{pattern}, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAnyPattern(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, value); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverToDestination sends events in chunks, dead-lettering the chunks that
+// fail. It stops with an error when ctx is cancelled or a chunk cannot be
+// dead-lettered, since those events reached neither place.
+func deliverToDestination(ctx context.Context, store WebhookStore, destination models.WebhookDestination, events []models.Event) error {
+	batchSize := destination.BatchSize
+	if batchSize <= 0 {
+		batchSize = WebhookBatchSize
+	}
+
+	for startIdx := 0; startIdx < len(events); startIdx += batchSize {
+		endIdx := min(startIdx+batchSize, len(events))
+		chunk := events[startIdx:endIdx]
+
+		body, err := json.Marshal(webhookPayload{
+			Destination: destination.Name,
+			SentAt:      time.Now().UTC(),
+			Events:      chunk,
+		})
+		if err != nil {
+			log.Printf("Failed to encode webhook payload for %s: %v", destination.Name, err)
+			continue
+		}
+
+		attempts, err := deliverWithRetry(ctx, destination, body)
+		if err == nil {
+			metrics.WebhookEventsDelivered.WithLabelValues(destination.Name).Add(float64(len(chunk)))
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Printf("Webhook %s failed after %d attempts, dead-lettering %d events: %v", destination.Name, attempts, len(chunk), err)
+		metrics.WebhookDeliveries.WithLabelValues(destination.Name, "dead_letter").Inc()
+		if dlErr := store.DeadLetter(ctx, destination, body, joinEventIDs(chunk), err.Error(), attempts); dlErr != nil {
+			return fmt.Errorf("failed to dead-letter webhook batch for %s: %w", destination.Name, dlErr)
+		}
+	}
+	return nil
+}
+
+type webhookError struct {
+	retryable bool
+	message   string
+}
+
+func (e *webhookError) Error() string {
+	return e.message
+}
+
+func deliverWithRetry(ctx context.Context, destination models.WebhookDestination, body []byte) (int, error) {
+	maxAttempts := destination.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = WebhookMaxAttempts
+	}
+
+	backoff := WebhookInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := sendWebhook(ctx, destination, body)
+		if err == nil {
+			metrics.WebhookDeliveries.WithLabelValues(destination.Name, "success").Inc()
+			return attempt, nil
+		}
+
+		if ctx.Err() != nil {
+			return attempt, ctx.Err()
+		}
+		if whErr, ok := err.(*webhookError); ok && !whErr.retryable {
+			return attempt, err
+		}
+		if attempt >= maxAttempts {
+			return attempt, err
+		}
+
+		metrics.WebhookDeliveries.WithLabelValues(destination.Name, "retry").Inc()
+		sleepContext(ctx, jitter(backoff))
+		if ctx.Err() != nil {
+			return attempt, ctx.Err()
+		}
+		backoff = min(backoff*2, WebhookMaxBackoff)
+	}
+}
+
+func sendWebhook(ctx context.Context, destination models.WebhookDestination, body []byte) error {
+	started := time.Now()
+	timestamp := started.Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, destination.URL, bytes.NewReader(body))
+	if err != nil {
+		return &webhookError{message: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhookPayload(destination.Secret, timestamp, body))
+
+	resp, err := WebhookClient.Do(req)
+	metrics.WebhookDeliveryDuration.WithLabelValues(destination.Name).Observe(time.Since(started).Seconds())
+	if err != nil {
+		return &webhookError{retryable: true, message: err.Error()}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return &webhookError{
+		retryable: retryable,
+		message:   fmt.Sprintf("webhook responded with %s", resp.Status),
+	}
+}
+
+// SignWebhookPayload returns the hex HMAC-SHA256 of "<timestamp>.<body>".
+// Receivers recompute it with the shared secret and compare, and reject old
+// timestamps to stop replays.
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func joinEventIDs(events []models.Event) string {
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, strconv.FormatInt(event.ID, 10))
+	}
+	return strings.Join(ids, ",")
+}
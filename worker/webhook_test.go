@@ -0,0 +1,211 @@
+package worker
+
+import (
+	"analytics-backend/database"
+	"analytics-backend/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type MockWebhookStore struct {
+	Messages      []redis.XMessage
+	Pending       []redis.XMessage
+	Destinations  []models.WebhookDestination
+	Acked         []string
+	DeadLetters   []string
+	DeadLetterErr error
+	Quarantined   []string
+}
+
+func (m *MockWebhookStore) ReadEvents() (string, []redis.XMessage, error) {
+	return database.StreamName, m.Messages, nil
+}
+
+func (m *MockWebhookStore) ReadPendingEvents() (string, []redis.XMessage, error) {
+	return database.StreamName, m.Pending, nil
+}
+
+func (m *MockWebhookStore) AckEvents(stream string, ids ...string) error {
+	m.Acked = append(m.Acked, ids...)
+	return nil
+}
+
+func (m *MockWebhookStore) ListDestinations(ctx context.Context) ([]models.WebhookDestination, error) {
+	return m.Destinations, nil
+}
+
+func (m *MockWebhookStore) DeadLetter(ctx context.Context, destination models.WebhookDestination, payload []byte, eventIDs string, reason string, attempts int) error {
+	if m.DeadLetterErr != nil {
+		return m.DeadLetterErr
+	}
+	m.DeadLetters = append(m.DeadLetters, eventIDs)
+	return nil
+}
+
+func (m *MockWebhookStore) Quarantine(stream string, msg redis.XMessage, reason error) error {
+	m.Quarantined = append(m.Quarantined, msg.ID)
+	return nil
+}
+
+func (m *MockWebhookStore) DeregisterConsumer() error {
+	return nil
+}
+
+func webhookTestMessages() []redis.XMessage {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	return []redis.XMessage{
+		{ID: "1-0", Values: map[string]interface{}{"id": "1", "user_id": "user-1", "action": "signup", "element": "signup_form", "timestamp": now}},
+		{ID: "2-0", Values: map[string]interface{}{"id": "2", "user_id": "user-2", "action": "click", "element": "button", "timestamp": now}},
+		{ID: "3-0", Values: map[string]interface{}{"id": "3", "user_id": "test_user", "action": "signup", "element": "signup_form", "timestamp": now}},
+	}
+}
+
+func TestProcessWebhookBatch_SignsAndFiltersEvents(t *testing.T) {
+	const secret = "s3cret"
+	var received []models.Event
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(WebhookTimestampHeader), 10, 64)
+		if got, want := r.Header.Get(WebhookSignatureHeader), "sha256="+SignWebhookPayload(secret, timestamp, body); got != want {
+			t.Errorf("expected signature %s, got %s", want, got)
+		}
+
+		var payload webhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("decode payload: %v", err)
+		}
+		received = append(received, payload.Events...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	store := &MockWebhookStore{
+		Messages: webhookTestMessages(),
+		Destinations: []models.WebhookDestination{{
+			ID:         1,
+			Name:       "crm",
+			URL:        server.URL,
+			Secret:     secret,
+			Actions:    []string{"signup"},
+			Properties: map[string]string{"user_id": "user-*"},
+		}},
+	}
+
+	if err := processWebhookBatch(context.Background(), store); err != nil {
+		t.Fatalf("processWebhookBatch failed: %v", err)
+	}
+	if len(received) != 1 || received[0].ID != 1 {
+		t.Fatalf("expected only event 1 to be delivered, got %#v", received)
+	}
+	if len(store.Acked) != 3 {
+		t.Fatalf("expected all 3 messages to be acked, got %d", len(store.Acked))
+	}
+}
+
+func TestProcessWebhookBatch_RetriesThenDeadLetters(t *testing.T) {
+	previousBackoff := WebhookInitialBackoff
+	WebhookInitialBackoff = time.Millisecond
+	defer func() { WebhookInitialBackoff = previousBackoff }()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	store := &MockWebhookStore{
+		Messages: webhookTestMessages(),
+		Destinations: []models.WebhookDestination{{
+			ID:          1,
+			Name:        "flaky",
+			URL:         server.URL,
+			Elements:    []string{"button"},
+			MaxAttempts: 3,
+		}},
+	}
+
+	if err := processWebhookBatch(context.Background(), store); err != nil {
+		t.Fatalf("processWebhookBatch failed: %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected 3 delivery attempts, got %d", calls.Load())
+	}
+	if len(store.DeadLetters) != 1 || store.DeadLetters[0] != "2" {
+		t.Fatalf("expected event 2 to be dead-lettered, got %#v", store.DeadLetters)
+	}
+}
+
+func TestProcessWebhookBatch_LeavesBatchUnackedWhenDeadLetterFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	store := &MockWebhookStore{
+		Messages:      webhookTestMessages(),
+		Destinations:  []models.WebhookDestination{{ID: 1, Name: "broken", URL: server.URL}},
+		DeadLetterErr: errors.New("redis unavailable"),
+	}
+
+	if err := processWebhookBatch(context.Background(), store); err == nil {
+		t.Fatal("expected the failed dead letter to be reported")
+	}
+	if len(store.Acked) != 0 {
+		t.Fatalf("expected the batch to stay pending, got acks for %v", store.Acked)
+	}
+}
+
+func TestProcessWebhookBatch_LeavesBatchUnackedWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	store := &MockWebhookStore{
+		Messages:     webhookTestMessages(),
+		Destinations: []models.WebhookDestination{{ID: 1, Name: "slow", URL: server.URL, MaxAttempts: 5}},
+	}
+
+	if err := processWebhookBatch(ctx, store); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the batch to stop on cancellation, got %v", err)
+	}
+	if len(store.Acked) != 0 || len(store.DeadLetters) != 0 {
+		t.Fatalf("expected the batch to be neither acked nor dead-lettered, got %v %v", store.Acked, store.DeadLetters)
+	}
+}
+
+func TestProcessPendingWebhookBatch_RedeliversPending(t *testing.T) {
+	var delivered atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	store := &MockWebhookStore{
+		Pending:      webhookTestMessages(),
+		Destinations: []models.WebhookDestination{{ID: 1, Name: "crm", URL: server.URL}},
+	}
+
+	pending, err := processPendingWebhookBatch(context.Background(), store)
+	if err != nil || !pending {
+		t.Fatalf("expected the pending batch to be delivered, got %v %v", pending, err)
+	}
+	if delivered.Load() != 1 || len(store.Acked) != 3 {
+		t.Fatalf("expected one delivery and 3 acks, got %d and %v", delivered.Load(), store.Acked)
+	}
+}